@@ -1,6 +1,7 @@
 package gonyan
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"time"
@@ -17,12 +18,33 @@ import (
 // 		reached the limit all stored logs are transmitted. The limit is
 // 		configurable by using the `SetBufferLimit` function. You can disable
 // 		this type of transmission by passing 0 to the function.
+// 	- byte limit reached: optionally the buffer can also be capped to a number
+// 		of bytes, so that few huge logs do not grow it too much; the limit
+// 		is configurable by using the `SetByteLimit` function.
+//
+// An absolute memory cap can be set by using the `SetMemoryLimit` function:
+// when a log does not fit, room is made according to the chosen
+// OverflowPolicy, the dropped logs being counted (see `Dropped`) and
+// reported to the function set with `SetDropFn`.
+//
+// Failed transmissions are not lost: their logs, but the ones already written
+// by the preceding payloads, are requeued at the head of the buffer and
+// transmitted again after a backoff (see `SetRetryBackoff`),
+// until the maximum number of retries is exceeded (see `SetMaxRetries`) and
+// they are handed to the dead-letter function (see `SetDeadLetterFn`).
+//
+// Independently of the trigger, each transmission can be split into several
+// writes on the stream whose size is capped by using the `SetPayloadLimit`
+// function.
 type BufferedStream struct {
 	// Stream is the target, for this BufferedStream, where logs are sent.
 	Stream Stream
 	// buffer for logs allocation it's emptied everytime logs are transmitted
 	// through the provided stream.
 	buffer [][]byte
+	// levels holds the level of each buffered log, unknownLevel until it is
+	// parsed from the log when needed.
+	levels []LogLevel
 	// maxSize corresponds to the maximum size reachable by the buffer, this to
 	// limit greedy memory allocation.
 	initialSize int
@@ -31,23 +53,83 @@ type BufferedStream struct {
 	// bufferMutex is a mutex used for accessing the buffer and its capacity
 	// counter.
 	bufferMutex sync.Mutex
+	// bufferCond is used, with the bufferMutex, to wake up the writers
+	// blocked by the memory cap when the buffer gets emptied and the
+	// transmissions waiting for their turn.
+	bufferCond *sync.Cond
+	// tickets numbers the batches taken for transmission while turn is the
+	// ticket of the batch allowed to be transmitted: batches are transmitted
+	// one at a time in the order they have been taken.
+	tickets, turn uint64
+	// requeued counts the logs at the head of the buffer requeued since the
+	// last flush, the logs of later failed batches are requeued after them.
+	requeued int
+	// memoryLimit is the absolute cap, in bytes, of the flattened buffer;
+	// this feature is optional and by default is disabled. Use
+	// SetMemoryLimit to set the cap and activate it.
+	memoryLimit int
+	// overflowPolicy defines how room is made when a log exceeds the memory
+	// cap.
+	overflowPolicy OverflowPolicy
+	// failures counts the failed transmissions of each buffered log.
+	failures []int
+	// maxRetries is the number of times failed logs are transmitted again
+	// before being dead-lettered.
+	maxRetries int
+	// minBackoff and maxBackoff bound the delay following a failure.
+	minBackoff, maxBackoff time.Duration
+	// retryAt is the time transmissions are suspended until after a
+	// failure.
+	retryAt time.Time
+	// deadLetter is an optional function receiving the logs whose retries
+	// are exhausted.
+	deadLetter func([][]byte, error)
+	// dropped counts the logs dropped by the memory cap for each reason.
+	dropped [droppedReasons]uint64
+	// drop is an optional function invoked for each dropped log.
+	drop func(DropReason, []byte)
 	// limit is used to perform an automatic data transmission when the
 	// internal buffer reaches the desired limit, this feature is optional
 	// and by default is disabled. Use SetBufferLimit to set the limit and
 	// activate it.
 	limit int
+	// byteLimit is used to perform an automatic data transmission before the
+	// flattened buffer exceeds the desired number of bytes, this feature is
+	// optional and by default is disabled. Use SetByteLimit to set the limit
+	// and activate it.
+	byteLimit int
+	// bufferBytes keeps track of the current flattened size of the buffer,
+	// separators included.
+	bufferBytes int
+	// payloadLimit caps the size of each write on the stream, the flattened
+	// buffer is split into several writes when bigger. This feature is
+	// optional and by default is disabled, use SetPayloadLimit to set the
+	// cap and activate it.
+	payloadLimit int
 	// scheduleInterval defines the time ticketing for automatic data
 	// transmission. This feature is optional and by default is disabled, use
 	// SetSchedulingInterval to set the time ticking and activate it.
 	scheduleInteval time.Duration
-	// routineRunning keeps track of the routine automatic transmission status.
-	routineRunning bool
-	// routineMutex is used to ensure atomic access on the routineRunning bool.
+	// routineCancel stops the automatic transmission routine, it is nil
+	// when the routine is not running.
+	routineCancel context.CancelFunc
+	// routineDone is closed when the running routine exits.
+	routineDone chan struct{}
+	// routineMutex is used to ensure atomic access on the routine state.
 	routineMutex sync.Mutex
 	// separator is used when flattening the buffer into a single dimensional
 	// blob of messages, by default is `\n` but can be whatever you expect it
 	// to be on the Stream receiver.
 	separator byte
+	// flushLevel is the level from which logs trigger an immediate
+	// transmission when flushOnLevel is set. Use SetFlushLevel to set the
+	// level and activate it.
+	flushLevel LogLevel
+	// flushOnLevel reports whether the flush level is enabled.
+	flushOnLevel bool
+	// framer is an optional Framer used in place of the separator to build
+	// the transmitted payloads.
+	framer Framer
 	// fatal is an optional function pointer used when something bad appens in
 	// the buffered stream.
 	fatal func(error)
@@ -62,17 +144,22 @@ const DefaultFlatByteSliceSeparator = '\n'
 
 // NewBufferedStream creates a new BufferedSteam using provided stream.
 func NewBufferedStream(stream Stream) *BufferedStream {
-	return &BufferedStream{
+	b := &BufferedStream{
 		limit:           0,
 		buffer:          make([][]byte, DefaultPreallocatedBufferSize),
 		initialSize:     DefaultPreallocatedBufferSize,
 		Stream:          stream,
 		scheduleInteval: 0,
 		separator:       DefaultFlatByteSliceSeparator,
+		maxRetries:      DefaultMaxRetries,
+		minBackoff:      DefaultMinRetryBackoff,
+		maxBackoff:      DefaultMaxRetryBackoff,
 		fatal: func(err error) {
 			fmt.Printf("[Gonyan] [BufferedSteam] [Fatal] %s.\n", err.Error())
 		},
 	}
+	b.bufferCond = sync.NewCond(&b.bufferMutex)
+	return b
 }
 
 // SetBufferLimit sets a custom cap limit to the buffer, when this cap is
@@ -87,6 +174,54 @@ func (b *BufferedStream) SetBufferLimit(bufferLimit int) {
 	b.limit = bufferLimit
 }
 
+// SetByteLimit sets a custom cap, in bytes, to the flattened buffer
+// (separators included): when a log would make the buffer exceed the cap the
+// buffer gets automatically emptied before storing it. Logs bigger than the
+// cap are buffered alone.
+//
+// NOTE: Accepted values are non negative integers, negative values are ignored
+// while setting the limit to 0 disables the feature.
+func (b *BufferedStream) SetByteLimit(byteLimit int) {
+	if byteLimit < 0 {
+		return
+	}
+	b.byteLimit = byteLimit
+}
+
+// SetPayloadLimit sets a custom cap, in bytes, to each write on the stream:
+// when the flattened buffer is bigger than the cap it is split into several
+// writes, each one containing whole logs. Logs bigger than the cap are
+// written alone.
+//
+// NOTE: Accepted values are non negative integers, negative values are ignored
+// while setting the limit to 0 disables the feature.
+func (b *BufferedStream) SetPayloadLimit(payloadLimit int) {
+	if payloadLimit < 0 {
+		return
+	}
+	b.payloadLimit = payloadLimit
+}
+
+// SetFlushLevel makes logs at or above provided level trigger an immediate
+// transmission of everything buffered, the log included, performed by the
+// writer so that the logs are delivered, in order, before Write returns: the
+// writer first waits for the asynchronous transmissions in flight, which
+// hold older logs. While backing off after a failed transmission logs are buffered as usual.
+func (b *BufferedStream) SetFlushLevel(level LogLevel) {
+	b.bufferMutex.Lock()
+	b.flushLevel = level
+	b.flushOnLevel = true
+	b.bufferMutex.Unlock()
+}
+
+// DisableFlushLevel disables the immediate transmissions triggered by the
+// level of the logs; the feature is disabled by default.
+func (b *BufferedStream) DisableFlushLevel() {
+	b.bufferMutex.Lock()
+	b.flushOnLevel = false
+	b.bufferMutex.Unlock()
+}
+
 // SetStartingSize sets the initial size of the buffer, note that the buffer
 // *will* be appended with new messages if it reaches the set size but when it
 // gets flushed and recreated it will be allocated with provided size.
@@ -107,17 +242,17 @@ func (b *BufferedStream) SetStartingSize(initSize int, send bool) (bool, error)
 	b.initialSize = initSize
 
 	b.bufferMutex.Lock()
-	oldBuffer, oldCount := b.flush()
-	b.bufferMutex.Unlock()
-
 	if !send {
+		b.flush()
+		b.bufferMutex.Unlock()
 		return true, nil
 	}
+	oldBatch := b.takeBatch()
+	b.bufferMutex.Unlock()
 
-	if oldBuffer != nil && oldCount != 0 {
-		if err := b.fireTransmission(oldBuffer, oldCount); err != nil {
-			return true, err
-		}
+	// On failure the logs are requeued as for any other transmission.
+	if err := b.transmit(oldBatch); err != nil {
+		return true, err
 	}
 
 	return true, nil
@@ -128,16 +263,19 @@ func (b *BufferedStream) SetStartingSize(initSize int, send bool) (bool, error)
 // provided flag is true, otherwise you will have to start the routine
 // by yourself.
 // Passing a non-positive value to the function will disable the feature
-// and stop the routine.
+// and stop the routine, the buffered logs are kept for the next
+// transmission.
 func (b *BufferedStream) SetSchedulingInterval(tick time.Duration, start bool) error {
 	if tick <= 0 {
-		b.scheduleInteval = 0
 		b.routineMutex.Lock()
-		b.routineRunning = false
+		b.scheduleInteval = 0
 		b.routineMutex.Unlock()
+		b.stopRoutine()
 		return nil
 	}
+	b.routineMutex.Lock()
 	b.scheduleInteval = tick
+	b.routineMutex.Unlock()
 
 	if !start {
 		return nil
@@ -155,66 +293,122 @@ func (b *BufferedStream) SetSchedulingInterval(tick time.Duration, start bool) e
 // goroutine, please note that if no scheduling interval has been set then no
 // routine will be started and an error will be returned.
 func (b *BufferedStream) StartAutonomousTransmission() error {
+	return b.StartAutonomousTransmissionContext(context.Background())
+}
+
+// StartAutonomousTransmissionContext starts the routine transmission in a
+// concurrent goroutine bound to provided context: when the context is done
+// the routine exits transmitting the buffered logs one last time. As for
+// StartAutonomousTransmission an error is returned if the routine is
+// already running or no scheduling interval has been set.
+// A stopped routine can be started again.
+func (b *BufferedStream) StartAutonomousTransmissionContext(ctx context.Context) error {
 	b.routineMutex.Lock()
-	routineRunning := b.routineRunning
-	b.routineMutex.Unlock()
+	defer b.routineMutex.Unlock()
 
-	if routineRunning {
+	if b.routineDone != nil {
 		return fmt.Errorf("routine already running")
 	}
 	if b.scheduleInteval == 0 {
 		return fmt.Errorf("no scheduling interval set")
 	}
 
+	// The routine is marked as running before being started so that
+	// concurrent starts cannot both succeed.
+	routineCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	b.routineCancel, b.routineDone = cancel, done
+
 	ticker := time.NewTicker(b.scheduleInteval)
 	go func(ticker *time.Ticker) {
-		if err := b.autonomousTranmissionRoutine(ticker); err != nil {
+		defer close(done)
+		if err := b.autonomousTranmissionRoutine(routineCtx, ticker); err != nil {
 			// TODO: Consider using a different communication channel.
 			if b.fatal != nil {
 				b.fatal(fmt.Errorf("routine has been stopped due to error: %s", err.Error()))
 			}
 		}
+
+		b.routineMutex.Lock()
+		if b.routineDone == done {
+			b.routineCancel, b.routineDone = nil, nil
+		}
+		b.routineMutex.Unlock()
+		cancel()
+
+		// The routine has not been stopped by StopAutonomousTransmission,
+		// which transmits the buffered logs by itself.
+		if ctx.Err() != nil {
+			b.transmitBuffer()
+		}
 	}(ticker)
 
 	return nil
 }
 
-// StopAutonomousTransmission sets the boolean state to false causing the next
-// routine iteration to be immediately interrupted.
-func (b *BufferedStream) StopAutonomousTransmission() {
+// StopAutonomousTransmission stops the routine, waiting for it to exit, and
+// then transmits the buffered logs returning the transmission error, if any.
+// The logs are transmitted even if the routine is not running.
+func (b *BufferedStream) StopAutonomousTransmission() error {
+	b.stopRoutine()
+	return b.transmitBuffer()
+}
+
+// stopRoutine stops the routine, if running, and waits for it to exit.
+func (b *BufferedStream) stopRoutine() {
 	b.routineMutex.Lock()
-	b.routineRunning = false
+	cancel, done := b.routineCancel, b.routineDone
+	b.routineCancel, b.routineDone = nil, nil
 	b.routineMutex.Unlock()
+
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
 }
 
-func (b *BufferedStream) autonomousTranmissionRoutine(ticker *time.Ticker) error {
+// routineRunning reports whether the routine is running.
+func (b *BufferedStream) routineRunning() bool {
 	b.routineMutex.Lock()
-	b.routineRunning = true
-	b.routineMutex.Unlock()
+	defer b.routineMutex.Unlock()
+	return b.routineDone != nil
+}
 
-	for range ticker.C {
-		b.routineMutex.Lock()
-		routineRunning := b.routineRunning
-		b.routineMutex.Unlock()
-		if routineRunning == false {
-			// Stop the ticker and exit.
-			ticker.Stop()
-			// return fmt.Errorf("routine has been stopped")
+// autonomousTranmissionRoutine transmits the buffered logs at every tick
+// until provided context is done.
+func (b *BufferedStream) autonomousTranmissionRoutine(ctx context.Context, ticker *time.Ticker) error {
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
 			return nil
+		case <-ticker.C:
 		}
 
 		// Let's flush the old buffer and send it through the stream and
 		// if the buffer was full fire a transmission with retrieved data.
+		// Failed transmissions are requeued and retried by the next ticks
+		// once the backoff expires, so the routine keeps running.
 		b.bufferMutex.Lock()
-		oldBuffer, oldSize := b.flush()
-		b.bufferMutex.Unlock()
-		if oldBuffer != nil && oldSize != 0 {
-			if err := b.fireTransmission(oldBuffer, oldSize); err != nil {
-				return fmt.Errorf("gonyan buffered stream failure during data transmission: %s", err.Error())
-			}
+		if b.backingOff() {
+			b.bufferMutex.Unlock()
+			continue
 		}
+		oldBatch := b.takeBatch()
+		b.bufferMutex.Unlock()
+		b.transmit(oldBatch)
 	}
-	return nil
+}
+
+// transmitBuffer transmits the buffered logs, even while backing off after a
+// failure, returning the transmission error.
+func (b *BufferedStream) transmitBuffer() error {
+	b.bufferMutex.Lock()
+	oldBatch := b.takeBatch()
+	b.bufferMutex.Unlock()
+	return b.transmit(oldBatch)
 }
 
 // SetFatalFn sets the optional function for fatal error signals.
@@ -231,18 +425,54 @@ func (b *BufferedStream) SetFlatBufferSeparator(separator byte) {
 	b.separator = separator
 }
 
-// Write will store provided log into the buffer prior transmission. If the log
-// makes the buffer full it will fire the log transmission to the stream.
+// Write will store a copy of provided log into the buffer prior transmission.
+// If the log makes the buffer full it will fire the log transmission to the
+// stream.
+// When a flush level is set the level of the log is parsed from its JSON
+// serialisation, see WriteLevel to avoid it.
 func (b *BufferedStream) Write(message []byte) (int, error) {
-	var oldBuffer [][]byte
-	var oldSize int
+	return b.write(message, unknownLevel)
+}
+
+// WriteLevel function defined to implement the LevelWriter interface.
+// It behaves as Write using provided level in place of the one serialised
+// in the log.
+func (b *BufferedStream) WriteLevel(level LogLevel, message []byte) (int, error) {
+	return b.write(message, level)
+}
+
+// write stores provided log, whose level may be unknownLevel, into the
+// buffer firing the transmissions triggered by it.
+func (b *BufferedStream) write(message []byte, level LogLevel) (int, error) {
+	var oldBatch, levelBatch *batch
 
 	b.bufferMutex.Lock()
 
 	// If capped transmission is enabled and the set limit has been reached
 	// then substitute the buffer and prepare the old one for transmission.
-	if b.limit > 0 && b.bufferCount >= b.limit {
-		oldBuffer, oldSize = b.flush()
+	// Transmissions are suspended while backing off after a failure.
+	if b.limit > 0 && b.bufferCount >= b.limit && !b.backingOff() {
+		oldBatch = b.takeBatch()
+	}
+
+	// The same applies if the byte limit is enabled and the message would
+	// make the buffer exceed it.
+	if b.byteLimit > 0 && b.bufferCount > 0 && b.bufferBytes+1+len(message) > b.byteLimit && !b.backingOff() {
+		oldBatch = b.takeBatch()
+	}
+
+	// If the memory cap is enabled make room for the message according to
+	// the overflow policy, the message itself may be the one dropped.
+	var dropped []droppedLog
+	if b.memoryLimit > 0 {
+		var accepted bool
+		if dropped, accepted = b.makeRoom(message, &level); !accepted {
+			count := b.bufferCount
+			b.bufferMutex.Unlock()
+			b.reportDrops(dropped)
+			b.transmitAsync(oldBatch)
+			return count, ErrBufferFull
+		}
 	}
 
 	// If the buffer count has reached the total length of the buffer then we
@@ -251,40 +481,94 @@ func (b *BufferedStream) Write(message []byte) (int, error) {
 		b.buffer = append(b.buffer, []byte{})
 	}
 
-	// Set the message in the buffer and then increment the position counter.
-	b.buffer[b.bufferCount] = message
+	// Set a copy of the message in the buffer, so that callers can reuse
+	// their slices, and then increment the position counter.
+	b.buffer[b.bufferCount] = append(make([]byte, 0, len(message)), message...)
+	if b.bufferCount > 0 {
+		b.bufferBytes++
+	}
+	b.bufferBytes += len(message)
 	b.bufferCount++
+	b.levels = append(b.levels, level)
+	b.failures = append(b.failures, 0)
 	// Concurrently safe read the value to be returned.
 	newCount := b.bufferCount
+
+	// If the log reaches the flush level everything buffered, the log
+	// included, is transmitted right away.
+	if b.flushOnLevel && !b.backingOff() {
+		if level == unknownLevel {
+			level = entryLevel(message)
+			b.levels[newCount-1] = level
+		}
+		if level >= b.flushLevel {
+			levelBatch = b.takeBatch()
+		}
+	}
 	b.bufferMutex.Unlock()
 
-	// If the buffer was full fire a transmission with provided data.
-	if oldBuffer != nil && oldSize != 0 {
-		go func(buffer [][]byte, size int) {
-			if err := b.fireTransmission(buffer, size); err != nil {
-				if b.fatal != nil {
-					b.fatal(fmt.Errorf("gonyan buffered stream failure during data transmission: %s", err.Error()))
-				}
-			}
-		}(oldBuffer, oldSize)
+	b.reportDrops(dropped)
+	if levelBatch == nil {
+		b.transmitAsync(oldBatch)
+		return newCount, nil
 	}
 
+	// The writer transmits the batches itself so that they are delivered,
+	// after the ones taken before, when Write returns; failures are
+	// requeued by transmit.
+	b.transmit(oldBatch)
+	b.transmit(levelBatch)
 	return newCount, nil
 }
 
+// transmitAsync fires, if the buffer was full, a transmission with provided
+// batch in a concurrent goroutine; failures are requeued by transmit.
+func (b *BufferedStream) transmitAsync(oldBatch *batch) {
+	if oldBatch == nil {
+		return
+	}
+	go b.transmit(oldBatch)
+}
+
 // fireTransmission receives the messages slice to be transmitted on the Stream
 // and writes it after flattening operation with provided optional separator
-// byte (by default: `\n`).
-func (b *BufferedStream) fireTransmission(messages [][]byte, amount int) error {
+// byte (by default: `\n`), or framing it with the Framer when set.
+// It returns the number of leading messages written, all of them unless an
+// error is returned.
+func (b *BufferedStream) fireTransmission(messages [][]byte, amount int) (int, error) {
 	if b.Stream == nil {
-		return fmt.Errorf("invalid stream found")
+		return 0, fmt.Errorf("invalid stream found")
+	}
+	if amount > len(messages) {
+		amount = len(messages)
 	}
 
-	flatBuffer := flatten(messages, b.separator)
-	if n, err := b.Stream.Write(flatBuffer); err != nil {
-		return fmt.Errorf("failed write on stream: %s, returned count: %d", err.Error(), n)
+	if b.framer != nil {
+		return b.fireFramedTransmission(messages, amount)
 	}
-	return nil
+
+	if b.payloadLimit <= 0 {
+		flatBuffer := flatten(messages[:amount], b.separator)
+		if n, err := b.Stream.Write(flatBuffer); err != nil {
+			return 0, fmt.Errorf("failed write on stream: %s, returned count: %d", err.Error(), n)
+		}
+		return amount, nil
+	}
+
+	sent := 0
+	for _, chunk := range split(messages[:amount], b.payloadLimit) {
+		flatBuffer := flatten(chunk, b.separator)
+		if n, err := b.Stream.Write(flatBuffer); err != nil {
+			return sent, fmt.Errorf("failed write on stream: %s, returned count: %d", err.Error(), n)
+		}
+		// Empty messages, skipped by split, count as written.
+		for count := len(chunk); count > 0; sent++ {
+			if len(messages[sent]) > 0 {
+				count--
+			}
+		}
+	}
+	return amount, nil
 }
 
 // flush will return the old buffer and its count and allocate a new empty
@@ -297,7 +581,16 @@ func (b *BufferedStream) flush() ([][]byte, int) {
 
 	// Create new buffer using set initial size.
 	b.buffer = make([][]byte, b.initialSize)
+	b.levels = make([]LogLevel, 0, b.initialSize)
+	b.failures = make([]int, 0, b.initialSize)
 	b.bufferCount = 0
+	b.bufferBytes = 0
+	b.requeued = 0
+
+	// Wake up the writers waiting for room.
+	if b.bufferCond != nil {
+		b.bufferCond.Broadcast()
+	}
 
 	return oldBuffer, oldBufferSize
 }
@@ -320,3 +613,31 @@ func flatten(matrix [][]byte, separator byte) []byte {
 	}
 	return flat
 }
+
+// split utility function divides the messages of a two dimensional byte slice
+// in groups whose flattened size, one separator byte between messages
+// included, does not exceed provided limit. Messages bigger than the limit
+// are grouped alone.
+func split(matrix [][]byte, limit int) [][][]byte {
+	chunks := [][][]byte{}
+	chunk := [][]byte{}
+	size := 0
+	for _, row := range matrix {
+		if len(row) == 0 {
+			continue
+		}
+		if len(chunk) > 0 && size+1+len(row) > limit {
+			chunks = append(chunks, chunk)
+			chunk, size = [][]byte{}, 0
+		}
+		if len(chunk) > 0 {
+			size++
+		}
+		chunk = append(chunk, row)
+		size += len(row)
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
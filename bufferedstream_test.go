@@ -2,9 +2,11 @@ package gonyan
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -23,7 +25,7 @@ func TestNewBufferedStream(t *testing.T) {
 	if b.separator != DefaultFlatByteSliceSeparator {
 		t.Fatalf("Unexpected default separator. Expected: %c - Found: %c.", DefaultFlatByteSliceSeparator, b.separator)
 	}
-	if b.routineRunning {
+	if b.routineRunning() {
 		t.Fatalf("Unexpected boolean flag. Routine Running should be false.")
 	}
 	if b.scheduleInteval != 0 {
@@ -177,9 +179,9 @@ func TestSetSchedulingInterval(t *testing.T) {
 
 	// Mess up internal values.
 	b.scheduleInteval = 100
-	b.routineMutex.Lock()
-	b.routineRunning = true
-	b.routineMutex.Unlock()
+	if err := b.StartAutonomousTransmission(); err != nil {
+		t.Fatalf("Unexpected error: %s.", err.Error())
+	}
 
 	if err := b.SetSchedulingInterval(-100, false); err != nil {
 		t.Fatalf("Unexpected error: %s.", err.Error())
@@ -187,37 +189,37 @@ func TestSetSchedulingInterval(t *testing.T) {
 	if b.scheduleInteval != 0 {
 		t.Fatalf("Unexpected scheduleInterval. Expected: %d - Found: %d.", 0, b.scheduleInteval)
 	}
-	if b.routineRunning {
+	if b.routineRunning() {
 		t.Fatalf("Unexpected routineRunning flag. Should be false!")
 	}
 
 	// Mess up internal values.
 	b.scheduleInteval = 100
-	b.routineMutex.Lock()
-	b.routineRunning = true
-	b.routineMutex.Unlock()
+	if err := b.StartAutonomousTransmission(); err != nil {
+		t.Fatalf("Unexpected error: %s.", err.Error())
+	}
 	if err := b.SetSchedulingInterval(0, false); err != nil {
 		t.Fatalf("Unexpected error: %s.", err.Error())
 	}
 	if b.scheduleInteval != 0 {
 		t.Fatalf("Unexpected scheduleInterval. Expected: %d - Found: %d.", 0, b.scheduleInteval)
 	}
-	if b.routineRunning {
+	if b.routineRunning() {
 		t.Fatalf("Unexpected routineRunning flag. Should be false!")
 	}
 
 	// Mess up internal values.
 	b.scheduleInteval = 100
-	b.routineMutex.Lock()
-	b.routineRunning = true
-	b.routineMutex.Unlock()
+	if err := b.StartAutonomousTransmission(); err != nil {
+		t.Fatalf("Unexpected error: %s.", err.Error())
+	}
 	if err := b.SetSchedulingInterval(0, true); err != nil {
 		t.Fatalf("Unexpected error: %s.", err.Error())
 	}
 	if b.scheduleInteval != 0 {
 		t.Fatalf("Unexpected scheduleInterval. Expected: %d - Found: %d.", 0, b.scheduleInteval)
 	}
-	if b.routineRunning {
+	if b.routineRunning() {
 		t.Fatalf("Unexpected routineRunning flag. Should be false!")
 	}
 
@@ -229,7 +231,7 @@ func TestSetSchedulingInterval(t *testing.T) {
 	if b.scheduleInteval != 10*time.Second {
 		t.Fatalf("Unexpected scheduleInterval. Expected: %d - Found: %d.", 10*time.Second, b.scheduleInteval)
 	}
-	if b.routineRunning {
+	if b.routineRunning() {
 		t.Fatalf("Unexpected routineRunning flag. Should be false!")
 	}
 
@@ -242,23 +244,20 @@ func TestSetSchedulingInterval(t *testing.T) {
 	if b.scheduleInteval != 1*time.Second {
 		t.Fatalf("Unexpected scheduleInterval. Expected: %d - Found: %d.", 1*time.Second, b.scheduleInteval)
 	}
-	time.Sleep(2 * time.Second) // Wait for the routine to be started.
-	b.routineMutex.Lock()
-	if !b.routineRunning {
-		b.routineMutex.Unlock()
+	if !b.routineRunning() {
 		t.Fatalf("Unexpected routineRunning flag. Should be true!")
 	}
-	b.routineMutex.Unlock()
 }
 
 func TestAutonomousTransmissionRoutine(t *testing.T) {
 	mock := newMockStream(3)
 	b := NewBufferedStream(mock)
 
+	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
 		ticker := time.NewTicker(1 * time.Second)
-		if err := b.autonomousTranmissionRoutine(ticker); err != nil {
-			t.Fatalf("Unexpected error: %s", err.Error())
+		if err := b.autonomousTranmissionRoutine(ctx, ticker); err != nil {
+			t.Errorf("Unexpected error: %s", err.Error())
 		}
 	}()
 
@@ -330,10 +329,7 @@ func TestAutonomousTransmissionRoutine(t *testing.T) {
 	default:
 		t.Fatalf("Failed read from mock stream.")
 	}
-	b.routineMutex.Lock()
-	b.routineRunning = false
-	b.routineMutex.Unlock()
-	time.Sleep(1 * time.Second)
+	cancel()
 }
 
 func TestAutonomousTransmissionSafeStop(t *testing.T) {
@@ -341,24 +337,40 @@ func TestAutonomousTransmissionSafeStop(t *testing.T) {
 	b := NewBufferedStream(mock)
 
 	ticker := time.NewTicker(1 * time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
 
 	go func(ticker *time.Ticker) {
-		if err := b.autonomousTranmissionRoutine(ticker); err != nil {
-			t.Fatalf("Unexpected error on exit: %s.", err.Error())
+		defer close(done)
+		if err := b.autonomousTranmissionRoutine(ctx, ticker); err != nil {
+			t.Errorf("Unexpected error on exit: %s.", err.Error())
 		}
 	}(ticker)
 
 	time.Sleep(2 * time.Second)
 
-	// Force ticker stop from the outside.
+	// Force ticker stop from the outside, the routine exits only once the
+	// context is done.
 	ticker.Stop()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("The routine should have exited.")
+	}
 }
 
 func TestAutonomousTransmissionErrors(t *testing.T) {
 	failer := newFailerMockStream("fail")
 	b := NewBufferedStream(failer)
+	b.SetRetryBackoff(0, 0)
+	b.SetMaxRetries(1)
+	deadLetters := make(chan [][]byte, 1)
+	b.SetDeadLetterFn(func(messages [][]byte, err error) {
+		deadLetters <- messages
+	})
 
-	ticker := time.NewTicker(1 * time.Second)
+	ticker := time.NewTicker(100 * time.Millisecond)
 
 	n, err := b.Write([]byte("write something in order to trigger a buffer flush"))
 	if err != nil {
@@ -369,24 +381,44 @@ func TestAutonomousTransmissionErrors(t *testing.T) {
 
 	}
 
-	err = b.autonomousTranmissionRoutine(ticker)
-	if err == nil {
-		t.Fatalf("Expected error, found nil.")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	exited := make(chan struct{})
+	go func(ticker *time.Ticker) {
+		defer close(exited)
+		if err := b.autonomousTranmissionRoutine(ctx, ticker); err != nil {
+			t.Errorf("Unexpected error on exit: %s.", err.Error())
+		}
+	}(ticker)
+
+	// The log is transmitted twice before being dead-lettered while the
+	// routine keeps running.
+	select {
+	case messages := <-deadLetters:
+		if len(messages) != 1 || string(messages[0]) != "write something in order to trigger a buffer flush" {
+			t.Fatalf("Unexpected dead-lettered logs: %q.", messages)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("The log should have been dead-lettered.")
+	}
+	select {
+	case <-exited:
+		t.Fatalf("The routine should keep running.")
+	default:
 	}
-	t.Logf("Expected error: %s.", err.Error())
 }
 
 func TestStartAutonomousTransmissionErrors(t *testing.T) {
 	mock := newMockStream(3)
 	b := NewBufferedStream(mock)
 
-	// Falsify routine running flag.
-	b.routineRunning = true
+	// Falsify routine running state.
+	b.routineDone = make(chan struct{})
 	if err := b.StartAutonomousTransmission(); err == nil {
 		t.Fatalf("Expected error. Found nil.")
 	}
 
-	b.routineRunning = false
+	b.routineDone = nil
 	b.scheduleInteval = 0
 	if err := b.StartAutonomousTransmission(); err == nil {
 		t.Fatalf("Expected error. Found nil.")
@@ -507,7 +539,7 @@ func TestFireTransmission(t *testing.T) {
 		[]byte("let's"),
 		[]byte("go"),
 	}
-	if err := b.fireTransmission(data, 4); err != nil {
+	if _, err := b.fireTransmission(data, 4); err != nil {
 		t.Fatalf("Unexpected error: %s", err.Error())
 	}
 
@@ -529,6 +561,14 @@ func TestFireTransmission(t *testing.T) {
 	if receivedSliced[3] != "go" {
 		t.Fatalf("Unexpected message in pos [%d]. Expected: %s - Found: %s.", 3, "go", receivedSliced[3])
 	}
+
+	// Only the first amount messages are transmitted.
+	if _, err := b.fireTransmission(data, 2); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if received := <-s.out; received != "hey\noh" {
+		t.Fatalf("Unexpected partial transmission: %q.", received)
+	}
 }
 
 func TestFireTransmissionFailure(t *testing.T) {
@@ -536,7 +576,7 @@ func TestFireTransmissionFailure(t *testing.T) {
 	b := NewBufferedStream(nil)
 	// Fire the transmission but no Stream has been
 	// provided and it will fail immediately.
-	err := b.fireTransmission(nil, 0)
+	_, err := b.fireTransmission(nil, 0)
 	if err == nil {
 		t.Fatalf("Unexpected nil error!")
 	}
@@ -556,7 +596,7 @@ func TestFireTransmissionFailure(t *testing.T) {
 	}
 	// Fire the data, but the chan is already full
 	// so this should fail.
-	err = b.fireTransmission(data, 2)
+	_, err = b.fireTransmission(data, 2)
 	if err == nil {
 		t.Fatalf("Unexpected nil error!")
 	}
@@ -575,6 +615,9 @@ func TestWriteFailureFatalInvocation(t *testing.T) {
 		invoked = true
 		mtx.Unlock()
 	})
+	// Without retries and dead-letter function failed logs are reported
+	// through the fatal function.
+	b.SetMaxRetries(0)
 	b.SetBufferLimit(2)
 	n, err := b.Write([]byte("hey"))
 	if err != nil {
@@ -688,3 +731,221 @@ func TestFlatten(t *testing.T) {
 		t.Fatalf("There where differences between the bytes. Expected: %s - Found: %s.", string(expected), string(flattened))
 	}
 }
+
+func TestWriteWithByteLimitBuffer(t *testing.T) {
+	s := newMockStream(2)
+	b := NewBufferedStream(s)
+	b.SetByteLimit(-1)
+	if b.byteLimit != 0 {
+		t.Fatalf("Unexpected byte limit value. Expected: %d - found: %d", 0, b.byteLimit)
+	}
+	// Two 5 bytes messages and their separator fit the limit.
+	b.SetByteLimit(11)
+
+	for _, message := range []string{"hey_1", "hey_2", "hey_3"} {
+		if _, err := b.Write([]byte(message)); err != nil {
+			t.Fatalf("Unexpected error: %s.", err.Error())
+		}
+	}
+	if received := <-s.out; received != "hey_1\nhey_2" {
+		t.Fatalf("Unexpected received message. Expected: `%s` - Found: `%s`.", "hey_1\nhey_2", received)
+	}
+	if b.bufferCount != 1 || b.bufferBytes != 5 {
+		t.Fatalf("Unexpected buffer state. Count: %d - Bytes: %d.", b.bufferCount, b.bufferBytes)
+	}
+
+	// Messages bigger than the limit are buffered alone.
+	if n, _ := b.Write([]byte("a message exceeding the limit")); n != 1 {
+		t.Fatalf("Unexpected number returned. Expected: %d - Found: %d.", 1, n)
+	}
+	if received := <-s.out; received != "hey_3" {
+		t.Fatalf("Unexpected received message. Expected: `%s` - Found: `%s`.", "hey_3", received)
+	}
+}
+
+func TestFireTransmissionWithPayloadLimit(t *testing.T) {
+	s := newMockStream(5)
+	b := NewBufferedStream(s)
+	b.SetPayloadLimit(-1)
+	if b.payloadLimit != 0 {
+		t.Fatalf("Unexpected payload limit value. Expected: %d - found: %d", 0, b.payloadLimit)
+	}
+	b.SetPayloadLimit(6)
+
+	data := [][]byte{
+		[]byte("hey"),
+		[]byte("oh"),
+		[]byte("let's"),
+		[]byte("go"),
+		[]byte("a very long message"),
+		nil,
+	}
+	if _, err := b.fireTransmission(data, 5); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	expected := []string{"hey\noh", "let's", "go", "a very long message"}
+	for i, message := range expected {
+		if received := <-s.out; received != message {
+			t.Fatalf("Unexpected write #%d. Expected: `%s` - Found: `%s`.", i, message, received)
+		}
+	}
+	if len(s.out) != 0 {
+		t.Fatalf("Unexpected additional writes: %d.", len(s.out))
+	}
+
+	// Writes following a failed one are not performed.
+	s = newMockStream(1)
+	b = NewBufferedStream(s)
+	b.SetPayloadLimit(6)
+	if _, err := b.fireTransmission(data, 5); err == nil {
+		t.Fatalf("Unexpected nil error!")
+	}
+}
+
+func TestFlushLevel(t *testing.T) {
+	s := newMockStream(3)
+	b := NewBufferedStream(s)
+	b.SetFlushLevel(Error)
+
+	b.Write(levelLog(Info, "1"))
+	b.Write(levelLog(Warning, "2"))
+	if len(s.out) != 0 {
+		t.Fatalf("Unexpected transmission.")
+	}
+	// The transmission is performed by the writer.
+	b.Write(levelLog(Error, "3"))
+	if len(s.out) != 1 || b.bufferCount != 0 {
+		t.Fatalf("Unexpected state. Transmissions: %d - Buffered: %d.", len(s.out), b.bufferCount)
+	}
+	expected := strings.Join([]string{string(levelLog(Info, "1")), string(levelLog(Warning, "2")), string(levelLog(Error, "3"))}, "\n")
+	if received := <-s.out; received != expected {
+		t.Fatalf("Unexpected received message. Expected: `%s` - Found: `%s`.", expected, received)
+	}
+
+	// Provided levels take the place of the serialised ones.
+	b.Write([]byte("plain"))
+	b.WriteLevel(Fatal, []byte("plain fatal"))
+	if received := <-s.out; received != "plain\nplain fatal" {
+		t.Fatalf("Unexpected received message: `%s`.", received)
+	}
+
+	b.DisableFlushLevel()
+	b.WriteLevel(Panic, []byte("buffered"))
+	if len(s.out) != 0 || b.bufferCount != 1 {
+		t.Fatalf("Unexpected state. Transmissions: %d - Buffered: %d.", len(s.out), b.bufferCount)
+	}
+}
+
+func TestFlushLevelOrdering(t *testing.T) {
+	s := &slowMockStream{marker: "slow", delay: 200 * time.Millisecond}
+	b := NewBufferedStream(s)
+	b.SetBufferLimit(2)
+	b.SetFlushLevel(Error)
+
+	b.Write([]byte("slow"))
+	b.Write([]byte("1"))
+	// The limit fires the asynchronous transmission of the first logs.
+	b.Write([]byte("2"))
+	// The flushed logs are transmitted once the older ones are.
+	b.WriteLevel(Error, []byte("3"))
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if strings.Join(s.out, "|") != "slow\n1|2\n3" {
+		t.Fatalf("Unexpected transmissions: %q.", s.out)
+	}
+}
+
+func TestFlushLevelOrderingRoutine(t *testing.T) {
+	s := &slowMockStream{marker: "slow", delay: 200 * time.Millisecond}
+	b := NewBufferedStream(s)
+	b.SetFlushLevel(Error)
+	b.SetSchedulingInterval(10*time.Millisecond, true)
+	defer b.StopAutonomousTransmission()
+
+	// The routine tick transmits the slow log.
+	b.Write([]byte("slow"))
+	time.Sleep(50 * time.Millisecond)
+	// The flushed log waits for the routine transmission.
+	b.WriteLevel(Error, []byte("error"))
+	b.Write([]byte("after"))
+	time.Sleep(50 * time.Millisecond)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if strings.Join(s.out, "|") != "slow|error|after" {
+		t.Fatalf("Unexpected transmissions: %q.", s.out)
+	}
+}
+
+func TestAutonomousTransmissionLifecycle(t *testing.T) {
+	mock := newMockStream(10)
+	b := NewBufferedStream(mock)
+	b.SetSchedulingInterval(time.Hour, false)
+
+	// Concurrent starts, only one succeeds.
+	var started int32
+	var group sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			if b.StartAutonomousTransmission() == nil {
+				atomic.AddInt32(&started, 1)
+			}
+		}()
+	}
+	group.Wait()
+	if started != 1 {
+		t.Fatalf("Unexpected number of started routines. Expected: %d - Found: %d.", 1, started)
+	}
+
+	// Stop returns once the routine exited and the buffer is transmitted.
+	b.Write([]byte("first"))
+	if err := b.StopAutonomousTransmission(); err != nil {
+		t.Fatalf("Unexpected error: %s.", err.Error())
+	}
+	if b.routineRunning() {
+		t.Fatalf("Unexpected routineRunning flag. Should be false!")
+	}
+	if len(mock.out) != 1 || <-mock.out != "first" {
+		t.Fatalf("The buffer should have been transmitted on stop.")
+	}
+
+	// The routine can be started again, and stopped by its context.
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := b.StartAutonomousTransmissionContext(ctx); err != nil {
+		t.Fatalf("Unexpected error: %s.", err.Error())
+	}
+	b.Write([]byte("second"))
+	cancel()
+	select {
+	case message := <-mock.out:
+		if message != "second" {
+			t.Fatalf("Unexpected message. Expected: %s - Found: %s.", "second", message)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("The buffer should have been transmitted on cancellation.")
+	}
+	if err := b.StartAutonomousTransmission(); err != nil {
+		t.Fatalf("Unexpected error: %s.", err.Error())
+	}
+	b.StopAutonomousTransmission()
+}
+
+func TestWriteCopiesMessage(t *testing.T) {
+	mock := newMockStream(1)
+	b := NewBufferedStream(mock)
+
+	message := []byte("original")
+	b.Write(message)
+	copy(message, "reused!!")
+
+	if err := b.StopAutonomousTransmission(); err != nil {
+		t.Fatalf("Unexpected error: %s.", err.Error())
+	}
+	if received := <-mock.out; received != "original" {
+		t.Fatalf("Unexpected message. Expected: %s - Found: %s.", "original", received)
+	}
+}
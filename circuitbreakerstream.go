@@ -0,0 +1,279 @@
+package gonyan
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// CircuitState represents the state of a CircuitBreakerStream.
+type CircuitState int
+
+// Circuit states:
+//
+//   - CircuitClosed: writes reach the wrapped stream;
+//   - CircuitOpen: writes fail immediately with ErrCircuitOpen;
+//   - CircuitHalfOpen: the cool-down expired, a single write at a time probes
+//     the wrapped stream.
+const (
+	CircuitClosed   CircuitState = iota
+	CircuitOpen     CircuitState = iota
+	CircuitHalfOpen CircuitState = iota
+)
+
+// String returns a label for the state.
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// ErrCircuitOpen is returned by CircuitBreakerStream writes rejected while
+// the circuit is open.
+var ErrCircuitOpen = errors.New("circuit open")
+
+// DefaultFailureThreshold defines the default number of consecutive failures
+// opening the circuit.
+const DefaultFailureThreshold = 5
+
+// DefaultSuccessThreshold defines the default number of consecutive
+// successful probes closing the circuit.
+const DefaultSuccessThreshold = 1
+
+// DefaultCoolDown defines the default time the circuit stays open before
+// probing the wrapped stream again.
+const DefaultCoolDown = 30 * time.Second
+
+// CircuitBreakerStream represents a wrapper over a standard Stream which stops
+// invoking it once it keeps failing, so that an unavailable sink does not
+// slow every log down:
+//
+//   - closed: writes are forwarded, reaching the failure threshold of
+//     consecutive failures the circuit opens;
+//   - open: writes fail immediately with ErrCircuitOpen until the cool-down
+//     expires and the circuit becomes half-open;
+//   - half-open: one write at a time is forwarded as a probe, a failure opens
+//     the circuit again while reaching the success threshold of
+//     consecutive successes closes it.
+//
+// Failures are detected through the errors returned by the wrapped stream
+// Write. Asynchronous streams, whose writes only queue the logs, report the
+// outcome of their deliveries through Report instead.
+type CircuitBreakerStream struct {
+	// Stream is the wrapped stream.
+	Stream Stream
+	// failureThreshold is the number of consecutive failures opening the
+	// circuit.
+	failureThreshold int
+	// successThreshold is the number of consecutive successful probes closing
+	// the circuit.
+	successThreshold int
+	// coolDown is the time the circuit stays open.
+	coolDown time.Duration
+	// state is the current circuit state.
+	state CircuitState
+	// failures counts the consecutive failures while closed.
+	failures int
+	// successes counts the consecutive successful probes while half-open.
+	successes int
+	// openedAt is the time the circuit has been opened.
+	openedAt time.Time
+	// probing reports whether a probe is in flight while half-open.
+	probing bool
+	// reporting reports whether the wrapped stream reports its outcomes
+	// through Report.
+	reporting bool
+	// mutex is used for accessing all the above.
+	mutex sync.Mutex
+	// stateChange is an optional function invoked on every transition.
+	stateChange func(from, to CircuitState)
+}
+
+// NewCircuitBreakerStream creates a new, closed, CircuitBreakerStream
+// wrapping provided stream.
+func NewCircuitBreakerStream(stream Stream) *CircuitBreakerStream {
+	return &CircuitBreakerStream{
+		Stream:           stream,
+		failureThreshold: DefaultFailureThreshold,
+		successThreshold: DefaultSuccessThreshold,
+		coolDown:         DefaultCoolDown,
+		state:            CircuitClosed,
+	}
+}
+
+// SetFailureThreshold sets the number of consecutive failures opening the
+// circuit. Non positive values are ignored.
+func (c *CircuitBreakerStream) SetFailureThreshold(threshold int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if threshold > 0 {
+		c.failureThreshold = threshold
+	}
+}
+
+// SetSuccessThreshold sets the number of consecutive successful probes
+// closing the circuit. Non positive values are ignored.
+func (c *CircuitBreakerStream) SetSuccessThreshold(threshold int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if threshold > 0 {
+		c.successThreshold = threshold
+	}
+}
+
+// SetCoolDown sets the time the circuit stays open before probing the
+// wrapped stream again. Negative values are ignored.
+func (c *CircuitBreakerStream) SetCoolDown(coolDown time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if coolDown >= 0 {
+		c.coolDown = coolDown
+	}
+}
+
+// SetStateChangeFn sets the optional function invoked on every state
+// transition. The function is invoked synchronously by Write, or Report,
+// once the lock is released: it can query the State but must not write to
+// the same CircuitBreakerStream.
+func (c *CircuitBreakerStream) SetStateChangeFn(stateChangeFn func(from, to CircuitState)) {
+	c.mutex.Lock()
+	c.stateChange = stateChangeFn
+	c.mutex.Unlock()
+}
+
+// State returns the current circuit state, an open circuit whose cool-down
+// expired is reported as half-open.
+func (c *CircuitBreakerStream) State() CircuitState {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.state == CircuitOpen && time.Since(c.openedAt) >= c.coolDown {
+		return CircuitHalfOpen
+	}
+	return c.state
+}
+
+// Write function defined to implement the Stream interface.
+// The function forwards provided bytes to the wrapped stream unless the
+// circuit is open, in which case ErrCircuitOpen is returned.
+func (c *CircuitBreakerStream) Write(messageBytes []byte) (int, error) {
+	if err := c.acquire(); err != nil {
+		return 0, err
+	}
+	n, err := c.Stream.Write(messageBytes)
+	c.release(err == nil)
+	return n, err
+}
+
+// Report records the outcome of a delivery performed asynchronously by the
+// wrapped stream: a nil error counts as a success, any other as a failure.
+// Once the wrapped stream reports, the writes it accepts no longer count as
+// successes. Outcomes reported while the circuit is open are ignored.
+func (c *CircuitBreakerStream) Report(err error) {
+	c.mutex.Lock()
+	c.reporting = true
+	var notify func()
+	if c.state != CircuitOpen {
+		notify = c.record(err == nil)
+	}
+	c.mutex.Unlock()
+	if notify != nil {
+		notify()
+	}
+}
+
+// acquire checks whether a write can be forwarded, moving from open to
+// half-open once the cool-down expired.
+func (c *CircuitBreakerStream) acquire() error {
+	c.mutex.Lock()
+	var notify func()
+	var err error
+	if c.state == CircuitOpen {
+		if time.Since(c.openedAt) < c.coolDown {
+			c.mutex.Unlock()
+			return ErrCircuitOpen
+		}
+		notify = c.transition(CircuitHalfOpen)
+	}
+	if c.state == CircuitHalfOpen {
+		if c.probing {
+			err = ErrCircuitOpen
+		} else {
+			c.probing = true
+		}
+	}
+	c.mutex.Unlock()
+
+	if notify != nil {
+		notify()
+	}
+	return err
+}
+
+// release records the outcome of a forwarded write.
+func (c *CircuitBreakerStream) release(success bool) {
+	c.mutex.Lock()
+	if c.state == CircuitHalfOpen {
+		c.probing = false
+	}
+	var notify func()
+	if !success || !c.reporting {
+		notify = c.record(success)
+	}
+	c.mutex.Unlock()
+
+	if notify != nil {
+		notify()
+	}
+}
+
+// record updates the counters with the outcome of a write, returning the
+// notification of the resulting transition, if any. It *must* be called
+// holding the lock.
+func (c *CircuitBreakerStream) record(success bool) func() {
+	if c.state == CircuitHalfOpen {
+		if !success {
+			return c.transition(CircuitOpen)
+		}
+		if c.successes++; c.successes >= c.successThreshold {
+			return c.transition(CircuitClosed)
+		}
+		return nil
+	}
+
+	if success {
+		c.failures = 0
+		return nil
+	}
+	if c.failures++; c.state == CircuitClosed && c.failures >= c.failureThreshold {
+		return c.transition(CircuitOpen)
+	}
+	return nil
+}
+
+// transition moves the circuit to provided state resetting the counters. It
+// returns the function notifying the transition, nil when there is nothing
+// to notify, which *must* be invoked once the lock is released. It *must* be
+// called holding the lock.
+func (c *CircuitBreakerStream) transition(to CircuitState) func() {
+	from := c.state
+	c.state = to
+	c.failures = 0
+	c.successes = 0
+	if to == CircuitOpen {
+		c.openedAt = time.Now()
+	}
+	stateChange := c.stateChange
+	if stateChange == nil || from == to {
+		return nil
+	}
+	return func() {
+		stateChange(from, to)
+	}
+}
@@ -0,0 +1,125 @@
+package gonyan
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerStream(t *testing.T) {
+	stream := &switchMockStream{}
+	c := NewCircuitBreakerStream(stream)
+	c.SetFailureThreshold(2)
+	c.SetSuccessThreshold(2)
+	c.SetCoolDown(50 * time.Millisecond)
+
+	var transitions []string
+	c.SetStateChangeFn(func(from, to CircuitState) {
+		// The callback is invoked outside the lock.
+		if c.State() != to {
+			t.Errorf("Unexpected state during the %s>%s transition: %s.", from, to, c.State())
+		}
+		transitions = append(transitions, from.String()+">"+to.String())
+	})
+
+	if _, err := c.Write([]byte("log")); err != nil {
+		t.Fatalf("Unexpected error: %s.", err.Error())
+	}
+
+	stream.setFailing(true)
+	for i := 0; i < 2; i++ {
+		if _, err := c.Write([]byte("log")); err == nil || err == ErrCircuitOpen {
+			t.Fatalf("Expected stream error, found: %v.", err)
+		}
+	}
+	if c.State() != CircuitOpen {
+		t.Fatalf("Unexpected state. Expected: %s - Found: %s.", CircuitOpen, c.State())
+	}
+	if _, err := c.Write([]byte("log")); err != ErrCircuitOpen {
+		t.Fatalf("Expected ErrCircuitOpen, found: %v.", err)
+	}
+	if stream.writes != 3 {
+		t.Fatalf("Unexpected writes. Expected: %d - Found: %d.", 3, stream.writes)
+	}
+
+	// A failed probe opens the circuit again.
+	time.Sleep(60 * time.Millisecond)
+	if c.State() != CircuitHalfOpen {
+		t.Fatalf("Unexpected state. Expected: %s - Found: %s.", CircuitHalfOpen, c.State())
+	}
+	if _, err := c.Write([]byte("log")); err == nil || err == ErrCircuitOpen {
+		t.Fatalf("Expected stream error, found: %v.", err)
+	}
+	if _, err := c.Write([]byte("log")); err != ErrCircuitOpen {
+		t.Fatalf("Expected ErrCircuitOpen, found: %v.", err)
+	}
+
+	// Two successful probes close it.
+	stream.setFailing(false)
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if _, err := c.Write([]byte("log")); err != nil {
+			t.Fatalf("Unexpected error: %s.", err.Error())
+		}
+	}
+	if c.State() != CircuitClosed {
+		t.Fatalf("Unexpected state. Expected: %s - Found: %s.", CircuitClosed, c.State())
+	}
+
+	expected := []string{"closed>open", "open>half-open", "half-open>open", "open>half-open", "half-open>closed"}
+	if len(transitions) != len(expected) {
+		t.Fatalf("Unexpected transitions. Expected: %v - Found: %v.", expected, transitions)
+	}
+	for i := range expected {
+		if transitions[i] != expected[i] {
+			t.Fatalf("Unexpected transitions. Expected: %v - Found: %v.", expected, transitions)
+		}
+	}
+}
+
+func TestCircuitBreakerStreamResetsFailures(t *testing.T) {
+	stream := &switchMockStream{}
+	c := NewCircuitBreakerStream(stream)
+	c.SetFailureThreshold(2)
+
+	for i := 0; i < 3; i++ {
+		stream.setFailing(true)
+		c.Write([]byte("log"))
+		stream.setFailing(false)
+		c.Write([]byte("log"))
+	}
+	if c.State() != CircuitClosed {
+		t.Fatalf("Unexpected state. Expected: %s - Found: %s.", CircuitClosed, c.State())
+	}
+}
+
+func TestCircuitBreakerStreamReport(t *testing.T) {
+	stream := &switchMockStream{}
+	c := NewCircuitBreakerStream(stream)
+	c.SetFailureThreshold(2)
+	c.SetCoolDown(50 * time.Millisecond)
+
+	// Accepted writes do not reset the reported failures.
+	for i := 0; i < 2; i++ {
+		if _, err := c.Write([]byte("log")); err != nil {
+			t.Fatalf("Unexpected error: %s.", err.Error())
+		}
+		c.Report(errors.New("delivery failed"))
+	}
+	if c.State() != CircuitOpen {
+		t.Fatalf("Unexpected state. Expected: %s - Found: %s.", CircuitOpen, c.State())
+	}
+
+	// The probe closes the circuit only once its delivery is reported.
+	time.Sleep(60 * time.Millisecond)
+	if _, err := c.Write([]byte("log")); err != nil {
+		t.Fatalf("Unexpected error: %s.", err.Error())
+	}
+	if c.State() != CircuitHalfOpen {
+		t.Fatalf("Unexpected state. Expected: %s - Found: %s.", CircuitHalfOpen, c.State())
+	}
+	c.Report(nil)
+	if c.State() != CircuitClosed {
+		t.Fatalf("Unexpected state. Expected: %s - Found: %s.", CircuitClosed, c.State())
+	}
+}
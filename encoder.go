@@ -0,0 +1,142 @@
+package gonyan
+
+import (
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+// maxPooledBufferSize is the capacity above which encoder buffers are not
+// returned to the pool, so that a few huge logs do not pin their memory.
+const maxPooledBufferSize = 64 * 1024
+
+// hexDigits is used to escape control characters.
+const hexDigits = "0123456789abcdef"
+
+// encoder serialises logs into a reusable buffer producing the same output
+// as json.Marshal of a LogMessage, without reflection.
+type encoder struct {
+	buf  []byte   // Serialised log;
+	keys []string // Scratch space used to sort the metadata keys.
+}
+
+// encoderPool holds the encoders used by the loggers.
+var encoderPool = sync.Pool{
+	New: func() interface{} {
+		return &encoder{buf: make([]byte, 0, 512)}
+	},
+}
+
+// getEncoder returns an encoder from the pool.
+func getEncoder() *encoder {
+	return encoderPool.Get().(*encoder)
+}
+
+// putEncoder returns provided encoder to the pool, its buffer *must* not be
+// used anymore.
+func putEncoder(e *encoder) {
+	if cap(e.buf) > maxPooledBufferSize {
+		return
+	}
+	encoderPool.Put(e)
+}
+
+// encode serialises provided log fields into the buffer, replacing its
+// content. Empty timestamp, level and metadata are omitted and the metadata
+// keys are sorted as done by json.Marshal.
+func (e *encoder) encode(tag string, timestamp int64, level, message string, metadata map[string]string) {
+	e.buf = append(e.buf[:0], `{"tag":`...)
+	e.buf = appendJSONString(e.buf, tag)
+	if timestamp != 0 {
+		e.buf = append(e.buf, `,"timestamp":`...)
+		e.buf = strconv.AppendInt(e.buf, timestamp, 10)
+	}
+	if level != "" {
+		e.buf = append(e.buf, `,"level":`...)
+		e.buf = appendJSONString(e.buf, level)
+	}
+	e.buf = append(e.buf, `,"message":`...)
+	e.buf = appendJSONString(e.buf, message)
+
+	if len(metadata) > 0 {
+		e.keys = e.keys[:0]
+		for key := range metadata {
+			e.keys = append(e.keys, key)
+		}
+		// Metadata are usually few, an insertion sort avoids allocations.
+		for i := 1; i < len(e.keys); i++ {
+			for j := i; j > 0 && e.keys[j] < e.keys[j-1]; j-- {
+				e.keys[j], e.keys[j-1] = e.keys[j-1], e.keys[j]
+			}
+		}
+
+		e.buf = append(e.buf, `,"metadata":{`...)
+		for i, key := range e.keys {
+			if i > 0 {
+				e.buf = append(e.buf, ',')
+			}
+			e.buf = appendJSONString(e.buf, key)
+			e.buf = append(e.buf, ':')
+			e.buf = appendJSONString(e.buf, metadata[key])
+			// Do not keep the keys alive while pooled.
+			e.keys[i] = ""
+		}
+		e.buf = append(e.buf, '}')
+	}
+	e.buf = append(e.buf, '}')
+}
+
+// appendJSONString appends provided string to dst as a JSON string, escaping
+// it as json.Marshal does: HTML characters and line/paragraph separators are
+// escaped and invalid UTF-8 bytes are replaced by the replacement character.
+func appendJSONString(dst []byte, s string) []byte {
+	dst = append(dst, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' && b != '<' && b != '>' && b != '&' {
+				i++
+				continue
+			}
+			dst = append(dst, s[start:i]...)
+			switch b {
+			case '"', '\\':
+				dst = append(dst, '\\', b)
+			case '\b':
+				dst = append(dst, '\\', 'b')
+			case '\f':
+				dst = append(dst, '\\', 'f')
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			case '\t':
+				dst = append(dst, '\\', 't')
+			default:
+				dst = append(dst, '\\', 'u', '0', '0', hexDigits[b>>4], hexDigits[b&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, "\ufffd"...)
+			i += size
+			start = i
+			continue
+		}
+		if r == '\u2028' || r == '\u2029' {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, '\\', 'u', '2', '0', '2', hexDigits[r&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	dst = append(dst, s[start:]...)
+	return append(dst, '"')
+}
@@ -0,0 +1,111 @@
+package gonyan
+
+import (
+	"fmt"
+	"sync"
+)
+
+// FailoverStream represents a wrapper routing logs to a secondary stream
+// (e.g. a local file or stderr) while the primary one is unhealthy.
+//
+// The primary stream health is tracked by a CircuitBreakerStream, exposed by
+// the Primary field to configure thresholds and cool-down: while the circuit
+// is closed logs are written to the primary stream, once it opens they are
+// routed to the secondary one until a probe succeeds and closes the circuit
+// again. Logs whose write fails on the primary stream are written to the
+// secondary one as well, so that no log is lost in the meantime.
+//
+// Asynchronous primary streams, whose writes succeed once the logs are
+// queued (e.g. the HTTP stream reporting to the breaker through its
+// SetCircuitBreaker method), only trip the circuit when deliveries fail: the
+// logs they give up do not reach the secondary stream unless their own
+// failure callback writes them to it.
+type FailoverStream struct {
+	// Primary is the circuit breaker wrapping the primary stream.
+	Primary *CircuitBreakerStream
+	// Secondary is the stream used while the primary one is unhealthy.
+	Secondary Stream
+	// failedOver reports whether logs are currently routed to the secondary
+	// stream.
+	failedOver bool
+	// mutex is used for accessing failedOver.
+	mutex sync.Mutex
+	// failover is an optional function invoked when logs start (true) or
+	// stop (false) being routed to the secondary stream.
+	failover func(failedOver bool, err error)
+}
+
+// NewFailoverStream creates a new FailoverStream writing to primary stream and
+// falling back to secondary one. The primary stream is wrapped into a new
+// CircuitBreakerStream unless it already is one.
+func NewFailoverStream(primary, secondary Stream) *FailoverStream {
+	breaker, ok := primary.(*CircuitBreakerStream)
+	if !ok {
+		breaker = NewCircuitBreakerStream(primary)
+	}
+	return &FailoverStream{
+		Primary:   breaker,
+		Secondary: secondary,
+	}
+}
+
+// SetFailoverFn sets the optional function invoked when logs start being
+// routed to the secondary stream, with failedOver set to true and the primary
+// stream error, and when they get back to the primary one, with failedOver
+// set to false. The function is invoked synchronously by Write, without
+// holding any lock.
+func (f *FailoverStream) SetFailoverFn(failoverFn func(failedOver bool, err error)) {
+	f.mutex.Lock()
+	f.failover = failoverFn
+	f.mutex.Unlock()
+}
+
+// FailedOver reports whether logs are currently routed to the secondary
+// stream.
+func (f *FailoverStream) FailedOver() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.failedOver
+}
+
+// Write function defined to implement the Stream interface.
+// The function writes provided bytes to the primary stream, falling back to
+// the secondary one when the primary fails or its circuit is open.
+func (f *FailoverStream) Write(messageBytes []byte) (int, error) {
+	n, err := f.Primary.Write(messageBytes)
+	f.update(err)
+	if err == nil {
+		return n, nil
+	}
+
+	n, secondaryErr := f.Secondary.Write(messageBytes)
+	if secondaryErr != nil {
+		return n, fmt.Errorf("failover failed due to: %s (primary: %s)", secondaryErr.Error(), err.Error())
+	}
+	return n, nil
+}
+
+// update tracks the routing after a primary stream write, invoking the
+// failover function on changes.
+func (f *FailoverStream) update(err error) {
+	state := f.Primary.State()
+
+	f.mutex.Lock()
+	switch {
+	case !f.failedOver && err != nil && state != CircuitClosed:
+		f.failedOver = true
+	case f.failedOver && state == CircuitClosed && err == nil:
+		f.failedOver = false
+	default:
+		f.mutex.Unlock()
+		return
+	}
+	failover, failedOver := f.failover, f.failedOver
+	f.mutex.Unlock()
+
+	// The function is invoked outside the lock so that it can inspect the
+	// stream.
+	if failover != nil {
+		failover(failedOver, err)
+	}
+}
@@ -0,0 +1,73 @@
+package gonyan
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFailoverStream(t *testing.T) {
+	primary := &switchMockStream{}
+	secondary := newMockStream(10)
+	f := NewFailoverStream(primary, secondary)
+	f.Primary.SetFailureThreshold(1)
+	f.Primary.SetCoolDown(50 * time.Millisecond)
+
+	var events []bool
+	f.SetFailoverFn(func(failedOver bool, err error) {
+		if failedOver && err == nil {
+			t.Fatalf("Expected the primary stream error.")
+		}
+		// The stream can be inspected by the function.
+		if f.FailedOver() != failedOver {
+			t.Fatalf("Unexpected routing state.")
+		}
+		events = append(events, failedOver)
+	})
+
+	if _, err := f.Write([]byte("first")); err != nil {
+		t.Fatalf("Unexpected error: %s.", err.Error())
+	}
+	if len(secondary.out) != 0 {
+		t.Fatalf("Unexpected secondary stream write.")
+	}
+
+	primary.setFailing(true)
+	for _, msg := range []string{"second", "third"} {
+		if _, err := f.Write([]byte(msg)); err != nil {
+			t.Fatalf("Unexpected error: %s.", err.Error())
+		}
+		if out := <-secondary.out; out != msg {
+			t.Fatalf("Unexpected secondary log. Expected: %s - Found: %s.", msg, out)
+		}
+	}
+	if !f.FailedOver() {
+		t.Fatalf("Expected the stream to be failed over.")
+	}
+	if primary.writes != 2 {
+		t.Fatalf("Unexpected primary writes. Expected: %d - Found: %d.", 2, primary.writes)
+	}
+
+	primary.setFailing(false)
+	time.Sleep(60 * time.Millisecond)
+	if _, err := f.Write([]byte("fourth")); err != nil {
+		t.Fatalf("Unexpected error: %s.", err.Error())
+	}
+	if f.FailedOver() || len(secondary.out) != 0 {
+		t.Fatalf("Expected logs back on the primary stream.")
+	}
+	if len(events) != 2 || !events[0] || events[1] {
+		t.Fatalf("Unexpected failover events: %v.", events)
+	}
+}
+
+func TestFailoverStreamSecondaryFailure(t *testing.T) {
+	f := NewFailoverStream(newFailerMockStream("primary"), newFailerMockStream("secondary"))
+	if _, err := f.Write([]byte("log")); err == nil {
+		t.Fatalf("Expected an error.")
+	}
+
+	breaker := NewCircuitBreakerStream(newMockStream(1))
+	if NewFailoverStream(breaker, nil).Primary != breaker {
+		t.Fatalf("Expected the provided circuit breaker to be used.")
+	}
+}
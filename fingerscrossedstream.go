@@ -0,0 +1,299 @@
+package gonyan
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+)
+
+// DefaultContextSize defines the default number of logs held for each
+// context by a FingersCrossedStream.
+const DefaultContextSize = 50
+
+// DefaultMaxContexts defines the default number of contexts tracked by a
+// FingersCrossedStream.
+const DefaultMaxContexts = 1000
+
+// ContextByTag groups the logs held by a FingersCrossedStream by their tag,
+// that is by logger.
+func ContextByTag(message *LogMessage) string {
+	return message.Tag
+}
+
+// ContextByMetadata returns a function grouping the logs held by a
+// FingersCrossedStream by the value of provided metadata key, such as a
+// request ID; logs missing the key are grouped by tag.
+func ContextByMetadata(key string) func(*LogMessage) string {
+	return func(message *LogMessage) string {
+		if value, ok := message.Metadata[key]; ok {
+			return "metadata:" + value
+		}
+		return "tag:" + message.Tag
+	}
+}
+
+// heldContext is the ring buffer of the logs held for a context.
+type heldContext struct {
+	key      string        // Context key;
+	messages [][]byte      // Ring buffer of the held logs;
+	start    int           // Index of the oldest held log;
+	count    int           // Number of held logs;
+	element  *list.Element // Position in the recently used contexts.
+}
+
+// FingersCrossedStream represents a wrapper over a standard Stream which holds
+// low severity logs back and only writes them when something goes wrong:
+//
+//   - logs below the trigger level are kept, per context, in a ring buffer
+//     holding the last ones (by default DefaultContextSize) and are
+//     silently discarded when overwritten;
+//   - a log at or above the trigger level (by default Error) makes the
+//     stream write the held logs of its context, oldest first, followed by
+//     the log itself; held logs left unwritten by a failure are held
+//     again.
+//
+// By default contexts group the logs by tag (see ContextByTag), they can be
+// grouped by request as well (see ContextByMetadata). Logs whose level is
+// at or above the pass-through level are written right away without being
+// held, by default the pass-through level is the trigger one.
+type FingersCrossedStream struct {
+	// Stream is the wrapped stream.
+	Stream Stream
+	// triggerLevel is the level from which logs release their context.
+	triggerLevel LogLevel
+	// passThroughLevel is the level from which logs are never held.
+	passThroughLevel LogLevel
+	// size is the number of logs held for each context.
+	size int
+	// maxContexts is the maximum number of contexts tracked, the least
+	// recently used ones being discarded.
+	maxContexts int
+	// contextKey returns the context of a log.
+	contextKey func(*LogMessage) string
+	// contexts holds the logs of each context.
+	contexts map[string]*heldContext
+	// recent keeps the contexts ordered from the most recently used.
+	recent *list.List
+	// mutex is used for accessing the contexts.
+	mutex sync.Mutex
+	// writeMutex serialises the writes on the wrapped stream, so that the
+	// released logs are not interleaved with other ones.
+	writeMutex sync.Mutex
+}
+
+// NewFingersCrossedStream creates a new FingersCrossedStream wrapping
+// provided stream.
+func NewFingersCrossedStream(stream Stream) *FingersCrossedStream {
+	return &FingersCrossedStream{
+		Stream:           stream,
+		triggerLevel:     Error,
+		passThroughLevel: Error,
+		size:             DefaultContextSize,
+		maxContexts:      DefaultMaxContexts,
+		contextKey:       ContextByTag,
+		contexts:         make(map[string]*heldContext),
+		recent:           list.New(),
+	}
+}
+
+// SetTriggerLevel sets the level from which logs release their context. The
+// pass-through level is lowered to provided level when higher.
+func (f *FingersCrossedStream) SetTriggerLevel(level LogLevel) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.triggerLevel = level
+	if f.passThroughLevel > level {
+		f.passThroughLevel = level
+	}
+}
+
+// SetPassThroughLevel sets the level from which logs are written right away
+// without being held, it cannot be higher than the trigger level.
+func (f *FingersCrossedStream) SetPassThroughLevel(level LogLevel) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if level > f.triggerLevel {
+		level = f.triggerLevel
+	}
+	f.passThroughLevel = level
+}
+
+// SetContextSize sets the number of logs held for each context, the held
+// logs are discarded. Non positive values are ignored.
+func (f *FingersCrossedStream) SetContextSize(size int) {
+	if size <= 0 {
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.size = size
+	f.reset()
+}
+
+// SetMaxContexts sets the maximum number of contexts tracked, the least
+// recently used ones being discarded. Non positive values are ignored.
+func (f *FingersCrossedStream) SetMaxContexts(maxContexts int) {
+	if maxContexts <= 0 {
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.maxContexts = maxContexts
+	f.evict()
+}
+
+// SetContextKey sets the function returning the context of each log, such
+// as ContextByTag or ContextByMetadata; the held logs are discarded.
+func (f *FingersCrossedStream) SetContextKey(contextKey func(*LogMessage) string) {
+	if contextKey == nil {
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.contextKey = contextKey
+	f.reset()
+}
+
+// Write function defined to implement the Stream interface.
+// The function holds, writes or releases provided log according to its
+// level, parsed from its JSON serialisation.
+func (f *FingersCrossedStream) Write(messageBytes []byte) (int, error) {
+	return f.write(messageBytes, unknownLevel)
+}
+
+// WriteLevel function defined to implement the LevelWriter interface.
+// It behaves as Write using provided level in place of the one serialised
+// in the log.
+func (f *FingersCrossedStream) WriteLevel(level LogLevel, messageBytes []byte) (int, error) {
+	return f.write(messageBytes, level)
+}
+
+// write holds, writes or releases provided log, whose level may be
+// unknownLevel. The log is parsed only when its level is unknown or its
+// context is needed.
+func (f *FingersCrossedStream) write(messageBytes []byte, level LogLevel) (int, error) {
+	var message *LogMessage
+	if level == unknownLevel {
+		message = parseHeld(messageBytes)
+		level = Debug
+		if parsed, err := ParseLevelLabel(message.Level); err == nil {
+			level = parsed
+		}
+	}
+
+	f.mutex.Lock()
+	triggerLevel, passThroughLevel, contextKey := f.triggerLevel, f.passThroughLevel, f.contextKey
+	f.mutex.Unlock()
+	if level >= passThroughLevel && level < triggerLevel {
+		f.writeMutex.Lock()
+		defer f.writeMutex.Unlock()
+		return f.Stream.Write(messageBytes)
+	}
+
+	if message == nil {
+		message = parseHeld(messageBytes)
+	}
+	key := contextKey(message)
+	if level < triggerLevel {
+		f.mutex.Lock()
+		// Callers may reuse the written bytes.
+		f.context(key).push(append([]byte{}, messageBytes...))
+		f.mutex.Unlock()
+		return len(messageBytes), nil
+	}
+
+	f.writeMutex.Lock()
+	defer f.writeMutex.Unlock()
+	f.mutex.Lock()
+	held := f.release(key)
+	f.mutex.Unlock()
+
+	for i, heldMessage := range held {
+		if n, err := f.Stream.Write(heldMessage); err != nil {
+			f.mutex.Lock()
+			f.restore(key, held[i:])
+			f.mutex.Unlock()
+			return 0, fmt.Errorf("failed write of held log on stream: %s, returned count: %d", err.Error(), n)
+		}
+	}
+	return f.Stream.Write(messageBytes)
+}
+
+// parseHeld deserialises provided log. Logs which are not valid serialised
+// LogMessages share the context of the logs without tag.
+func parseHeld(messageBytes []byte) *LogMessage {
+	message, err := Deserialise(messageBytes)
+	if err != nil {
+		return &LogMessage{}
+	}
+	return message
+}
+
+// context returns the context with provided key, created when missing, and
+// marks it as the most recently used. It *must* be called holding the lock.
+func (f *FingersCrossedStream) context(key string) *heldContext {
+	c, ok := f.contexts[key]
+	if !ok {
+		c = &heldContext{key: key, messages: make([][]byte, f.size)}
+		c.element = f.recent.PushFront(c)
+		f.contexts[key] = c
+		f.evict()
+	} else {
+		f.recent.MoveToFront(c.element)
+	}
+	return c
+}
+
+// push stores provided log in the ring buffer, overwriting the oldest one
+// when full.
+func (c *heldContext) push(message []byte) {
+	if c.count < len(c.messages) {
+		c.messages[(c.start+c.count)%len(c.messages)] = message
+		c.count++
+		return
+	}
+	c.messages[c.start] = message
+	c.start = (c.start + 1) % len(c.messages)
+}
+
+// restore holds again provided released logs ahead of the ones held for the
+// same context meanwhile. It *must* be called holding the lock.
+func (f *FingersCrossedStream) restore(key string, messages [][]byte) {
+	messages = append(messages, f.release(key)...)
+	c := f.context(key)
+	for _, message := range messages {
+		c.push(message)
+	}
+}
+
+// release removes the context with provided key returning its logs, oldest
+// first. It *must* be called holding the lock.
+func (f *FingersCrossedStream) release(key string) [][]byte {
+	c, ok := f.contexts[key]
+	if !ok {
+		return nil
+	}
+	delete(f.contexts, key)
+	f.recent.Remove(c.element)
+
+	held := make([][]byte, c.count)
+	for i := range held {
+		held[i] = c.messages[(c.start+i)%len(c.messages)]
+	}
+	return held
+}
+
+// evict discards the least recently used contexts exceeding the maximum. It
+// *must* be called holding the lock.
+func (f *FingersCrossedStream) evict() {
+	for f.recent.Len() > f.maxContexts {
+		c := f.recent.Remove(f.recent.Back()).(*heldContext)
+		delete(f.contexts, c.key)
+	}
+}
+
+// reset discards all the held logs. It *must* be called holding the lock.
+func (f *FingersCrossedStream) reset() {
+	f.contexts = make(map[string]*heldContext)
+	f.recent.Init()
+}
@@ -0,0 +1,156 @@
+package gonyan
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// requestLog returns a serialised log with provided level, message and
+// request metadata.
+func requestLog(level LogLevel, message, request string) []byte {
+	return []byte(fmt.Sprintf(`{"tag":"api","level":"%s","message":"%s","metadata":{"request":"%s"}}`, GetLevelLabel(level), message, request))
+}
+
+// drain returns the messages received by provided mock stream.
+func drain(s *mockStream) []string {
+	var received []string
+	for len(s.out) > 0 {
+		received = append(received, <-s.out)
+	}
+	return received
+}
+
+func TestFingersCrossedStream(t *testing.T) {
+	s := newMockStream(10)
+	f := NewFingersCrossedStream(s)
+	f.SetContextSize(2)
+
+	f.Write(levelLog(Debug, "1"))
+	f.Write(levelLog(Info, "2"))
+	f.Write(levelLog(Warning, "3"))
+	if len(s.out) != 0 {
+		t.Fatalf("Unexpected writes: %q.", drain(s))
+	}
+
+	// Only the last held logs are released, oldest first.
+	if _, err := f.Write(levelLog(Error, "4")); err != nil {
+		t.Fatalf("Unexpected error: %s.", err.Error())
+	}
+	expected := []string{string(levelLog(Info, "2")), string(levelLog(Warning, "3")), string(levelLog(Error, "4"))}
+	if received := drain(s); fmt.Sprint(received) != fmt.Sprint(expected) {
+		t.Fatalf("Unexpected writes. Expected: %q - Found: %q.", expected, received)
+	}
+
+	// The released context starts over.
+	f.Write(levelLog(Debug, "5"))
+	f.WriteLevel(Fatal, []byte("plain"))
+	if received := drain(s); len(received) != 1 || received[0] != "plain" {
+		t.Fatalf("Unexpected writes: %q.", received)
+	}
+	f.Write(levelLog(Fatal, "6"))
+	if received := drain(s); len(received) != 2 || received[0] != string(levelLog(Debug, "5")) {
+		t.Fatalf("Unexpected writes: %q.", received)
+	}
+}
+
+func TestFingersCrossedStreamLevels(t *testing.T) {
+	s := newMockStream(10)
+	f := NewFingersCrossedStream(s)
+	f.SetTriggerLevel(Fatal)
+	f.SetPassThroughLevel(Warning)
+
+	f.Write(levelLog(Info, "1"))
+	f.Write(levelLog(Error, "2"))
+	if received := drain(s); len(received) != 1 || received[0] != string(levelLog(Error, "2")) {
+		t.Fatalf("Unexpected writes: %q.", received)
+	}
+
+	// Lowering the trigger level lowers the pass-through one as well.
+	f.SetTriggerLevel(Info)
+	if f.passThroughLevel != Info {
+		t.Fatalf("Unexpected pass-through level. Expected: %d - Found: %d.", Info, f.passThroughLevel)
+	}
+	f.Write(levelLog(Info, "3"))
+	if received := drain(s); len(received) != 2 || received[0] != string(levelLog(Info, "1")) {
+		t.Fatalf("Unexpected writes: %q.", received)
+	}
+}
+
+func TestFingersCrossedStreamContexts(t *testing.T) {
+	s := newMockStream(10)
+	f := NewFingersCrossedStream(s)
+	f.SetContextKey(ContextByMetadata("request"))
+	f.SetMaxContexts(2)
+
+	f.Write(requestLog(Debug, "a1", "a"))
+	f.Write(requestLog(Debug, "b1", "b"))
+	f.Write(requestLog(Debug, "a2", "a"))
+	// The least recently used context is discarded.
+	f.Write(requestLog(Debug, "c1", "c"))
+
+	f.Write(requestLog(Error, "a3", "a"))
+	expected := []string{string(requestLog(Debug, "a1", "a")), string(requestLog(Debug, "a2", "a")), string(requestLog(Error, "a3", "a"))}
+	if received := drain(s); fmt.Sprint(received) != fmt.Sprint(expected) {
+		t.Fatalf("Unexpected writes. Expected: %q - Found: %q.", expected, received)
+	}
+	f.Write(requestLog(Error, "b2", "b"))
+	if received := drain(s); len(received) != 1 {
+		t.Fatalf("Unexpected writes: %q.", received)
+	}
+}
+
+func TestFingersCrossedStreamFailure(t *testing.T) {
+	s := &switchMockStream{failing: true}
+	f := NewFingersCrossedStream(s)
+	if _, err := f.Write(levelLog(Debug, "held")); err != nil {
+		t.Fatalf("Unexpected error: %s.", err.Error())
+	}
+	if _, err := f.Write(levelLog(Error, "trigger")); err == nil {
+		t.Fatalf("Expected error, found nil.")
+	}
+
+	// The unwritten logs are held again, ahead of the newer ones.
+	f.Write(levelLog(Info, "newer"))
+	s.setFailing(false)
+	if _, err := f.Write(levelLog(Error, "trigger")); err != nil {
+		t.Fatalf("Unexpected error: %s.", err.Error())
+	}
+	expected := []string{string(levelLog(Debug, "held")), string(levelLog(Info, "newer")), string(levelLog(Error, "trigger"))}
+	if fmt.Sprint(s.out) != fmt.Sprint(expected) {
+		t.Fatalf("Unexpected writes. Expected: %q - Found: %q.", expected, s.out)
+	}
+}
+
+func TestFingersCrossedStreamConcurrentRelease(t *testing.T) {
+	s := &switchMockStream{}
+	f := NewFingersCrossedStream(s)
+	f.SetTriggerLevel(Fatal)
+	f.SetPassThroughLevel(Warning)
+	for i := 0; i < 10; i++ {
+		f.Write(levelLog(Debug, "held"))
+	}
+
+	var group sync.WaitGroup
+	group.Add(1)
+	go func() {
+		defer group.Done()
+		for i := 0; i < 100; i++ {
+			f.WriteLevel(Warning, []byte("passing"))
+		}
+	}()
+	f.Write(levelLog(Fatal, "trigger"))
+	group.Wait()
+
+	// The released logs are written together.
+	first := -1
+	for i, message := range s.out {
+		if message == string(levelLog(Debug, "held")) {
+			first = i
+			break
+		}
+	}
+	if first < 0 || len(s.out) < first+11 || s.out[first+10] != string(levelLog(Fatal, "trigger")) {
+		t.Fatalf("The released logs should not be interleaved: %q.", s.out)
+	}
+}
@@ -0,0 +1,320 @@
+package gonyan
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// DefaultMaxFrameSize defines the maximum size of a message read by a
+// Deframer.
+const DefaultMaxFrameSize = 64 * 1024 * 1024
+
+// Framer defines how the logs of a BufferedStream transmission are framed
+// into a single payload, and how such payload is split back into logs.
+type Framer interface {
+	// Frame builds the payload carrying provided messages, empty ones
+	// included.
+	Frame(messages [][]byte) []byte
+	// Split is a bufio.SplitFunc returning the messages of a payload built
+	// by Frame, one at a time.
+	Split(data []byte, atEOF bool) (advance int, token []byte, err error)
+}
+
+// DelimiterFramer terminates each message with a delimiter, which can be
+// longer than a single byte. Messages must not contain the delimiter.
+type DelimiterFramer struct {
+	Delimiter []byte
+}
+
+// NewlineFramer returns a DelimiterFramer terminating each message with
+// `\n`, as in newline delimited JSON.
+func NewlineFramer() DelimiterFramer {
+	return DelimiterFramer{Delimiter: []byte{'\n'}}
+}
+
+// NULFramer returns a DelimiterFramer terminating each message with a NUL
+// byte.
+func NULFramer() DelimiterFramer {
+	return DelimiterFramer{Delimiter: []byte{0}}
+}
+
+// Frame function defined to implement the Framer interface.
+func (f DelimiterFramer) Frame(messages [][]byte) []byte {
+	var payload []byte
+	for _, message := range messages {
+		payload = append(payload, message...)
+		payload = append(payload, f.Delimiter...)
+	}
+	return payload
+}
+
+// Split function defined to implement the Framer interface. A trailing
+// message missing its delimiter is returned as well.
+func (f DelimiterFramer) Split(data []byte, atEOF bool) (int, []byte, error) {
+	if len(f.Delimiter) == 0 {
+		return 0, nil, errors.New("empty delimiter")
+	}
+	if i := bytes.Index(data, f.Delimiter); i >= 0 {
+		return i + len(f.Delimiter), data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// VarintFramer prefixes each message with its length encoded as an unsigned
+// varint, as in protobuf delimited streams.
+type VarintFramer struct{}
+
+// Frame function defined to implement the Framer interface.
+func (f VarintFramer) Frame(messages [][]byte) []byte {
+	var payload []byte
+	prefix := make([]byte, binary.MaxVarintLen64)
+	for _, message := range messages {
+		payload = append(payload, prefix[:binary.PutUvarint(prefix, uint64(len(message)))]...)
+		payload = append(payload, message...)
+	}
+	return payload
+}
+
+// Split function defined to implement the Framer interface.
+func (f VarintFramer) Split(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) == 0 {
+		return 0, nil, nil
+	}
+	length, n := binary.Uvarint(data)
+	if n < 0 {
+		return 0, nil, errors.New("invalid varint length prefix")
+	}
+	if n == 0 || uint64(len(data)-n) < length {
+		if atEOF {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		return 0, nil, nil
+	}
+	end := n + int(length)
+	return end, data[n:end], nil
+}
+
+// LengthPrefixFramer prefixes each message with its length encoded as a
+// 4 bytes big-endian unsigned integer.
+type LengthPrefixFramer struct{}
+
+// Frame function defined to implement the Framer interface.
+func (f LengthPrefixFramer) Frame(messages [][]byte) []byte {
+	var payload []byte
+	prefix := make([]byte, 4)
+	for _, message := range messages {
+		binary.BigEndian.PutUint32(prefix, uint32(len(message)))
+		payload = append(payload, prefix...)
+		payload = append(payload, message...)
+	}
+	return payload
+}
+
+// Split function defined to implement the Framer interface.
+func (f LengthPrefixFramer) Split(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) == 0 {
+		return 0, nil, nil
+	}
+	if len(data) < 4 || uint64(len(data)-4) < uint64(binary.BigEndian.Uint32(data)) {
+		if atEOF {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		return 0, nil, nil
+	}
+	end := 4 + int(binary.BigEndian.Uint32(data))
+	return end, data[4:end], nil
+}
+
+// JSONArrayFramer wraps the messages, which must be valid JSON values, into
+// a JSON array; empty messages are encoded as `null`.
+type JSONArrayFramer struct{}
+
+// Frame function defined to implement the Framer interface.
+func (f JSONArrayFramer) Frame(messages [][]byte) []byte {
+	payload := []byte{'['}
+	for i, message := range messages {
+		if i > 0 {
+			payload = append(payload, ',')
+		}
+		if len(message) == 0 {
+			message = []byte("null")
+		}
+		payload = append(payload, message...)
+	}
+	return append(payload, ']')
+}
+
+// Split function defined to implement the Framer interface, it returns the
+// raw JSON values of the array.
+func (f JSONArrayFramer) Split(data []byte, atEOF bool) (int, []byte, error) {
+	i := skipJSONSpace(data, 0)
+	if i < len(data) && (data[i] == '[' || data[i] == ',') {
+		i = skipJSONSpace(data, i+1)
+	}
+	if i == len(data) {
+		if atEOF {
+			return len(data), nil, nil
+		}
+		return 0, nil, nil
+	}
+	if data[i] == ']' {
+		return i + 1, nil, nil
+	}
+
+	end := jsonValueEnd(data, i)
+	if end < 0 {
+		if atEOF {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		return 0, nil, nil
+	}
+	return end, data[i:end], nil
+}
+
+// skipJSONSpace returns the index of the first non whitespace byte from
+// provided index.
+func skipJSONSpace(data []byte, i int) int {
+	for i < len(data) && (data[i] == ' ' || data[i] == '\t' || data[i] == '\r' || data[i] == '\n') {
+		i++
+	}
+	return i
+}
+
+// jsonValueEnd returns the index following the JSON value starting at
+// provided index, -1 when the value is incomplete.
+func jsonValueEnd(data []byte, i int) int {
+	depth := 0
+	inString, escaped := false, false
+	for j := i; j < len(data); j++ {
+		c := data[j]
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+				if depth == 0 {
+					return j + 1
+				}
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '{', '[':
+			depth++
+		case '}', ']':
+			if depth == 0 {
+				return j
+			}
+			if depth--; depth == 0 {
+				return j + 1
+			}
+		case ',', ' ', '\t', '\r', '\n':
+			if depth == 0 {
+				return j
+			}
+		}
+	}
+	return -1
+}
+
+// Deframer reads the messages framed by a Framer from a reader.
+type Deframer struct {
+	scanner *bufio.Scanner
+}
+
+// NewDeframer creates a new Deframer reading the payloads, built by provided
+// framer, from provided reader. Messages bigger than DefaultMaxFrameSize are
+// rejected.
+func NewDeframer(r io.Reader, framer Framer) *Deframer {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), DefaultMaxFrameSize)
+	scanner.Split(framer.Split)
+	return &Deframer{scanner: scanner}
+}
+
+// Next returns the next message, io.EOF once all messages have been read.
+func (d *Deframer) Next() ([]byte, error) {
+	if !d.scanner.Scan() {
+		if err := d.scanner.Err(); err != nil {
+			return nil, fmt.Errorf("deframing failed due to: %s", err.Error())
+		}
+		return nil, io.EOF
+	}
+	// The scanner reuses its buffer.
+	return append([]byte{}, d.scanner.Bytes()...), nil
+}
+
+// Deframe splits a payload built by provided framer into its messages.
+func Deframe(payload []byte, framer Framer) ([][]byte, error) {
+	d := NewDeframer(bytes.NewReader(payload), framer)
+	messages := [][]byte{}
+	for {
+		message, err := d.Next()
+		if err == io.EOF {
+			return messages, nil
+		}
+		if err != nil {
+			return messages, err
+		}
+		messages = append(messages, message)
+	}
+}
+
+// SetFramer sets the Framer building the payload of each transmission in
+// place of the flat buffer separator, which is used again when provided
+// framer is nil. Differently from the separator, framers keep the empty
+// messages. When a payload limit is set the size of each message is
+// computed framing it alone, which is exact for the built-in framers but
+// JSONArrayFramer, whose payloads are slightly smaller.
+func (b *BufferedStream) SetFramer(framer Framer) {
+	b.framer = framer
+}
+
+// fireFramedTransmission writes the messages framed by the framer, split
+// according to the payload limit.
+func (b *BufferedStream) fireFramedTransmission(messages [][]byte, amount int) (int, error) {
+	if amount > len(messages) {
+		amount = len(messages)
+	}
+	messages = messages[:amount]
+
+	chunks := [][][]byte{messages}
+	if b.payloadLimit > 0 {
+		chunks = [][][]byte{}
+		chunk := [][]byte{}
+		size := 0
+		for _, message := range messages {
+			messageSize := len(b.framer.Frame([][]byte{message}))
+			if len(chunk) > 0 && size+messageSize > b.payloadLimit {
+				chunks = append(chunks, chunk)
+				chunk, size = [][]byte{}, 0
+			}
+			chunk = append(chunk, message)
+			size += messageSize
+		}
+		if len(chunk) > 0 {
+			chunks = append(chunks, chunk)
+		}
+	}
+
+	sent := 0
+	for _, chunk := range chunks {
+		if n, err := b.Stream.Write(b.framer.Frame(chunk)); err != nil {
+			return sent, fmt.Errorf("failed write on stream: %s, returned count: %d", err.Error(), n)
+		}
+		sent += len(chunk)
+	}
+	return amount, nil
+}
@@ -0,0 +1,114 @@
+package gonyan
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestFramersRoundTrip(t *testing.T) {
+	messages := [][]byte{
+		[]byte(`{"message":"multi\nline"}`),
+		{},
+		[]byte(`{"message":"last"}`),
+	}
+
+	type TestCase struct {
+		framer   Framer
+		expected string
+	}
+	testCases := []TestCase{
+		{framer: VarintFramer{}, expected: "\x19{\"message\":\"multi\\nline\"}\x00\x12{\"message\":\"last\"}"},
+		{framer: LengthPrefixFramer{}, expected: "\x00\x00\x00\x19{\"message\":\"multi\\nline\"}\x00\x00\x00\x00\x00\x00\x00\x12{\"message\":\"last\"}"},
+		{framer: DelimiterFramer{Delimiter: []byte("\r\n--\r\n")}, expected: "{\"message\":\"multi\\nline\"}\r\n--\r\n\r\n--\r\n{\"message\":\"last\"}\r\n--\r\n"},
+		{framer: NULFramer(), expected: "{\"message\":\"multi\\nline\"}\x00\x00{\"message\":\"last\"}\x00"},
+	}
+	for i, testCase := range testCases {
+		payload := testCase.framer.Frame(messages)
+		if string(payload) != testCase.expected {
+			t.Fatalf("Case#%d - Unexpected payload. Expected: %q - Found: %q.", i, testCase.expected, payload)
+		}
+		deframed, err := Deframe(payload, testCase.framer)
+		if err != nil {
+			t.Fatalf("Case#%d - Unexpected error: %s.", i, err.Error())
+		}
+		if fmt.Sprintf("%q", deframed) != fmt.Sprintf("%q", messages) {
+			t.Fatalf("Case#%d - Unexpected messages. Expected: %q - Found: %q.", i, messages, deframed)
+		}
+	}
+
+	// Messages containing the delimiter are split.
+	deframed, _ := Deframe(NewlineFramer().Frame([][]byte{[]byte("multi\nline")}), NewlineFramer())
+	if len(deframed) != 2 {
+		t.Fatalf("Unexpected messages: %q.", deframed)
+	}
+}
+
+func TestJSONArrayFramer(t *testing.T) {
+	messages := [][]byte{
+		[]byte(`{"message":"a, [b] \"c\" {d}","metadata":{"k":["v"]}}`),
+		[]byte(`"string"`),
+		[]byte(`42`),
+		{},
+	}
+	payload := JSONArrayFramer{}.Frame(messages)
+	expected := `[{"message":"a, [b] \"c\" {d}","metadata":{"k":["v"]}},"string",42,null]`
+	if string(payload) != expected {
+		t.Fatalf("Unexpected payload. Expected: %s - Found: %s.", expected, payload)
+	}
+
+	deframed, err := Deframe([]byte(" [ "+string(messages[0])+" ,\n\"string\", 42 ,null ]\n"), JSONArrayFramer{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s.", err.Error())
+	}
+	if len(deframed) != 4 || string(deframed[0]) != string(messages[0]) || string(deframed[2]) != "42" || string(deframed[3]) != "null" {
+		t.Fatalf("Unexpected messages: %q.", deframed)
+	}
+
+	if deframed, err := Deframe([]byte("[]"), JSONArrayFramer{}); err != nil || len(deframed) != 0 {
+		t.Fatalf("Unexpected result: %q, %v.", deframed, err)
+	}
+}
+
+func TestDeframerErrors(t *testing.T) {
+	for i, framer := range []Framer{VarintFramer{}, LengthPrefixFramer{}, JSONArrayFramer{}} {
+		payload := framer.Frame([][]byte{[]byte(`{"message":"truncated"}`)})
+		d := NewDeframer(bytes.NewReader(payload[:len(payload)-3]), framer)
+		if _, err := d.Next(); err == nil || err == io.EOF {
+			t.Fatalf("Case#%d - Expected error, found: %v.", i, err)
+		}
+	}
+	if _, err := Deframe([]byte("a"), DelimiterFramer{}); err == nil {
+		t.Fatalf("Expected error for the empty delimiter.")
+	}
+}
+
+func TestBufferedStreamWithFramer(t *testing.T) {
+	s := newMockStream(5)
+	b := NewBufferedStream(s)
+	b.SetFramer(LengthPrefixFramer{})
+	// Each message takes 4 more bytes.
+	b.SetPayloadLimit(17)
+
+	for _, message := range []string{"hey", "", "oh", "let's go"} {
+		b.Write([]byte(message))
+	}
+	if _, err := b.SetStartingSize(10, true); err != nil {
+		t.Fatalf("Unexpected error: %s.", err.Error())
+	}
+
+	expected := [][]string{{"hey", "", "oh"}, {"let's go"}}
+	for i, chunk := range expected {
+		deframed, err := Deframe([]byte(<-s.out), LengthPrefixFramer{})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s.", err.Error())
+		}
+		if fmt.Sprintf("%q", deframed) != fmt.Sprintf("%q", chunk) {
+			t.Fatalf("Unexpected write #%d. Expected: %q - Found: %q.", i, chunk, deframed)
+		}
+	}
+	if len(s.out) != 0 {
+		t.Fatalf("Unexpected additional writes: %d.", len(s.out))
+	}
+}
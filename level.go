@@ -1,5 +1,10 @@
 package gonyan
 
+import (
+	"fmt"
+	"strings"
+)
+
 // LogLevel is used to define supported logging levels.
 type LogLevel int
 
@@ -22,6 +27,10 @@ const (
 	Panic   LogLevel = iota
 )
 
+// unknownLevel is used internally in place of the level of a log which has
+// not been parsed yet.
+const unknownLevel LogLevel = -1
+
 // GetLevelLabel returns a string label for provided level.
 func GetLevelLabel(level LogLevel) string {
 	switch level {
@@ -43,3 +52,14 @@ func GetLevelLabel(level LogLevel) string {
 		return ""
 	}
 }
+
+// ParseLevelLabel returns the level corresponding to provided label, as
+// returned by GetLevelLabel. The comparison is case insensitive.
+func ParseLevelLabel(label string) (LogLevel, error) {
+	for level := Debug; level <= Panic; level++ {
+		if strings.EqualFold(label, GetLevelLabel(level)) {
+			return level, nil
+		}
+	}
+	return Debug, fmt.Errorf("invalid level label `%s`", label)
+}
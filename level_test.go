@@ -30,3 +30,21 @@ func TestGetLevelLabel(t *testing.T) {
 		t.Fatalf("Label returned with invalid level value")
 	}
 }
+
+func TestParseLevelLabel(t *testing.T) {
+	for level := Debug; level <= Panic; level++ {
+		parsed, err := ParseLevelLabel(GetLevelLabel(level))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if parsed != level {
+			t.Fatalf("Unexpected level parsed. Expected: %d - Found: %d.", level, parsed)
+		}
+	}
+	if parsed, err := ParseLevelLabel("warning"); err != nil || parsed != Warning {
+		t.Fatalf("Lower case label should be parsed. Found: %d, %v.", parsed, err)
+	}
+	if _, err := ParseLevelLabel("not-a-level"); err == nil {
+		t.Fatalf("Invalid label should have failed.")
+	}
+}
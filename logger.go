@@ -60,7 +60,7 @@ func (l *Logger) RegisterStream(level LogLevel, stream Stream) {
 // The function accepts a format and a variadic number of arguments
 // to compose the final log data.
 func (l *Logger) Debugf(format string, args ...interface{}) {
-	l.Debug(fmt.Sprintf(format, args...))
+	l.Logf(Debug, format, args...)
 }
 
 // Debug logs provided message into registered debug level streams.
@@ -72,7 +72,7 @@ func (l *Logger) Debug(message string) {
 // The function accepts a format and a variadic number of arguments
 // to compose the final log data.
 func (l *Logger) Verbosef(format string, args ...interface{}) {
-	l.Verbose(fmt.Sprintf(format, args...))
+	l.Logf(Verbose, format, args...)
 }
 
 // Verbose logs provided message into registered verbose level streams.
@@ -84,7 +84,7 @@ func (l *Logger) Verbose(message string) {
 // The function accepts a format and a variadic number of arguments
 // to compose the final log data.
 func (l *Logger) Infof(format string, args ...interface{}) {
-	l.Info(fmt.Sprintf(format, args...))
+	l.Logf(Info, format, args...)
 }
 
 // Info logs provided message into info level streams.
@@ -96,7 +96,7 @@ func (l *Logger) Info(message string) {
 // The function accepts a format and a variadic number of arguments
 // to compose the final log data.
 func (l *Logger) Warningf(format string, args ...interface{}) {
-	l.Warning(fmt.Sprintf(format, args...))
+	l.Logf(Warning, format, args...)
 }
 
 // Warning logs provided message into warning level streams.
@@ -108,7 +108,7 @@ func (l *Logger) Warning(message string) {
 // The function accepts a format and a variadic number of arguments
 // to compose the final log data.
 func (l *Logger) Errorf(format string, args ...interface{}) {
-	l.Error(fmt.Sprintf(format, args...))
+	l.Logf(Error, format, args...)
 }
 
 // Error logs provided message into error level streams.
@@ -120,7 +120,7 @@ func (l *Logger) Error(message string) {
 // The function accepts a format and a variadic number of arguments
 // to compose the final log data.
 func (l *Logger) Fatalf(format string, args ...interface{}) {
-	l.Fatal(fmt.Sprintf(format, args...))
+	l.Logf(Fatal, format, args...)
 }
 
 // Fatal logs provided message into fatal level streams.
@@ -133,7 +133,7 @@ func (l *Logger) Fatal(message string) {
 // to compose the final log data.
 // Note: When log is performed panic() is invoked.
 func (l *Logger) Panicf(format string, args ...interface{}) {
-	l.Fatal(fmt.Sprintf(format, args...))
+	l.Logf(Fatal, format, args...)
 }
 
 // Panic logs provided message into panic level streams.
@@ -145,24 +145,40 @@ func (l *Logger) Panic(message string) {
 
 // Logf logs provided message into the streams corresponding to provided level.
 // The function accepts a format and a variadic number of arguments
-// to compose the final log data.
+// to compose the final log data, the message is formatted only when streams
+// are registered for the level.
 func (l *Logger) Logf(level LogLevel, format string, args ...interface{}) {
-	l.Logf(level, fmt.Sprintf(format, args...))
+	if count, ok := l.streamManager.registered(level); ok && count == 0 {
+		return
+	}
+	l.Log(level, fmt.Sprintf(format, args...))
 }
 
 // Log function builds the final JSON message and sends it to the correct streams.
+// When no stream is registered for the level the function returns right away,
+// otherwise the message is serialised into a pooled buffer without allocations:
+// streams must not retain the written bytes, as required by io.Writer.
 func (l *Logger) Log(level LogLevel, message string) {
+	count, ok := l.streamManager.registered(level)
+	if !ok {
+		fmt.Printf("[FATAL] [gonyan] Can't send log `%s` to stream `%s`", message, GetLevelLabel(level))
+		return
+	}
+	if count == 0 {
+		return
+	}
+
 	var t int64
 	if l.timestamp {
 		t = time.Now().UTC().UnixNano()
 	}
 
-	m := NewLogMessage(l.tag, t, message, l.metadata)
+	e := getEncoder()
+	defer putEncoder(e)
+	e.encode(l.tag, t, GetLevelLabel(level), message, l.metadata)
 
 	// Send message to streams via the StreamManager.
 	l.m.Lock()
 	defer l.m.Unlock()
-	if err := l.streamManager.Send(level, m); err != nil {
-		fmt.Printf("[FATAL] [gonyan] Can't send log `%s` to stream `%s`", message, GetLevelLabel(level))
-	}
+	l.streamManager.send(level, e.buf)
 }
@@ -1,6 +1,7 @@
 package gonyan
 
 import (
+	"io/ioutil"
 	"os"
 	"testing"
 )
@@ -84,7 +85,7 @@ func TestLoggerStreamsProperLogDataForDebug(t *testing.T) {
 	l.Debugf("Hi %s", "there")
 
 	message := <-stream.out
-	expected := `{"tag":"TestLoggerStreamsProperLogDataForDebug","message":"Hi there"}`
+	expected := `{"tag":"TestLoggerStreamsProperLogDataForDebug","level":"Debug","message":"Hi there"}`
 	if message != expected {
 		t.Fatalf("Unexpected message received from stream. Expected: `%s`, found: `%s`", expected, message)
 	}
@@ -93,7 +94,7 @@ func TestLoggerStreamsProperLogDataForDebug(t *testing.T) {
 	l.Debugf("this log should have metadata")
 
 	message = <-stream.out
-	expected = `{"tag":"TestLoggerStreamsProperLogDataForDebug","message":"this log should have metadata","metadata":{"custom":"field"}}`
+	expected = `{"tag":"TestLoggerStreamsProperLogDataForDebug","level":"Debug","message":"this log should have metadata","metadata":{"custom":"field"}}`
 	if message != expected {
 		t.Fatalf("Unexpected message received from stream. Expected: `%s`, found: `%s`", expected, message)
 	}
@@ -110,7 +111,7 @@ func TestLoggerStreamsProperLogDataForVerbose(t *testing.T) {
 	l.Verbose("Hi there")
 
 	message := <-stream.out
-	expected := `{"tag":"TestLoggerStreamsProperLogDataForVerbose","message":"Hi there"}`
+	expected := `{"tag":"TestLoggerStreamsProperLogDataForVerbose","level":"Verbose","message":"Hi there"}`
 	if message != expected {
 		t.Fatalf("Unexpected message received from stream. Expected: `%s`, found: `%s`", expected, message)
 	}
@@ -119,7 +120,7 @@ func TestLoggerStreamsProperLogDataForVerbose(t *testing.T) {
 	l.Verbosef("this log should have metadata")
 
 	message = <-stream.out
-	expected = `{"tag":"TestLoggerStreamsProperLogDataForVerbose","message":"this log should have metadata","metadata":{"custom":"field"}}`
+	expected = `{"tag":"TestLoggerStreamsProperLogDataForVerbose","level":"Verbose","message":"this log should have metadata","metadata":{"custom":"field"}}`
 	if message != expected {
 		t.Fatalf("Unexpected message received from stream. Expected: `%s`, found: `%s`", expected, message)
 	}
@@ -136,7 +137,7 @@ func TestLoggerStreamsProperLogDataForInfo(t *testing.T) {
 	l.Info("Hi there")
 
 	message := <-stream.out
-	expected := `{"tag":"TestLoggerStreamsProperLogDataForInfo","message":"Hi there"}`
+	expected := `{"tag":"TestLoggerStreamsProperLogDataForInfo","level":"Info","message":"Hi there"}`
 	if message != expected {
 		t.Fatalf("Unexpected message received from stream. Expected: `%s`, found: `%s`", expected, message)
 	}
@@ -145,7 +146,7 @@ func TestLoggerStreamsProperLogDataForInfo(t *testing.T) {
 	l.Infof("this log should have metadata")
 
 	message = <-stream.out
-	expected = `{"tag":"TestLoggerStreamsProperLogDataForInfo","message":"this log should have metadata","metadata":{"custom":"field"}}`
+	expected = `{"tag":"TestLoggerStreamsProperLogDataForInfo","level":"Info","message":"this log should have metadata","metadata":{"custom":"field"}}`
 	if message != expected {
 		t.Fatalf("Unexpected message received from stream. Expected: `%s`, found: `%s`", expected, message)
 	}
@@ -162,7 +163,7 @@ func TestLoggerStreamsProperLogDataForWarning(t *testing.T) {
 	l.Warning("Hi there")
 
 	message := <-stream.out
-	expected := `{"tag":"TestLoggerStreamsProperLogDataForWarning","message":"Hi there"}`
+	expected := `{"tag":"TestLoggerStreamsProperLogDataForWarning","level":"Warning","message":"Hi there"}`
 	if message != expected {
 		t.Fatalf("Unexpected message received from stream. Expected: `%s`, found: `%s`", expected, message)
 	}
@@ -171,7 +172,7 @@ func TestLoggerStreamsProperLogDataForWarning(t *testing.T) {
 	l.Warningf("this log should have metadata")
 
 	message = <-stream.out
-	expected = `{"tag":"TestLoggerStreamsProperLogDataForWarning","message":"this log should have metadata","metadata":{"custom":"field"}}`
+	expected = `{"tag":"TestLoggerStreamsProperLogDataForWarning","level":"Warning","message":"this log should have metadata","metadata":{"custom":"field"}}`
 	if message != expected {
 		t.Fatalf("Unexpected message received from stream. Expected: `%s`, found: `%s`", expected, message)
 	}
@@ -188,7 +189,7 @@ func TestLoggerStreamsProperLogDataForError(t *testing.T) {
 	l.Error("Hi there")
 
 	message := <-stream.out
-	expected := `{"tag":"TestLoggerStreamsProperLogDataForError","message":"Hi there"}`
+	expected := `{"tag":"TestLoggerStreamsProperLogDataForError","level":"Error","message":"Hi there"}`
 	if message != expected {
 		t.Fatalf("Unexpected message received from stream. Expected: `%s`, found: `%s`", expected, message)
 	}
@@ -197,7 +198,7 @@ func TestLoggerStreamsProperLogDataForError(t *testing.T) {
 	l.Errorf("this log should have metadata")
 
 	message = <-stream.out
-	expected = `{"tag":"TestLoggerStreamsProperLogDataForError","message":"this log should have metadata","metadata":{"custom":"field"}}`
+	expected = `{"tag":"TestLoggerStreamsProperLogDataForError","level":"Error","message":"this log should have metadata","metadata":{"custom":"field"}}`
 	if message != expected {
 		t.Fatalf("Unexpected message received from stream. Expected: `%s`, found: `%s`", expected, message)
 	}
@@ -214,7 +215,7 @@ func TestLoggerStreamsProperLogDataForFatal(t *testing.T) {
 	l.Fatal("Hi there")
 
 	message := <-stream.out
-	expected := `{"tag":"TestLoggerStreamsProperLogDataForFatal","message":"Hi there"}`
+	expected := `{"tag":"TestLoggerStreamsProperLogDataForFatal","level":"Fatal","message":"Hi there"}`
 	if message != expected {
 		t.Fatalf("Unexpected message received from stream. Expected: `%s`, found: `%s`", expected, message)
 	}
@@ -223,7 +224,7 @@ func TestLoggerStreamsProperLogDataForFatal(t *testing.T) {
 	l.Fatalf("this log should have metadata")
 
 	message = <-stream.out
-	expected = `{"tag":"TestLoggerStreamsProperLogDataForFatal","message":"this log should have metadata","metadata":{"custom":"field"}}`
+	expected = `{"tag":"TestLoggerStreamsProperLogDataForFatal","level":"Fatal","message":"this log should have metadata","metadata":{"custom":"field"}}`
 	if message != expected {
 		t.Fatalf("Unexpected message received from stream. Expected: `%s`, found: `%s`", expected, message)
 	}
@@ -257,3 +258,98 @@ func TestLoggerMutexReenable(t *testing.T) {
 		t.Fatalf("Disabled flag should be false!")
 	}
 }
+
+// countingStringer counts the times it is formatted.
+type countingStringer struct {
+	count int
+}
+
+func (c *countingStringer) String() string {
+	c.count++
+	return "formatted"
+}
+
+// TestLoggerLazyFormatting verifies that messages are formatted only when
+// streams are registered for the level, and that Logf logs properly.
+func TestLoggerLazyFormatting(t *testing.T) {
+	l := NewLogger("TestLoggerLazyFormatting", false)
+	stream := newMockStream(1)
+	l.RegisterStream(Error, stream)
+
+	arg := &countingStringer{}
+	l.Debugf("%s", arg)
+	l.Logf(Info, "%s", arg)
+	if arg.count != 0 {
+		t.Fatalf("Unexpected formatting. Expected: %d - Found: %d.", 0, arg.count)
+	}
+
+	l.Logf(Error, "%s", arg)
+	expected := `{"tag":"TestLoggerLazyFormatting","level":"Error","message":"formatted"}`
+	if message := <-stream.out; arg.count != 1 || message != expected {
+		t.Fatalf("Unexpected message received from stream. Expected: `%s`, found: `%s`", expected, message)
+	}
+}
+
+// TestLoggerLogAllocations verifies that logging does not allocate, with and
+// without streams registered for the level.
+func TestLoggerLogAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items with the race detector enabled")
+	}
+
+	l := NewLogger("TestLoggerLogAllocations", true)
+	l.SetMetadata(map[string]string{"request": "42", "user": "alice"})
+	l.RegisterStream(Info, ioutil.Discard)
+
+	for _, level := range []LogLevel{Debug, Info} {
+		allocs := testing.AllocsPerRun(100, func() {
+			l.Log(level, "a \"quoted\" message")
+		})
+		if allocs != 0 {
+			t.Fatalf("Unexpected allocations for level %s. Expected: %d - Found: %.1f.", GetLevelLabel(level), 0, allocs)
+		}
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		l.Debugf("a formatted %s", "message")
+	})
+	if allocs != 0 {
+		t.Fatalf("Unexpected allocations formatting without streams. Expected: %d - Found: %.1f.", 0, allocs)
+	}
+}
+
+func BenchmarkLoggerLog(b *testing.B) {
+	l := NewLogger("BenchmarkLoggerLog", true)
+	l.RegisterStream(Info, ioutil.Discard)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		l.Info("a benchmarked message")
+	}
+}
+
+func BenchmarkLoggerLogMetadata(b *testing.B) {
+	l := NewLogger("BenchmarkLoggerLogMetadata", true)
+	l.SetMetadata(map[string]string{"request": "42", "user": "alice"})
+	l.RegisterStream(Info, ioutil.Discard)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		l.Info("a benchmarked message")
+	}
+}
+
+func BenchmarkLoggerLogNoStreams(b *testing.B) {
+	l := NewLogger("BenchmarkLoggerLogNoStreams", true)
+	l.RegisterStream(Info, ioutil.Discard)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		l.Debug("a benchmarked message")
+	}
+}
+
+func BenchmarkLoggerLogfNoStreams(b *testing.B) {
+	l := NewLogger("BenchmarkLoggerLogfNoStreams", true)
+	l.RegisterStream(Info, ioutil.Discard)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		l.Debugf("a benchmarked %s", "message")
+	}
+}
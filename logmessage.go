@@ -1,6 +1,7 @@
 package gonyan
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 )
@@ -10,6 +11,7 @@ import (
 type LogMessage struct {
 	Tag       string            `json:"tag"`
 	Timestamp int64             `json:"timestamp,omitempty"`
+	Level     string            `json:"level,omitempty"`
 	Message   string            `json:"message"`
 	Metadata  map[string]string `json:"metadata,omitempty"`
 }
@@ -27,12 +29,10 @@ func NewLogMessage(tag string, timestamp int64, message string, metadata map[str
 // Serialise uses caller LogMessage data to generate a valid JSON string
 // serialised log.
 func (m *LogMessage) Serialise() ([]byte, error) {
-	messageBytes, err := json.Marshal(m)
-	if err != nil {
-		return nil, fmt.Errorf("%s", err.Error())
-	}
-
-	return messageBytes, nil
+	e := getEncoder()
+	defer putEncoder(e)
+	e.encode(m.Tag, m.Timestamp, m.Level, m.Message, m.Metadata)
+	return append([]byte(nil), e.buf...), nil
 }
 
 // Deserialise uses provided data to generate a LogMessage structure.
@@ -44,3 +44,23 @@ func Deserialise(messageBytes []byte) (*LogMessage, error) {
 
 	return logMessage, nil
 }
+
+// DeserialiseBatch splits a flattened blob of serialised logs (as produced by
+// a BufferedStream using the default separator) and deserialises each of them.
+// Lines that are not valid serialised LogMessages are not discarded, they are
+// returned as a LogMessage carrying the raw line as Message.
+func DeserialiseBatch(batch []byte) []*LogMessage {
+	lines := bytes.Split(batch, []byte{DefaultFlatByteSliceSeparator})
+	messages := make([]*LogMessage, 0, len(lines))
+	for _, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		logMessage, err := Deserialise(line)
+		if err != nil {
+			logMessage = &LogMessage{Message: string(line)}
+		}
+		messages = append(messages, logMessage)
+	}
+	return messages
+}
@@ -2,6 +2,7 @@ package gonyan
 
 import (
 	"bytes"
+	"encoding/json"
 	"testing"
 	"time"
 )
@@ -103,3 +104,56 @@ func TestDeserialisationFailure(t *testing.T) {
 		t.Fatalf("Deserialisation should have failed for input: `%s`", input)
 	}
 }
+
+// TestDeserialiseBatch verifies that a flattened buffer is split into its
+// messages and that invalid lines are kept as raw messages.
+func TestDeserialiseBatch(t *testing.T) {
+	batch := []byte(`{"tag":"Test","message":"first"}` + "\n\n" + `not-a-json` + "\n" + `{"tag":"Test","message":"second","metadata":{"custom":"field"}}`)
+	messages := DeserialiseBatch(batch)
+	if len(messages) != 3 {
+		t.Fatalf("Unexpected number of messages. Expected: %d - Found: %d.", 3, len(messages))
+	}
+	if messages[0].Tag != "Test" || messages[0].Message != "first" {
+		t.Fatalf("Unexpected first message: %+v.", messages[0])
+	}
+	if messages[1].Tag != "" || messages[1].Message != "not-a-json" {
+		t.Fatalf("Unexpected raw message: %+v.", messages[1])
+	}
+	if messages[2].Message != "second" || messages[2].Metadata["custom"] != "field" {
+		t.Fatalf("Unexpected last message: %+v.", messages[2])
+	}
+
+	if messages := DeserialiseBatch(nil); len(messages) != 0 {
+		t.Fatalf("Unexpected messages from empty batch: %+v.", messages)
+	}
+}
+
+// TestSerialiseMatchesJSON verifies that the serialisation matches the one of
+// encoding/json, escaping included.
+func TestSerialiseMatchesJSON(t *testing.T) {
+	tricky := "quote \" backslash \\ <html> & \b\f\n\r\t \x01 \x7f \u00e9 \u2028 \u2029 invalid \xff"
+	messages := []*LogMessage{
+		NewLogMessage("", 0, "", nil),
+		NewLogMessage("Test", -1, tricky, map[string]string{}),
+		{Tag: tricky, Level: "Error", Message: "m", Metadata: map[string]string{"z": "1", "a": tricky, "m": "", tricky: "k"}},
+	}
+	for _, message := range messages {
+		expected, _ := json.Marshal(message)
+		serialised, err := message.Serialise()
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if !bytes.Equal(serialised, expected) {
+			t.Fatalf("Unexpected serialised log. Expected: %s - Found: %s.", expected, serialised)
+		}
+	}
+}
+
+func BenchmarkSerialise(b *testing.B) {
+	message := NewLogMessage("BenchmarkSerialise", time.Now().UnixNano(), "a benchmarked message", map[string]string{"request": "42"})
+	message.Level = "Info"
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		message.Serialise()
+	}
+}
@@ -2,6 +2,9 @@ package gonyan
 
 import (
 	"fmt"
+	"strings"
+	"sync"
+	"time"
 )
 
 // mockStream is a simple Stream implementation used for testing purposes.
@@ -36,3 +39,46 @@ func newFailerMockStream(expectedError string) *failerMockStream {
 func (f *failerMockStream) Write(messageBytes []byte) (int, error) {
 	return 0, fmt.Errorf(f.err)
 }
+
+// switchMockStream is a Stream failing while its failing flag is set.
+type switchMockStream struct {
+	failing bool
+	writes  int
+	out     []string
+	mutex   sync.Mutex
+}
+
+func (s *switchMockStream) setFailing(failing bool) {
+	s.mutex.Lock()
+	s.failing = failing
+	s.mutex.Unlock()
+}
+
+func (s *switchMockStream) Write(messageBytes []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.writes++
+	if s.failing {
+		return 0, fmt.Errorf("stream is failing")
+	}
+	s.out = append(s.out, string(messageBytes))
+	return len(messageBytes), nil
+}
+
+// slowMockStream is a Stream delaying the writes containing its marker.
+type slowMockStream struct {
+	marker string
+	delay  time.Duration
+	out    []string
+	mutex  sync.Mutex
+}
+
+func (s *slowMockStream) Write(messageBytes []byte) (int, error) {
+	if strings.Contains(string(messageBytes), s.marker) {
+		time.Sleep(s.delay)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.out = append(s.out, string(messageBytes))
+	return len(messageBytes), nil
+}
@@ -0,0 +1,8 @@
+//go:build !race
+// +build !race
+
+package gonyan
+
+// raceEnabled reports whether the tests run with the race detector, which
+// makes sync.Pool drop items at random.
+const raceEnabled = false
@@ -0,0 +1,248 @@
+package gonyan
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// OverflowPolicy defines how a BufferedStream makes room for a log exceeding
+// its memory cap.
+type OverflowPolicy int
+
+// Supported overflow policies:
+//
+//   - OverflowBlock: the writer waits until a transmission empties the
+//     buffer, make sure one is triggered (e.g. by the scheduling interval);
+//   - OverflowDropOldest: the oldest buffered logs are dropped;
+//   - OverflowDropNewest: the log being written is dropped;
+//   - OverflowDropLowestLevel: the buffered logs with the lowest level are
+//     dropped first, oldest first, the log being written being dropped if
+//     its level is the lowest. Logs without a valid level count as Debug.
+const (
+	OverflowBlock           OverflowPolicy = iota
+	OverflowDropOldest      OverflowPolicy = iota
+	OverflowDropNewest      OverflowPolicy = iota
+	OverflowDropLowestLevel OverflowPolicy = iota
+)
+
+// DropReason explains why a log has been dropped by a BufferedStream.
+type DropReason int
+
+// Drop reasons:
+//
+//   - DroppedOldest: dropped by OverflowDropOldest;
+//   - DroppedNewest: dropped by OverflowDropNewest;
+//   - DroppedLowestLevel: dropped by OverflowDropLowestLevel;
+//   - DroppedTooLarge: the log alone exceeds the memory cap.
+const (
+	DroppedOldest      DropReason = iota
+	DroppedNewest      DropReason = iota
+	DroppedLowestLevel DropReason = iota
+	DroppedTooLarge    DropReason = iota
+)
+
+// droppedReasons is the number of drop reasons.
+const droppedReasons = 4
+
+// String returns a label for the reason.
+func (r DropReason) String() string {
+	switch r {
+	case DroppedOldest:
+		return "oldest"
+	case DroppedNewest:
+		return "newest"
+	case DroppedLowestLevel:
+		return "lowest level"
+	case DroppedTooLarge:
+		return "too large"
+	default:
+		return "unknown"
+	}
+}
+
+// ErrBufferFull is returned by BufferedStream.Write when the log being
+// written is dropped by the memory cap.
+var ErrBufferFull = errors.New("buffer full")
+
+// droppedLog holds a log dropped by the memory cap and the reason.
+type droppedLog struct {
+	reason  DropReason
+	message []byte
+}
+
+// SetMemoryLimit sets an absolute cap, in bytes, to the flattened buffer
+// (separators included) and the policy used to make room when a log would
+// exceed it. Differently from the byte limit no transmission is triggered,
+// so the cap also holds when transmissions are slow or failing. Logs bigger
+// than the cap are always dropped. Logs requeued by a failed transmission
+// cannot wait for room: the oldest logs are dropped in their place, or the
+// lowest level ones with OverflowDropLowestLevel.
+//
+// NOTE: Accepted values are non negative integers, negative values are ignored
+// while setting the limit to 0 disables the feature.
+func (b *BufferedStream) SetMemoryLimit(memoryLimit int, policy OverflowPolicy) {
+	if memoryLimit < 0 {
+		return
+	}
+	b.bufferMutex.Lock()
+	b.memoryLimit = memoryLimit
+	b.overflowPolicy = policy
+	// Blocked writers must check the new cap.
+	b.bufferCond.Broadcast()
+	b.bufferMutex.Unlock()
+}
+
+// SetDropFn sets the optional function invoked with the reason and the
+// content of each log dropped by the memory cap.
+func (b *BufferedStream) SetDropFn(dropFn func(DropReason, []byte)) {
+	b.bufferMutex.Lock()
+	b.drop = dropFn
+	b.bufferMutex.Unlock()
+}
+
+// Dropped returns the number of logs dropped by the memory cap for provided
+// reason.
+func (b *BufferedStream) Dropped(reason DropReason) uint64 {
+	if reason < 0 || reason >= droppedReasons {
+		return 0
+	}
+	b.bufferMutex.Lock()
+	defer b.bufferMutex.Unlock()
+	return b.dropped[reason]
+}
+
+// makeRoom makes room for provided message according to the overflow
+// policy, returning the dropped logs and whether the message can be stored.
+// The level of the message, when unknownLevel, is parsed only if needed.
+// This is not cuncurrent safe by its own and *must* be called after a lock
+// has been set.
+func (b *BufferedStream) makeRoom(message []byte, level *LogLevel) ([]droppedLog, bool) {
+	if len(message) > b.memoryLimit {
+		return b.dropLog(nil, DroppedTooLarge, message), false
+	}
+
+	var dropped []droppedLog
+	for b.memoryLimit > 0 && b.bufferCount > 0 && b.bufferBytes+1+len(message) > b.memoryLimit {
+		switch b.overflowPolicy {
+		case OverflowDropOldest:
+			dropped = b.dropLog(dropped, DroppedOldest, b.remove(0))
+		case OverflowDropNewest:
+			return b.dropLog(dropped, DroppedNewest, message), false
+		case OverflowDropLowestLevel:
+			if *level == unknownLevel {
+				*level = entryLevel(message)
+			}
+			index := b.lowestLevel(*level)
+			if index < 0 {
+				return b.dropLog(dropped, DroppedLowestLevel, message), false
+			}
+			dropped = b.dropLog(dropped, DroppedLowestLevel, b.remove(index))
+		default:
+			b.bufferCond.Wait()
+		}
+	}
+	return dropped, true
+}
+
+// capRequeued drops logs until the buffer, grown by requeued logs, fits the
+// memory cap. Requeued logs cannot wait for room: whatever the policy the
+// oldest logs are dropped, but with OverflowDropLowestLevel which drops the
+// lowest level ones. It *must* be called after a lock has been set.
+func (b *BufferedStream) capRequeued() []droppedLog {
+	var dropped []droppedLog
+	for b.bufferCount > 0 && b.bufferBytes > b.memoryLimit {
+		if b.overflowPolicy == OverflowDropLowestLevel {
+			index, _ := b.lowestBuffered()
+			dropped = b.dropLog(dropped, DroppedLowestLevel, b.remove(index))
+			continue
+		}
+		dropped = b.dropLog(dropped, DroppedOldest, b.remove(0))
+	}
+	return dropped
+}
+
+// dropLog counts provided dropped log and appends it to the dropped ones.
+// It *must* be called after a lock has been set.
+func (b *BufferedStream) dropLog(dropped []droppedLog, reason DropReason, message []byte) []droppedLog {
+	b.dropped[reason]++
+	return append(dropped, droppedLog{reason: reason, message: message})
+}
+
+// reportDrops invokes the drop function, if any, for each dropped log.
+func (b *BufferedStream) reportDrops(dropped []droppedLog) {
+	if len(dropped) == 0 {
+		return
+	}
+	b.bufferMutex.Lock()
+	drop := b.drop
+	b.bufferMutex.Unlock()
+	if drop == nil {
+		return
+	}
+	for _, d := range dropped {
+		drop(d.reason, d.message)
+	}
+}
+
+// remove removes the buffered log at provided index and returns it.
+// It *must* be called after a lock has been set.
+func (b *BufferedStream) remove(index int) []byte {
+	message := b.buffer[index]
+	copy(b.buffer[index:b.bufferCount], b.buffer[index+1:b.bufferCount])
+	b.levels = append(b.levels[:index], b.levels[index+1:]...)
+	b.failures = append(b.failures[:index], b.failures[index+1:]...)
+	b.bufferCount--
+	b.buffer[b.bufferCount] = nil
+	if index < b.requeued {
+		b.requeued--
+	}
+
+	b.bufferBytes -= len(message)
+	if b.bufferCount > 0 {
+		b.bufferBytes--
+	}
+	return message
+}
+
+// lowestLevel returns the index of the oldest buffered log with the lowest
+// level, or -1 when provided level is strictly lower than all of them.
+// It *must* be called after a lock has been set.
+func (b *BufferedStream) lowestLevel(level LogLevel) int {
+	index, lowest := b.lowestBuffered()
+	if index < 0 || level < lowest {
+		return -1
+	}
+	return index
+}
+
+// lowestBuffered returns the index and the level of the oldest buffered log
+// with the lowest level, -1 when the buffer is empty. Unknown levels are
+// parsed once and stored. It *must* be called after a lock has been set.
+func (b *BufferedStream) lowestBuffered() (int, LogLevel) {
+	index, lowest := -1, unknownLevel
+	for i := 0; i < b.bufferCount; i++ {
+		if b.levels[i] == unknownLevel {
+			b.levels[i] = entryLevel(b.buffer[i])
+		}
+		if index < 0 || b.levels[i] < lowest {
+			index, lowest = i, b.levels[i]
+		}
+	}
+	return index, lowest
+}
+
+// entryLevel returns the level of a serialised log, Debug when missing or
+// invalid.
+func entryLevel(message []byte) LogLevel {
+	entry := struct {
+		Level string `json:"level"`
+	}{}
+	if err := json.Unmarshal(message, &entry); err != nil {
+		return Debug
+	}
+	level, err := ParseLevelLabel(entry.Level)
+	if err != nil {
+		return Debug
+	}
+	return level
+}
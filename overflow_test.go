@@ -0,0 +1,175 @@
+package gonyan
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// levelLog returns a serialised log with provided level and message.
+func levelLog(level LogLevel, message string) []byte {
+	return []byte(fmt.Sprintf(`{"tag":"t","level":"%s","message":"%s"}`, GetLevelLabel(level), message))
+}
+
+func TestMemoryLimitDropOldest(t *testing.T) {
+	b := NewBufferedStream(nil)
+	var reasons []DropReason
+	var messages []string
+	b.SetDropFn(func(reason DropReason, message []byte) {
+		reasons = append(reasons, reason)
+		messages = append(messages, string(message))
+	})
+	b.SetMemoryLimit(11, OverflowDropOldest)
+
+	for _, message := range []string{"hey_1", "hey_2", "hey_3"} {
+		if _, err := b.Write([]byte(message)); err != nil {
+			t.Fatalf("Unexpected error: %s.", err.Error())
+		}
+	}
+	if b.bufferCount != 2 || string(b.buffer[0]) != "hey_2" || string(b.buffer[1]) != "hey_3" || b.bufferBytes != 11 {
+		t.Fatalf("Unexpected buffer: %q (%d bytes).", b.buffer[:b.bufferCount], b.bufferBytes)
+	}
+	if _, err := b.Write([]byte("a message exceeding the limit")); err != ErrBufferFull {
+		t.Fatalf("Expected ErrBufferFull, found: %v.", err)
+	}
+	if b.Dropped(DroppedOldest) != 1 || b.Dropped(DroppedTooLarge) != 1 || b.Dropped(DroppedNewest) != 0 {
+		t.Fatalf("Unexpected counters: %d, %d, %d.", b.Dropped(DroppedOldest), b.Dropped(DroppedTooLarge), b.Dropped(DroppedNewest))
+	}
+	if fmt.Sprint(reasons) != "[oldest too large]" || messages[0] != "hey_1" {
+		t.Fatalf("Unexpected drops: %v - %q.", reasons, messages)
+	}
+}
+
+func TestMemoryLimitDropNewest(t *testing.T) {
+	b := NewBufferedStream(nil)
+	b.SetMemoryLimit(11, OverflowDropNewest)
+	b.Write([]byte("hey_1"))
+	b.Write([]byte("hey_2"))
+	if n, err := b.Write([]byte("hey_3")); err != ErrBufferFull || n != 2 {
+		t.Fatalf("Unexpected result: %d, %v.", n, err)
+	}
+	if b.bufferCount != 2 || string(b.buffer[1]) != "hey_2" || b.Dropped(DroppedNewest) != 1 {
+		t.Fatalf("Unexpected buffer: %q.", b.buffer[:b.bufferCount])
+	}
+}
+
+func TestMemoryLimitDropLowestLevel(t *testing.T) {
+	b := NewBufferedStream(nil)
+	size := len(levelLog(Debug, "1"))
+	b.SetMemoryLimit(3*size+2, OverflowDropLowestLevel)
+
+	b.Write(levelLog(Error, "1"))
+	b.Write(levelLog(Debug, "2"))
+	b.Write(levelLog(Debug, "3"))
+	// The oldest of the lowest level logs is dropped.
+	if _, err := b.Write(levelLog(Fatal, "4")); err != nil {
+		t.Fatalf("Unexpected error: %s.", err.Error())
+	}
+	// On equal levels the buffered log is dropped.
+	if _, err := b.Write(levelLog(Debug, "5")); err != nil {
+		t.Fatalf("Unexpected error: %s.", err.Error())
+	}
+	if _, err := b.Write(levelLog(Error, "6")); err != nil {
+		t.Fatalf("Unexpected error: %s.", err.Error())
+	}
+	// The log being written has the lowest level.
+	if _, err := b.Write(levelLog(Debug, "7")); err != ErrBufferFull {
+		t.Fatalf("Expected ErrBufferFull, found: %v.", err)
+	}
+
+	var buffered []string
+	for _, message := range b.buffer[:b.bufferCount] {
+		buffered = append(buffered, string(message))
+	}
+	expected := []string{string(levelLog(Error, "1")), string(levelLog(Fatal, "4")), string(levelLog(Error, "6"))}
+	if strings.Join(buffered, "|") != strings.Join(expected, "|") {
+		t.Fatalf("Unexpected buffer: %q.", buffered)
+	}
+	if b.Dropped(DroppedLowestLevel) != 4 {
+		t.Fatalf("Unexpected counter. Expected: %d - Found: %d.", 4, b.Dropped(DroppedLowestLevel))
+	}
+}
+
+func TestMemoryLimitWriteLevel(t *testing.T) {
+	b := NewBufferedStream(nil)
+	b.SetMemoryLimit(11, OverflowDropLowestLevel)
+
+	// The provided levels are used, the logs are not parsed.
+	b.WriteLevel(Error, []byte("hey_1"))
+	b.WriteLevel(Debug, []byte("hey_2"))
+	if _, err := b.WriteLevel(Info, []byte("hey_3")); err != nil {
+		t.Fatalf("Unexpected error: %s.", err.Error())
+	}
+	if _, err := b.WriteLevel(Debug, []byte("hey_4")); err != ErrBufferFull {
+		t.Fatalf("Expected ErrBufferFull, found: %v.", err)
+	}
+	if b.bufferCount != 2 || string(b.buffer[0]) != "hey_1" || string(b.buffer[1]) != "hey_3" {
+		t.Fatalf("Unexpected buffer: %q.", b.buffer[:b.bufferCount])
+	}
+}
+
+func TestMemoryLimitRequeue(t *testing.T) {
+	s := &switchMockStream{failing: true}
+	b := NewBufferedStream(s)
+	b.SetRetryBackoff(0, 0)
+	b.SetMemoryLimit(11, OverflowDropOldest)
+	var messages []string
+	b.SetDropFn(func(reason DropReason, message []byte) {
+		messages = append(messages, string(message))
+	})
+
+	b.Write([]byte("hey_1"))
+	b.Write([]byte("hey_2"))
+	failed := b.takeBatch()
+	b.Write([]byte("hey_3"))
+	b.Write([]byte("hey_4"))
+
+	// The requeued logs would exceed the cap, the oldest are dropped.
+	if err := b.transmit(failed); err == nil {
+		t.Fatalf("Expected error, found nil.")
+	}
+	if b.bufferCount != 2 || string(b.buffer[0]) != "hey_3" || b.bufferBytes != 11 || b.failures[0] != 0 {
+		t.Fatalf("Unexpected buffer: %q (%d bytes).", b.buffer[:b.bufferCount], b.bufferBytes)
+	}
+	if b.Dropped(DroppedOldest) != 2 || strings.Join(messages, "|") != "hey_1|hey_2" {
+		t.Fatalf("Unexpected drops: %d - %q.", b.Dropped(DroppedOldest), messages)
+	}
+}
+
+func TestMemoryLimitBlock(t *testing.T) {
+	s := newMockStream(2)
+	b := NewBufferedStream(s)
+	b.SetMemoryLimit(11, OverflowBlock)
+	b.Write([]byte("hey_1"))
+	b.Write([]byte("hey_2"))
+
+	var group sync.WaitGroup
+	group.Add(1)
+	go func() {
+		defer group.Done()
+		if _, err := b.Write([]byte("hey_3")); err != nil {
+			t.Errorf("Unexpected error: %s.", err.Error())
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	b.bufferMutex.Lock()
+	count := b.bufferCount
+	b.bufferMutex.Unlock()
+	if count != 2 {
+		t.Fatalf("The writer should be blocked. Buffered: %d.", count)
+	}
+
+	if _, err := b.SetStartingSize(10, true); err != nil {
+		t.Fatalf("Unexpected error: %s.", err.Error())
+	}
+	group.Wait()
+	if received := <-s.out; received != "hey_1\nhey_2" {
+		t.Fatalf("Unexpected received message: `%s`.", received)
+	}
+	if b.bufferCount != 1 || string(b.buffer[0]) != "hey_3" {
+		t.Fatalf("Unexpected buffer: %q.", b.buffer[:b.bufferCount])
+	}
+}
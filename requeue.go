@@ -0,0 +1,216 @@
+package gonyan
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultMaxRetries defines the default number of times a failed batch is
+// transmitted again before being dead-lettered.
+const DefaultMaxRetries = 3
+
+// DefaultMinRetryBackoff defines the default delay before the first
+// transmission following a failure.
+const DefaultMinRetryBackoff = time.Second
+
+// DefaultMaxRetryBackoff defines the default upper bound of the delays
+// following consecutive failures.
+const DefaultMaxRetryBackoff = time.Minute
+
+// batch holds the logs taken from the buffer for a transmission together
+// with their levels and failed transmissions.
+type batch struct {
+	messages [][]byte   // Flushed buffer;
+	levels   []LogLevel // Levels of the logs in the flushed buffer;
+	failures []int      // Failed transmissions of the logs in the flushed buffer;
+	count    int        // Number of logs in the flushed buffer;
+	ticket   uint64     // Position in the transmission sequence.
+}
+
+// SetMaxRetries sets the number of times the logs of a failed transmission
+// are transmitted again before being handed to the dead-letter function, by
+// default DefaultMaxRetries. Each log counts its own retries.
+//
+// NOTE: Accepted values are non negative integers, negative values are ignored
+// while setting the value to 0 dead-letters the logs at the first failure.
+func (b *BufferedStream) SetMaxRetries(maxRetries int) {
+	if maxRetries < 0 {
+		return
+	}
+	b.bufferMutex.Lock()
+	b.maxRetries = maxRetries
+	b.bufferMutex.Unlock()
+}
+
+// SetRetryBackoff sets the delay before the first transmission following a
+// failure, doubled at every consecutive failure up to provided maximum; by
+// default DefaultMinRetryBackoff and DefaultMaxRetryBackoff. Meanwhile
+// neither the buffer limits nor the scheduling interval trigger
+// transmissions.
+//
+// NOTE: Negative values are ignored.
+func (b *BufferedStream) SetRetryBackoff(minBackoff, maxBackoff time.Duration) {
+	if minBackoff < 0 || maxBackoff < 0 {
+		return
+	}
+	if maxBackoff < minBackoff {
+		maxBackoff = minBackoff
+	}
+	b.bufferMutex.Lock()
+	b.minBackoff = minBackoff
+	b.maxBackoff = maxBackoff
+	b.bufferMutex.Unlock()
+}
+
+// SetDeadLetterFn sets the optional function receiving the logs given up
+// after the maximum number of retries, together with the last transmission
+// error. When missing the fatal function is invoked instead.
+func (b *BufferedStream) SetDeadLetterFn(deadLetterFn func([][]byte, error)) {
+	b.bufferMutex.Lock()
+	b.deadLetter = deadLetterFn
+	b.bufferMutex.Unlock()
+}
+
+// takeBatch flushes the buffer returning its logs, their levels and failed
+// transmissions. The batch takes the next place in the transmission
+// sequence, it *must* therefore be handed to transmit.
+// This is not cuncurrent safe by its own and *must* be called after a lock
+// has been set.
+func (b *BufferedStream) takeBatch() *batch {
+	levels, failures := b.levels, b.failures
+	messages, count := b.flush()
+	bt := &batch{messages: messages, levels: levels, failures: failures, count: count, ticket: b.tickets}
+	b.tickets++
+	return bt
+}
+
+// endTurn passes the turn to the next batch of the transmission sequence.
+// It *must* be called after a lock has been set.
+func (b *BufferedStream) endTurn() {
+	b.turn++
+	if b.bufferCond != nil {
+		b.bufferCond.Broadcast()
+	}
+}
+
+// backingOff reports whether transmissions are suspended after a failure.
+// It *must* be called after a lock has been set.
+func (b *BufferedStream) backingOff() bool {
+	return time.Now().Before(b.retryAt)
+}
+
+// transmit fires a transmission of provided batch, once the batches taken
+// before it have been transmitted; on failure its logs not written yet are
+// requeued at the head of the buffer, or dead-lettered once their retries
+// are exhausted, and the transmission error is returned.
+func (b *BufferedStream) transmit(bt *batch) error {
+	if bt == nil {
+		return nil
+	}
+	b.bufferMutex.Lock()
+	for b.turn != bt.ticket && b.bufferCond != nil {
+		b.bufferCond.Wait()
+	}
+	b.bufferMutex.Unlock()
+
+	var sent int
+	var err error
+	if bt.messages != nil && bt.count > 0 {
+		sent, err = b.fireTransmission(bt.messages, bt.count)
+	}
+
+	b.bufferMutex.Lock()
+	if err == nil {
+		if bt.count > 0 {
+			b.retryAt = time.Time{}
+		}
+		b.endTurn()
+		b.bufferMutex.Unlock()
+		return nil
+	}
+
+	// The logs written by the payloads preceding the failed one are not
+	// transmitted again.
+	var dead, entries [][]byte
+	var levels []LogLevel
+	var failures []int
+	for i := sent; i < bt.count; i++ {
+		if bt.failures[i]+1 > b.maxRetries {
+			dead = append(dead, bt.messages[i])
+			continue
+		}
+		entries = append(entries, bt.messages[i])
+		levels = append(levels, bt.levels[i])
+		failures = append(failures, bt.failures[i]+1)
+	}
+	dropped := b.requeue(entries, levels, failures)
+	deadLetter := b.deadLetter
+	b.endTurn()
+	b.bufferMutex.Unlock()
+
+	b.reportDrops(dropped)
+	if len(dead) > 0 {
+		if deadLetter != nil {
+			deadLetter(dead, err)
+		} else if b.fatal != nil {
+			b.fatal(fmt.Errorf("%d logs dropped after exhausting the retries due to: %s", len(dead), err.Error()))
+		}
+	}
+	return err
+}
+
+// requeue puts provided logs back at the head of the buffer, after the ones
+// requeued by the previous transmissions, with their levels and failed
+// transmissions, and schedules the next transmission
+// according to the most failed log. The logs dropped by the memory cap are
+// returned.
+// It *must* be called after a lock has been set.
+func (b *BufferedStream) requeue(entries [][]byte, levels []LogLevel, failures []int) []droppedLog {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	size := len(entries) + b.bufferCount
+	if size < b.initialSize {
+		size = b.initialSize
+	}
+	at := b.requeued
+	buffer := make([][]byte, size)
+	copy(buffer, b.buffer[:at])
+	copy(buffer[at:], entries)
+	copy(buffer[at+len(entries):], b.buffer[at:b.bufferCount])
+
+	// Each log is followed by a separator but the last one.
+	for _, message := range entries {
+		b.bufferBytes += len(message) + 1
+	}
+	if b.bufferCount == 0 {
+		b.bufferBytes--
+	}
+	b.buffer = buffer
+	b.levels = append(append(append(make([]LogLevel, 0, size), b.levels[:at]...), levels...), b.levels[at:]...)
+	b.failures = append(append(append(make([]int, 0, size), b.failures[:at]...), failures...), b.failures[at:]...)
+	b.bufferCount += len(entries)
+	b.requeued += len(entries)
+
+	retries := 0
+	for _, failed := range failures {
+		if failed > retries {
+			retries = failed
+		}
+	}
+
+	backoff := b.minBackoff
+	for i := 1; i < retries && backoff < b.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > b.maxBackoff {
+		backoff = b.maxBackoff
+	}
+	b.retryAt = time.Now().Add(backoff)
+
+	if b.memoryLimit > 0 {
+		return b.capRequeued()
+	}
+	return nil
+}
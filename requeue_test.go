@@ -0,0 +1,125 @@
+package gonyan
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRequeueFailedTransmission(t *testing.T) {
+	s := &switchMockStream{failing: true}
+	b := NewBufferedStream(s)
+	b.SetRetryBackoff(0, 0)
+
+	b.Write([]byte("a"))
+	b.Write([]byte("b"))
+	if err := b.transmit(b.takeBatch()); err == nil {
+		t.Fatalf("Expected error, found nil.")
+	}
+	if b.bufferCount != 2 || fmt.Sprint(b.failures) != "[1 1]" || b.bufferBytes != 3 {
+		t.Fatalf("Unexpected buffer state. Count: %d - Failures: %v - Bytes: %d.", b.bufferCount, b.failures, b.bufferBytes)
+	}
+
+	// Requeued logs precede the new ones.
+	b.Write([]byte("c"))
+	s.setFailing(false)
+	if err := b.transmit(b.takeBatch()); err != nil {
+		t.Fatalf("Unexpected error: %s.", err.Error())
+	}
+	if len(s.out) != 1 || s.out[0] != "a\nb\nc" {
+		t.Fatalf("Unexpected transmissions: %q.", s.out)
+	}
+	if b.bufferCount != 0 || len(b.failures) != 0 {
+		t.Fatalf("Unexpected buffer state. Count: %d - Failures: %v.", b.bufferCount, b.failures)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	s := &switchMockStream{failing: true}
+	b := NewBufferedStream(s)
+	b.SetRetryBackoff(0, 0)
+	b.SetMaxRetries(1)
+	var dead [][]byte
+	b.SetDeadLetterFn(func(messages [][]byte, err error) {
+		if err == nil {
+			t.Fatalf("Expected the transmission error.")
+		}
+		dead = append(dead, messages...)
+	})
+
+	b.Write([]byte("a"))
+	b.transmit(b.takeBatch())
+	b.Write([]byte("b"))
+	b.transmit(b.takeBatch())
+
+	// The first log exhausted its retry, the second one failed once.
+	if len(dead) != 1 || string(dead[0]) != "a" {
+		t.Fatalf("Unexpected dead-lettered logs: %q.", dead)
+	}
+	if b.bufferCount != 1 || string(b.buffer[0]) != "b" || b.failures[0] != 1 {
+		t.Fatalf("Unexpected buffer: %q - Failures: %v.", b.buffer[:b.bufferCount], b.failures)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	s := &switchMockStream{failing: true}
+	b := NewBufferedStream(s)
+	b.SetRetryBackoff(time.Hour, time.Minute)
+	if b.minBackoff != time.Hour || b.maxBackoff != time.Hour {
+		t.Fatalf("Unexpected backoff: %s - %s.", b.minBackoff, b.maxBackoff)
+	}
+	b.SetBufferLimit(1)
+
+	b.Write([]byte("a"))
+	b.transmit(b.takeBatch())
+	if !b.backingOff() {
+		t.Fatalf("Transmissions should be suspended.")
+	}
+
+	// The buffer limit does not trigger transmissions while backing off.
+	b.Write([]byte("b"))
+	b.Write([]byte("c"))
+	if b.bufferCount != 3 || s.writes != 1 {
+		t.Fatalf("Unexpected state. Buffered: %d - Writes: %d.", b.bufferCount, s.writes)
+	}
+}
+
+func TestRequeueFailedChunks(t *testing.T) {
+	// The first payload is written, the following ones fail.
+	s := newMockStream(1)
+	b := NewBufferedStream(s)
+	b.SetRetryBackoff(0, 0)
+	b.SetPayloadLimit(3)
+
+	for _, message := range []string{"a", "b", "c", "d"} {
+		b.Write([]byte(message))
+	}
+	if err := b.transmit(b.takeBatch()); err == nil {
+		t.Fatalf("Expected error, found nil.")
+	}
+	if received := <-s.out; received != "a\nb" {
+		t.Fatalf("Unexpected received message: `%s`.", received)
+	}
+	if b.bufferCount != 2 || string(b.buffer[0]) != "c" || string(b.buffer[1]) != "d" || b.bufferBytes != 3 {
+		t.Fatalf("Only the failed payloads should be requeued. Found: %q.", b.buffer[:b.bufferCount])
+	}
+}
+
+func TestRequeueConcurrentFailures(t *testing.T) {
+	s := &switchMockStream{failing: true}
+	b := NewBufferedStream(s)
+	b.SetRetryBackoff(0, 0)
+
+	b.Write([]byte("a"))
+	b.transmit(b.takeBatch())
+	first := b.takeBatch()
+	b.Write([]byte("b"))
+	second := b.takeBatch()
+
+	// Each log keeps its own count and the requeued logs keep their order.
+	b.transmit(first)
+	b.transmit(second)
+	if b.bufferCount != 2 || string(b.buffer[0]) != "a" || fmt.Sprint(b.failures) != "[2 1]" {
+		t.Fatalf("Unexpected buffer: %q - Failures: %v.", b.buffer[:b.bufferCount], b.failures)
+	}
+}
@@ -1,6 +1,15 @@
 package gonyan
 
 // Stream interface holds the protocol to allow custom streams definition.
+// As for io.Writer, streams must not retain the written bytes since loggers
+// reuse their buffers.
 type Stream interface {
 	Write([]byte) (int, error)
 }
+
+// LevelWriter is an optional interface implemented by streams which take
+// advantage of knowing the level of each log; the StreamManager prefers it
+// over Write.
+type LevelWriter interface {
+	WriteLevel(level LogLevel, message []byte) (int, error)
+}
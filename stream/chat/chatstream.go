@@ -0,0 +1,304 @@
+// Package chat contains definition of the Gonyan Stream posting alerts to
+// chat platforms through their incoming webhooks: Slack (Block Kit),
+// Microsoft Teams (message cards) and Discord (embeds).
+//
+// Logs are rendered with level-based colours and their metadata as a table.
+// Logs written within the digest window, or received with a single Write,
+// are aggregated into a single digest message so that a burst of errors does
+// not flood the channel. Requests are spaced according to the platform rate
+// limits and `429 Too Many Requests` responses are retried after the delay
+// suggested by the platform.
+package chat
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gonyan"
+)
+
+// Platform represents one of the supported chat platforms.
+type Platform int
+
+// Supported chat platforms.
+const (
+	Slack   Platform = iota
+	Teams   Platform = iota
+	Discord Platform = iota
+)
+
+// DefaultDigestWindow defines the default time logs are collected before
+// sending them as a single digest message.
+const DefaultDigestWindow = 5 * time.Second
+
+// DefaultMaxAttempts defines the default number of attempts performed for
+// each message when rate limited.
+const DefaultMaxAttempts = 3
+
+// DefaultTimeout defines the default timeout of each webhook request.
+const DefaultTimeout = 10 * time.Second
+
+// MaxPendingLogs defines the maximum number of logs kept while waiting for
+// their digest, or while it cannot be sent: the oldest ones are dropped
+// beyond it.
+const MaxPendingLogs = 1000
+
+// minIntervals holds the minimum time between two requests to the same
+// webhook for each platform: Slack allows one message per second, Discord
+// five requests every two seconds and Teams four requests per second.
+var minIntervals = map[Platform]time.Duration{
+	Slack:   time.Second,
+	Teams:   250 * time.Millisecond,
+	Discord: 400 * time.Millisecond,
+}
+
+// Stream defines the Gonyan Stream for chat webhooks.
+type Stream struct {
+	platform     Platform                                   // Target chat platform;
+	url          string                                     // Webhook URL;
+	client       *http.Client                               // HTTP client used for requests;
+	render       func([]*gonyan.LogMessage) ([]byte, error) // Platform payload renderer;
+	digestWindow time.Duration                              // Time logs are aggregated for;
+	minInterval  time.Duration                              // Minimum time between requests;
+	maxAttempts  int                                        // Attempts when rate limited;
+	pending      []*gonyan.LogMessage                       // Logs waiting for the digest;
+	timer        *time.Timer                                // Digest window timer;
+	pendingMutex sync.Mutex                                 // Mutex for pending logs and timer;
+	lastSent     time.Time                                  // Time of the last request;
+	sendMutex    sync.Mutex                                 // Mutex serialising requests;
+	fatal        func(error)                                // Callback for asynchronous failures.
+}
+
+// NewStream creates a new chat stream posting to provided webhook URL of
+// provided platform.
+func NewStream(platform Platform, webhookURL string) *Stream {
+	s := &Stream{
+		platform:     platform,
+		url:          webhookURL,
+		client:       &http.Client{Timeout: DefaultTimeout},
+		digestWindow: DefaultDigestWindow,
+		minInterval:  minIntervals[platform],
+		maxAttempts:  DefaultMaxAttempts,
+		pending:      []*gonyan.LogMessage{},
+		fatal: func(err error) {
+			fmt.Printf("[Gonyan] [Chat] [Fatal] %s.\n", err.Error())
+		},
+	}
+	switch platform {
+	case Teams:
+		s.render = renderTeams
+	case Discord:
+		s.render = renderDiscord
+	default:
+		s.render = renderSlack
+	}
+	return s
+}
+
+// SetDigestWindow sets the time logs are collected before being sent as a
+// single digest message. Passing 0 disables the aggregation and makes Write
+// send the logs synchronously.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (c *Stream) SetDigestWindow(window time.Duration) *Stream {
+	if window >= 0 {
+		c.digestWindow = window
+	}
+	return c
+}
+
+// SetMinInterval overrides the minimum time between two requests, by default
+// it matches the platform rate limit.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (c *Stream) SetMinInterval(interval time.Duration) *Stream {
+	if interval >= 0 {
+		c.minInterval = interval
+	}
+	return c
+}
+
+// SetMaxAttempts sets the number of attempts performed for each message when
+// rate limited. Values lower than 1 are ignored.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (c *Stream) SetMaxAttempts(attempts int) *Stream {
+	if attempts > 0 {
+		c.maxAttempts = attempts
+	}
+	return c
+}
+
+// SetClient allows to replace the HTTP client used for requests.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (c *Stream) SetClient(client *http.Client) *Stream {
+	if client != nil {
+		c.client = client
+	}
+	return c
+}
+
+// SetFatalFn sets the optional function used to signal failures of digests
+// sent asynchronously at the end of the digest window.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (c *Stream) SetFatalFn(fatalFn func(error)) *Stream {
+	c.fatal = fatalFn
+	return c
+}
+
+// Write function defined to implement the Stream interface.
+// When the digest window is disabled the logs are sent synchronously,
+// otherwise they are collected and sent when the window expires.
+func (c *Stream) Write(messageBytes []byte) (int, error) {
+	messages := gonyan.DeserialiseBatch(messageBytes)
+	if len(messages) == 0 {
+		return 0, nil
+	}
+
+	if c.digestWindow == 0 {
+		if err := c.send(messages); err != nil {
+			return 0, err
+		}
+		return len(messageBytes), nil
+	}
+
+	c.pendingMutex.Lock()
+	c.pending = append(c.pending, messages...)
+	c.trimPending()
+	c.startTimer()
+	c.pendingMutex.Unlock()
+
+	return len(messageBytes), nil
+}
+
+// trimPending drops the oldest pending logs beyond MaxPendingLogs. It *must*
+// be called holding the pending lock.
+func (c *Stream) trimPending() {
+	if over := len(c.pending) - MaxPendingLogs; over > 0 {
+		c.pending = c.pending[over:]
+	}
+}
+
+// startTimer starts the digest window timer, if not running. It *must* be
+// called holding the pending lock.
+func (c *Stream) startTimer() {
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.digestWindow, func() {
+			if err := c.Flush(); err != nil && c.fatal != nil {
+				c.fatal(err)
+			}
+		})
+	}
+}
+
+// Flush immediately sends the logs collected in the current digest window.
+// When the digest cannot be sent its logs are kept, ahead of the ones
+// written meanwhile, for the next digest; at most MaxPendingLogs logs are
+// kept, the oldest ones being dropped.
+func (c *Stream) Flush() error {
+	c.pendingMutex.Lock()
+	messages := c.pending
+	c.pending = []*gonyan.LogMessage{}
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.pendingMutex.Unlock()
+
+	if len(messages) == 0 {
+		return nil
+	}
+	if err := c.send(messages); err != nil {
+		c.pendingMutex.Lock()
+		c.pending = append(messages, c.pending...)
+		c.trimPending()
+		if c.digestWindow > 0 {
+			c.startTimer()
+		}
+		c.pendingMutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+// send renders provided logs into a single message and posts it, respecting
+// the platform rate limits.
+func (c *Stream) send(messages []*gonyan.LogMessage) error {
+	body, err := c.render(messages)
+	if err != nil {
+		return fmt.Errorf("message rendering failed: %s", err.Error())
+	}
+
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+
+	for attempt := 1; ; attempt++ {
+		if wait := c.minInterval - time.Since(c.lastSent); wait > 0 {
+			time.Sleep(wait)
+		}
+		c.lastSent = time.Now()
+
+		retryAfter, err := c.post(body)
+		if err == nil {
+			return nil
+		}
+		if retryAfter < 0 || attempt >= c.maxAttempts {
+			return fmt.Errorf("chat webhook request failed: %s", err.Error())
+		}
+		time.Sleep(retryAfter)
+	}
+}
+
+// post performs a single webhook request. When rate limited it returns the
+// delay to be waited before retrying, otherwise a negative delay.
+func (c *Stream) post(body []byte) (time.Duration, error) {
+	request, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return -1, fmt.Errorf("request creation failed due to: %s", err.Error())
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return -1, fmt.Errorf("request execution failed due to: %s", err.Error())
+	}
+	defer response.Body.Close()
+
+	details, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return 0, nil
+	}
+
+	err = fmt.Errorf("unexpected status `%s`: %s", response.Status, strings.TrimSpace(string(details)))
+	if response.StatusCode != http.StatusTooManyRequests {
+		return -1, err
+	}
+	return retryDelay(response.Header, details), err
+}
+
+// retryDelay extracts the delay suggested by a rate limited response from
+// the `Retry-After` header or, for Discord, the `retry_after` body field
+// (expressed in seconds). One second is used when no hint is available.
+func retryDelay(header http.Header, body []byte) time.Duration {
+	if seconds, err := strconv.ParseFloat(header.Get("Retry-After"), 64); err == nil && seconds >= 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+
+	hint := struct {
+		RetryAfter float64 `json:"retry_after"`
+	}{}
+	if err := json.Unmarshal(body, &hint); err == nil && hint.RetryAfter > 0 {
+		return time.Duration(hint.RetryAfter * float64(time.Second))
+	}
+	return time.Second
+}
@@ -0,0 +1,181 @@
+package chat
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookServer collects the received payloads, answering with provided
+// statuses in order (the last one is repeated).
+type webhookServer struct {
+	mtx      sync.Mutex
+	payloads []map[string]interface{}
+	times    []time.Time
+	statuses []int
+}
+
+func (s *webhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	payload := map[string]interface{}{}
+	json.Unmarshal(body, &payload)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.payloads = append(s.payloads, payload)
+	s.times = append(s.times, time.Now())
+
+	status := s.statuses[len(s.statuses)-1]
+	if len(s.payloads) <= len(s.statuses) {
+		status = s.statuses[len(s.payloads)-1]
+	}
+	if status == http.StatusTooManyRequests {
+		w.WriteHeader(status)
+		w.Write([]byte(`{"retry_after":0.05}`))
+		return
+	}
+	w.WriteHeader(status)
+}
+
+func (s *webhookServer) count() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return len(s.payloads)
+}
+
+// TestWriteDigest verifies that logs written within the window are sent as
+// a single digest.
+func TestWriteDigest(t *testing.T) {
+	server := &webhookServer{statuses: []int{http.StatusNoContent}}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	s := NewStream(Discord, ts.URL).SetDigestWindow(200 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if _, err := s.Write([]byte(`{"tag":"app","level":"Error","message":"failure"}`)); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+	}
+	if server.count() != 0 {
+		t.Fatalf("Logs should be held until the window expires.")
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	if server.count() != 1 {
+		t.Fatalf("Unexpected number of messages. Expected: %d - Found: %d.", 1, server.count())
+	}
+	server.mtx.Lock()
+	content := server.payloads[0]["content"]
+	server.mtx.Unlock()
+	if content != "3 logs: 3 Error" {
+		t.Fatalf("Unexpected digest content: %v.", content)
+	}
+
+	if err := s.Flush(); err != nil {
+		t.Fatalf("Empty flush should not fail: %s", err.Error())
+	}
+}
+
+// TestWriteRateLimit verifies the spacing between requests and the retry of
+// rate limited requests.
+func TestWriteRateLimit(t *testing.T) {
+	server := &webhookServer{statuses: []int{http.StatusOK, http.StatusTooManyRequests, http.StatusOK}}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	s := NewStream(Slack, ts.URL).SetDigestWindow(0).SetMinInterval(100 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if _, err := s.Write([]byte(`{"tag":"app","level":"Info","message":"hello"}`)); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+	}
+
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+	if len(server.payloads) != 3 {
+		t.Fatalf("Unexpected number of requests. Expected: %d - Found: %d.", 3, len(server.payloads))
+	}
+	for i := 1; i < len(server.times); i++ {
+		if gap := server.times[i].Sub(server.times[i-1]); gap < 90*time.Millisecond {
+			t.Fatalf("Requests should be spaced by the minimum interval. Found gap: %s.", gap)
+		}
+	}
+}
+
+// TestWriteFailure verifies that non rate limiting errors are not retried.
+func TestWriteFailure(t *testing.T) {
+	server := &webhookServer{statuses: []int{http.StatusBadRequest}}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	s := NewStream(Teams, ts.URL).SetDigestWindow(0).SetMinInterval(0)
+	n, err := s.Write([]byte(`{"message":"hello"}`))
+	if err == nil {
+		t.Fatalf("An error was expected!")
+	}
+	if n != 0 {
+		t.Fatalf("Unexpected number of written bytes. Expected: %d - Found: %d.", 0, n)
+	}
+	if server.count() != 1 {
+		t.Fatalf("Unexpected number of requests. Expected: %d - Found: %d.", 1, server.count())
+	}
+}
+
+// TestFlushFailure verifies that the logs of a digest which cannot be sent
+// are kept for the next one.
+func TestFlushFailure(t *testing.T) {
+	server := &webhookServer{statuses: []int{http.StatusInternalServerError, http.StatusNoContent}}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	s := NewStream(Discord, ts.URL).SetDigestWindow(time.Hour).SetMinInterval(0)
+	s.Write([]byte(`{"tag":"app","level":"Error","message":"failure"}`))
+	if err := s.Flush(); err == nil {
+		t.Fatalf("An error was expected!")
+	}
+	s.Write([]byte(`{"tag":"app","level":"Warning","message":"later"}`))
+	if err := s.Flush(); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+	if content := server.payloads[1]["content"]; content != "2 logs: 1 Error, 1 Warning" {
+		t.Fatalf("Unexpected digest content: %v.", content)
+	}
+}
+
+// TestWritePendingLimit verifies that at most MaxPendingLogs logs wait for
+// the digest.
+func TestWritePendingLimit(t *testing.T) {
+	s := NewStream(Discord, "http://127.0.0.1:0").SetDigestWindow(time.Hour)
+	for i := 0; i < MaxPendingLogs+10; i++ {
+		s.Write([]byte(`{"tag":"app","level":"Error","message":"failure"}`))
+	}
+
+	s.pendingMutex.Lock()
+	defer s.pendingMutex.Unlock()
+	if len(s.pending) != MaxPendingLogs {
+		t.Fatalf("Unexpected pending logs. Expected: %d - Found: %d.", MaxPendingLogs, len(s.pending))
+	}
+	s.timer.Stop()
+}
+
+// TestRetryDelay verifies the rate limiting hints parsing.
+func TestRetryDelay(t *testing.T) {
+	header := http.Header{}
+	header.Set("Retry-After", "2")
+	if delay := retryDelay(header, nil); delay != 2*time.Second {
+		t.Fatalf("Unexpected delay. Expected: %s - Found: %s.", 2*time.Second, delay)
+	}
+	if delay := retryDelay(http.Header{}, []byte(`{"retry_after":0.5}`)); delay != 500*time.Millisecond {
+		t.Fatalf("Unexpected delay. Expected: %s - Found: %s.", 500*time.Millisecond, delay)
+	}
+	if delay := retryDelay(http.Header{}, nil); delay != time.Second {
+		t.Fatalf("Unexpected default delay: %s.", delay)
+	}
+}
@@ -0,0 +1,317 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gonyan"
+)
+
+// MaxDigestEntries defines the maximum number of logs detailed in a digest
+// message, remaining logs are only counted.
+const MaxDigestEntries = 10
+
+// maxMetadataFields caps the metadata fields rendered for each log; Slack
+// does not accept more than 10 fields per section.
+const maxMetadataFields = 10
+
+// maxTextLength caps the rendered message text, all platforms limit the
+// length of a single text element.
+const maxTextLength = 2000
+
+// LevelColour returns the hex RGB colour (without `#`) used to render logs
+// of provided level label.
+func LevelColour(level string) string {
+	parsed, err := gonyan.ParseLevelLabel(level)
+	if err != nil {
+		return "9E9E9E"
+	}
+	switch parsed {
+	case gonyan.Info:
+		return "2196F3"
+	case gonyan.Warning:
+		return "FF9800"
+	case gonyan.Error:
+		return "F44336"
+	case gonyan.Fatal, gonyan.Panic:
+		return "B71C1C"
+	default:
+		return "9E9E9E"
+	}
+}
+
+// title returns the headline of a single log.
+func title(message *gonyan.LogMessage) string {
+	parts := []string{}
+	if message.Level != "" {
+		parts = append(parts, "["+message.Level+"]")
+	}
+	if message.Tag != "" {
+		parts = append(parts, message.Tag)
+	}
+	if len(parts) == 0 {
+		return "Log"
+	}
+	return strings.Join(parts, " ")
+}
+
+// digestTitle returns the headline of a digest message summarising the
+// number of logs for each level.
+func digestTitle(messages []*gonyan.LogMessage) string {
+	counts := make(map[string]int)
+	for _, message := range messages {
+		level := message.Level
+		if level == "" {
+			level = "Unknown"
+		}
+		counts[level]++
+	}
+
+	levels := make([]string, 0, len(counts))
+	for level := range counts {
+		levels = append(levels, level)
+	}
+	sort.Slice(levels, func(i, j int) bool { return severity(levels[i]) > severity(levels[j]) })
+
+	summary := make([]string, 0, len(levels))
+	for _, level := range levels {
+		summary = append(summary, fmt.Sprintf("%d %s", counts[level], level))
+	}
+	return fmt.Sprintf("%d logs: %s", len(messages), strings.Join(summary, ", "))
+}
+
+// highestLevel returns the most severe level label among provided logs.
+func highestLevel(messages []*gonyan.LogMessage) string {
+	highest := ""
+	for _, message := range messages {
+		if highest == "" || severity(message.Level) > severity(highest) {
+			highest = message.Level
+		}
+	}
+	return highest
+}
+
+// severity returns a sortable severity for provided level label, unknown
+// labels are the least severe.
+func severity(level string) int {
+	parsed, err := gonyan.ParseLevelLabel(level)
+	if err != nil {
+		return -1
+	}
+	return int(parsed)
+}
+
+// field is a generic name-value pair rendered as a metadata table row.
+type field struct {
+	name  string
+	value string
+}
+
+// fields returns the metadata of provided log sorted by key, together with
+// its timestamp when available.
+func fields(message *gonyan.LogMessage) []field {
+	keys := make([]string, 0, len(message.Metadata))
+	for key := range message.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	rows := []field{}
+	if message.Timestamp != 0 {
+		rows = append(rows, field{name: "time", value: time.Unix(0, message.Timestamp).UTC().Format(time.RFC3339)})
+	}
+	for _, key := range keys {
+		if len(rows) == maxMetadataFields {
+			break
+		}
+		rows = append(rows, field{name: key, value: message.Metadata[key]})
+	}
+	return rows
+}
+
+// truncate shortens provided text to the maximum length supported, in bytes,
+// without splitting multi-byte characters.
+func truncate(text string, length int) string {
+	if len(text) <= length {
+		return text
+	}
+	cut := length - 3
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return text[:cut] + "..."
+}
+
+// digestEntries returns the logs detailed in a digest and how many are left
+// out.
+func digestEntries(messages []*gonyan.LogMessage) ([]*gonyan.LogMessage, int) {
+	if len(messages) <= MaxDigestEntries {
+		return messages, 0
+	}
+	return messages[:MaxDigestEntries], len(messages) - MaxDigestEntries
+}
+
+// renderSlack renders provided logs as a Slack Block Kit payload, using a
+// coloured attachment for each log.
+func renderSlack(messages []*gonyan.LogMessage) ([]byte, error) {
+	type text struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	type block struct {
+		Type     string `json:"type"`
+		Text     *text  `json:"text,omitempty"`
+		Fields   []text `json:"fields,omitempty"`
+		Elements []text `json:"elements,omitempty"`
+	}
+	type attachment struct {
+		Colour string  `json:"color"`
+		Blocks []block `json:"blocks"`
+	}
+
+	headline := title(messages[0])
+	if len(messages) > 1 {
+		headline = digestTitle(messages)
+	}
+	entries, omitted := digestEntries(messages)
+
+	attachments := make([]attachment, 0, len(entries))
+	for _, message := range entries {
+		blocks := []block{{
+			Type: "section",
+			Text: &text{Type: "mrkdwn", Text: truncate(fmt.Sprintf("*%s*\n%s", title(message), message.Message), maxTextLength)},
+		}}
+		if rows := fields(message); len(rows) > 0 {
+			section := block{Type: "section"}
+			for _, row := range rows {
+				section.Fields = append(section.Fields, text{Type: "mrkdwn", Text: fmt.Sprintf("*%s*\n%s", row.name, row.value)})
+			}
+			blocks = append(blocks, section)
+		}
+		attachments = append(attachments, attachment{Colour: "#" + LevelColour(message.Level), Blocks: blocks})
+	}
+
+	payload := struct {
+		Text        string       `json:"text"`
+		Blocks      []block      `json:"blocks"`
+		Attachments []attachment `json:"attachments"`
+	}{
+		Text:        headline,
+		Blocks:      []block{{Type: "header", Text: &text{Type: "plain_text", Text: truncate(headline, 150)}}},
+		Attachments: attachments,
+	}
+	if omitted > 0 {
+		payload.Blocks = append(payload.Blocks, block{
+			Type:     "context",
+			Elements: []text{{Type: "mrkdwn", Text: fmt.Sprintf("%d more logs not shown", omitted)}},
+		})
+	}
+	return json.Marshal(payload)
+}
+
+// renderTeams renders provided logs as a Microsoft Teams message card, each
+// log is a section with its metadata as facts.
+func renderTeams(messages []*gonyan.LogMessage) ([]byte, error) {
+	type fact struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	type section struct {
+		ActivityTitle string `json:"activityTitle"`
+		Text          string `json:"text"`
+		Facts         []fact `json:"facts,omitempty"`
+	}
+
+	headline := title(messages[0])
+	if len(messages) > 1 {
+		headline = digestTitle(messages)
+	}
+	entries, omitted := digestEntries(messages)
+
+	sections := make([]section, 0, len(entries)+1)
+	for _, message := range entries {
+		s := section{ActivityTitle: title(message), Text: truncate(message.Message, maxTextLength)}
+		for _, row := range fields(message) {
+			s.Facts = append(s.Facts, fact{Name: row.name, Value: row.value})
+		}
+		sections = append(sections, s)
+	}
+	if omitted > 0 {
+		sections = append(sections, section{Text: fmt.Sprintf("%d more logs not shown", omitted)})
+	}
+
+	return json.Marshal(struct {
+		Type       string    `json:"@type"`
+		Context    string    `json:"@context"`
+		ThemeColor string    `json:"themeColor"`
+		Summary    string    `json:"summary"`
+		Title      string    `json:"title"`
+		Sections   []section `json:"sections"`
+	}{
+		Type:       "MessageCard",
+		Context:    "https://schema.org/extensions",
+		ThemeColor: LevelColour(highestLevel(messages)),
+		Summary:    headline,
+		Title:      headline,
+		Sections:   sections,
+	})
+}
+
+// renderDiscord renders provided logs as a Discord webhook payload with a
+// coloured embed for each log.
+func renderDiscord(messages []*gonyan.LogMessage) ([]byte, error) {
+	type embedField struct {
+		Name   string `json:"name"`
+		Value  string `json:"value"`
+		Inline bool   `json:"inline"`
+	}
+	type embed struct {
+		Title       string       `json:"title"`
+		Description string       `json:"description"`
+		Colour      int64        `json:"color"`
+		Fields      []embedField `json:"fields,omitempty"`
+		Timestamp   string       `json:"timestamp,omitempty"`
+	}
+
+	content := ""
+	if len(messages) > 1 {
+		content = digestTitle(messages)
+	}
+	entries, omitted := digestEntries(messages)
+	if omitted > 0 {
+		content += fmt.Sprintf(" (%d more logs not shown)", omitted)
+	}
+
+	embeds := make([]embed, 0, len(entries))
+	for _, message := range entries {
+		colour, _ := strconv.ParseInt(LevelColour(message.Level), 16, 64)
+		e := embed{
+			Title:       truncate(title(message), 256),
+			Description: truncate(message.Message, maxTextLength),
+			Colour:      colour,
+		}
+		if message.Timestamp != 0 {
+			e.Timestamp = time.Unix(0, message.Timestamp).UTC().Format(time.RFC3339)
+		}
+		for _, row := range fields(message) {
+			if row.name == "time" {
+				continue
+			}
+			e.Fields = append(e.Fields, embedField{Name: row.name, Value: truncate(row.value, 1024), Inline: true})
+		}
+		embeds = append(embeds, e)
+	}
+
+	return json.Marshal(struct {
+		Content string  `json:"content,omitempty"`
+		Embeds  []embed `json:"embeds"`
+	}{
+		Content: content,
+		Embeds:  embeds,
+	})
+}
@@ -0,0 +1,152 @@
+package chat
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"gonyan"
+)
+
+func testMessages(n int) []*gonyan.LogMessage {
+	messages := []*gonyan.LogMessage{{
+		Tag:       "app",
+		Timestamp: 1483439014000000200,
+		Level:     "Error",
+		Message:   "something failed",
+		Metadata:  map[string]string{"user": "x", "host": "h"},
+	}}
+	for i := 1; i < n; i++ {
+		messages = append(messages, &gonyan.LogMessage{Tag: "app", Level: "Warning", Message: "careful"})
+	}
+	return messages
+}
+
+// TestLevelColour verifies the level-based colours.
+func TestLevelColour(t *testing.T) {
+	cases := map[string]string{
+		"Debug":   "9E9E9E",
+		"Info":    "2196F3",
+		"Warning": "FF9800",
+		"Error":   "F44336",
+		"Panic":   "B71C1C",
+		"":        "9E9E9E",
+	}
+	for level, expected := range cases {
+		if found := LevelColour(level); found != expected {
+			t.Fatalf("Unexpected colour for `%s`. Expected: %s - Found: %s.", level, expected, found)
+		}
+	}
+}
+
+// TestRenderSlack verifies the Block Kit payload.
+func TestRenderSlack(t *testing.T) {
+	body, err := renderSlack(testMessages(1))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	payload := struct {
+		Text        string
+		Attachments []struct {
+			Color  string
+			Blocks []struct {
+				Type   string
+				Fields []struct{ Text string }
+			}
+		}
+	}{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatalf("Invalid payload: %s", err.Error())
+	}
+	if payload.Text != "[Error] app" {
+		t.Fatalf("Unexpected text: %s.", payload.Text)
+	}
+	if len(payload.Attachments) != 1 || payload.Attachments[0].Color != "#F44336" {
+		t.Fatalf("Unexpected attachments: %+v.", payload.Attachments)
+	}
+	fields := payload.Attachments[0].Blocks[1].Fields
+	if len(fields) != 3 || fields[0].Text != "*time*\n2017-01-03T10:23:34Z" || fields[1].Text != "*host*\nh" {
+		t.Fatalf("Unexpected metadata fields: %+v.", fields)
+	}
+}
+
+// TestRenderTeamsDigest verifies the message card digest payload.
+func TestRenderTeamsDigest(t *testing.T) {
+	body, err := renderTeams(testMessages(12))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	payload := struct {
+		ThemeColor string
+		Title      string
+		Sections   []struct {
+			ActivityTitle string
+			Text          string
+			Facts         []struct{ Name, Value string }
+		}
+	}{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatalf("Invalid payload: %s", err.Error())
+	}
+	if payload.ThemeColor != "F44336" {
+		t.Fatalf("The most severe level should define the colour. Found: %s.", payload.ThemeColor)
+	}
+	if payload.Title != "12 logs: 1 Error, 11 Warning" {
+		t.Fatalf("Unexpected title: %s.", payload.Title)
+	}
+	if len(payload.Sections) != MaxDigestEntries+1 {
+		t.Fatalf("Unexpected number of sections. Expected: %d - Found: %d.", MaxDigestEntries+1, len(payload.Sections))
+	}
+	if last := payload.Sections[MaxDigestEntries]; last.Text != "2 more logs not shown" {
+		t.Fatalf("Unexpected last section: %+v.", last)
+	}
+	if len(payload.Sections[0].Facts) != 3 {
+		t.Fatalf("Unexpected facts: %+v.", payload.Sections[0].Facts)
+	}
+}
+
+// TestRenderDiscord verifies the embeds payload.
+func TestRenderDiscord(t *testing.T) {
+	messages := testMessages(2)
+	messages[1].Message = strings.Repeat("x", 3000)
+	body, err := renderDiscord(messages)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	payload := struct {
+		Content string
+		Embeds  []struct {
+			Title       string
+			Description string
+			Color       int64
+			Timestamp   string
+			Fields      []struct{ Name, Value string }
+		}
+	}{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatalf("Invalid payload: %s", err.Error())
+	}
+	if payload.Content != "2 logs: 1 Error, 1 Warning" || len(payload.Embeds) != 2 {
+		t.Fatalf("Unexpected payload: %+v.", payload)
+	}
+	first := payload.Embeds[0]
+	if first.Color != 0xF44336 || first.Timestamp != "2017-01-03T10:23:34Z" || len(first.Fields) != 2 {
+		t.Fatalf("Unexpected first embed: %+v.", first)
+	}
+	if len(payload.Embeds[1].Description) != maxTextLength {
+		t.Fatalf("Long messages should be truncated. Found length: %d.", len(payload.Embeds[1].Description))
+	}
+}
+
+// TestTruncate verifies that texts are cut without splitting characters.
+func TestTruncate(t *testing.T) {
+	if truncated := truncate("short", 10); truncated != "short" {
+		t.Fatalf("Unexpected truncated text: `%s`.", truncated)
+	}
+	// Each character takes two bytes, the cut falls in the middle of one.
+	truncated := truncate(strings.Repeat("\u00e9", 10), 8)
+	if truncated != "\u00e9\u00e9..." || !utf8.ValidString(truncated) {
+		t.Fatalf("Unexpected truncated text: `%s`.", truncated)
+	}
+}
@@ -0,0 +1,357 @@
+// Package elastic contains definition of the Gonyan Stream indexing logs
+// into Elasticsearch or OpenSearch through the `_bulk` API.
+//
+// Each Write call is treated as a batch: the payload is split using the
+// default BufferedStream separator and every serialised LogMessage becomes a
+// document of a single bulk request. Wrap the Stream in a
+// gonyan.BufferedStream to index logs in batches:
+//
+//	elasticStream := elastic.NewStream("http://elastic:9200", "logs-%Y.%m.%d")
+//	buffered := gonyan.NewBufferedStream(elasticStream)
+//	buffered.SetBufferLimit(1000)
+//	buffered.SetSchedulingInterval(5*time.Second, true)
+package elastic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gonyan"
+)
+
+// BulkPath is the path of the bulk API, appended to the base URL.
+const BulkPath = "/_bulk"
+
+// DefaultMaxAttempts defines the default number of attempts performed for
+// each document before giving up.
+const DefaultMaxAttempts = 3
+
+// DefaultMinBackoff defines the default delay before the first retry.
+const DefaultMinBackoff = 200 * time.Millisecond
+
+// DefaultMaxBackoff defines the default upper bound for retry delays.
+const DefaultMaxBackoff = 10 * time.Second
+
+// DefaultTimeout defines the default timeout of each bulk request.
+const DefaultTimeout = 30 * time.Second
+
+// Stream defines the Gonyan Stream for Elasticsearch and OpenSearch.
+type Stream struct {
+	url          string                           // Bulk API URL;
+	indexPattern string                           // Date patterned index name;
+	action       string                           // Bulk action (index or create);
+	client       *http.Client                     // HTTP client used for requests;
+	headers      map[string]string                // HTTP headers container;
+	maxAttempts  int                              // Attempts for each document;
+	minBackoff   time.Duration                    // Delay before the first retry;
+	maxBackoff   time.Duration                    // Upper bound of retry delays;
+	onError      func(document []byte, err error) // Callback for failed documents.
+}
+
+// NewStream creates a new bulk indexing stream for the cluster reachable at
+// provided base URL. The index pattern can contain the `%Y`, `%m`, `%d` and
+// `%H` verbs which are replaced with the UTC date of each log (e.g.
+// `logs-%Y.%m.%d`), `%%` produces a literal percent sign.
+func NewStream(baseURL string, indexPattern string) *Stream {
+	return &Stream{
+		url:          strings.TrimSuffix(baseURL, "/") + BulkPath,
+		indexPattern: indexPattern,
+		action:       "index",
+		client:       &http.Client{Timeout: DefaultTimeout},
+		headers:      make(map[string]string),
+		maxAttempts:  DefaultMaxAttempts,
+		minBackoff:   DefaultMinBackoff,
+		maxBackoff:   DefaultMaxBackoff,
+		onError: func(document []byte, err error) {
+			fmt.Printf("[Gonyan] [Elastic] document not indexed: %s.\nDocument: %s\n", err.Error(), document)
+		},
+	}
+}
+
+// UseCreateAction makes the stream emit `create` bulk actions instead of
+// `index` ones, as required by data streams.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (e *Stream) UseCreateAction() *Stream {
+	e.action = "create"
+	return e
+}
+
+// SetHeader sets provided key-value pair for later usage as HTTP headers.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (e *Stream) SetHeader(key, value string) *Stream {
+	e.headers[key] = value
+	return e
+}
+
+// SetBasicAuth sets the credentials used to authenticate the requests.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (e *Stream) SetBasicAuth(username, password string) *Stream {
+	request := &http.Request{Header: make(http.Header)}
+	request.SetBasicAuth(username, password)
+	return e.SetHeader("Authorization", request.Header.Get("Authorization"))
+}
+
+// SetClient allows to replace the HTTP client used for requests.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (e *Stream) SetClient(client *http.Client) *Stream {
+	if client != nil {
+		e.client = client
+	}
+	return e
+}
+
+// SetRetry configures how documents failed with a 429 or 5xx status (or
+// involved in a failed bulk request) are retried: up to maxAttempts attempts
+// are performed, waiting an exponentially growing delay between minBackoff
+// and maxBackoff.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (e *Stream) SetRetry(maxAttempts int, minBackoff, maxBackoff time.Duration) *Stream {
+	if maxAttempts > 0 {
+		e.maxAttempts = maxAttempts
+	}
+	if minBackoff > 0 {
+		e.minBackoff = minBackoff
+	}
+	if maxBackoff >= e.minBackoff {
+		e.maxBackoff = maxBackoff
+	}
+	return e
+}
+
+// SetErrorFn sets the callback invoked for every document that could not be
+// indexed, either because it was rejected by the cluster or because all the
+// attempts failed. By default failures are printed to stdout.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (e *Stream) SetErrorFn(errorFn func(document []byte, err error)) *Stream {
+	e.onError = errorFn
+	return e
+}
+
+// document represents a single bulk action/document pair.
+type document struct {
+	action []byte
+	source []byte
+}
+
+// Write function defined to implement the Stream interface.
+// The function synchronously indexes the serialised logs, retrying only the
+// documents failed with transient errors. Documents rejected by the cluster
+// are reported through the error callback, as are the documents still
+// failing after all the attempts. Write only fails when none of the
+// documents could be indexed, so that retrying the whole batch cannot index
+// any document twice.
+func (e *Stream) Write(messageBytes []byte) (int, error) {
+	messages := gonyan.DeserialiseBatch(messageBytes)
+	if len(messages) == 0 {
+		return 0, nil
+	}
+
+	pending := make([]document, 0, len(messages))
+	for _, message := range messages {
+		doc, err := e.buildDocument(message)
+		if err != nil {
+			e.reportError([]byte(message.Message), err)
+			continue
+		}
+		pending = append(pending, doc)
+	}
+
+	total := len(pending)
+	backoff := e.minBackoff
+	var lastErr error
+	for attempt := 1; len(pending) > 0; attempt++ {
+		pending, lastErr = e.bulk(pending)
+		if len(pending) == 0 {
+			break
+		}
+		if attempt >= e.maxAttempts {
+			for _, doc := range pending {
+				e.reportError(doc.source, lastErr)
+			}
+			if len(pending) < total {
+				return len(messageBytes), nil
+			}
+			return 0, fmt.Errorf("%d documents not indexed after %d attempts: %s", len(pending), attempt, lastErr.Error())
+		}
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > e.maxBackoff {
+			backoff = e.maxBackoff
+		}
+	}
+	return len(messageBytes), nil
+}
+
+// bulkResponse holds the fields of the bulk API response used to detect the
+// outcome of each document.
+type bulkResponse struct {
+	Errors bool                          `json:"errors"`
+	Items  []map[string]bulkResponseItem `json:"items"`
+}
+
+type bulkResponseItem struct {
+	Status int `json:"status"`
+	Error  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error,omitempty"`
+}
+
+// bulk sends provided documents with a single request and returns the ones
+// that should be retried together with the error that caused the retry.
+// Rejected documents are reported through the error callback.
+func (e *Stream) bulk(documents []document) ([]document, error) {
+	body := bytes.Buffer{}
+	for _, doc := range documents {
+		body.Write(doc.action)
+		body.WriteByte('\n')
+		body.Write(doc.source)
+		body.WriteByte('\n')
+	}
+
+	request, err := http.NewRequest(http.MethodPost, e.url, &body)
+	if err != nil {
+		return documents, fmt.Errorf("request creation failed due to: %s", err.Error())
+	}
+	request.Header.Set("Content-Type", "application/x-ndjson")
+	for key, val := range e.headers {
+		request.Header.Set(key, val)
+	}
+
+	response, err := e.client.Do(request)
+	if err != nil {
+		return documents, fmt.Errorf("request execution failed due to: %s", err.Error())
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		details, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		err := fmt.Errorf("unexpected status `%s`: %s", response.Status, strings.TrimSpace(string(details)))
+		if isRetryable(response.StatusCode) {
+			return documents, err
+		}
+		for _, doc := range documents {
+			e.reportError(doc.source, err)
+		}
+		return nil, nil
+	}
+
+	result := bulkResponse{}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return documents, fmt.Errorf("bulk response decoding failed due to: %s", err.Error())
+	}
+	if !result.Errors {
+		return nil, nil
+	}
+	if len(result.Items) != len(documents) {
+		return documents, fmt.Errorf("unexpected number of bulk response items. Expected: %d - Found: %d", len(documents), len(result.Items))
+	}
+
+	retry := []document{}
+	var retryErr error
+	for i, item := range result.Items {
+		for _, outcome := range item {
+			if outcome.Status >= 200 && outcome.Status < 300 {
+				continue
+			}
+			err := fmt.Errorf("status %d", outcome.Status)
+			if outcome.Error != nil {
+				err = fmt.Errorf("status %d, %s: %s", outcome.Status, outcome.Error.Type, outcome.Error.Reason)
+			}
+			if isRetryable(outcome.Status) {
+				retry = append(retry, documents[i])
+				retryErr = err
+				continue
+			}
+			e.reportError(documents[i].source, err)
+		}
+	}
+	return retry, retryErr
+}
+
+// buildDocument converts provided message into a bulk action/document pair.
+func (e *Stream) buildDocument(message *gonyan.LogMessage) (document, error) {
+	timestamp := time.Now().UTC()
+	if message.Timestamp != 0 {
+		timestamp = time.Unix(0, message.Timestamp).UTC()
+	}
+
+	action, err := json.Marshal(map[string]map[string]string{
+		e.action: {"_index": formatIndex(e.indexPattern, timestamp)},
+	})
+	if err != nil {
+		return document{}, fmt.Errorf("action serialisation failed: %s", err.Error())
+	}
+
+	source, err := json.Marshal(struct {
+		Timestamp string            `json:"@timestamp"`
+		Tag       string            `json:"tag,omitempty"`
+		Level     string            `json:"level,omitempty"`
+		Message   string            `json:"message"`
+		Metadata  map[string]string `json:"metadata,omitempty"`
+	}{
+		Timestamp: timestamp.Format(time.RFC3339Nano),
+		Tag:       message.Tag,
+		Level:     message.Level,
+		Message:   message.Message,
+		Metadata:  message.Metadata,
+	})
+	if err != nil {
+		return document{}, fmt.Errorf("document serialisation failed: %s", err.Error())
+	}
+	return document{action: action, source: source}, nil
+}
+
+func (e *Stream) reportError(source []byte, err error) {
+	if e.onError != nil {
+		e.onError(source, err)
+	}
+}
+
+// isRetryable reports whether provided status code represents a transient
+// failure.
+func isRetryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// formatIndex replaces the date verbs of provided pattern using provided
+// time.
+func formatIndex(pattern string, t time.Time) string {
+	var index strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' || i+1 == len(pattern) {
+			index.WriteByte(pattern[i])
+			continue
+		}
+		i++
+		switch pattern[i] {
+		case 'Y':
+			index.WriteString(strconv.Itoa(t.Year()))
+		case 'm':
+			index.WriteString(fmt.Sprintf("%02d", int(t.Month())))
+		case 'd':
+			index.WriteString(fmt.Sprintf("%02d", t.Day()))
+		case 'H':
+			index.WriteString(fmt.Sprintf("%02d", t.Hour()))
+		case '%':
+			index.WriteByte('%')
+		default:
+			index.WriteByte('%')
+			index.WriteByte(pattern[i])
+		}
+	}
+	return index.String()
+}
@@ -0,0 +1,204 @@
+package elastic
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// bulkServer is a fake bulk API failing documents depending on their
+// message: `retry` documents fail with 429 the first time they are seen,
+// `reject` documents always fail with 400 and `unavailable` ones with 503.
+type bulkServer struct {
+	mtx      sync.Mutex
+	requests [][]string // Messages received, per request;
+	indexes  []string   // Index names received;
+	seen     map[string]bool
+}
+
+func (b *bulkServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != BulkPath {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	messages := []string{}
+	items := []string{}
+	errors := false
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		action := map[string]map[string]string{}
+		json.Unmarshal(scanner.Bytes(), &action)
+		b.indexes = append(b.indexes, action["index"]["_index"])
+
+		scanner.Scan()
+		source := map[string]interface{}{}
+		json.Unmarshal(scanner.Bytes(), &source)
+		message := source["message"].(string)
+		messages = append(messages, message)
+
+		status := 201
+		switch {
+		case message == "retry" && !b.seen[message]:
+			b.seen[message] = true
+			status = 429
+		case message == "reject":
+			status = 400
+		case message == "unavailable":
+			status = 503
+		}
+		if status != 201 {
+			errors = true
+			items = append(items, fmt.Sprintf(`{"index":{"status":%d,"error":{"type":"failure","reason":"%s"}}}`, status, message))
+			continue
+		}
+		items = append(items, `{"index":{"status":201}}`)
+	}
+	b.requests = append(b.requests, messages)
+	fmt.Fprintf(w, `{"took":1,"errors":%t,"items":[%s]}`, errors, strings.Join(items, ","))
+}
+
+// TestWritePartialFailures verifies that only failed documents are retried
+// and rejected documents are reported.
+func TestWritePartialFailures(t *testing.T) {
+	server := &bulkServer{seen: make(map[string]bool)}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	rejected := []string{}
+	s := NewStream(ts.URL, "logs-%Y.%m.%d-%%").SetRetry(3, time.Millisecond, time.Millisecond)
+	s.SetErrorFn(func(document []byte, err error) {
+		rejected = append(rejected, string(document))
+		if !strings.Contains(err.Error(), "status 400") {
+			t.Errorf("Unexpected rejection error: %s", err.Error())
+		}
+	})
+
+	batch := `{"tag":"app","timestamp":1483439014000000200,"level":"Info","message":"ok"}
+{"tag":"app","timestamp":1483439014000000200,"message":"retry"}
+{"tag":"app","timestamp":1483439014000000200,"message":"reject"}`
+	n, err := s.Write([]byte(batch))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if n != len(batch) {
+		t.Fatalf("Unexpected number of written bytes. Expected: %d - Found: %d.", len(batch), n)
+	}
+
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+	if len(server.requests) != 2 {
+		t.Fatalf("Unexpected number of bulk requests. Expected: %d - Found: %d.", 2, len(server.requests))
+	}
+	if len(server.requests[1]) != 1 || server.requests[1][0] != "retry" {
+		t.Fatalf("Only the failed document should be retried. Found: %+v.", server.requests[1])
+	}
+	if server.indexes[0] != "logs-2017.01.03-%" {
+		t.Fatalf("Unexpected index. Expected: `%s` - Found: `%s`.", "logs-2017.01.03-%", server.indexes[0])
+	}
+	expected := `{"@timestamp":"2017-01-03T10:23:34.0000002Z","tag":"app","message":"reject"}`
+	if len(rejected) != 1 || rejected[0] != expected {
+		t.Fatalf("Unexpected rejected documents. Expected: [%s] - Found: %+v.", expected, rejected)
+	}
+}
+
+// TestWritePartialExhaustion verifies that documents still failing after
+// all the attempts are reported without failing the Write when other
+// documents were indexed, which would be duplicated by a retry.
+func TestWritePartialExhaustion(t *testing.T) {
+	server := &bulkServer{seen: make(map[string]bool)}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	failed := []string{}
+	s := NewStream(ts.URL, "logs").SetRetry(2, time.Millisecond, time.Millisecond)
+	s.SetErrorFn(func(document []byte, err error) {
+		failed = append(failed, string(document))
+	})
+
+	batch := `{"message":"ok"}` + "\n" + `{"message":"unavailable"}`
+	if n, err := s.Write([]byte(batch)); err != nil || n != len(batch) {
+		t.Fatalf("Unexpected write outcome: %d, %v.", n, err)
+	}
+	if len(failed) != 1 || !strings.Contains(failed[0], `"message":"unavailable"`) {
+		t.Fatalf("Unexpected failed documents: %+v.", failed)
+	}
+
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+	if len(server.requests) != 2 || len(server.requests[1]) != 1 {
+		t.Fatalf("Only the failed document should be retried. Found: %+v.", server.requests)
+	}
+}
+
+// TestWriteRequestFailures verifies the handling of request level failures.
+func TestWriteRequestFailures(t *testing.T) {
+	calls := 0
+	mtx := sync.Mutex{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		calls++
+		mtx.Unlock()
+		if r.Header.Get("Authorization") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	failures := 0
+	s := NewStream(ts.URL, "logs").SetRetry(2, time.Millisecond, time.Millisecond).UseCreateAction()
+	s.SetErrorFn(func(document []byte, err error) { failures++ })
+
+	// Non retryable statuses reject all the documents at once.
+	if _, err := s.Write([]byte(`{"message":"a"}` + "\n" + `{"message":"b"}`)); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if failures != 2 || calls != 1 {
+		t.Fatalf("Unexpected failures/calls. Expected: 2/1 - Found: %d/%d.", failures, calls)
+	}
+
+	// Retryable statuses exhaust the attempts and make Write fail.
+	s.SetBasicAuth("user", "pass")
+	failures, calls = 0, 0
+	n, err := s.Write([]byte(`{"message":"a"}`))
+	if err == nil {
+		t.Fatalf("An error was expected!")
+	}
+	if n != 0 {
+		t.Fatalf("Unexpected number of written bytes. Expected: %d - Found: %d.", 0, n)
+	}
+	if failures != 1 || calls != 2 {
+		t.Fatalf("Unexpected failures/calls. Expected: 1/2 - Found: %d/%d.", failures, calls)
+	}
+}
+
+// TestFormatIndex verifies the index pattern verbs.
+func TestFormatIndex(t *testing.T) {
+	date := time.Date(2017, time.January, 3, 9, 0, 0, 0, time.UTC)
+	cases := map[string]string{
+		"logs-%Y.%m.%d": "logs-2017.01.03",
+		"logs-%H":       "logs-09",
+		"plain":         "plain",
+		"odd-%x-%":      "odd-%x-%",
+	}
+	for pattern, expected := range cases {
+		if found := formatIndex(pattern, date); found != expected {
+			t.Fatalf("Unexpected index for `%s`. Expected: `%s` - Found: `%s`.", pattern, expected, found)
+		}
+	}
+}
@@ -0,0 +1,566 @@
+// Package fluent contains definition of the Gonyan Stream speaking the
+// Fluentd Forward protocol (as implemented by Fluentd and Fluent Bit).
+//
+// Each Write call is treated as a batch: the payload is split using the
+// default BufferedStream separator and every serialised LogMessage becomes a
+// Fluentd event whose tag is the logger tag. Logs can be buffered by the
+// Stream itself, BufferedStream-style, so that they are grouped together and
+// sent with a single Forward or PackedForward message once the buffer limit
+// is reached or the flush interval expires:
+//
+//	fluentStream := fluent.NewStream("127.0.0.1:24224").SetMode(fluent.PackedForwardMode)
+//	fluentStream.SetBufferLimit(500).SetFlushInterval(5 * time.Second)
+//	defer fluentStream.Close()
+package fluent
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"gonyan"
+)
+
+// Mode represents one of the event modes defined by the Forward protocol.
+type Mode int
+
+// Supported Forward protocol modes:
+//
+//   - MessageMode: one message per event `[tag, time, record, option]`;
+//   - ForwardMode: one message per tag `[tag, [[time, record], ...], option]`;
+//   - PackedForwardMode: one message per tag carrying the events as a
+//     MessagePack binary stream `[tag, bin, option]`.
+const (
+	MessageMode       Mode = iota
+	ForwardMode       Mode = iota
+	PackedForwardMode Mode = iota
+)
+
+// DefaultTag is the Fluentd tag used for logs without a tag.
+const DefaultTag = "gonyan"
+
+// DefaultAckTimeout defines the default time waited for a chunk ack.
+const DefaultAckTimeout = 5 * time.Second
+
+// DefaultDialTimeout defines the default timeout for connection attempts.
+const DefaultDialTimeout = 5 * time.Second
+
+// DefaultMaxAttempts defines the default number of transmission attempts
+// performed for each chunk before giving up.
+const DefaultMaxAttempts = 3
+
+// DefaultMaxBuffered defines the default maximum number of logs kept by the
+// Stream while they cannot be sent.
+const DefaultMaxBuffered = 10000
+
+// Stream defines the Gonyan Stream for the Fluentd Forward protocol.
+type Stream struct {
+	network     string        // Network used to dial the server (tcp, unix);
+	address     string        // Server address;
+	mode        Mode          // Forward protocol mode;
+	defaultTag  string        // Tag used when the log has none;
+	requireAck  bool          // Flag to activate at-least-once delivery;
+	ackTimeout  time.Duration // Time waited for each ack response;
+	dialTimeout time.Duration // Timeout applied to connection attempts;
+	maxAttempts int           // Transmission attempts for each chunk;
+	conn        net.Conn      // Current connection, lazily created;
+	connMutex   sync.Mutex    // Mutex serialising connection usage;
+
+	bufferLimit   int                  // Number of buffered logs triggering a flush;
+	flushInterval time.Duration        // Maximum time logs are buffered;
+	maxBuffered   int                  // Maximum number of logs kept while unsent;
+	pending       []*gonyan.LogMessage // Logs waiting to be sent, oldest first;
+	dropped       uint64               // Number of logs dropped by maxBuffered;
+	timer         *time.Timer          // Timer of the flush interval, if running;
+	pendingMutex  sync.Mutex           // Mutex used for accessing the above;
+	flushMutex    sync.Mutex           // Mutex serialising flushes to keep the order;
+	fatal         func(error)          // Callback for asynchronous failures.
+}
+
+// NewStream creates a new Fluentd stream sending events to provided TCP
+// address using the Message mode.
+func NewStream(address string) *Stream {
+	return &Stream{
+		network:     "tcp",
+		address:     address,
+		mode:        MessageMode,
+		defaultTag:  DefaultTag,
+		requireAck:  false,
+		ackTimeout:  DefaultAckTimeout,
+		dialTimeout: DefaultDialTimeout,
+		maxAttempts: DefaultMaxAttempts,
+		maxBuffered: DefaultMaxBuffered,
+		fatal: func(err error) {
+			fmt.Printf("[Gonyan] [Fluent] [Fatal] %s.\n", err.Error())
+		},
+	}
+}
+
+// SetNetwork allows to define the network used to reach the server, by
+// default it is `tcp` but `unix` can be used for unix domain sockets.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (f *Stream) SetNetwork(network string) *Stream {
+	f.network = network
+	return f
+}
+
+// SetMode allows to define the Forward protocol mode used to encode events.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (f *Stream) SetMode(mode Mode) *Stream {
+	f.mode = mode
+	return f
+}
+
+// SetDefaultTag sets the Fluentd tag used for logs without a tag.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (f *Stream) SetDefaultTag(tag string) *Stream {
+	f.defaultTag = tag
+	return f
+}
+
+// EnableAck activates at-least-once delivery: each chunk is sent with a
+// unique chunk ID and retransmitted until the server acknowledges it or the
+// maximum number of attempts is reached.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (f *Stream) EnableAck() *Stream {
+	f.requireAck = true
+	return f
+}
+
+// DisableAck deactivates chunk acknowledgement; ack is disabled by default.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (f *Stream) DisableAck() *Stream {
+	f.requireAck = false
+	return f
+}
+
+// SetAckTimeout sets the time waited for a chunk ack before considering the
+// transmission failed. Non-positive values are ignored.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (f *Stream) SetAckTimeout(timeout time.Duration) *Stream {
+	if timeout > 0 {
+		f.ackTimeout = timeout
+	}
+	return f
+}
+
+// SetDialTimeout sets the timeout of connection attempts. Non-positive values
+// are ignored.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (f *Stream) SetDialTimeout(timeout time.Duration) *Stream {
+	if timeout > 0 {
+		f.dialTimeout = timeout
+	}
+	return f
+}
+
+// SetMaxAttempts sets the number of transmission attempts for each chunk.
+// Values lower than 1 are ignored.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (f *Stream) SetMaxAttempts(attempts int) *Stream {
+	if attempts > 0 {
+		f.maxAttempts = attempts
+	}
+	return f
+}
+
+// SetBufferLimit enables buffering: logs are kept by the Stream and sent
+// together once provided number of them is reached. Setting the limit to 0,
+// the default, disables the feature; negative values are ignored.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (f *Stream) SetBufferLimit(limit int) *Stream {
+	if limit >= 0 {
+		f.pendingMutex.Lock()
+		f.bufferLimit = limit
+		f.pendingMutex.Unlock()
+	}
+	return f
+}
+
+// SetFlushInterval enables buffering: logs are kept by the Stream at most for
+// provided interval before being sent. Setting the interval to 0, the
+// default, disables the feature; negative values are ignored.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (f *Stream) SetFlushInterval(interval time.Duration) *Stream {
+	if interval >= 0 {
+		f.pendingMutex.Lock()
+		f.flushInterval = interval
+		f.pendingMutex.Unlock()
+	}
+	return f
+}
+
+// SetMaxBuffered sets the maximum number of logs kept by the Stream while
+// they cannot be sent, by default DefaultMaxBuffered; the oldest logs are
+// dropped beyond it. Values lower than 1 are ignored.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (f *Stream) SetMaxBuffered(maxBuffered int) *Stream {
+	if maxBuffered > 0 {
+		f.pendingMutex.Lock()
+		f.maxBuffered = maxBuffered
+		f.pendingMutex.Unlock()
+	}
+	return f
+}
+
+// SetFatalFn sets the optional function receiving the failures of the
+// flushes not performed by Flush or Close.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (f *Stream) SetFatalFn(fatalFn func(error)) *Stream {
+	f.fatal = fatalFn
+	return f
+}
+
+// Dropped returns the number of logs dropped because the Stream kept more
+// unsent logs than allowed by SetMaxBuffered.
+func (f *Stream) Dropped() uint64 {
+	f.pendingMutex.Lock()
+	defer f.pendingMutex.Unlock()
+	return f.dropped
+}
+
+// Write function defined to implement the Stream interface.
+// The function decodes the serialised logs, encodes them according to the
+// configured mode and synchronously sends them to the server, waiting for
+// the acks when required. When buffering is enabled the logs are only
+// buffered, the flushes triggered by the buffer limit being performed by the
+// writer.
+//
+// Logs already sent are never sent again: when only some of the logs of a
+// Write are sent the others are kept by the Stream, and sent before the
+// following ones, while the failure is reported to the fatal function
+// instead of being returned.
+func (f *Stream) Write(messageBytes []byte) (int, error) {
+	messages := gonyan.DeserialiseBatch(messageBytes)
+	if len(messages) == 0 {
+		return 0, nil
+	}
+
+	f.pendingMutex.Lock()
+	if f.bufferLimit == 0 && f.flushInterval == 0 {
+		f.pendingMutex.Unlock()
+		if err := f.flush(messages); err != nil {
+			return 0, err
+		}
+		return len(messageBytes), nil
+	}
+
+	f.pending = append(f.pending, messages...)
+	f.capPending()
+	full := f.bufferLimit > 0 && len(f.pending) >= f.bufferLimit
+	if !full {
+		f.startTimer()
+	}
+	f.pendingMutex.Unlock()
+
+	if full {
+		f.report(f.flush(nil))
+	}
+	return len(messageBytes), nil
+}
+
+// Flush sends the buffered logs, the ones not sent are kept for the next
+// flush.
+func (f *Stream) Flush() error {
+	return f.flush(nil)
+}
+
+// Close flushes the buffered logs and closes the underlying connection, if
+// any. A new connection is created by the next Write.
+func (f *Stream) Close() error {
+	err := f.Flush()
+
+	f.connMutex.Lock()
+	defer f.connMutex.Unlock()
+	if closeErr := f.closeConn(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// flush sends the buffered logs followed by provided ones, which are owned
+// by the caller. It returns an error when none of provided logs is sent, or
+// when provided logs are missing and any buffered log is not sent; logs not
+// sent are kept but the caller's ones in the first case.
+func (f *Stream) flush(messages []*gonyan.LogMessage) error {
+	f.flushMutex.Lock()
+	defer f.flushMutex.Unlock()
+
+	f.pendingMutex.Lock()
+	owned := len(f.pending)
+	batch := append(f.pending, messages...)
+	f.pending = nil
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+	f.pendingMutex.Unlock()
+
+	for _, c := range f.encode(batch) {
+		err := f.send(c)
+		if err == nil {
+			continue
+		}
+		// The caller retries its logs on failure, they are kept only when
+		// some of them have been sent.
+		if len(messages) > 0 && c.first <= owned {
+			f.keep(batch[c.first:owned])
+			return err
+		}
+		f.keep(batch[c.first:])
+		if len(messages) > 0 {
+			f.report(err)
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// keep puts back provided unsent logs at the head of the buffer.
+func (f *Stream) keep(messages []*gonyan.LogMessage) {
+	if len(messages) == 0 {
+		return
+	}
+	f.pendingMutex.Lock()
+	defer f.pendingMutex.Unlock()
+	f.pending = append(append([]*gonyan.LogMessage{}, messages...), f.pending...)
+	f.capPending()
+	f.startTimer()
+}
+
+// capPending drops the oldest logs exceeding maxBuffered. It *must* be
+// called holding the pending lock.
+func (f *Stream) capPending() {
+	if over := len(f.pending) - f.maxBuffered; over > 0 {
+		f.pending = f.pending[over:]
+		f.dropped += uint64(over)
+	}
+}
+
+// startTimer starts the flush interval timer, if enabled and not running.
+// It *must* be called holding the pending lock.
+func (f *Stream) startTimer() {
+	if f.flushInterval > 0 && f.timer == nil {
+		f.timer = time.AfterFunc(f.flushInterval, func() {
+			f.report(f.Flush())
+		})
+	}
+}
+
+// report hands provided error, if any, to the fatal function.
+func (f *Stream) report(err error) {
+	if err != nil && f.fatal != nil {
+		f.fatal(err)
+	}
+}
+
+// chunk represents an encoded Forward protocol message waiting to be sent.
+type chunk struct {
+	id      string
+	payload []byte
+	first   int // Index of the first log of the chunk in the encoded batch.
+}
+
+// encode converts provided messages into the chunks to be transmitted
+// according to the configured mode. Consecutive messages sharing the same
+// tag are grouped together in Forward and PackedForward modes so that the
+// original order is preserved.
+func (f *Stream) encode(messages []*gonyan.LogMessage) []chunk {
+	chunks := []chunk{}
+	if f.mode == MessageMode {
+		for i, message := range messages {
+			id := f.newChunkID()
+			payload := appendArrayHeader(nil, 4)
+			payload = appendString(payload, f.tagOf(message))
+			payload = appendEventTime(payload, eventTime(message))
+			payload = appendRecord(payload, message)
+			payload = appendOption(payload, id, 0)
+			chunks = append(chunks, chunk{id: id, payload: payload, first: i})
+		}
+		return chunks
+	}
+
+	for start := 0; start < len(messages); {
+		tag := f.tagOf(messages[start])
+		end := start + 1
+		for end < len(messages) && f.tagOf(messages[end]) == tag {
+			end++
+		}
+		group, first := messages[start:end], start
+		start = end
+
+		entries := []byte{}
+		if f.mode == ForwardMode {
+			entries = appendArrayHeader(entries, len(group))
+		}
+		for _, message := range group {
+			entries = appendArrayHeader(entries, 2)
+			entries = appendEventTime(entries, eventTime(message))
+			entries = appendRecord(entries, message)
+		}
+
+		id := f.newChunkID()
+		payload := appendArrayHeader(nil, 3)
+		payload = appendString(payload, tag)
+		if f.mode == ForwardMode {
+			payload = append(payload, entries...)
+			payload = appendOption(payload, id, 0)
+		} else {
+			payload = appendBinary(payload, entries)
+			payload = appendOption(payload, id, len(group))
+		}
+		chunks = append(chunks, chunk{id: id, payload: payload, first: first})
+	}
+	return chunks
+}
+
+// send transmits provided chunk, reconnecting and retransmitting it on
+// failure up to the configured number of attempts.
+func (f *Stream) send(c chunk) error {
+	f.connMutex.Lock()
+	defer f.connMutex.Unlock()
+
+	var err error
+	for attempt := 0; attempt < f.maxAttempts; attempt++ {
+		if err = f.sendOnce(c); err == nil {
+			return nil
+		}
+		// The connection state is unknown, drop it and retry with a new one.
+		f.closeConn()
+	}
+	return fmt.Errorf("chunk transmission failed after %d attempts: %s", f.maxAttempts, err.Error())
+}
+
+// sendOnce performs a single transmission attempt. It is not concurrent safe
+// by its own and *must* be called holding the connection lock.
+func (f *Stream) sendOnce(c chunk) error {
+	if f.conn == nil {
+		conn, err := net.DialTimeout(f.network, f.address, f.dialTimeout)
+		if err != nil {
+			return fmt.Errorf("connection failed due to: %s", err.Error())
+		}
+		f.conn = conn
+	}
+
+	if _, err := f.conn.Write(c.payload); err != nil {
+		return fmt.Errorf("write failed due to: %s", err.Error())
+	}
+	if !f.requireAck {
+		return nil
+	}
+
+	f.conn.SetReadDeadline(time.Now().Add(f.ackTimeout))
+	defer f.conn.SetReadDeadline(time.Time{})
+
+	response, err := newDecoder(f.conn).decode()
+	if err != nil {
+		return fmt.Errorf("ack read failed due to: %s", err.Error())
+	}
+	ack, ok := response.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("invalid ack response: %v", response)
+	}
+	if id, _ := ack["ack"].(string); id != c.id {
+		return fmt.Errorf("unexpected ack `%v` for chunk `%s`", ack["ack"], c.id)
+	}
+	return nil
+}
+
+// closeConn closes the current connection. It *must* be called holding the
+// connection lock.
+func (f *Stream) closeConn() error {
+	if f.conn == nil {
+		return nil
+	}
+	err := f.conn.Close()
+	f.conn = nil
+	return err
+}
+
+// newChunkID returns a new unique chunk ID, or an empty string when ack is
+// disabled.
+func (f *Stream) newChunkID() string {
+	if !f.requireAck {
+		return ""
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		id = []byte(fmt.Sprintf("%016x", time.Now().UnixNano()))
+	}
+	return base64.StdEncoding.EncodeToString(id)
+}
+
+// tagOf returns the Fluentd tag for provided message.
+func (f *Stream) tagOf(message *gonyan.LogMessage) string {
+	if message.Tag == "" {
+		return f.defaultTag
+	}
+	return message.Tag
+}
+
+// eventTime returns the time of provided message, logs without timestamp
+// are stamped with the current time.
+func eventTime(message *gonyan.LogMessage) time.Time {
+	if message.Timestamp == 0 {
+		return time.Now()
+	}
+	return time.Unix(0, message.Timestamp)
+}
+
+// appendRecord appends the Fluentd record for provided message: metadata
+// fields are flattened into the record together with the `message` and,
+// when set, `level` fields. Metadata named as those fields are prefixed by
+// `metadata_` so that they are not overwritten.
+func appendRecord(b []byte, message *gonyan.LogMessage) []byte {
+	record := make(map[string]string, len(message.Metadata)+2)
+	for key, val := range message.Metadata {
+		if key == "message" || key == "level" {
+			key = "metadata_" + key
+		}
+		record[key] = val
+	}
+	record["message"] = message.Message
+	if message.Level != "" {
+		record["level"] = message.Level
+	}
+	return appendStringMap(b, record)
+}
+
+// appendOption appends the option map carrying the chunk ID and, for
+// PackedForward mode, the number of events. An empty option map is used
+// when neither is available.
+func appendOption(b []byte, id string, size int) []byte {
+	n := 0
+	if id != "" {
+		n++
+	}
+	if size > 0 {
+		n++
+	}
+	b = appendMapHeader(b, n)
+	if size > 0 {
+		b = appendString(b, "size")
+		b = appendInt(b, int64(size))
+	}
+	if id != "" {
+		b = appendString(b, "chunk")
+		b = appendString(b, id)
+	}
+	return b
+}
@@ -0,0 +1,339 @@
+package fluent
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer is a minimal Forward protocol server decoding the received
+// messages and, optionally, acknowledging them.
+type fakeServer struct {
+	listener  net.Listener
+	messages  chan []interface{}
+	ack       bool
+	dropAcks  int
+	dropAfter int // Number of acks sent before dropping them.
+	mtx       sync.Mutex
+}
+
+func newFakeServer(t *testing.T, ack bool, dropAcks int) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected listen error: %s", err.Error())
+	}
+	s := &fakeServer{
+		listener: listener,
+		messages: make(chan []interface{}, 100),
+		ack:      ack,
+		dropAcks: dropAcks,
+	}
+	go s.serve()
+	return s
+}
+
+func (s *fakeServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeServer) handle(conn net.Conn) {
+	defer conn.Close()
+	d := newDecoder(conn)
+	for {
+		value, err := d.decode()
+		if err != nil {
+			return
+		}
+		message := value.([]interface{})
+		s.messages <- message
+		if !s.ack {
+			continue
+		}
+		s.mtx.Lock()
+		drop := s.dropAcks > 0 && s.dropAfter == 0
+		if drop {
+			s.dropAcks--
+		} else if s.dropAfter > 0 {
+			s.dropAfter--
+		}
+		s.mtx.Unlock()
+		if drop {
+			// Simulate a lost ack by closing the connection.
+			return
+		}
+		option := message[len(message)-1].(map[string]interface{})
+		conn.Write(appendStringMap(nil, map[string]string{"ack": option["chunk"].(string)}))
+	}
+}
+
+func (s *fakeServer) next(t *testing.T) []interface{} {
+	select {
+	case message := <-s.messages:
+		return message
+	case <-time.After(2 * time.Second):
+		t.Fatalf("No message received by the fake server.")
+	}
+	return nil
+}
+
+func (s *fakeServer) close() {
+	s.listener.Close()
+}
+
+const testBatch = `{"tag":"app","timestamp":1483439014000000200,"level":"Error","message":"first","metadata":{"custom":"field","message":"hidden"}}
+{"tag":"app","message":"second"}
+{"tag":"other","message":"third"}`
+
+// TestWriteMessageMode verifies that each log is sent as a single message.
+func TestWriteMessageMode(t *testing.T) {
+	server := newFakeServer(t, false, 0)
+	defer server.close()
+
+	s := NewStream(server.listener.Addr().String())
+	defer s.Close()
+
+	n, err := s.Write([]byte(testBatch))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if n != len(testBatch) {
+		t.Fatalf("Unexpected number of written bytes. Expected: %d - Found: %d.", len(testBatch), n)
+	}
+
+	message := server.next(t)
+	if len(message) != 4 {
+		t.Fatalf("Unexpected message length. Expected: %d - Found: %d.", 4, len(message))
+	}
+	if message[0] != "app" {
+		t.Fatalf("Unexpected tag. Expected: `%s` - Found: `%v`.", "app", message[0])
+	}
+	expectedTime := time.Unix(0, 1483439014000000200).UTC()
+	if !message[1].(time.Time).Equal(expectedTime) {
+		t.Fatalf("Unexpected time. Expected: %s - Found: %s.", expectedTime, message[1])
+	}
+	record := message[2].(map[string]interface{})
+	if record["message"] != "first" || record["level"] != "Error" || record["custom"] != "field" || record["metadata_message"] != "hidden" {
+		t.Fatalf("Unexpected record: %+v.", record)
+	}
+
+	if message := server.next(t); message[0] != "app" || message[2].(map[string]interface{})["message"] != "second" {
+		t.Fatalf("Unexpected second message: %+v.", message)
+	}
+	if message := server.next(t); message[0] != "other" {
+		t.Fatalf("Unexpected third message: %+v.", message)
+	}
+}
+
+// TestWriteForwardMode verifies that consecutive logs sharing the same tag
+// are grouped into a single message.
+func TestWriteForwardMode(t *testing.T) {
+	server := newFakeServer(t, false, 0)
+	defer server.close()
+
+	s := NewStream(server.listener.Addr().String()).SetMode(ForwardMode)
+	defer s.Close()
+
+	if _, err := s.Write([]byte(testBatch)); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	message := server.next(t)
+	if message[0] != "app" {
+		t.Fatalf("Unexpected tag. Expected: `%s` - Found: `%v`.", "app", message[0])
+	}
+	entries := message[1].([]interface{})
+	if len(entries) != 2 {
+		t.Fatalf("Unexpected number of entries. Expected: %d - Found: %d.", 2, len(entries))
+	}
+	second := entries[1].([]interface{})[1].(map[string]interface{})
+	if second["message"] != "second" {
+		t.Fatalf("Unexpected second record: %+v.", second)
+	}
+
+	message = server.next(t)
+	if message[0] != "other" || len(message[1].([]interface{})) != 1 {
+		t.Fatalf("Unexpected second message: %+v.", message)
+	}
+}
+
+// TestWritePackedForwardMode verifies that events are packed in a binary
+// stream and the option carries their count.
+func TestWritePackedForwardMode(t *testing.T) {
+	server := newFakeServer(t, false, 0)
+	defer server.close()
+
+	s := NewStream(server.listener.Addr().String()).SetMode(PackedForwardMode).SetDefaultTag("fallback")
+	defer s.Close()
+
+	if _, err := s.Write([]byte(`{"message":"a"}` + "\n" + `{"message":"b"}`)); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	message := server.next(t)
+	if message[0] != "fallback" {
+		t.Fatalf("Unexpected tag. Expected: `%s` - Found: `%v`.", "fallback", message[0])
+	}
+	option := message[2].(map[string]interface{})
+	if option["size"] != int64(2) {
+		t.Fatalf("Unexpected size option. Expected: %d - Found: %v.", 2, option["size"])
+	}
+
+	d := newDecoder(bytes.NewReader(message[1].([]byte)))
+	for _, expected := range []string{"a", "b"} {
+		entry, err := d.decode()
+		if err != nil {
+			t.Fatalf("Unexpected error decoding packed entry: %s", err.Error())
+		}
+		record := entry.([]interface{})[1].(map[string]interface{})
+		if record["message"] != expected {
+			t.Fatalf("Unexpected packed record. Expected: `%s` - Found: `%v`.", expected, record["message"])
+		}
+	}
+}
+
+// TestWriteWithAck verifies that chunks are acknowledged and retransmitted
+// when the ack gets lost.
+func TestWriteWithAck(t *testing.T) {
+	server := newFakeServer(t, true, 1)
+	defer server.close()
+
+	s := NewStream(server.listener.Addr().String()).SetMode(ForwardMode).EnableAck().SetAckTimeout(time.Second)
+	defer s.Close()
+
+	if _, err := s.Write([]byte(`{"tag":"app","message":"a"}`)); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	first := server.next(t)
+	second := server.next(t)
+	firstChunk := first[2].(map[string]interface{})["chunk"]
+	secondChunk := second[2].(map[string]interface{})["chunk"]
+	if firstChunk == nil || firstChunk != secondChunk {
+		t.Fatalf("Retransmission should reuse the chunk ID. First: %v - Second: %v.", firstChunk, secondChunk)
+	}
+}
+
+// TestWriteFailure verifies that unreachable servers make Write fail.
+func TestWriteFailure(t *testing.T) {
+	server := newFakeServer(t, false, 0)
+	address := server.listener.Addr().String()
+	server.close()
+
+	s := NewStream(address).SetMaxAttempts(2).SetDialTimeout(time.Second)
+	n, err := s.Write([]byte(`{"message":"a"}`))
+	if err == nil {
+		t.Fatalf("An error was expected!")
+	}
+	if n != 0 {
+		t.Fatalf("Unexpected number of written bytes. Expected: %d - Found: %d.", 0, n)
+	}
+
+	if n, err := s.Write(nil); n != 0 || err != nil {
+		t.Fatalf("Empty writes should be ignored. Found: %d, %v.", n, err)
+	}
+}
+
+// TestWriteBuffered verifies that logs are buffered until the buffer limit
+// is reached or the flush interval expires.
+func TestWriteBuffered(t *testing.T) {
+	server := newFakeServer(t, false, 0)
+	defer server.close()
+
+	s := NewStream(server.listener.Addr().String()).SetMode(ForwardMode).SetBufferLimit(3)
+	if _, err := s.Write([]byte(`{"tag":"app","message":"a"}` + "\n" + `{"tag":"app","message":"b"}`)); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	select {
+	case message := <-server.messages:
+		t.Fatalf("Unexpected message sent before reaching the limit: %+v.", message)
+	case <-time.After(100 * time.Millisecond):
+	}
+	s.Write([]byte(`{"tag":"app","message":"c"}`))
+	if message := server.next(t); len(message[1].([]interface{})) != 3 {
+		t.Fatalf("Unexpected buffered message: %+v.", message)
+	}
+
+	s.SetFlushInterval(50 * time.Millisecond)
+	s.Write([]byte(`{"tag":"app","message":"d"}`))
+	if message := server.next(t); len(message[1].([]interface{})) != 1 {
+		t.Fatalf("Unexpected message flushed by the interval: %+v.", message)
+	}
+
+	// Close flushes the buffered logs.
+	s.SetFlushInterval(0)
+	s.Write([]byte(`{"tag":"app","message":"e"}`))
+	if err := s.Close(); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if message := server.next(t); len(message[1].([]interface{})) != 1 {
+		t.Fatalf("Unexpected message flushed by Close: %+v.", message)
+	}
+}
+
+// TestWritePartialFailure verifies that, when only some chunks are sent, the
+// sent logs are not sent again while the others are kept for the next flush.
+func TestWritePartialFailure(t *testing.T) {
+	server := newFakeServer(t, true, 1)
+	defer server.close()
+	server.dropAfter = 1
+
+	var failures []error
+	s := NewStream(server.listener.Addr().String()).EnableAck().SetAckTimeout(time.Second).SetMaxAttempts(1)
+	s.SetFatalFn(func(err error) {
+		failures = append(failures, err)
+	})
+	defer s.Close()
+
+	// The ack of the second log is lost.
+	if _, err := s.Write([]byte(testBatch)); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(failures) != 1 {
+		t.Fatalf("Unexpected reported failures: %v.", failures)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	received := []string{}
+	for i := 0; i < 4; i++ {
+		received = append(received, server.next(t)[2].(map[string]interface{})["message"].(string))
+	}
+	if fmt.Sprint(received) != "[first second second third]" {
+		t.Fatalf("Unexpected received logs: %q.", received)
+	}
+}
+
+// TestMaxBuffered verifies that the oldest unsent logs are dropped beyond
+// the maximum.
+func TestMaxBuffered(t *testing.T) {
+	server := newFakeServer(t, false, 0)
+	address := server.listener.Addr().String()
+	server.close()
+
+	var failures int
+	s := NewStream(address).SetMaxAttempts(1).SetBufferLimit(2).SetMaxBuffered(3)
+	s.SetFatalFn(func(err error) {
+		failures++
+	})
+	for i := 0; i < 3; i++ {
+		if _, err := s.Write([]byte(`{"message":"a"}` + "\n" + `{"message":"b"}`)); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+	}
+	if failures != 3 || s.Dropped() != 3 {
+		t.Fatalf("Unexpected failures and drops. Found: %d, %d.", failures, s.Dropped())
+	}
+	if err := s.Flush(); err == nil {
+		t.Fatalf("An error was expected!")
+	}
+}
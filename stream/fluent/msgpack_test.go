@@ -0,0 +1,88 @@
+package fluent
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMsgpackRoundTrip verifies that encoded values are decoded back to the
+// expected Go values.
+func TestMsgpackRoundTrip(t *testing.T) {
+	longString := strings.Repeat("x", 300)
+	now := time.Date(2017, time.January, 3, 10, 23, 34, 200, time.UTC)
+
+	b := appendArrayHeader(nil, 16)
+	// Nil, true and false are only decoded.
+	b = append(b, 0xc0, 0xc3, 0xc2)
+	b = appendInt(b, 5)
+	b = appendInt(b, -5)
+	b = appendInt(b, -200)
+	b = appendInt(b, math.MinInt32)
+	b = appendInt(b, math.MinInt64)
+	b = appendUint(b, 200)
+	b = appendUint(b, math.MaxUint16)
+	b = appendUint(b, math.MaxUint64)
+	// 64 bit float 1.5, only decoded.
+	b = append(b, 0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0)
+	b = appendString(b, longString)
+	b = appendBinary(b, []byte("bin"))
+	b = appendEventTime(b, now)
+	b = appendStringMap(b, map[string]string{"a": "b"})
+
+	value, err := newDecoder(bytes.NewReader(b)).decode()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	expected := []interface{}{
+		nil, true, false, int64(5), int64(-5), int64(-200), int64(math.MinInt32), int64(math.MinInt64),
+		uint64(200), uint64(math.MaxUint16), uint64(math.MaxUint64), 1.5, longString, []byte("bin"), now,
+		map[string]interface{}{"a": "b"},
+	}
+	if !reflect.DeepEqual(value, expected) {
+		t.Fatalf("Unexpected decoded value. Expected: %+v - Found: %+v.", expected, value)
+	}
+}
+
+// TestMsgpackLargeContainers verifies the 16 bit container headers.
+func TestMsgpackLargeContainers(t *testing.T) {
+	m := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		m[string(rune('a'+i))] = "v"
+	}
+	b := appendArrayHeader(nil, 20)
+	for i := 0; i < 20; i++ {
+		b = appendInt(b, int64(i))
+	}
+	b = appendStringMap(b, m)
+
+	d := newDecoder(bytes.NewReader(b))
+	array, err := d.decode()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(array.([]interface{})) != 20 {
+		t.Fatalf("Unexpected array length: %d.", len(array.([]interface{})))
+	}
+	decodedMap, err := d.decode()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(decodedMap.(map[string]interface{})) != 20 {
+		t.Fatalf("Unexpected map length: %d.", len(decodedMap.(map[string]interface{})))
+	}
+}
+
+// TestMsgpackDecodeFailures verifies truncated and unsupported inputs.
+func TestMsgpackDecodeFailures(t *testing.T) {
+	if _, err := newDecoder(bytes.NewReader([]byte{0xa5, 'a'})).decode(); err == nil {
+		t.Fatalf("Truncated string should have failed.")
+	}
+	if _, err := newDecoder(bytes.NewReader([]byte{0xc1})).decode(); err == nil {
+		t.Fatalf("Unsupported type byte should have failed.")
+	}
+}
@@ -0,0 +1,220 @@
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTokenLeeway defines how long before its expiry a token is refreshed.
+const DefaultTokenLeeway = 30 * time.Second
+
+// Default header names used by HMACAuth.
+const (
+	DefaultSignatureHeader = "X-Signature"
+	DefaultTimestampHeader = "X-Timestamp"
+)
+
+// Authenticator adds credentials to the requests performed by the stream. It
+// is invoked for every attempt with the body actually sent, after the
+// compression.
+type Authenticator interface {
+	Authenticate(request *http.Request, body []byte) error
+}
+
+// AuthenticatorFunc is an adapter allowing to use ordinary functions as
+// Authenticator.
+type AuthenticatorFunc func(request *http.Request, body []byte) error
+
+// Authenticate function defined to implement the Authenticator interface.
+func (f AuthenticatorFunc) Authenticate(request *http.Request, body []byte) error {
+	return f(request, body)
+}
+
+// SetAuth sets the Authenticator applied to every request attempt.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (h *Stream) SetAuth(auth Authenticator) *Stream {
+	h.auth = auth
+	return h
+}
+
+// BasicAuth returns an Authenticator using HTTP basic authentication.
+func BasicAuth(username, password string) Authenticator {
+	return AuthenticatorFunc(func(request *http.Request, body []byte) error {
+		request.SetBasicAuth(username, password)
+		return nil
+	})
+}
+
+// BearerAuth returns an Authenticator sending provided static bearer token.
+func BearerAuth(token string) Authenticator {
+	return AuthenticatorFunc(func(request *http.Request, body []byte) error {
+		request.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	})
+}
+
+// TokenAuth is an Authenticator sending a bearer token obtained from a
+// callback and cached until shortly before its expiry. The token is also
+// discarded when the endpoint answers `401 Unauthorized`.
+type TokenAuth struct {
+	fetch  func() (string, time.Time, error) // Callback providing token and expiry;
+	leeway time.Duration                     // Time before expiry the token is refreshed;
+	token  string                            // Cached token;
+	expiry time.Time                         // Expiry of the cached token;
+	mutex  sync.Mutex                        // Mutex for the cached token.
+}
+
+// NewTokenAuth creates a new TokenAuth using provided callback, returning
+// the token and its expiry (zero when it never expires), to obtain tokens.
+func NewTokenAuth(fetch func() (string, time.Time, error)) *TokenAuth {
+	return &TokenAuth{fetch: fetch, leeway: DefaultTokenLeeway}
+}
+
+// SetLeeway sets how long before its expiry a token is refreshed, by default
+// DefaultTokenLeeway.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (a *TokenAuth) SetLeeway(leeway time.Duration) *TokenAuth {
+	if leeway >= 0 {
+		a.leeway = leeway
+	}
+	return a
+}
+
+// Authenticate function defined to implement the Authenticator interface.
+func (a *TokenAuth) Authenticate(request *http.Request, body []byte) error {
+	token, err := a.Token()
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// Token returns the cached token, obtaining a new one when missing or about
+// to expire.
+func (a *TokenAuth) Token() (string, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.token != "" && (a.expiry.IsZero() || time.Now().Add(a.leeway).Before(a.expiry)) {
+		return a.token, nil
+	}
+
+	token, expiry, err := a.fetch()
+	if err != nil {
+		return "", fmt.Errorf("token refresh failed due to: %s", err.Error())
+	}
+	if token == "" {
+		return "", errors.New("token refresh returned an empty token")
+	}
+	a.token, a.expiry = token, expiry
+	return token, nil
+}
+
+// Invalidate discards the cached token so that the next request obtains a
+// new one.
+func (a *TokenAuth) Invalidate() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.token = ""
+}
+
+// ClientCredentialsAuth returns a TokenAuth obtaining its tokens through the
+// OAuth2 client credentials grant (RFC 6749, section 4.4) from provided
+// token URL. The client credentials are sent with HTTP basic authentication
+// and the token expiry is taken from the `expires_in` field. A nil client
+// selects the default HTTP client.
+func ClientCredentialsAuth(client *http.Client, tokenURL, clientID, clientSecret string, scopes ...string) *TokenAuth {
+	if client == nil {
+		client = &http.Client{Timeout: DefaultTimeout}
+	}
+	return NewTokenAuth(func() (string, time.Time, error) {
+		form := url.Values{"grant_type": {"client_credentials"}}
+		if len(scopes) > 0 {
+			form.Set("scope", strings.Join(scopes, " "))
+		}
+		request, err := http.NewRequest(http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		request.Header.Set("Accept", "application/json")
+		request.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+
+		requested := time.Now()
+		response, err := client.Do(request)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		defer response.Body.Close()
+
+		payload, err := ioutil.ReadAll(io.LimitReader(response.Body, 1<<20))
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		if response.StatusCode != http.StatusOK {
+			return "", time.Time{}, fmt.Errorf("unexpected status `%s`: %s", response.Status, strings.TrimSpace(string(payload)))
+		}
+
+		token := struct {
+			AccessToken string      `json:"access_token"`
+			TokenType   string      `json:"token_type"`
+			ExpiresIn   json.Number `json:"expires_in"`
+		}{}
+		if err := json.Unmarshal(payload, &token); err != nil {
+			return "", time.Time{}, fmt.Errorf("invalid token response: %s", err.Error())
+		}
+		if token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer") {
+			return "", time.Time{}, fmt.Errorf("unsupported token type `%s`", token.TokenType)
+		}
+
+		var expiry time.Time
+		if seconds, err := strconv.ParseInt(token.ExpiresIn.String(), 10, 64); err == nil && seconds > 0 {
+			expiry = requested.Add(time.Duration(seconds) * time.Second)
+		}
+		return token.AccessToken, expiry, nil
+	})
+}
+
+// HMACAuth returns an Authenticator signing every request with HMAC-SHA256:
+// the timestamp header carries the current unix time in seconds and the
+// signature header `sha256=<hex digest>` of the timestamp, a `.` and the
+// body. Empty header names select DefaultSignatureHeader and
+// DefaultTimestampHeader.
+func HMACAuth(secret []byte, signatureHeader, timestampHeader string) Authenticator {
+	if signatureHeader == "" {
+		signatureHeader = DefaultSignatureHeader
+	}
+	if timestampHeader == "" {
+		timestampHeader = DefaultTimestampHeader
+	}
+	return AuthenticatorFunc(func(request *http.Request, body []byte) error {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		request.Header.Set(timestampHeader, timestamp)
+		request.Header.Set(signatureHeader, HMACSignature(secret, timestamp, body))
+		return nil
+	})
+}
+
+// HMACSignature computes the signature sent by HMACAuth, allowing receivers
+// to verify the requests.
+func HMACSignature(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
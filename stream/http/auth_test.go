@@ -0,0 +1,154 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestStaticAuth verifies the basic and bearer authenticators.
+func TestStaticAuth(t *testing.T) {
+	headers := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Get("Authorization")
+	}))
+	defer ts.Close()
+
+	cases := map[string]Authenticator{
+		"Basic dXNlcjpwYXNz": BasicAuth("user", "pass"),
+		"Bearer token":       BearerAuth("token"),
+	}
+	for expected, auth := range cases {
+		s := NewStream(ts.URL).SetAuth(auth)
+		if err := deliverBody(s, []byte("hey")); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if header := <-headers; header != expected {
+			t.Fatalf("Unexpected authorization. Expected: `%s` - Found: `%s`.", expected, header)
+		}
+	}
+
+	s := NewStream(ts.URL).SetAuth(AuthenticatorFunc(func(*http.Request, []byte) error {
+		return errors.New("no credentials")
+	}))
+	if err := deliverBody(s, []byte("hey")); err == nil || err.Error() != "request authentication failed due to: no credentials" {
+		t.Fatalf("Unexpected error: %v.", err)
+	}
+}
+
+// TestTokenAuth verifies the token caching, refresh before expiry and
+// invalidation on `401 Unauthorized`.
+func TestTokenAuth(t *testing.T) {
+	fetches := 0
+	expiry := time.Now().Add(time.Hour)
+	auth := NewTokenAuth(func() (string, time.Time, error) {
+		fetches++
+		return fmt.Sprintf("token-%d", fetches), expiry, nil
+	})
+
+	mtx := &sync.Mutex{}
+	rejected := map[string]bool{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if rejected[r.Header.Get("Authorization")] {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+
+	s := NewStream(ts.URL).SetAuth(auth).SetRetryPolicy(RetryPolicy{MaxAttempts: 2, RetryableStatuses: []int{http.StatusUnauthorized}})
+	deliverBody(s, nil)
+	deliverBody(s, nil)
+	if fetches != 1 {
+		t.Fatalf("The token should have been cached. Fetches: %d.", fetches)
+	}
+
+	// Revoked tokens are replaced by the following attempt.
+	mtx.Lock()
+	rejected["Bearer token-1"] = true
+	mtx.Unlock()
+	if failure := s.deliver(encodeRecord(nil, nil)); failure != nil || fetches != 2 {
+		t.Fatalf("Unexpected result: %+v, %d fetches.", failure, fetches)
+	}
+
+	// Tokens about to expire are refreshed.
+	expiry = time.Now().Add(10 * time.Second)
+	auth.Invalidate()
+	auth.Token()
+	if token, _ := auth.Token(); token != "token-4" {
+		t.Fatalf("Tokens within the leeway should be refreshed. Found: %s.", token)
+	}
+	auth.SetLeeway(0)
+	if token, _ := auth.Token(); token != "token-4" {
+		t.Fatalf("Valid tokens should be cached. Found: %s.", token)
+	}
+
+	failing := NewTokenAuth(func() (string, time.Time, error) { return "", time.Time{}, nil })
+	if _, err := failing.Token(); err == nil {
+		t.Fatalf("Empty tokens should fail.")
+	}
+}
+
+// TestClientCredentialsAuth verifies the OAuth2 client credentials grant.
+func TestClientCredentialsAuth(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		user, pass, _ := r.BasicAuth()
+		if user != "client" || pass != "s3cr3t" || r.PostForm.Get("grant_type") != "client_credentials" || r.PostForm.Get("scope") != "logs:write audit" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"invalid_client"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"granted","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer ts.Close()
+
+	auth := ClientCredentialsAuth(nil, ts.URL, "client", "s3cr3t", "logs:write", "audit")
+	if token, err := auth.Token(); err != nil || token != "granted" {
+		t.Fatalf("Unexpected token: `%s` (%v).", token, err)
+	}
+	if auth.expiry.Before(time.Now().Add(59*time.Minute)) || auth.expiry.After(time.Now().Add(time.Hour)) {
+		t.Fatalf("Unexpected expiry: %s.", auth.expiry)
+	}
+
+	auth = ClientCredentialsAuth(nil, ts.URL, "client", "wrong")
+	if _, err := auth.Token(); err == nil {
+		t.Fatalf("Invalid credentials should fail.")
+	}
+}
+
+// TestHMACAuth verifies that the signature covers timestamp and the body
+// actually sent.
+func TestHMACAuth(t *testing.T) {
+	secret := []byte("shared")
+	verified := make(chan bool, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		timestamp := r.Header.Get("X-Time")
+		unix, _ := strconv.ParseInt(timestamp, 10, 64)
+		verified <- time.Since(time.Unix(unix, 0)) < time.Minute &&
+			r.Header.Get(DefaultSignatureHeader) == HMACSignature(secret, timestamp, body) &&
+			r.Header.Get("Content-Encoding") == "gzip"
+	}))
+	defer ts.Close()
+
+	s := NewStream(ts.URL).SetCompression(Gzip, 0).SetAuth(HMACAuth(secret, "", "X-Time"))
+	if err := deliverBody(s, []byte("signed")); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if !<-verified {
+		t.Fatalf("Invalid signature.")
+	}
+
+	if HMACSignature(secret, "1", []byte("a")) == HMACSignature(secret, "2", []byte("a")) {
+		t.Fatalf("The timestamp should be signed.")
+	}
+}
@@ -0,0 +1,274 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"gonyan"
+)
+
+// BatchEncoding defines how the logs of a batch are encoded in the request
+// body.
+type BatchEncoding int
+
+// Supported batch encodings:
+//
+//   - NoBatching: batching disabled, every Write results in a request;
+//   - NDJSON: one log per line (`application/x-ndjson`);
+//   - JSONArray: a JSON array of logs (`application/json`);
+//   - Wrapped: a JSON object holding the array of logs under the wrapper
+//     key, `{"logs":[...]}` by default (`application/json`).
+const (
+	NoBatching BatchEncoding = iota
+	NDJSON     BatchEncoding = iota
+	JSONArray  BatchEncoding = iota
+	Wrapped    BatchEncoding = iota
+)
+
+// DefaultBatchEntries defines the default maximum number of logs per batch.
+const DefaultBatchEntries = 500
+
+// DefaultBatchBytes defines the default maximum size of a batch body.
+const DefaultBatchBytes = 1 << 20
+
+// DefaultBatchLinger defines the default maximum time a log waits for its
+// batch to be completed.
+const DefaultBatchLinger = time.Second
+
+// DefaultBatchSeparator defines the default separator of the logs written
+// together, the one used by gonyan.BufferedStream by default.
+const DefaultBatchSeparator = '\n'
+
+// DefaultWrapperKey defines the default key of the logs array in Wrapped
+// bodies.
+const DefaultWrapperKey = "logs"
+
+// contentType returns the Content-Type of the bodies using the encoding.
+func (e BatchEncoding) contentType() string {
+	if e == NDJSON {
+		return "application/x-ndjson"
+	}
+	return "application/json"
+}
+
+// EnableBatching makes the stream collect the written logs and send them in
+// batches using provided encoding; NoBatching disables it. The Content-Type
+// header is set accordingly unless explicitly provided. Logs written
+// together, such as the ones flushed by a gonyan.BufferedStream, are split
+// on the separator set with SetBatchSeparator.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (h *Stream) EnableBatching(encoding BatchEncoding) *Stream {
+	h.batchEncoding = encoding
+	return h
+}
+
+// SetBatchSeparator sets the byte separating the logs written together, by
+// default DefaultBatchSeparator; the logs are split when batching or
+// rendering templates. It must match the separator of the
+// gonyan.BufferedStream writing to the stream, set with its
+// SetFlatBufferSeparator method, otherwise whole transmissions are batched
+// as single logs. See SetFramer for framed transmissions.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (h *Stream) SetBatchSeparator(separator byte) *Stream {
+	h.batchSeparator = separator
+	return h
+}
+
+// SetFramer sets the gonyan.Framer splitting the logs written together in
+// place of the batch separator, which is used again when provided framer is
+// nil. It must match the framer of the gonyan.BufferedStream writing to the
+// stream, set with its SetFramer method.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (h *Stream) SetFramer(framer gonyan.Framer) *Stream {
+	h.framer = framer
+	return h
+}
+
+// splitLogs splits provided bytes into the logs written together, skipping
+// the empty ones.
+func (h *Stream) splitLogs(messageBytes []byte) ([][]byte, error) {
+	entries := [][]byte{}
+	if h.framer != nil {
+		messages, err := gonyan.Deframe(messageBytes, h.framer)
+		if err != nil {
+			return nil, fmt.Errorf("deframing failed due to: %s", err.Error())
+		}
+		for _, entry := range messages {
+			if len(entry) > 0 {
+				entries = append(entries, entry)
+			}
+		}
+		return entries, nil
+	}
+	for _, entry := range bytes.Split(messageBytes, []byte{h.batchSeparator}) {
+		if entry = bytes.TrimSpace(entry); len(entry) > 0 {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// SetBatchLimits sets the maximum number of logs and the maximum body size,
+// in bytes, of a batch: a batch reaching either is sent immediately. Logs
+// exceeding the size on their own are sent alone. Non-positive values are
+// ignored.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (h *Stream) SetBatchLimits(maxEntries, maxBytes int) *Stream {
+	if maxEntries > 0 {
+		h.batchMaxEntries = maxEntries
+	}
+	if maxBytes > 0 {
+		h.batchMaxBytes = maxBytes
+	}
+	return h
+}
+
+// SetBatchLinger sets the maximum time a log waits for its batch to be
+// completed before the batch is sent anyway.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (h *Stream) SetBatchLinger(linger time.Duration) *Stream {
+	if linger > 0 {
+		h.batchLinger = linger
+	}
+	return h
+}
+
+// SetWrapperKey sets the key holding the array of logs in Wrapped bodies.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (h *Stream) SetWrapperKey(key string) *Stream {
+	h.batchWrapperKey = key
+	return h
+}
+
+// Flush immediately sends the pending batch, if any.
+func (h *Stream) Flush() error {
+	h.batchMutex.Lock()
+	defer h.batchMutex.Unlock()
+	return h.submitBatch()
+}
+
+// addToBatch appends provided log, to be sent to provided rendered target,
+// to the pending batch, sending the batches completed meanwhile. Batches are
+// submitted holding the lock so that they are queued in order.
+func (h *Stream) addToBatch(entry []byte, t *target) error {
+	h.batchMutex.Lock()
+	defer h.batchMutex.Unlock()
+
+	if len(h.batchEntries) > 0 && (!sameTarget(t, h.batchTarget) || h.encodedSize(len(h.batchEntries)+1, h.batchSize+len(entry)) > h.batchMaxBytes) {
+		if err := h.submitBatch(); err != nil {
+			return err
+		}
+	}
+
+	// Entries are copied as the caller may reuse its buffer.
+	h.batchEntries = append(h.batchEntries, append([]byte(nil), entry...))
+	h.batchSize += len(entry)
+	h.batchTarget = t
+	if len(h.batchEntries) >= h.batchMaxEntries || h.encodedSize(len(h.batchEntries), h.batchSize) >= h.batchMaxBytes {
+		if err := h.submitBatch(); err != nil {
+			return err
+		}
+	}
+	if len(h.batchEntries) > 0 && h.batchTimer == nil {
+		generation := h.batchGeneration
+		h.batchTimer = time.AfterFunc(h.batchLinger, func() {
+			h.lingerExpired(generation)
+		})
+	}
+	return nil
+}
+
+// lingerExpired sends the batch identified by provided generation, unless
+// it has already been sent.
+func (h *Stream) lingerExpired(generation uint64) {
+	h.batchMutex.Lock()
+	defer h.batchMutex.Unlock()
+	if generation != h.batchGeneration {
+		return
+	}
+	t := h.batchTarget
+	if body := h.takeBatch(); body != nil {
+		if _, err := h.submit(body, t); err != nil {
+			h.reportFailure(&Failure{Body: body, Err: err})
+		}
+	}
+}
+
+// submitBatch encodes and submits the pending batch, if any. It *must* be
+// called holding the batch lock.
+func (h *Stream) submitBatch() error {
+	t := h.batchTarget
+	body := h.takeBatch()
+	if body == nil {
+		return nil
+	}
+	_, err := h.submit(body, t)
+	return err
+}
+
+// takeBatch encodes and resets the pending batch, returning nil when empty.
+// It *must* be called holding the batch lock.
+func (h *Stream) takeBatch() []byte {
+	if h.batchTimer != nil {
+		h.batchTimer.Stop()
+		h.batchTimer = nil
+	}
+	h.batchGeneration++
+	if len(h.batchEntries) == 0 {
+		return nil
+	}
+
+	body := bytes.NewBuffer(make([]byte, 0, h.encodedSize(len(h.batchEntries), h.batchSize)))
+	switch h.batchEncoding {
+	case NDJSON:
+		for _, entry := range h.batchEntries {
+			body.Write(entry)
+			body.WriteByte('\n')
+		}
+	default:
+		if h.batchEncoding == Wrapped {
+			key, _ := json.Marshal(h.batchWrapperKey)
+			body.WriteByte('{')
+			body.Write(key)
+			body.WriteByte(':')
+		}
+		body.WriteByte('[')
+		for i, entry := range h.batchEntries {
+			if i > 0 {
+				body.WriteByte(',')
+			}
+			body.Write(entry)
+		}
+		body.WriteByte(']')
+		if h.batchEncoding == Wrapped {
+			body.WriteByte('}')
+		}
+	}
+
+	h.batchEntries = nil
+	h.batchSize = 0
+	h.batchTarget = nil
+	return body.Bytes()
+}
+
+// encodedSize returns the body size of a batch of provided number of logs
+// whose total size is provided.
+func (h *Stream) encodedSize(entries, size int) int {
+	switch h.batchEncoding {
+	case NDJSON:
+		return size + entries
+	case Wrapped:
+		// `{"key":[` and `]}` around the array.
+		return size + entries - 1 + 2 + len(h.batchWrapperKey) + 4
+	default:
+		return size + entries - 1 + 2
+	}
+}
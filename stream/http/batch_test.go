@@ -0,0 +1,182 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gonyan"
+)
+
+// batchRecorder records the received bodies and content types.
+type batchRecorder struct {
+	mutex        sync.Mutex
+	bodies       []string
+	contentTypes []string
+}
+
+func (rec *batchRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	payload, _ := ioutil.ReadAll(r.Body)
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	rec.bodies = append(rec.bodies, string(payload))
+	rec.contentTypes = append(rec.contentTypes, r.Header.Get("Content-Type"))
+}
+
+// TestBatchEncodings verifies the body produced by each encoding.
+func TestBatchEncodings(t *testing.T) {
+	cases := []struct {
+		encoding    BatchEncoding
+		contentType string
+		expected    string
+	}{
+		{NDJSON, "application/x-ndjson", "{\"m\":1}\n{\"m\":2}\n{\"m\":3}\n"},
+		{JSONArray, "application/json", `[{"m":1},{"m":2},{"m":3}]`},
+		{Wrapped, "application/json", `{"entries":[{"m":1},{"m":2},{"m":3}]}`},
+	}
+	for _, c := range cases {
+		rec := &batchRecorder{}
+		ts := httptest.NewServer(rec)
+		s := NewStream(ts.URL).EnableBatching(c.encoding).SetWrapperKey("entries").EnableOrdering()
+
+		s.Write([]byte(`{"m":1}`))
+		// Logs flushed together by a BufferedStream.
+		s.Write([]byte("{\"m\":2}\n{\"m\":3}\n"))
+		if err := s.Close(); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		ts.Close()
+
+		if len(rec.bodies) != 1 || rec.bodies[0] != c.expected {
+			t.Fatalf("Encoding %d: unexpected bodies: %q.", c.encoding, rec.bodies)
+		}
+		if rec.contentTypes[0] != c.contentType {
+			t.Fatalf("Encoding %d: unexpected content type: %s.", c.encoding, rec.contentTypes[0])
+		}
+		if c.encoding != NDJSON && !json.Valid([]byte(rec.bodies[0])) {
+			t.Fatalf("Encoding %d: invalid JSON body.", c.encoding)
+		}
+	}
+}
+
+// TestBatchSeparator verifies that logs written together are split on the
+// configured separator.
+func TestBatchSeparator(t *testing.T) {
+	rec := &batchRecorder{}
+	ts := httptest.NewServer(rec)
+	defer ts.Close()
+
+	s := NewStream(ts.URL).EnableBatching(JSONArray).SetBatchSeparator(0).EnableOrdering()
+	s.Write([]byte("{\"m\":1}\x00{\"m\":2}\x00"))
+	s.Close()
+	if len(rec.bodies) != 1 || rec.bodies[0] != `[{"m":1},{"m":2}]` {
+		t.Fatalf("Unexpected bodies: %q.", rec.bodies)
+	}
+}
+
+// TestBatchFramer verifies that logs written together are split by the
+// framer, when set.
+func TestBatchFramer(t *testing.T) {
+	rec := &batchRecorder{}
+	ts := httptest.NewServer(rec)
+	defer ts.Close()
+
+	framer := gonyan.LengthPrefixFramer{}
+	s := NewStream(ts.URL).EnableBatching(JSONArray).SetFramer(framer).EnableOrdering()
+	if _, err := s.Write(framer.Frame([][]byte{[]byte(`{"m":"a\nb"}`), []byte(`{"m":2}`)})); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if _, err := s.Write([]byte{0, 0, 0, 9, '{'}); err == nil {
+		t.Fatalf("Truncated payloads should fail.")
+	}
+	s.Close()
+	if len(rec.bodies) != 1 || rec.bodies[0] != `[{"m":"a\nb"},{"m":2}]` {
+		t.Fatalf("Unexpected bodies: %q.", rec.bodies)
+	}
+}
+
+// TestBatchLimits verifies that batches are split by number of logs and by
+// size, and that the linger time sends incomplete batches.
+func TestBatchLimits(t *testing.T) {
+	rec := &batchRecorder{}
+	ts := httptest.NewServer(rec)
+	defer ts.Close()
+
+	// Each log is 9 bytes, a 3 logs array is 31 bytes.
+	s := NewStream(ts.URL).EnableBatching(JSONArray).SetBatchLimits(4, 31).SetBatchLinger(50 * time.Millisecond).EnableOrdering()
+	s.SetHeader("Content-Type", "application/vnd.custom+json")
+	for i := 0; i < 7; i++ {
+		s.Write([]byte(fmt.Sprintf(`{"m":%03d}`, i)))
+	}
+	// A log larger than the limit is sent alone.
+	s.Write([]byte(`{"m":"` + strings.Repeat("x", 40) + `"}`))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		rec.mutex.Lock()
+		received := len(rec.bodies)
+		rec.mutex.Unlock()
+		if received == 4 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Close()
+
+	rec.mutex.Lock()
+	expected := []string{
+		`[{"m":000},{"m":001},{"m":002}]`,
+		`[{"m":003},{"m":004},{"m":005}]`,
+		`[{"m":006}]`,
+		`[{"m":"` + strings.Repeat("x", 40) + `"}]`,
+	}
+	if fmt.Sprint(rec.bodies) != fmt.Sprint(expected) {
+		t.Fatalf("Unexpected bodies: %q.", rec.bodies)
+	}
+	if rec.contentTypes[0] != "application/vnd.custom+json" {
+		t.Fatalf("Explicit content types should be kept. Found: %s.", rec.contentTypes[0])
+	}
+
+	rec.bodies = nil
+	rec.mutex.Unlock()
+
+	// Batches are also bound by the number of logs.
+	s = NewStream(ts.URL).EnableBatching(NDJSON).SetBatchLimits(2, 0).EnableOrdering()
+	s.Write([]byte("a\nb\nc\n"))
+	s.Close()
+
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	if fmt.Sprint(rec.bodies) != fmt.Sprint([]string{"a\nb\n", "c\n"}) {
+		t.Fatalf("Unexpected bodies: %q.", rec.bodies)
+	}
+}
+
+// TestBatchLinger verifies that incomplete batches are sent after the linger
+// time, each batch using the prepared body.
+func TestBatchLinger(t *testing.T) {
+	rec := &batchRecorder{}
+	ts := httptest.NewServer(rec)
+	defer ts.Close()
+
+	s := NewStream(ts.URL).EnableBatching(NDJSON).SetBatchLinger(50 * time.Millisecond)
+	s.SetCustomBodyPrepareFunction(func(in []byte) ([]byte, error) {
+		return append([]byte("# batch\n"), in...), nil
+	})
+	defer s.Close()
+	s.Write([]byte("a"))
+	s.Write([]byte("b"))
+	time.Sleep(500 * time.Millisecond)
+
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	if fmt.Sprint(rec.bodies) != fmt.Sprint([]string{"# batch\na\nb\n"}) {
+		t.Fatalf("Unexpected bodies: %q.", rec.bodies)
+	}
+}
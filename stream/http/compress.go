@@ -0,0 +1,127 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Compression defines the algorithm used to compress the request bodies.
+type Compression int
+
+// Supported compression algorithms:
+//
+//   - NoCompression: bodies are sent as they are;
+//   - Gzip: `Content-Encoding: gzip` (RFC 1952);
+//   - Deflate: `Content-Encoding: deflate`, the zlib format (RFC 1950).
+const (
+	NoCompression Compression = iota
+	Gzip          Compression = iota
+	Deflate       Compression = iota
+)
+
+// DefaultCompressionMinSize defines the default size, in bytes, below which
+// bodies are not compressed.
+const DefaultCompressionMinSize = 1024
+
+// SetCompression enables the compression of the bodies whose size reaches
+// minSize bytes, setting the Content-Encoding header accordingly. Bodies
+// are compressed after the custom body prepare function, if any, and after
+// the batch encoding. A negative minSize selects DefaultCompressionMinSize.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (h *Stream) SetCompression(compression Compression, minSize int) *Stream {
+	if minSize < 0 {
+		minSize = DefaultCompressionMinSize
+	}
+	h.compression = compression
+	h.compressionMin = minSize
+	return h
+}
+
+// compress compresses provided body according to the stream settings,
+// returning the resulting Content-Encoding, empty when not compressed.
+func (h *Stream) compress(body []byte) ([]byte, string, error) {
+	if h.compression == NoCompression || len(body) < h.compressionMin {
+		return body, "", nil
+	}
+
+	var buffer bytes.Buffer
+	var writer io.WriteCloser
+	var encoding string
+	switch h.compression {
+	case Gzip:
+		writer, encoding = gzip.NewWriter(&buffer), "gzip"
+	case Deflate:
+		writer, encoding = zlib.NewWriter(&buffer), "deflate"
+	default:
+		return nil, "", fmt.Errorf("unsupported compression %d", h.compression)
+	}
+	if _, err := writer.Write(body); err != nil {
+		return nil, "", fmt.Errorf("body compression failed due to: %s", err.Error())
+	}
+	if err := writer.Close(); err != nil {
+		return nil, "", fmt.Errorf("body compression failed due to: %s", err.Error())
+	}
+	return buffer.Bytes(), encoding, nil
+}
+
+// DecompressReader wraps provided body with a reader decoding provided
+// Content-Encoding: `gzip`, `deflate` (zlib or, as sent by some clients, raw
+// deflate) or `identity`/empty, which return the body as it is.
+func DecompressReader(body io.Reader, contentEncoding string) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "", "identity":
+		return ioutil.NopCloser(body), nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+	case "deflate":
+		buffered := bufio.NewReader(body)
+		header, err := buffered.Peek(2)
+		if err == nil && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 && header[0]&0x0f == 8 {
+			return zlib.NewReader(buffered)
+		}
+		return flate.NewReader(buffered), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding `%s`", contentEncoding)
+	}
+}
+
+// ReadBody reads the whole body of provided request decompressing it
+// according to its Content-Encoding header.
+func ReadBody(r *http.Request) ([]byte, error) {
+	reader, err := DecompressReader(r.Body, r.Header.Get("Content-Encoding"))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// DecompressHandler wraps provided handler transparently decompressing the
+// request bodies, so that it can be used by test servers and collectors
+// receiving logs from compressing streams. Requests with an unsupported or
+// invalid encoding are answered with `415 Unsupported Media Type`.
+func DecompressHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reader, err := DecompressReader(r.Body, r.Header.Get("Content-Encoding"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+		defer reader.Close()
+
+		r.Body = reader
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,101 @@
+package http
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestCompress verifies the compression threshold and the round trip of
+// each algorithm through DecompressReader.
+func TestCompress(t *testing.T) {
+	body := []byte(strings.Repeat(`{"message":"compress me"}`+"\n", 100))
+	cases := []struct {
+		compression Compression
+		encoding    string
+	}{
+		{Gzip, "gzip"},
+		{Deflate, "deflate"},
+	}
+	for _, c := range cases {
+		s := NewStream("").SetCompression(c.compression, -1)
+		payload, encoding, err := s.compress(body)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if encoding != c.encoding || len(payload) >= len(body) {
+			t.Fatalf("Unexpected compression result: `%s`, %d bytes.", encoding, len(payload))
+		}
+		reader, err := DecompressReader(bytes.NewReader(payload), encoding)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if decompressed, _ := ioutil.ReadAll(reader); !bytes.Equal(decompressed, body) {
+			t.Fatalf("Unexpected round trip result for `%s`.", encoding)
+		}
+
+		payload, encoding, _ = s.compress([]byte("small"))
+		if encoding != "" || string(payload) != "small" {
+			t.Fatalf("Bodies below the threshold should not be compressed.")
+		}
+	}
+
+	// Raw deflate streams are accepted too.
+	var buffer bytes.Buffer
+	writer, _ := flate.NewWriter(&buffer, flate.DefaultCompression)
+	writer.Write(body)
+	writer.Close()
+	reader, _ := DecompressReader(&buffer, "deflate")
+	if decompressed, _ := ioutil.ReadAll(reader); !bytes.Equal(decompressed, body) {
+		t.Fatalf("Unexpected raw deflate round trip result.")
+	}
+
+	if _, err := DecompressReader(&buffer, "br"); err == nil {
+		t.Fatalf("Unsupported encodings should fail.")
+	}
+}
+
+// TestWriteCompressed verifies that prepared bodies are compressed and
+// decoded by DecompressHandler.
+func TestWriteCompressed(t *testing.T) {
+	received := make(chan string, 1)
+	encodings := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodings <- r.Header.Get("Content-Encoding")
+		DecompressHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			payload, _ := ioutil.ReadAll(r.Body)
+			received <- string(payload)
+		})).ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	s := NewStream(ts.URL).SetCompression(Gzip, 10)
+	s.SetCustomBodyPrepareFunction(func(in []byte) ([]byte, error) {
+		return append([]byte("prepared: "), in...), nil
+	})
+	defer s.Close()
+	s.Write([]byte("hey ho, let's go"))
+
+	if encoding := <-encodings; encoding != "gzip" {
+		t.Fatalf("Unexpected content encoding: `%s`.", encoding)
+	}
+	if payload := <-received; payload != "prepared: hey ho, let's go" {
+		t.Fatalf("Unexpected payload: `%s`.", payload)
+	}
+
+	request, _ := http.NewRequest(http.MethodPost, ts.URL, strings.NewReader("not gzip"))
+	request.Header.Set("Content-Encoding", "gzip")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	response.Body.Close()
+	<-encodings
+	if response.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("Unexpected status: %d.", response.StatusCode)
+	}
+}
@@ -0,0 +1,237 @@
+package http
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// LoadBalancing defines how the endpoint of each request is selected when
+// the stream has multiple endpoints.
+type LoadBalancing int
+
+// Supported load balancing strategies:
+//
+//   - RoundRobin: endpoints are used in turn;
+//   - LeastPending: the endpoint with the fewest requests in flight is used,
+//     in turn among the equally loaded ones.
+const (
+	RoundRobin   LoadBalancing = iota
+	LeastPending LoadBalancing = iota
+)
+
+// DefaultEjectionThreshold defines the default number of consecutive failed
+// requests ejecting an endpoint.
+const DefaultEjectionThreshold = 3
+
+// DefaultEjectionTime defines the default time an endpoint stays ejected.
+const DefaultEjectionTime = 30 * time.Second
+
+// endpoint holds the state of one of the stream endpoints.
+type endpoint struct {
+	pending  int64     // Requests in flight, first for atomic alignment;
+	url      string    // Endpoint URL;
+	failures int       // Consecutive failed requests;
+	ejected  time.Time // Time the ejection expires, zero when healthy.
+}
+
+// EndpointStatus describes the state of an endpoint.
+type EndpointStatus struct {
+	URL      string    // Endpoint URL;
+	Pending  int       // Requests in flight;
+	Failures int       // Consecutive failed requests;
+	Ejected  time.Time // Time the ejection expires, zero when healthy.
+}
+
+// SetEndpoints makes the stream spread its requests over provided endpoint
+// URLs, replacing the one provided to NewStream, according to the load
+// balancing strategy. Endpoints failing repeatedly, with transport errors or
+// retryable statuses, are ejected for a while (see SetHealthCheck) and
+// retries are sent to the next endpoint. URL templates take precedence over
+// the endpoints.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (h *Stream) SetEndpoints(urls ...string) *Stream {
+	if len(urls) == 0 {
+		return h
+	}
+	endpoints := make([]*endpoint, len(urls))
+	for i, u := range urls {
+		endpoints[i] = &endpoint{url: u}
+	}
+	h.endpointMutex.Lock()
+	h.url = urls[0]
+	h.endpoints = endpoints
+	h.endpointMutex.Unlock()
+	return h
+}
+
+// SetLoadBalancing sets the strategy selecting the endpoint of each request,
+// by default RoundRobin.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (h *Stream) SetLoadBalancing(balancing LoadBalancing) *Stream {
+	h.endpointMutex.Lock()
+	h.balancing = balancing
+	h.endpointMutex.Unlock()
+	return h
+}
+
+// SetHealthCheck sets the number of consecutive failed requests ejecting an
+// endpoint and the time it stays ejected, by default
+// DefaultEjectionThreshold and DefaultEjectionTime; a zero threshold
+// disables the ejection. Ejected endpoints are only used when no healthy
+// one is left.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (h *Stream) SetHealthCheck(threshold int, ejection time.Duration) *Stream {
+	if threshold < 0 || ejection < 0 {
+		return h
+	}
+	h.endpointMutex.Lock()
+	h.ejectFailures = threshold
+	h.ejectDuration = ejection
+	h.endpointMutex.Unlock()
+	return h
+}
+
+// SetReplication makes the stream send each body, or batch, to provided
+// number of distinct endpoints for redundancy, by default 1. The replicas
+// are retried independently: the body is considered delivered when at
+// least one of them succeeds, the failed ones being reported to the failure
+// function anyway. Bodies with a templated URL are never replicated.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (h *Stream) SetReplication(replicas int) *Stream {
+	if replicas > 0 {
+		h.endpointMutex.Lock()
+		h.replicas = replicas
+		h.endpointMutex.Unlock()
+	}
+	return h
+}
+
+// Endpoints returns the state of the endpoints set with SetEndpoints.
+func (h *Stream) Endpoints() []EndpointStatus {
+	h.endpointMutex.Lock()
+	defer h.endpointMutex.Unlock()
+	now := time.Now()
+	statuses := make([]EndpointStatus, len(h.endpoints))
+	for i, e := range h.endpoints {
+		statuses[i] = EndpointStatus{
+			URL:      e.url,
+			Pending:  int(atomic.LoadInt64(&e.pending)),
+			Failures: e.failures,
+		}
+		if now.Before(e.ejected) {
+			statuses[i].Ejected = e.ejected
+		}
+	}
+	return statuses
+}
+
+// routed reports whether the endpoint of provided target is selected by the
+// stream rather than rendered by the URL template.
+func routed(t *target) bool {
+	return t == nil || t.url == ""
+}
+
+// pickReplicas selects the distinct endpoints the first attempts of provided
+// target are sent to; none is selected without endpoints or with a rendered
+// URL.
+func (h *Stream) pickReplicas(t *target) []*endpoint {
+	if !routed(t) {
+		return nil
+	}
+	h.endpointMutex.Lock()
+	replicas := h.replicas
+	if replicas > len(h.endpoints) {
+		replicas = len(h.endpoints)
+	}
+	h.endpointMutex.Unlock()
+
+	picked := make([]*endpoint, 0, replicas)
+	for len(picked) < replicas {
+		picked = append(picked, h.pickEndpoint(picked))
+	}
+	return picked
+}
+
+// pickEndpoint selects the endpoint of the next attempt, preferring healthy
+// endpoints not excluded, and counts the attempt as pending. It returns nil
+// without endpoints.
+func (h *Stream) pickEndpoint(exclude []*endpoint) *endpoint {
+	h.endpointMutex.Lock()
+	defer h.endpointMutex.Unlock()
+	count := len(h.endpoints)
+	if count == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	start := int(h.nextEndpoint % uint64(count))
+	h.nextEndpoint++
+	var best *endpoint
+	var bestHealthy bool
+	for i := 0; i < count; i++ {
+		e := h.endpoints[(start+i)%count]
+		if excluded(exclude, e) {
+			continue
+		}
+		healthy := !now.Before(e.ejected)
+		switch {
+		case best == nil, healthy && !bestHealthy:
+			best, bestHealthy = e, healthy
+		case healthy == bestHealthy && h.balancing == LeastPending && atomic.LoadInt64(&e.pending) < atomic.LoadInt64(&best.pending):
+			best = e
+		}
+		if bestHealthy && h.balancing == RoundRobin {
+			break
+		}
+	}
+	if best == nil {
+		// Every endpoint is excluded, the exclusion is ignored.
+		best = h.endpoints[start]
+	}
+	atomic.AddInt64(&best.pending, 1)
+	return best
+}
+
+// excluded reports whether provided endpoint is in the exclusion list.
+func excluded(exclude []*endpoint, e *endpoint) bool {
+	for _, other := range exclude {
+		if other == e {
+			return true
+		}
+	}
+	return false
+}
+
+// send performs a single request to provided endpoint, previously selected
+// by pickEndpoint, recording the outcome for the health checking. Without an
+// endpoint the URL provided to NewStream is used unless the target carries a
+// rendered one. It returns the endpoint URL.
+func (h *Stream) send(payload []byte, encoding string, t *target, e *endpoint) (string, error) {
+	if !routed(t) {
+		return t.url, h.sendRequest(payload, encoding, t, "")
+	}
+	if e == nil {
+		return h.url, h.sendRequest(payload, encoding, t, h.url)
+	}
+
+	err := h.sendRequest(payload, encoding, t, e.url)
+	atomic.AddInt64(&e.pending, -1)
+
+	statusErr, _ := err.(*StatusError)
+	h.endpointMutex.Lock()
+	defer h.endpointMutex.Unlock()
+	// Endpoints refusing a body are still healthy.
+	if err == nil || statusErr != nil && !h.retry.retryable(statusErr.StatusCode) {
+		e.failures = 0
+		return e.url, err
+	}
+	if e.failures++; h.ejectFailures > 0 && e.failures >= h.ejectFailures {
+		e.ejected = time.Now().Add(h.ejectDuration)
+		e.failures = 0
+	}
+	return e.url, err
+}
@@ -0,0 +1,166 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// endpointServers starts provided number of servers answering with the
+// status returned by the status function and counting their requests.
+func endpointServers(count int, status func(i int) int) ([]*httptest.Server, []int64) {
+	servers := make([]*httptest.Server, count)
+	requests := make([]int64, count)
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&requests[i], 1)
+			w.WriteHeader(status(i))
+		}))
+	}
+	return servers, requests
+}
+
+// TestRoundRobin verifies that the requests are spread over the endpoints.
+func TestRoundRobin(t *testing.T) {
+	servers, requests := endpointServers(3, func(int) int { return http.StatusOK })
+	s := NewStream("")
+	for _, ts := range servers {
+		defer ts.Close()
+	}
+	s.SetEndpoints(servers[0].URL, servers[1].URL, servers[2].URL)
+
+	for i := 0; i < 6; i++ {
+		if err := deliverBody(s, []byte("hey")); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+	}
+	for i := range requests {
+		if requests[i] != 2 {
+			t.Fatalf("Unexpected requests. Expected: 2 per endpoint - Found: %v.", requests)
+		}
+	}
+}
+
+// TestLeastPending verifies that the least loaded endpoint is selected and
+// that the pending requests are counted.
+func TestLeastPending(t *testing.T) {
+	s := NewStream("").SetEndpoints("a", "b", "c").SetLoadBalancing(LeastPending)
+	a := s.pickEndpoint(nil)
+	b := s.pickEndpoint(nil)
+	c := s.pickEndpoint(nil)
+	if a == b || b == c || a == c {
+		t.Fatalf("Unexpected selection: %s, %s, %s.", a.url, b.url, c.url)
+	}
+	atomic.AddInt64(&b.pending, -1)
+	if e := s.pickEndpoint(nil); e != b {
+		t.Fatalf("Unexpected selection. Expected: %s - Found: %s.", b.url, e.url)
+	}
+	if e := s.pickEndpoint([]*endpoint{a, b}); e != c {
+		t.Fatalf("Unexpected selection. Expected: %s - Found: %s.", c.url, e.url)
+	}
+	for _, status := range s.Endpoints() {
+		if status.URL == "c" && status.Pending != 2 {
+			t.Fatalf("Unexpected pending requests: %+v.", status)
+		}
+	}
+}
+
+// TestEjection verifies that failing endpoints are ejected and that retries
+// move to the next endpoint.
+func TestEjection(t *testing.T) {
+	servers, requests := endpointServers(2, func(i int) int {
+		if i == 0 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	})
+	for _, ts := range servers {
+		defer ts.Close()
+	}
+	s := NewStream("").SetEndpoints(servers[0].URL, servers[1].URL).SetHealthCheck(1, time.Hour)
+	s.SetRetryPolicy(RetryPolicy{MaxAttempts: 2, RetryableStatuses: []int{5}})
+
+	for i := 0; i < 4; i++ {
+		if failure := s.deliver(encodeRecord(nil, []byte("hey"))); failure != nil {
+			t.Fatalf("Unexpected failure: %s", failure.Err.Error())
+		}
+	}
+	if requests[0] != 1 || requests[1] != 4 {
+		t.Fatalf("Unexpected requests. Expected: [1 4] - Found: %v.", requests)
+	}
+	statuses := s.Endpoints()
+	if statuses[0].Ejected.IsZero() || !statuses[1].Ejected.IsZero() {
+		t.Fatalf("Unexpected endpoint statuses: %+v.", statuses)
+	}
+
+	// Ejected endpoints are used when no healthy one is left.
+	s.SetEndpoints(servers[0].URL).SetHealthCheck(1, time.Hour)
+	s.deliver(encodeRecord(nil, []byte("hey")))
+	if failure := s.deliver(encodeRecord(nil, []byte("hey"))); failure == nil || failure.Endpoint != servers[0].URL || requests[0] != 5 {
+		t.Fatalf("Unexpected failure: %+v - requests: %v.", failure, requests)
+	}
+}
+
+// TestReplication verifies that each body is sent to distinct endpoints and
+// that it is delivered when at least a replica succeeds.
+func TestReplication(t *testing.T) {
+	servers, requests := endpointServers(3, func(i int) int {
+		if i == 2 {
+			return http.StatusBadRequest
+		}
+		return http.StatusOK
+	})
+	for _, ts := range servers {
+		defer ts.Close()
+	}
+
+	var mutex sync.Mutex
+	var failures []*Failure
+	s := NewStream("").SetEndpoints(servers[0].URL, servers[1].URL, servers[2].URL).SetReplication(5)
+	s.SetFailureFn(func(f *Failure) {
+		mutex.Lock()
+		failures = append(failures, f)
+		mutex.Unlock()
+	})
+	if failure := s.deliver(encodeRecord(nil, []byte("hey"))); failure != nil {
+		t.Fatalf("Unexpected failure: %s", failure.Err.Error())
+	}
+	if requests[0] != 1 || requests[1] != 1 || requests[2] != 1 {
+		t.Fatalf("Unexpected requests. Expected: [1 1 1] - Found: %v.", requests)
+	}
+	if len(failures) != 1 || failures[0].Endpoint != servers[2].URL {
+		t.Fatalf("Unexpected failures: %+v.", failures)
+	}
+
+	s.SetEndpoints(servers[2].URL, servers[2].URL).SetReplication(2)
+	if failure := s.deliver(encodeRecord(nil, []byte("hey"))); failure == nil || failure.Response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("A failure was expected when every replica fails, found: %+v.", failure)
+	}
+}
+
+// TestEndpointsQueryTemplate verifies that rendered query parameters are
+// appended to the selected endpoint.
+func TestEndpointsQueryTemplate(t *testing.T) {
+	rec := &templateRecorder{}
+	first := httptest.NewServer(rec)
+	defer first.Close()
+	second := httptest.NewServer(rec)
+	defer second.Close()
+
+	s := NewStream("").SetMethod(http.MethodGet).SetEndpoints(first.URL, second.URL).EnableOrdering()
+	s.SetQueryParamTemplate("tag", "{{.Tag}}")
+	s.Write([]byte(`{"tag":"a","message":"1"}` + "\n" + `{"tag":"b","message":"2"}`))
+	s.Close()
+
+	if len(rec.requests) != 2 || rec.requests[0] != `/?tag=a||{"tag":"a","message":"1"}` || rec.requests[1] != `/?tag=b||{"tag":"b","message":"2"}` {
+		t.Fatalf("Unexpected requests: %q.", rec.requests)
+	}
+	statuses := s.Endpoints()
+	if statuses[0].Failures != 0 || statuses[1].Failures != 0 {
+		t.Fatalf("Unexpected endpoint statuses: %+v.", statuses)
+	}
+}
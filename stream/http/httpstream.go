@@ -4,30 +4,117 @@ package http
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
-	"net/url"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"gonyan"
 )
 
+// DefaultTimeout defines the default timeout of each request.
+const DefaultTimeout = 30 * time.Second
+
+// DefaultSpoolRetryInterval defines the default time waited by the spool
+// sender before sending again a body whose attempts have been exhausted.
+const DefaultSpoolRetryInterval = 5 * time.Second
+
 // Stream defines the standard Gonyan Stream for HTTP and HTTPS requests.
 type Stream struct {
-	method      string                       // HTTP used method;
-	url         string                       // The URL webhook;
-	useHTTPS    bool                         // Flag to activate TLS/SSL;
-	prepareBody func([]byte) ([]byte, error) // Function executed on body before transmission;
-	headers     map[string]string            // HTTP headers container;
-	queryParams map[string]string            // GET query parameter container.
+	dropped         int64                         // Bodies dropped by the queue policy, first for atomic alignment;
+	method          string                        // HTTP used method;
+	url             string                        // The URL webhook;
+	useHTTPS        bool                          // Flag to enforce TLS/SSL;
+	prepareBody     func([]byte) ([]byte, error)  // Function executed on body before transmission;
+	headers         map[string]string             // HTTP headers container;
+	queryParams     map[string]string             // GET query parameter container;
+	client          *http.Client                  // HTTP client shared by the requests;
+	transport       *http.Transport               // Default client transport, nil once replaced;
+	timeout         time.Duration                 // Maximum duration of each request attempt;
+	auth            Authenticator                 // Optional credentials provider;
+	urlTemplate     *template.Template            // Optional URL template;
+	queryTemplates  map[string]*template.Template // Query parameter templates;
+	headerTemplates map[string]*template.Template // Header templates;
+	bodyTemplate    *template.Template            // Optional body template;
+	workers         int                           // Number of concurrent requests;
+	ordered         bool                          // Whether requests are sent one at a time, in order;
+	queueSize       int                           // Capacity of the request queue;
+	queuePolicy     QueuePolicy                   // Behaviour when the queue is full;
+	queue           chan []byte                   // Bodies waiting for a worker;
+	queueClosed     bool                          // Whether the queue has been closed;
+	queueMutex      sync.RWMutex                  // Mutex for the queue closure;
+	startOnce       sync.Once                     // Guards the workers start;
+	compression     Compression                   // Algorithm used to compress the bodies;
+	compressionMin  int                           // Minimum size of the compressed bodies;
+	batchEncoding   BatchEncoding                 // Encoding of batched bodies, NoBatching when disabled;
+	batchMaxEntries int                           // Maximum number of logs per batch;
+	batchMaxBytes   int                           // Maximum size of a batch body;
+	batchLinger     time.Duration                 // Maximum time a log waits for its batch;
+	batchWrapperKey string                        // Key of the logs array in Wrapped bodies;
+	batchSeparator  byte                          // Separator of the logs written together;
+	framer          gonyan.Framer                 // Optional framer of the logs written together;
+	batchEntries    [][]byte                      // Logs of the pending batch;
+	batchTarget     *target                       // Rendered target of the pending batch;
+	batchSize       int                           // Size of the logs of the pending batch;
+	batchTimer      *time.Timer                   // Linger timer of the pending batch;
+	batchGeneration uint64                        // Identifies the pending batch for its timer;
+	batchMutex      sync.Mutex                    // Mutex for the pending batch;
+	spool           *Spool                        // Optional write-ahead queue;
+	spoolRetry      time.Duration                 // Time waited after a failed spooled request;
+	endpoints       []*endpoint                   // Endpoints set with SetEndpoints, empty for the single URL;
+	balancing       LoadBalancing                 // Strategy selecting the endpoints;
+	nextEndpoint    uint64                        // Counter rotating the endpoints;
+	ejectFailures   int                           // Consecutive failures ejecting an endpoint, 0 to disable;
+	ejectDuration   time.Duration                 // Time an endpoint stays ejected;
+	replicas        int                           // Number of endpoints each body is sent to;
+	endpointMutex   sync.Mutex                    // Mutex for the endpoints;
+	retry           RetryPolicy                   // Policy for failed requests;
+	failure         func(*Failure)                // Callback for requests given up;
+	breaker         *gonyan.CircuitBreakerStream  // Optional breaker the outcomes are reported to;
+	done            chan struct{}                 // Closed when the stream is closed;
+	closeOnce       sync.Once                     // Guards the closure of done;
+	senderGroup     sync.WaitGroup                // Tracks the workers and the spool sender.
 }
 
 // NewStream creates a new HTTP stream and sets its webhook URL.
 func NewStream(url string) *Stream {
+	transport := newTransport(DefaultWorkers)
 	return &Stream{
-		method:      http.MethodPost,
-		url:         url,
-		useHTTPS:    false,
-		prepareBody: nil,
-		headers:     make(map[string]string),
-		queryParams: make(map[string]string),
+		method:          http.MethodPost,
+		url:             url,
+		useHTTPS:        false,
+		prepareBody:     nil,
+		headers:         make(map[string]string),
+		queryParams:     make(map[string]string),
+		queryTemplates:  make(map[string]*template.Template),
+		headerTemplates: make(map[string]*template.Template),
+		client:          &http.Client{Transport: transport},
+		transport:       transport,
+		timeout:         DefaultTimeout,
+		workers:         DefaultWorkers,
+		queueSize:       DefaultQueueSize,
+		queuePolicy:     Block,
+		compressionMin:  DefaultCompressionMinSize,
+		batchMaxEntries: DefaultBatchEntries,
+		batchMaxBytes:   DefaultBatchBytes,
+		batchLinger:     DefaultBatchLinger,
+		batchWrapperKey: DefaultWrapperKey,
+		batchSeparator:  DefaultBatchSeparator,
+		spoolRetry:      DefaultSpoolRetryInterval,
+		ejectFailures:   DefaultEjectionThreshold,
+		ejectDuration:   DefaultEjectionTime,
+		replicas:        1,
+		retry:           DefaultRetryPolicy(),
+		failure: func(f *Failure) {
+			fmt.Printf("[Gonyan] [Stream] request firing failed after %d attempts due to: %s.\nRequest body: %+v", f.Attempts, f.Err.Error(), f.Body)
+		},
+		done: make(chan struct{}),
 	}
 }
 
@@ -51,7 +138,8 @@ func (h *Stream) SetCustomBodyPrepareFunction(f func([]byte) ([]byte, error)) *S
 }
 
 // DisableHTTPS will set the internal flag for HTTPS to `false`
-// thus disabling it; note that HTTPS is disabled by default.
+// thus disabling it; note that HTTPS is disabled by default. When disabled
+// the URL is used as provided.
 // Note: the method will return the same instance of the invoked structure
 // so that multiple `Set` functions can be chained together.
 func (h *Stream) DisableHTTPS() *Stream {
@@ -59,8 +147,9 @@ func (h *Stream) DisableHTTPS() *Stream {
 	return h
 }
 
-// EnableHTTPS will set the internal flag for HTTPS to `true` thus enabling it.
-// HTTPS is disabled by default.
+// EnableHTTPS will set the internal flag for HTTPS to `true` thus enabling it:
+// `http://` URLs, and URLs without a scheme, are rewritten to `https://`
+// while requests to other schemes fail. HTTPS is disabled by default.
 // Note: the method will return the same instance of the invoked structure
 // so that multiple `Set` functions can be chained together.
 func (h *Stream) EnableHTTPS() *Stream {
@@ -116,64 +205,375 @@ func (h *Stream) RemoveQueryParam(key string) {
 	delete(h.queryParams, key)
 }
 
+// SetClient allows to replace the HTTP client shared by the requests. The
+// default one keeps the connections alive. The transport settings of the
+// stream (TLS and proxy) only apply to the default transport.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (h *Stream) SetClient(client *http.Client) *Stream {
+	if client != nil {
+		h.client = client
+		h.transport = nil
+	}
+	return h
+}
+
+// SetWorkers sets the number of requests performed concurrently, by default
+// DefaultWorkers. It has no effect after the first Write.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (h *Stream) SetWorkers(workers int) *Stream {
+	if workers > 0 {
+		h.workers = workers
+		if h.transport != nil {
+			h.transport.MaxIdleConnsPerHost = workers
+		}
+	}
+	return h
+}
+
+// EnableOrdering makes the stream perform a single request at a time so that
+// bodies are delivered in the order they are written, retries included. It
+// has no effect after the first Write.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (h *Stream) EnableOrdering() *Stream {
+	h.ordered = true
+	return h
+}
+
+// DisableOrdering restores concurrent requests; ordering is disabled by
+// default. It has no effect after the first Write.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (h *Stream) DisableOrdering() *Stream {
+	h.ordered = false
+	return h
+}
+
+// SetQueueSize sets the number of bodies which can wait for a worker, by
+// default DefaultQueueSize. It has no effect after the first Write.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (h *Stream) SetQueueSize(size int) *Stream {
+	if size >= 0 {
+		h.queueSize = size
+	}
+	return h
+}
+
+// SetQueuePolicy sets the behaviour of Write when the queue is full, by
+// default Block.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (h *Stream) SetQueuePolicy(policy QueuePolicy) *Stream {
+	h.queuePolicy = policy
+	return h
+}
+
+// Dropped returns the number of bodies dropped because the queue was full.
+func (h *Stream) Dropped() int64 {
+	return atomic.LoadInt64(&h.dropped)
+}
+
+// SetRetryPolicy sets the policy used to retry failed requests, by default
+// DefaultRetryPolicy. Responses with a non-2xx status are failures.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (h *Stream) SetRetryPolicy(policy RetryPolicy) *Stream {
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = 1
+	}
+	if policy.MaxBackoff < policy.MinBackoff {
+		policy.MaxBackoff = policy.MinBackoff
+	}
+	h.retry = policy
+	return h
+}
+
+// SetFailureFn sets the function invoked with the details of every request
+// given up after the attempts allowed by the retry policy; by default the
+// failure is printed. Spooled bodies are kept and sent again later unless
+// the failure is not retryable, the Failure reports which is the case.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (h *Stream) SetFailureFn(failureFn func(*Failure)) *Stream {
+	h.failure = failureFn
+	return h
+}
+
+// SetCircuitBreaker makes the stream report the outcome of every delivery to
+// provided breaker, usually the gonyan.CircuitBreakerStream wrapping it:
+// writes only queue the bodies and never fail because of the endpoint, the
+// breaker is therefore tripped by the requests given up instead. When the
+// breaker is the primary of a gonyan.FailoverStream the given up bodies are
+// not written to its secondary stream: the failure function set with
+// SetFailureFn can do it using the Failure body.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (h *Stream) SetCircuitBreaker(breaker *gonyan.CircuitBreakerStream) *Stream {
+	h.breaker = breaker
+	return h
+}
+
+// SetSpool makes the stream append every prepared body to provided Spool
+// before sending it, in place of the in-memory queue. A background sender
+// drains the Spool in order, one request at a time, removing
+// the bodies only once the request succeeds and retrying failed ones, so that
+// logs survive endpoint outages and, thanks to the Spool replay, process
+// restarts. The stream must be closed with Close to stop the sender.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (h *Stream) SetSpool(spool *Spool) *Stream {
+	if h.spool != nil || spool == nil {
+		return h
+	}
+	h.spool = spool
+	h.senderGroup.Add(1)
+	go h.drainSpool()
+	return h
+}
+
+// Close sends the pending batch, aborts the pending retries, waits for the
+// queued bodies to be sent,
+// stops the spool sender, if any, and closes the Spool. Bodies not sent yet
+// are kept in the Spool for the next process.
+func (h *Stream) Close() error {
+	var err error
+	h.closeOnce.Do(func() {
+		if flushErr := h.Flush(); flushErr != nil {
+			err = flushErr
+		}
+		close(h.done)
+		h.closeQueue()
+		h.senderGroup.Wait()
+		if h.spool != nil {
+			if closeErr := h.spool.Close(); closeErr != nil {
+				err = closeErr
+			}
+		}
+	})
+	return err
+}
+
 // Write function defined to implement the Stream interface.
 // The function prepares the body and fires the HTTP/HTTPS request
 // using (optionally provided) headers and GET query parameters.
-// Note: the actual HTTP request is performed inside a simple goroutine, it
-// will be optimised in the future.
+// When a Spool is set the body is appended to it and sent by the spool
+// sender, otherwise it is queued for the workers performing, and retrying,
+// the requests. When batching is enabled the logs are collected and the
+// body is built once the batch is complete. When templates are set each log
+// is rendered on its own.
 func (h *Stream) Write(messageBytes []byte) (int, error) {
-	body := messageBytes
+	if h.templated() {
+		if err := h.writeTemplated(messageBytes); err != nil {
+			return 0, err
+		}
+		return len(messageBytes), nil
+	}
+	if h.batchEncoding != NoBatching {
+		entries, err := h.splitLogs(messageBytes)
+		if err != nil {
+			return 0, err
+		}
+		for _, entry := range entries {
+			if err := h.addToBatch(entry, nil); err != nil {
+				return 0, err
+			}
+		}
+		return len(messageBytes), nil
+	}
+	return h.submit(messageBytes, nil)
+}
+
+// submit prepares provided body and hands it over, together with its
+// rendered target if any, to the spool or to the workers, returning the size
+// of the prepared body.
+func (h *Stream) submit(body []byte, t *target) (int, error) {
 	if h.prepareBody != nil {
 		var err error
-		body, err = h.prepareBody(messageBytes)
+		body, err = h.prepareBody(body)
 		if err != nil {
 			return 0, fmt.Errorf("custom body prepare failed due to: %s", err.Error())
 		}
 	}
 
-	go func(body []byte) {
-		// TODO: Handle request in a better way.
-		if err := h.fireRequest(body); err != nil {
-			fmt.Printf("[Gonyan] [Stream] request firing failed due to: %s.\nRequest body: %+v", err.Error(), body)
-			return
+	record := encodeRecord(t, body)
+	if h.spool != nil {
+		if err := h.spool.Append(record); err != nil {
+			return 0, fmt.Errorf("spool append failed due to: %s", err.Error())
 		}
-	}(body)
+		return len(body), nil
+	}
 
+	if err := h.enqueue(record); err != nil {
+		return 0, err
+	}
 	return len(body), nil
 }
 
-// fireRequest function will create and execute the actual HTTP request putting
-// together all setup information, headers etc.
-// The expected input is the previously prepared body (if a prepare function is
-// provided).
-func (h *Stream) fireRequest(preparedBody []byte) error {
-	targetURL := h.url
+// drainSpool sends the spooled bodies in order until the stream is closed.
+func (h *Stream) drainSpool() {
+	defer h.senderGroup.Done()
+	for {
+		body, err := h.spool.Peek()
+		if err != nil {
+			fmt.Printf("[Gonyan] [Stream] spool read failed due to: %s.\n", err.Error())
+		} else if body == nil {
+			select {
+			case <-h.spool.notify:
+				continue
+			case <-h.done:
+				return
+			}
+		} else {
+			failure := h.deliver(body)
+			h.reportOutcome(failure)
+			if failure == nil || failure.Err == errInvalidRecord || failure.Response != nil && !h.retry.retryable(failure.Response.StatusCode) {
+				// Bodies refused by the endpoint, or which cannot be
+				// decoded, would block the spool forever, they are dropped.
+				if err := h.spool.Ack(); err != nil {
+					fmt.Printf("[Gonyan] [Stream] spool ack failed due to: %s.\n", err.Error())
+				}
+				if failure != nil {
+					h.reportFailure(failure)
+				}
+				continue
+			}
+			if h.closed() {
+				return
+			}
+			failure.Spooled = true
+			h.reportFailure(failure)
+		}
 
-	// Prepare GET Query parameters for GET method.
-	if h.method == http.MethodGet {
-		getParams := url.Values{}
-		for key, val := range h.queryParams {
-			getParams.Add(key, val)
+		select {
+		case <-time.After(h.spoolRetry):
+		case <-h.done:
+			return
 		}
-		targetURL += "?" + getParams.Encode()
+	}
+}
+
+// newTransport creates the default transport, keeping alive a connection
+// per worker.
+func newTransport(workers int) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   workers,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// reportFailure invokes the failure callback, if any.
+func (h *Stream) reportFailure(failure *Failure) {
+	if h.failure != nil {
+		h.failure(failure)
+	}
+}
+
+// reportOutcome reports the outcome of a delivery to the circuit breaker, if
+// any.
+func (h *Stream) reportOutcome(failure *Failure) {
+	if h.breaker == nil {
+		return
+	}
+	if failure != nil {
+		h.breaker.Report(failure.Err)
+		return
+	}
+	h.breaker.Report(nil)
+}
+
+// closed reports whether the stream has been closed.
+func (h *Stream) closed() bool {
+	select {
+	case <-h.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// sendRequest performs a single request to provided endpoint URL with
+// provided, possibly compressed, body and its Content-Encoding, empty when
+// not compressed. The rendered target, when provided, overrides the headers
+// and either replaces the URL or the query parameters.
+func (h *Stream) sendRequest(preparedBody []byte, contentEncoding string, t *target, endpointURL string) error {
+	var targetURL string
+	if routed(t) {
+		queryParams := h.queryParams
+		if t != nil && t.query != nil {
+			queryParams = t.query
+		}
+		var err error
+		if targetURL, err = h.requestURL(endpointURL, queryParams); err != nil {
+			return fmt.Errorf("request creation failed due to: %s", err.Error())
+		}
+	} else {
+		targetURL = t.url
 	}
 
 	request, err := http.NewRequest(h.method, targetURL, bytes.NewBuffer(preparedBody))
 	if err != nil {
 		return fmt.Errorf("request creation failed due to: %s", err.Error())
 	}
+	if h.timeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+		defer cancel()
+		request = request.WithContext(ctx)
+	}
 
 	// Add all headers to request.
 	for key, val := range h.headers {
 		request.Header.Add(key, val)
 	}
+	if t != nil {
+		for key, val := range t.headers {
+			request.Header.Set(key, val)
+		}
+	}
+	if h.batchEncoding != NoBatching && request.Header.Get("Content-Type") == "" {
+		request.Header.Set("Content-Type", h.batchEncoding.contentType())
+	}
+	if contentEncoding != "" {
+		request.Header.Set("Content-Encoding", contentEncoding)
+	}
+	if h.auth != nil {
+		if err := h.auth.Authenticate(request, preparedBody); err != nil {
+			return fmt.Errorf("request authentication failed due to: %s", err.Error())
+		}
+	}
 
-	client := &http.Client{}
-	response, err := client.Do(request)
+	response, err := h.client.Do(request)
 	if err != nil {
 		return fmt.Errorf("request execution failed due to: %s", err.Error())
 	}
 	defer response.Body.Close()
 
+	if response.StatusCode == http.StatusUnauthorized {
+		// Expired credentials are refreshed by the next attempt.
+		if invalidator, ok := h.auth.(interface{ Invalidate() }); ok {
+			invalidator.Invalidate()
+		}
+	}
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		details, _ := ioutil.ReadAll(io.LimitReader(response.Body, maxResponseDetails))
+		return &StatusError{
+			StatusCode: response.StatusCode,
+			Status:     response.Status,
+			Header:     response.Header,
+			Body:       details,
+		}
+	}
+	// Drain the body so that the connection can be reused.
+	io.Copy(ioutil.Discard, response.Body)
 	return nil
 }
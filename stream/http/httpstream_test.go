@@ -6,12 +6,22 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"reflect"
 	"sync"
 	"testing"
 	"time"
 )
 
+// deliverBody sends provided body through the delivery path of provided
+// stream, returning the error of the last attempt when it fails.
+func deliverBody(s *Stream, body []byte) error {
+	if failure := s.deliver(encodeRecord(nil, body)); failure != nil {
+		return failure.Err
+	}
+	return nil
+}
+
 // TestConstructorURL verifies that the URL is properly copied.
 func TestConstructorURL(t *testing.T) {
 	s := NewStream("the-url.com")
@@ -179,8 +189,8 @@ func TestRemoveQueryParam(t *testing.T) {
 	}
 }
 
-// TestFireRequest successfully fires an HTTP PUT request.
-func TestFireRequest(t *testing.T) {
+// TestDeliver successfully delivers a body with an HTTP PUT request.
+func TestDeliver(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		if r.Method != http.MethodPut {
@@ -208,14 +218,14 @@ func TestFireRequest(t *testing.T) {
 	s := NewStream(ts.URL)
 	s.DisableHTTPS()
 	s.SetMethod(http.MethodPut)
-	if err := s.fireRequest([]byte("hey")); err != nil {
+	if err := deliverBody(s, []byte("hey")); err != nil {
 		t.Fatalf("Unexpected error: %s", err.Error())
 	}
 }
 
-// TestFireRequestVerifyHeadersWithSet successfully fires an HTTP PUT request
+// TestDeliverVerifyHeadersWithSet successfully delivers an HTTP PUT request
 // and verify that headers have been set using SetHeader.
-func TestFireRequestVerifyHeadersWithSet(t *testing.T) {
+func TestDeliverVerifyHeadersWithSet(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		if r.Method != http.MethodPost {
@@ -238,14 +248,14 @@ func TestFireRequestVerifyHeadersWithSet(t *testing.T) {
 	s.DisableHTTPS()
 
 	s.SetHeader("hey", "oh").SetHeader("lets", "go")
-	if err := s.fireRequest([]byte{}); err != nil {
+	if err := deliverBody(s, []byte{}); err != nil {
 		t.Fatalf("Unexpected error: %s", err.Error())
 	}
 }
 
-// TestFireRequestVerifyHeadersWithSetAll successfully fires an HTTP PUT request
+// TestDeliverVerifyHeadersWithSetAll successfully delivers an HTTP PUT request
 // and verify that headers have been set using SetAllHeaders.
-func TestFireRequestVerifyHeadersWithSetAll(t *testing.T) {
+func TestDeliverVerifyHeadersWithSetAll(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		if r.Method != http.MethodPost {
@@ -277,15 +287,15 @@ func TestFireRequestVerifyHeadersWithSetAll(t *testing.T) {
 		"what": "not",
 	})
 	s.RemoveHeader("what")
-	if err := s.fireRequest([]byte{}); err != nil {
+	if err := deliverBody(s, []byte{}); err != nil {
 		t.Fatalf("Unexpected error: %s", err.Error())
 	}
 }
 
-// TestFireRequestVerifyQueryParamsWithSet successfully fires an HTTP GET
+// TestDeliverVerifyQueryParamsWithSet successfully delivers an HTTP GET
 // request and verify that GET query parameters have been
 // set using SetQueryParam.
-func TestFireRequestVerifyQueryParamsWithSet(t *testing.T) {
+func TestDeliverVerifyQueryParamsWithSet(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		if r.Method != http.MethodGet {
@@ -311,15 +321,15 @@ func TestFireRequestVerifyQueryParamsWithSet(t *testing.T) {
 	s.SetMethod(http.MethodGet)
 
 	s.SetQueryParam("hey", "oh").SetQueryParam("lets", "go")
-	if err := s.fireRequest([]byte{}); err != nil {
+	if err := deliverBody(s, []byte{}); err != nil {
 		t.Fatalf("Unexpected error: %s", err.Error())
 	}
 }
 
-// TestFireRequestVerifyQueryParamsWithSetAll successfully fires an HTTP GET
+// TestDeliverVerifyQueryParamsWithSetAll successfully delivers an HTTP GET
 // request and verify that GET query parameters have been
 // set using SetAllQueryParams.
-func TestFireRequestVerifyQueryParamsWithSetAll(t *testing.T) {
+func TestDeliverVerifyQueryParamsWithSetAll(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		if r.Method != http.MethodGet {
@@ -353,16 +363,15 @@ func TestFireRequestVerifyQueryParamsWithSetAll(t *testing.T) {
 		"what": "not",
 	})
 	s.RemoveQueryParam("what")
-	if err := s.fireRequest([]byte{}); err != nil {
+	if err := deliverBody(s, []byte{}); err != nil {
 		t.Fatalf("Unexpected error: %s", err.Error())
 	}
 }
 
-// TestFireRequestFailure covers the possible error generated by
-// fireRequest function.
-func TestFireRequestFailure(t *testing.T) {
-	s := NewStream("invalid-url.com")
-	if err := s.fireRequest([]byte("hey")); err == nil {
+// TestDeliverFailure covers the possible errors of the delivery.
+func TestDeliverFailure(t *testing.T) {
+	s := NewStream("invalid-url.com").SetRetryPolicy(RetryPolicy{MaxAttempts: 1})
+	if err := deliverBody(s, []byte("hey")); err == nil {
 		t.Fatalf("This request should have failed, found nil error instead.")
 	}
 
@@ -374,7 +383,7 @@ func TestFireRequestFailure(t *testing.T) {
 
 	s = NewStream(ts.URL)
 	s.SetMethod("NOT A METHOD")
-	if err := s.fireRequest([]byte("hey")); err == nil {
+	if err := deliverBody(s, []byte("hey")); err == nil {
 		t.Fatalf("This request should have failed, found nil error instead.")
 	}
 }
@@ -464,3 +473,98 @@ func TestWritePrepareBodyFails(t *testing.T) {
 		t.Fatalf("Unexpected number of written bytes. Expected: %d - Found: %d.", 0, nbytes)
 	}
 }
+
+// TestWriteReusedBuffer verifies that queued bodies are not affected by the
+// caller reusing its buffer after Write.
+func TestWriteReusedBuffer(t *testing.T) {
+	release := make(chan struct{})
+	mtx := &sync.Mutex{}
+	received := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Keep the bodies queued until all of them are written.
+		<-release
+		payload, _ := ioutil.ReadAll(r.Body)
+		mtx.Lock()
+		received = append(received, string(payload))
+		mtx.Unlock()
+	}))
+	defer ts.Close()
+
+	s := NewStream(ts.URL).EnableOrdering()
+	buffer := make([]byte, 1)
+	for _, body := range []string{"a", "b", "c"} {
+		copy(buffer, body)
+		if _, err := s.Write(buffer); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+	}
+	copy(buffer, "x")
+	close(release)
+	s.Close()
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if fmt.Sprint(received) != "[a b c]" {
+		t.Fatalf("Unexpected bodies received: %q.", received)
+	}
+}
+
+// TestWriteSpool verifies that spooled bodies are delivered in order despite
+// endpoint failures, and replayed by a new stream after a restart.
+func TestWriteSpool(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	mtx := &sync.Mutex{}
+	failures := 2
+	received := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if failures > 0 {
+			failures--
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		payload, _ := ioutil.ReadAll(r.Body)
+		received = append(received, string(payload))
+	}))
+	defer ts.Close()
+
+	spool, err := NewSpool(dir, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	// Bodies written before the sender starts are replayed on restart.
+	spool.Append(encodeRecord(nil, []byte("replayed")))
+	spool.Close()
+
+	spool, _ = NewSpool(dir, 0)
+	s := NewStream(ts.URL)
+	s.spoolRetry = 10 * time.Millisecond
+	s.SetSpool(spool)
+	for _, body := range []string{"a", "b", "c"} {
+		if _, err := s.Write([]byte(body)); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for spool.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	s.Close()
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if fmt.Sprint(received) != "[replayed a b c]" {
+		t.Fatalf("Unexpected received bodies: %v.", received)
+	}
+	if _, err := s.Write([]byte("closed")); err == nil {
+		t.Fatalf("Writes on a closed stream should fail.")
+	}
+}
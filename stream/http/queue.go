@@ -0,0 +1,121 @@
+package http
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// QueuePolicy defines what Write does when the request queue is full.
+type QueuePolicy int
+
+// Supported queue policies:
+//
+//   - Block: Write waits for room in the queue, slowing the logger down;
+//   - DropNewest: the body being written is dropped and Write returns
+//     ErrQueueFull;
+//   - DropOldest: the oldest queued body is dropped to make room; with a
+//     zero sized queue nothing can be dropped and Write blocks.
+const (
+	Block      QueuePolicy = iota
+	DropNewest QueuePolicy = iota
+	DropOldest QueuePolicy = iota
+)
+
+// DefaultWorkers defines the default number of concurrent requests.
+const DefaultWorkers = 4
+
+// DefaultQueueSize defines the default number of bodies waiting for a
+// worker.
+const DefaultQueueSize = 1000
+
+// ErrQueueFull is returned by Write when the queue is full and the
+// DropNewest policy is selected.
+var ErrQueueFull = errors.New("request queue full")
+
+// ErrStreamClosed is returned by Write once the stream has been closed.
+var ErrStreamClosed = errors.New("stream closed")
+
+// enqueue queues provided body for the workers, starting them at the first
+// invocation, according to the queue policy.
+func (h *Stream) enqueue(body []byte) error {
+	h.startOnce.Do(h.startWorkers)
+
+	h.queueMutex.RLock()
+	defer h.queueMutex.RUnlock()
+	if h.queueClosed {
+		return ErrStreamClosed
+	}
+
+	switch {
+	case h.queuePolicy == DropNewest:
+		select {
+		case h.queue <- body:
+			return nil
+		default:
+			atomic.AddInt64(&h.dropped, 1)
+			return ErrQueueFull
+		}
+	case h.queuePolicy == DropOldest && cap(h.queue) > 0:
+		for {
+			select {
+			case h.queue <- body:
+				return nil
+			default:
+			}
+			select {
+			case <-h.queue:
+				atomic.AddInt64(&h.dropped, 1)
+			default:
+			}
+		}
+	default:
+		select {
+		case h.queue <- body:
+			return nil
+		case <-h.done:
+			return ErrStreamClosed
+		}
+	}
+}
+
+// startWorkers creates the queue and starts the workers.
+func (h *Stream) startWorkers() {
+	workers := h.workers
+	if h.ordered {
+		workers = 1
+	}
+	h.queue = make(chan []byte, h.queueSize)
+	for i := 0; i < workers; i++ {
+		h.senderGroup.Add(1)
+		go h.work()
+	}
+}
+
+// work sends the queued bodies until the queue is closed.
+func (h *Stream) work() {
+	defer h.senderGroup.Done()
+	for body := range h.queue {
+		failure := h.deliver(body)
+		h.reportOutcome(failure)
+		if failure != nil {
+			h.reportFailure(failure)
+		}
+	}
+}
+
+// closeQueue stops accepting bodies, letting the workers send the queued
+// ones and exit.
+func (h *Stream) closeQueue() {
+	// Workers must not be started once closed.
+	h.startOnce.Do(func() {})
+
+	h.queueMutex.Lock()
+	defer h.queueMutex.Unlock()
+	if h.queueClosed {
+		return
+	}
+	h.queueClosed = true
+	if h.queue != nil {
+		close(h.queue)
+	}
+}
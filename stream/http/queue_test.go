@@ -0,0 +1,202 @@
+package http
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder is a test endpoint recording bodies and client addresses, which
+// can hold requests until released.
+type recorder struct {
+	mutex    sync.Mutex
+	bodies   []string
+	remotes  map[string]bool
+	inFlight int
+	maxIn    int
+	received chan string
+	release  chan struct{}
+}
+
+func newRecorder(hold bool) *recorder {
+	r := &recorder{remotes: map[string]bool{}, received: make(chan string, 100)}
+	if hold {
+		r.release = make(chan struct{})
+	}
+	return r
+}
+
+func (rec *recorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	payload, _ := ioutil.ReadAll(r.Body)
+	rec.mutex.Lock()
+	rec.inFlight++
+	if rec.inFlight > rec.maxIn {
+		rec.maxIn = rec.inFlight
+	}
+	rec.remotes[r.RemoteAddr] = true
+	rec.mutex.Unlock()
+
+	rec.received <- string(payload)
+	if rec.release != nil {
+		<-rec.release
+	} else {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	rec.mutex.Lock()
+	rec.inFlight--
+	rec.bodies = append(rec.bodies, string(payload))
+	rec.mutex.Unlock()
+}
+
+// TestWriteOrdering verifies that ordered streams deliver bodies in order
+// over a single kept-alive connection.
+func TestWriteOrdering(t *testing.T) {
+	rec := newRecorder(false)
+	ts := httptest.NewServer(rec)
+	defer ts.Close()
+
+	s := NewStream(ts.URL).EnableOrdering()
+	expected := []string{}
+	for i := 0; i < 20; i++ {
+		body := fmt.Sprintf("body-%d", i)
+		expected = append(expected, body)
+		if _, err := s.Write([]byte(body)); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+	}
+	s.Close()
+
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	if fmt.Sprint(rec.bodies) != fmt.Sprint(expected) {
+		t.Fatalf("Unexpected bodies order: %v.", rec.bodies)
+	}
+	if rec.maxIn != 1 || len(rec.remotes) != 1 {
+		t.Fatalf("A single connection and request in flight were expected. Found: %d connections, %d requests.", len(rec.remotes), rec.maxIn)
+	}
+
+	if _, err := s.Write([]byte("late")); err != ErrStreamClosed {
+		t.Fatalf("An ErrStreamClosed error was expected. Found: %v.", err)
+	}
+}
+
+// TestWriteWorkers verifies that concurrent requests are bounded by the
+// number of workers.
+func TestWriteWorkers(t *testing.T) {
+	rec := newRecorder(false)
+	ts := httptest.NewServer(rec)
+	defer ts.Close()
+
+	s := NewStream(ts.URL).SetWorkers(3)
+	for i := 0; i < 50; i++ {
+		s.Write([]byte("body"))
+	}
+	s.Close()
+
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	if len(rec.bodies) != 50 {
+		t.Fatalf("Unexpected number of bodies. Expected: %d - Found: %d.", 50, len(rec.bodies))
+	}
+	if rec.maxIn > 3 || len(rec.remotes) > 3 {
+		t.Fatalf("Too many concurrent requests or connections: %d, %d.", rec.maxIn, len(rec.remotes))
+	}
+}
+
+// TestQueuePolicies verifies the behaviour of each policy when the queue is
+// full.
+func TestQueuePolicies(t *testing.T) {
+	cases := []struct {
+		policy   QueuePolicy
+		expected string
+	}{
+		{DropNewest, "[a b]"},
+		{DropOldest, "[a c]"},
+		{Block, "[a b c]"},
+	}
+	for _, c := range cases {
+		rec := newRecorder(true)
+		ts := httptest.NewServer(rec)
+		s := NewStream(ts.URL).SetWorkers(1).SetQueueSize(1).SetQueuePolicy(c.policy)
+
+		// `a` is in flight, `b` queued.
+		s.Write([]byte("a"))
+		<-rec.received
+		s.Write([]byte("b"))
+
+		written := make(chan error, 1)
+		go func() {
+			_, err := s.Write([]byte("c"))
+			written <- err
+		}()
+
+		switch c.policy {
+		case DropNewest:
+			if err := <-written; err != ErrQueueFull {
+				t.Fatalf("An ErrQueueFull error was expected. Found: %v.", err)
+			}
+		case DropOldest:
+			if err := <-written; err != nil {
+				t.Fatalf("Unexpected error: %s", err.Error())
+			}
+		case Block:
+			select {
+			case err := <-written:
+				t.Fatalf("Write should have blocked. Found: %v.", err)
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+
+		close(rec.release)
+		if c.policy == Block {
+			if err := <-written; err != nil {
+				t.Fatalf("Unexpected error: %s", err.Error())
+			}
+		}
+		s.Close()
+		ts.Close()
+
+		if fmt.Sprint(rec.bodies) != c.expected {
+			t.Fatalf("Policy %d: unexpected bodies. Expected: %s - Found: %v.", c.policy, c.expected, rec.bodies)
+		}
+		if c.policy != Block && s.Dropped() != 1 {
+			t.Fatalf("Policy %d: unexpected dropped counter: %d.", c.policy, s.Dropped())
+		}
+	}
+}
+
+// TestQueueDropOldestUnbuffered verifies that the DropOldest policy blocks
+// when the queue has no room at all.
+func TestQueueDropOldestUnbuffered(t *testing.T) {
+	rec := newRecorder(true)
+	ts := httptest.NewServer(rec)
+	defer ts.Close()
+	s := NewStream(ts.URL).SetWorkers(1).SetQueueSize(0).SetQueuePolicy(DropOldest)
+
+	s.Write([]byte("a"))
+	<-rec.received
+	written := make(chan error, 1)
+	go func() {
+		_, err := s.Write([]byte("b"))
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		t.Fatalf("Write should have blocked. Found: %v.", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(rec.release)
+	if err := <-written; err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	s.Close()
+	if fmt.Sprint(rec.bodies) != "[a b]" || s.Dropped() != 0 {
+		t.Fatalf("Unexpected bodies: %v - dropped: %d.", rec.bodies, s.Dropped())
+	}
+}
@@ -0,0 +1,242 @@
+package http
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxAttempts defines the default number of attempts performed for
+// each request.
+const DefaultMaxAttempts = 3
+
+// DefaultMinBackoff defines the default delay before the first retry.
+const DefaultMinBackoff = 100 * time.Millisecond
+
+// DefaultMaxBackoff defines the default upper bound for retry delays.
+const DefaultMaxBackoff = 10 * time.Second
+
+// DefaultJitter defines the default fraction of each delay randomised.
+const DefaultJitter = 0.2
+
+// maxResponseDetails is the maximum number of response body bytes kept in a
+// StatusError.
+const maxResponseDetails = 4096
+
+// RetryPolicy defines how failed requests are retried. Transport errors are
+// always retryable, responses only when their status is listed in
+// RetryableStatuses.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts performed for each
+	// request, 1 disables the retries.
+	MaxAttempts int
+	// MinBackoff is the delay before the first retry, doubled at every
+	// following one up to MaxBackoff.
+	MinBackoff time.Duration
+	// MaxBackoff is the upper bound of the retry delays.
+	MaxBackoff time.Duration
+	// Jitter is the fraction, between 0 and 1, of each delay which is
+	// randomised to avoid synchronised retries.
+	Jitter float64
+	// HonourRetryAfter makes the delay suggested by a `Retry-After` header
+	// take the place of the computed one, up to MaxBackoff.
+	HonourRetryAfter bool
+	// RetryableStatuses lists the response statuses to be retried: values
+	// from 1 to 5 match a whole class (5 matches every 5xx status), the
+	// others match the exact status.
+	RetryableStatuses []int
+}
+
+// DefaultRetryPolicy returns the policy used by new streams: three attempts
+// with jittered exponential backoff, honouring `Retry-After`, retrying
+// `408 Request Timeout`, `429 Too Many Requests` and every 5xx status.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:       DefaultMaxAttempts,
+		MinBackoff:        DefaultMinBackoff,
+		MaxBackoff:        DefaultMaxBackoff,
+		Jitter:            DefaultJitter,
+		HonourRetryAfter:  true,
+		RetryableStatuses: []int{http.StatusRequestTimeout, http.StatusTooManyRequests, 5},
+	}
+}
+
+// retryable reports whether provided response status can be retried.
+func (p *RetryPolicy) retryable(status int) bool {
+	for _, s := range p.RetryableStatuses {
+		if s == status || s >= 1 && s <= 5 && status/100 == s {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the delay preceding provided retry, starting from 1.
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	delay := p.MinBackoff
+	for i := 1; i < retry && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	if p.Jitter > 0 && delay > 0 {
+		jitter := p.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		delay -= time.Duration(rand.Float64() * jitter * float64(delay))
+	}
+	return delay
+}
+
+// StatusError is the error returned when the endpoint answers with a non-2xx
+// status; it carries the response details.
+type StatusError struct {
+	StatusCode int         // Response status code;
+	Status     string      // Response status line;
+	Header     http.Header // Response headers;
+	Body       []byte      // Response body, truncated to 4 KiB.
+}
+
+// Error function defined to implement the error interface.
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status `%s`: %s", e.Status, strings.TrimSpace(string(e.Body)))
+}
+
+// Failure describes a request given up after all the attempts allowed by
+// the retry policy.
+type Failure struct {
+	Body     []byte       // Request body;
+	Attempts int          // Number of attempts performed;
+	Err      error        // Last error, a *StatusError for non-2xx responses;
+	Response *StatusError // Last response details, nil on transport errors;
+	Endpoint string       // URL of the endpoint of the last attempt;
+	Spooled  bool         // Whether the body is kept in the spool for later.
+}
+
+// deliver sends provided queued record retrying according to the retry
+// policy, to as many endpoints as the replication requires. It returns the
+// failure when the request is given up, nil on success.
+func (h *Stream) deliver(record []byte) *Failure {
+	t, body, err := decodeRecord(record)
+	if err != nil {
+		return &Failure{Body: record, Err: err}
+	}
+	// Bodies are compressed once for all the attempts.
+	payload, encoding, err := h.compress(body)
+	if err != nil {
+		return &Failure{Body: body, Err: err}
+	}
+
+	replicas := h.pickReplicas(t)
+	if len(replicas) <= 1 {
+		var first *endpoint
+		if len(replicas) == 1 {
+			first = replicas[0]
+		}
+		return h.retryRequest(body, payload, encoding, t, first, nil)
+	}
+
+	// Replicas are sent concurrently, each one retried on its own while
+	// avoiding the endpoints of the others.
+	failures := make([]*Failure, len(replicas))
+	var group sync.WaitGroup
+	for i := range replicas {
+		exclude := make([]*endpoint, 0, len(replicas)-1)
+		exclude = append(exclude, replicas[:i]...)
+		exclude = append(exclude, replicas[i+1:]...)
+		group.Add(1)
+		go func(i int, exclude []*endpoint) {
+			defer group.Done()
+			failures[i] = h.retryRequest(body, payload, encoding, t, replicas[i], exclude)
+		}(i, exclude)
+	}
+	group.Wait()
+
+	var failed []*Failure
+	for _, failure := range failures {
+		if failure != nil {
+			failed = append(failed, failure)
+		}
+	}
+	if len(failed) == len(replicas) {
+		return failed[0]
+	}
+	// The record is delivered, the failed replicas are only reported.
+	for _, failure := range failed {
+		h.reportFailure(failure)
+	}
+	return nil
+}
+
+// retryRequest performs the attempts allowed by the retry policy for provided
+// compressed payload, starting from provided endpoint, if any, and avoiding
+// the excluded ones. It returns the failure when the request is given up.
+func (h *Stream) retryRequest(body, payload []byte, encoding string, t *target, first *endpoint, exclude []*endpoint) *Failure {
+	policy := h.retry
+	for attempt := 1; ; attempt++ {
+		e := first
+		if attempt > 1 && routed(t) {
+			e = h.pickEndpoint(exclude)
+		}
+		endpointURL, err := h.send(payload, encoding, t, e)
+		if err == nil {
+			return nil
+		}
+
+		statusErr, _ := err.(*StatusError)
+		retryable := statusErr == nil || policy.retryable(statusErr.StatusCode)
+		if !retryable || attempt >= policy.MaxAttempts {
+			return &Failure{Body: body, Attempts: attempt, Err: err, Response: statusErr, Endpoint: endpointURL}
+		}
+
+		delay := policy.backoff(attempt)
+		if statusErr != nil && policy.HonourRetryAfter {
+			// The suggested delay is bounded so that a misbehaving server
+			// cannot stall the delivery.
+			if retryAfter := parseRetryAfter(statusErr.Header.Get("Retry-After")); retryAfter > 0 {
+				delay = retryAfter
+				if policy.MaxBackoff > 0 && delay > policy.MaxBackoff {
+					delay = policy.MaxBackoff
+				}
+			}
+		}
+		if !h.sleep(delay) {
+			return &Failure{Body: body, Attempts: attempt, Err: err, Response: statusErr, Endpoint: endpointURL}
+		}
+	}
+}
+
+// sleep waits provided delay returning false if the stream gets closed
+// meanwhile.
+func (h *Stream) sleep(delay time.Duration) bool {
+	select {
+	case <-time.After(delay):
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+// parseRetryAfter parses a `Retry-After` header value expressed either in
+// seconds or as an HTTP date; zero is returned when the value is missing or
+// invalid.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
@@ -0,0 +1,215 @@
+package http
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"gonyan"
+)
+
+// TestRetryPolicyRetryable verifies the status classes matching.
+func TestRetryPolicyRetryable(t *testing.T) {
+	policy := DefaultRetryPolicy()
+	cases := map[int]bool{
+		http.StatusOK:                  false,
+		http.StatusBadRequest:          false,
+		http.StatusRequestTimeout:      true,
+		http.StatusTooManyRequests:     true,
+		http.StatusInternalServerError: true,
+		http.StatusGatewayTimeout:      true,
+	}
+	for status, expected := range cases {
+		if policy.retryable(status) != expected {
+			t.Fatalf("Unexpected retryable value for status %d. Expected: %t.", status, expected)
+		}
+	}
+
+	policy.RetryableStatuses = []int{4}
+	if !policy.retryable(http.StatusNotFound) || policy.retryable(http.StatusBadGateway) {
+		t.Fatalf("The 4xx class should be retryable, 5xx not.")
+	}
+}
+
+// TestRetryPolicyBackoff verifies the exponential growth, the cap and the
+// jitter bounds.
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	expected := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, e := range expected {
+		if delay := policy.backoff(i + 1); delay != e*time.Millisecond {
+			t.Fatalf("Unexpected delay for retry %d. Expected: %s - Found: %s.", i+1, e*time.Millisecond, delay)
+		}
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if delay := policy.backoff(2); delay > 200*time.Millisecond || delay < 100*time.Millisecond {
+			t.Fatalf("Jittered delay out of bounds: %s.", delay)
+		}
+	}
+}
+
+// TestParseRetryAfter verifies both the supported formats.
+func TestParseRetryAfter(t *testing.T) {
+	if d := parseRetryAfter("3"); d != 3*time.Second {
+		t.Fatalf("Unexpected delay: %s.", d)
+	}
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if d := parseRetryAfter(date); d < 58*time.Second || d > time.Minute {
+		t.Fatalf("Unexpected delay: %s.", d)
+	}
+	if parseRetryAfter("") != 0 || parseRetryAfter("soon") != 0 {
+		t.Fatalf("Invalid values should result in no delay.")
+	}
+}
+
+// TestDeliverRetries verifies that retryable failures are retried and
+// that non-retryable ones are given up immediately, reporting the response.
+func TestDeliverRetries(t *testing.T) {
+	mtx := &sync.Mutex{}
+	statuses := []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK}
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		status := statuses[attempts%len(statuses)]
+		attempts++
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "1")
+		}
+		w.WriteHeader(status)
+		w.Write([]byte("details"))
+	}))
+	defer ts.Close()
+
+	s := NewStream(ts.URL)
+	s.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, MinBackoff: 10 * time.Millisecond, MaxBackoff: time.Second, HonourRetryAfter: true, RetryableStatuses: []int{429, 5}})
+	start := time.Now()
+	if failure := s.deliver(encodeRecord(nil, []byte("hey"))); failure != nil {
+		t.Fatalf("Unexpected failure: %s", failure.Err.Error())
+	}
+	if attempts != 3 {
+		t.Fatalf("Unexpected number of attempts. Expected: %d - Found: %d.", 3, attempts)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("Retry-After should have been honoured. Elapsed: %s.", elapsed)
+	}
+
+	statuses = []int{http.StatusBadRequest}
+	attempts = 0
+	failure := s.deliver(encodeRecord(nil, []byte("hey")))
+	if failure == nil || failure.Attempts != 1 || attempts != 1 {
+		t.Fatalf("Non-retryable failures should be given up immediately. Found: %+v.", failure)
+	}
+	if failure.Response == nil || failure.Response.StatusCode != http.StatusBadRequest || string(failure.Response.Body) != "details" || string(failure.Body) != "hey" {
+		t.Fatalf("Unexpected failure details: %+v - %+v.", failure, failure.Response)
+	}
+	if failure.Err.Error() != "unexpected status `400 Bad Request`: details" {
+		t.Fatalf("Unexpected error: %s.", failure.Err.Error())
+	}
+
+	statuses = []int{http.StatusBadGateway}
+	attempts = 0
+	s.SetRetryPolicy(RetryPolicy{MaxAttempts: 2, RetryableStatuses: []int{5}})
+	if failure := s.deliver(encodeRecord(nil, []byte("hey"))); failure == nil || failure.Attempts != 2 || attempts != 2 {
+		t.Fatalf("Retryable failures should be given up after the max attempts. Found: %+v.", failure)
+	}
+}
+
+// TestDeliverRetryAfterLimit verifies that the `Retry-After` delay is
+// bounded by the max backoff.
+func TestDeliverRetryAfterLimit(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer ts.Close()
+
+	s := NewStream(ts.URL)
+	s.SetRetryPolicy(RetryPolicy{MaxAttempts: 2, MinBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond, HonourRetryAfter: true, RetryableStatuses: []int{429}})
+	start := time.Now()
+	if failure := s.deliver(encodeRecord(nil, []byte("hey"))); failure == nil || failure.Attempts != 2 {
+		t.Fatalf("The request should be given up after the max attempts. Found: %+v.", failure)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Retry-After should be bounded by the max backoff. Elapsed: %s.", elapsed)
+	}
+}
+
+// TestWriteFailureFn verifies that asynchronous failures reach the failure
+// callback and that spooled bodies refused by the endpoint are dropped.
+func TestWriteFailureFn(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}))
+	defer ts.Close()
+
+	failures := make(chan *Failure, 2)
+	s := NewStream(ts.URL).SetFailureFn(func(f *Failure) { failures <- f })
+	s.Write([]byte("refused"))
+
+	select {
+	case failure := <-failures:
+		if string(failure.Body) != "refused" || failure.Response.StatusCode != http.StatusUnprocessableEntity || failure.Spooled {
+			t.Fatalf("Unexpected failure: %+v.", failure)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The failure callback was not invoked.")
+	}
+
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+	spool, _ := NewSpool(dir, 0)
+	s.SetSpool(spool)
+	defer s.Close()
+	s.Write([]byte("dropped"))
+
+	select {
+	case failure := <-failures:
+		if string(failure.Body) != "dropped" || failure.Spooled {
+			t.Fatalf("Unexpected failure: %+v.", failure)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The failure callback was not invoked.")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for spool.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if spool.Len() != 0 {
+		t.Fatalf("Refused bodies should be dropped from the spool.")
+	}
+}
+
+// TestWriteCircuitBreaker verifies that the failed deliveries open the
+// circuit breaker wrapping the stream.
+func TestWriteCircuitBreaker(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	s := NewStream(ts.URL).SetRetryPolicy(RetryPolicy{MaxAttempts: 1}).SetFailureFn(func(*Failure) {})
+	defer s.Close()
+	breaker := gonyan.NewCircuitBreakerStream(s)
+	breaker.SetFailureThreshold(2)
+	s.SetCircuitBreaker(breaker)
+
+	for i := 0; i < 2; i++ {
+		if _, err := breaker.Write([]byte("log")); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for breaker.State() != gonyan.CircuitOpen && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := breaker.Write([]byte("log")); err != gonyan.ErrCircuitOpen {
+		t.Fatalf("The failed deliveries should have opened the circuit. Found: %v.", err)
+	}
+}
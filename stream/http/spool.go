@@ -0,0 +1,419 @@
+package http
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultSpoolSize defines the default maximum size, in bytes, of a Spool.
+const DefaultSpoolSize = 64 << 20
+
+// DefaultSegmentSize defines the default maximum size, in bytes, of a single
+// Spool segment file.
+const DefaultSegmentSize = 1 << 20
+
+// segmentExtension is the file extension of Spool segments.
+const segmentExtension = ".seg"
+
+// cursorFile is the name of the file keeping the acknowledged position.
+const cursorFile = "cursor"
+
+// recordHeaderSize is the size of the header preceding every record: the
+// payload length and its CRC-32, both as 4 bytes big endian integers.
+const recordHeaderSize = 8
+
+// ErrRecordTooLarge is returned when a record cannot fit in the Spool.
+var ErrRecordTooLarge = errors.New("record exceeds the spool size")
+
+// ErrSpoolClosed is returned when using a closed Spool.
+var ErrSpoolClosed = errors.New("spool closed")
+
+// Spool is a durable, segment based, on-disk FIFO queue used as write-ahead
+// log by the HTTP Stream: request bodies are appended to the Spool before
+// being sent and removed only once acknowledged, so that endpoint outages and
+// process restarts do not lose logs.
+//
+// Records are appended to segment files inside the Spool directory; a new
+// segment is started when the current one reaches the segment size and
+// segments are deleted once all their records are acknowledged. When the
+// total size exceeds the configured maximum, the oldest segments are evicted
+// even if not sent yet. Records are written to the operating system on
+// Append, but not synced to the disk.
+type Spool struct {
+	dir         string        // Directory holding the segments;
+	maxSize     int64         // Maximum total size of the segments;
+	segmentSize int64         // Maximum size of a single segment;
+	segments    []*segment    // Segments, from the oldest to the newest;
+	nextID      uint64        // Identifier of the next segment;
+	size        int64         // Total size of the segments;
+	active      *os.File      // Segment appended to, nil when none;
+	reader      *os.File      // Open handle on the oldest segment;
+	readOffset  int64         // Offset of the next record in the oldest segment;
+	readIndex   int           // Acknowledged records in the oldest segment;
+	pending     []byte        // Record returned by Peek, not yet acknowledged;
+	dropped     int64         // Records evicted before being acknowledged;
+	closed      bool          // Whether the Spool has been closed;
+	notify      chan struct{} // Signalled whenever a record is appended;
+	mutex       sync.Mutex    // Mutex for all the above.
+}
+
+// segment describes a Spool segment file.
+type segment struct {
+	id      uint64 // Increasing segment identifier;
+	size    int64  // Size of the valid records in the file;
+	records int    // Number of records in the file.
+}
+
+// NewSpool opens, or creates, the Spool stored in provided directory capping
+// its size to maxSize bytes; a non-positive size selects DefaultSpoolSize.
+// Records left unacknowledged by a previous process are kept and returned
+// first by Peek.
+func NewSpool(dir string, maxSize int64) (*Spool, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultSpoolSize
+	}
+	segmentSize := int64(DefaultSegmentSize)
+	if maxSize/4 < segmentSize {
+		segmentSize = maxSize / 4
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("spool directory creation failed due to: %s", err.Error())
+	}
+	s := &Spool{
+		dir:         dir,
+		maxSize:     maxSize,
+		segmentSize: segmentSize,
+		segments:    []*segment{},
+		nextID:      1,
+		notify:      make(chan struct{}, 1),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load scans the existing segments and restores the acknowledged position.
+// New segments are given identifiers greater than both the existing segments
+// and the cursor, so that a stale cursor never matches them.
+func (s *Spool) load() error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("spool directory read failed due to: %s", err.Error())
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, segmentExtension) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+		seg, err := s.scan(id)
+		if err != nil {
+			return err
+		}
+		s.segments = append(s.segments, seg)
+		s.size += seg.size
+		if id >= s.nextID {
+			s.nextID = id + 1
+		}
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].id < s.segments[j].id })
+
+	content, err := ioutil.ReadFile(filepath.Join(s.dir, cursorFile))
+	if err != nil {
+		return nil
+	}
+	var id uint64
+	var offset int64
+	var index int
+	if _, err := fmt.Sscanf(string(content), "%d %d %d", &id, &offset, &index); err != nil {
+		return nil
+	}
+	if id >= s.nextID {
+		s.nextID = id + 1
+	}
+	// Segments preceding the cursor were completely acknowledged.
+	for len(s.segments) > 0 && s.segments[0].id < id {
+		s.removeHead()
+	}
+	if len(s.segments) > 0 && s.segments[0].id == id && offset <= s.segments[0].size {
+		s.readOffset = offset
+		s.readIndex = index
+	}
+	return nil
+}
+
+// scan reads provided segment counting its valid records. A truncated or
+// corrupted tail, left by an interrupted write, is ignored.
+func (s *Spool) scan(id uint64) (*segment, error) {
+	file, err := os.Open(s.segmentPath(id))
+	if err != nil {
+		return nil, fmt.Errorf("spool segment open failed due to: %s", err.Error())
+	}
+	defer file.Close()
+
+	seg := &segment{id: id}
+	for {
+		record, err := readRecord(file, seg.size)
+		if err != nil {
+			return seg, nil
+		}
+		seg.size += recordHeaderSize + int64(len(record))
+		seg.records++
+	}
+}
+
+// Append durably queues provided record.
+func (s *Spool) Append(record []byte) error {
+	recordSize := recordHeaderSize + int64(len(record))
+	if recordSize > s.maxSize {
+		return ErrRecordTooLarge
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return ErrSpoolClosed
+	}
+
+	// Evict the oldest segments to make room, sealing the active one when
+	// it is the only segment left.
+	for s.size+recordSize > s.maxSize && len(s.segments) > 0 {
+		if len(s.segments) == 1 && s.active != nil {
+			if err := s.seal(); err != nil {
+				return err
+			}
+		}
+		s.dropped += int64(s.segments[0].records - s.readIndex)
+		s.removeHead()
+	}
+
+	if s.active != nil {
+		if active := s.segments[len(s.segments)-1]; active.size > 0 && active.size+recordSize > s.segmentSize {
+			if err := s.seal(); err != nil {
+				return err
+			}
+		}
+	}
+	if s.active == nil {
+		if err := s.startSegment(); err != nil {
+			return err
+		}
+	}
+
+	buffer := make([]byte, recordSize)
+	binary.BigEndian.PutUint32(buffer[0:4], uint32(len(record)))
+	binary.BigEndian.PutUint32(buffer[4:8], crc32.ChecksumIEEE(record))
+	copy(buffer[recordHeaderSize:], record)
+	if _, err := s.active.Write(buffer); err != nil {
+		return fmt.Errorf("spool write failed due to: %s", err.Error())
+	}
+	active := s.segments[len(s.segments)-1]
+	active.size += recordSize
+	active.records++
+	s.size += recordSize
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Peek returns the oldest unacknowledged record, or nil when the Spool is
+// empty. Repeated calls return the same record until Ack is invoked.
+func (s *Spool) Peek() ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil, ErrSpoolClosed
+	}
+
+	for s.pending == nil && len(s.segments) > 0 {
+		head := s.segments[0]
+		if s.readOffset < head.size {
+			if s.reader == nil {
+				reader, err := os.Open(s.segmentPath(head.id))
+				if err != nil {
+					return nil, fmt.Errorf("spool segment open failed due to: %s", err.Error())
+				}
+				s.reader = reader
+			}
+			record, err := readRecord(s.reader, s.readOffset)
+			if err != nil {
+				return nil, fmt.Errorf("spool read failed due to: %s", err.Error())
+			}
+			s.pending = record
+			break
+		}
+		if len(s.segments) == 1 && s.active != nil {
+			// Everything has been acknowledged.
+			break
+		}
+		s.removeHead()
+		s.saveCursor()
+	}
+	return s.pending, nil
+}
+
+// Ack acknowledges the record returned by the last Peek, removing it from the
+// Spool.
+func (s *Spool) Ack() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.pending == nil {
+		// The record has been evicted meanwhile.
+		return nil
+	}
+	s.readOffset += recordHeaderSize + int64(len(s.pending))
+	s.readIndex++
+	s.pending = nil
+	return s.saveCursor()
+}
+
+// Len returns the number of unacknowledged records.
+func (s *Spool) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	count := 0
+	for _, seg := range s.segments {
+		count += seg.records
+	}
+	if len(s.segments) > 0 {
+		count -= s.readIndex
+	}
+	return count
+}
+
+// Size returns the total size, in bytes, of the Spool segments.
+func (s *Spool) Size() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.size
+}
+
+// Dropped returns the number of records evicted, because of the size cap,
+// before being acknowledged.
+func (s *Spool) Dropped() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.dropped
+}
+
+// Close syncs and closes the segment files. Unacknowledged records are kept
+// on disk for the next NewSpool on the same directory.
+func (s *Spool) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.reader != nil {
+		s.reader.Close()
+		s.reader = nil
+	}
+	if s.active != nil {
+		return s.seal()
+	}
+	return nil
+}
+
+// startSegment creates a new active segment. It *must* be called holding the
+// lock.
+func (s *Spool) startSegment() error {
+	id := s.nextID
+	file, err := os.OpenFile(s.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("spool segment creation failed due to: %s", err.Error())
+	}
+	s.active = file
+	s.nextID++
+	s.segments = append(s.segments, &segment{id: id})
+	return nil
+}
+
+// seal syncs and closes the active segment. It *must* be called holding the
+// lock.
+func (s *Spool) seal() error {
+	file := s.active
+	s.active = nil
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("spool segment sync failed due to: %s", err.Error())
+	}
+	return file.Close()
+}
+
+// removeHead deletes the oldest segment resetting the read position. It
+// *must* be called holding the lock.
+func (s *Spool) removeHead() {
+	head := s.segments[0]
+	if s.reader != nil {
+		s.reader.Close()
+		s.reader = nil
+	}
+	if len(s.segments) == 1 && s.active != nil {
+		s.active.Close()
+		s.active = nil
+	}
+	os.Remove(s.segmentPath(head.id))
+	s.segments = s.segments[1:]
+	s.size -= head.size
+	s.readOffset = 0
+	s.readIndex = 0
+	s.pending = nil
+}
+
+// saveCursor persists the acknowledged position. It *must* be called holding
+// the lock.
+func (s *Spool) saveCursor() error {
+	id := uint64(0)
+	if len(s.segments) > 0 {
+		id = s.segments[0].id
+	}
+	content := fmt.Sprintf("%d %d %d\n", id, s.readOffset, s.readIndex)
+	temporary := filepath.Join(s.dir, cursorFile+".tmp")
+	if err := ioutil.WriteFile(temporary, []byte(content), 0644); err != nil {
+		return fmt.Errorf("spool cursor write failed due to: %s", err.Error())
+	}
+	if err := os.Rename(temporary, filepath.Join(s.dir, cursorFile)); err != nil {
+		return fmt.Errorf("spool cursor write failed due to: %s", err.Error())
+	}
+	return nil
+}
+
+// segmentPath returns the path of provided segment.
+func (s *Spool) segmentPath(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, segmentExtension))
+}
+
+// readRecord reads the record at provided offset verifying its checksum.
+func readRecord(file io.ReaderAt, offset int64) ([]byte, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := file.ReadAt(header, offset); err != nil {
+		return nil, err
+	}
+	record := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+	if _, err := file.ReadAt(record, offset+recordHeaderSize); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(record) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errors.New("corrupted record")
+	}
+	return record, nil
+}
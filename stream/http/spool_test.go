@@ -0,0 +1,175 @@
+package http
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// drain peeks and acknowledges all the records of provided spool.
+func drain(t *testing.T, s *Spool) []string {
+	records := []string{}
+	for {
+		record, err := s.Peek()
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if record == nil {
+			return records
+		}
+		records = append(records, string(record))
+		if err := s.Ack(); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+	}
+}
+
+// TestSpoolOrder verifies that records are returned in order across segments
+// and that acknowledged segments are deleted.
+func TestSpoolOrder(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	s, err := NewSpool(dir, 400)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	defer s.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := s.Append([]byte(fmt.Sprintf("record-%d", i))); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+	}
+	if s.Len() != 10 {
+		t.Fatalf("Unexpected length. Expected: %d - Found: %d.", 10, s.Len())
+	}
+
+	first, _ := s.Peek()
+	again, _ := s.Peek()
+	if string(first) != "record-0" || string(again) != "record-0" {
+		t.Fatalf("Peek should return the same record until acked. Found: `%s`, `%s`.", first, again)
+	}
+
+	records := drain(t, s)
+	for i, record := range records {
+		if record != fmt.Sprintf("record-%d", i) {
+			t.Fatalf("Unexpected record %d: `%s`.", i, record)
+		}
+	}
+	if len(records) != 10 || s.Len() != 0 {
+		t.Fatalf("Unexpected drained records: %d (left %d).", len(records), s.Len())
+	}
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExtension))
+	if len(segments) != 1 {
+		t.Fatalf("Only the active segment should be left. Found: %v.", segments)
+	}
+}
+
+// TestSpoolReplay verifies that unacknowledged records survive a restart,
+// including a torn record at the end of a segment.
+func TestSpoolReplay(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	s, _ := NewSpool(dir, 0)
+	for _, record := range []string{"a", "b", "c"} {
+		s.Append([]byte(record))
+	}
+	s.Peek()
+	s.Ack()
+	s.Close()
+
+	if _, err := s.Peek(); err != ErrSpoolClosed {
+		t.Fatalf("Closed spools should fail. Found: %v.", err)
+	}
+
+	// Simulate an interrupted write.
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExtension))
+	file, _ := os.OpenFile(segments[0], os.O_APPEND|os.O_WRONLY, 0644)
+	file.Write([]byte{0, 0, 0, 9, 1, 2})
+	file.Close()
+
+	s, err := NewSpool(dir, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	s.Append([]byte("d"))
+	records := drain(t, s)
+	s.Close()
+	if fmt.Sprint(records) != "[b c d]" {
+		t.Fatalf("Unexpected replayed records: %v.", records)
+	}
+
+	s, _ = NewSpool(dir, 0)
+	defer s.Close()
+	if s.Len() != 0 {
+		t.Fatalf("Acknowledged records should not be replayed. Found: %d.", s.Len())
+	}
+}
+
+// TestSpoolEviction verifies the oldest-first eviction when the size cap is
+// reached.
+func TestSpoolEviction(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	// 20 bytes records, 50 bytes segments.
+	s, _ := NewSpool(dir, 200)
+	defer s.Close()
+	for i := 0; i < 20; i++ {
+		if err := s.Append([]byte(fmt.Sprintf("record-%05d", i))); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		if s.Size() > 200 {
+			t.Fatalf("Size cap exceeded: %d.", s.Size())
+		}
+	}
+	if s.Dropped() == 0 || int(s.Dropped())+s.Len() != 20 {
+		t.Fatalf("Unexpected counters. Dropped: %d - Len: %d.", s.Dropped(), s.Len())
+	}
+
+	records := drain(t, s)
+	if records[len(records)-1] != "record-00019" || records[0] != fmt.Sprintf("record-%05d", s.Dropped()) {
+		t.Fatalf("The oldest records should have been evicted. Found: %v.", records)
+	}
+
+	if err := s.Append(make([]byte, 300)); err != ErrRecordTooLarge {
+		t.Fatalf("An ErrRecordTooLarge error was expected. Found: %v.", err)
+	}
+}
+
+// TestSpoolEvictionReopen verifies that records appended after an eviction
+// emptying the spool survive a reopen.
+func TestSpoolEvictionReopen(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	s, _ := NewSpool(dir, 200)
+	for i := 0; i < 8; i++ {
+		s.Append([]byte(fmt.Sprintf("record-%05d", i)))
+	}
+	drain(t, s)
+	// The record evicts every segment, the active one included.
+	large := make([]byte, 180)
+	if err := s.Append(large); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	s.Close()
+
+	s, err := NewSpool(dir, 200)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	defer s.Close()
+	record, err := s.Peek()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(record) != len(large) {
+		t.Fatalf("The record appended after the eviction should have been kept. Found: %d bytes.", len(record))
+	}
+}
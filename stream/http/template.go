@@ -0,0 +1,353 @@
+package http
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"gonyan"
+)
+
+// Types of the queued records, stored in their first byte.
+const (
+	recordBody     byte = 0 // The body alone;
+	recordTargeted byte = 1 // The rendered target followed by the body.
+)
+
+// errInvalidRecord is returned for queued records which cannot be decoded.
+var errInvalidRecord = errors.New("invalid queued record")
+
+// target holds the URL and the headers rendered for a request.
+type target struct {
+	url     string            // Complete URL, empty when the endpoint is selected by the stream;
+	query   map[string]string // Query parameters appended to the selected endpoint, nil for the static ones;
+	headers map[string]string // Rendered headers, overriding the static ones.
+}
+
+// TemplateFuncs returns the functions available to the templates:
+//
+//   - json: JSON encoding of the argument;
+//   - upper, lower: case conversion;
+//   - level: canonical label of a level, either a gonyan.LogLevel or a label;
+//   - timestamp: RFC 3339 formatting of a log timestamp;
+//   - formatTime: formatting of a log timestamp with provided layout.
+func TemplateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			encoded, err := json.Marshal(v)
+			return string(encoded), err
+		},
+		"upper": strings.ToUpper,
+		"lower": strings.ToLower,
+		"level": func(v interface{}) string {
+			switch level := v.(type) {
+			case gonyan.LogLevel:
+				return gonyan.GetLevelLabel(level)
+			case int:
+				return gonyan.GetLevelLabel(gonyan.LogLevel(level))
+			case string:
+				if parsed, err := gonyan.ParseLevelLabel(level); err == nil {
+					return gonyan.GetLevelLabel(parsed)
+				}
+				return level
+			default:
+				return fmt.Sprint(v)
+			}
+		},
+		"timestamp": func(timestamp int64) string {
+			return time.Unix(0, timestamp).UTC().Format(time.RFC3339Nano)
+		},
+		"formatTime": func(layout string, timestamp int64) string {
+			return time.Unix(0, timestamp).UTC().Format(layout)
+		},
+	}
+}
+
+// SetURLTemplate sets a text/template rendering the URL of each request
+// from the deserialised gonyan.LogMessage, such as
+// `https://hooks.example.com/{{.Tag}}/{{lower .Level}}`. See TemplateFuncs
+// for the available functions.
+//
+// Once a template is set, every log is sent with its own request unless
+// batching is enabled: in this case consecutive logs rendering the same URL
+// and headers share the batch.
+func (h *Stream) SetURLTemplate(text string) error {
+	t, err := template.New("url").Funcs(TemplateFuncs()).Parse(text)
+	if err != nil {
+		return fmt.Errorf("invalid URL template: %s", err.Error())
+	}
+	h.urlTemplate = t
+	return nil
+}
+
+// SetQueryParamTemplate sets a text/template rendering the value of provided
+// query parameter; as the static ones, query parameters are only used by GET
+// requests.
+func (h *Stream) SetQueryParamTemplate(key, text string) error {
+	t, err := template.New(key).Funcs(TemplateFuncs()).Parse(text)
+	if err != nil {
+		return fmt.Errorf("invalid query parameter template: %s", err.Error())
+	}
+	h.queryTemplates[key] = t
+	return nil
+}
+
+// SetHeaderTemplate sets a text/template rendering the value of provided
+// header, overriding the static one.
+func (h *Stream) SetHeaderTemplate(key, text string) error {
+	t, err := template.New(key).Funcs(TemplateFuncs()).Parse(text)
+	if err != nil {
+		return fmt.Errorf("invalid header template: %s", err.Error())
+	}
+	h.headerTemplates[key] = t
+	return nil
+}
+
+// SetBodyTemplate sets a text/template rendering the body of each log, such
+// as `{"text":{{json .Message}},"severity":"{{upper .Level}}"}`. When
+// batching is enabled it renders each entry of the batch. The custom body
+// prepare function, if any, is applied to the rendered body.
+func (h *Stream) SetBodyTemplate(text string) error {
+	t, err := template.New("body").Funcs(TemplateFuncs()).Parse(text)
+	if err != nil {
+		return fmt.Errorf("invalid body template: %s", err.Error())
+	}
+	h.bodyTemplate = t
+	return nil
+}
+
+// templated reports whether any template has been set.
+func (h *Stream) templated() bool {
+	return h.urlTemplate != nil || h.bodyTemplate != nil || len(h.queryTemplates) > 0 || len(h.headerTemplates) > 0
+}
+
+// render renders the body and the target of provided log, whose serialised
+// form is line. The target is nil when neither URL, query parameters nor
+// headers are templated.
+func (h *Stream) render(message *gonyan.LogMessage, line []byte) ([]byte, *target, error) {
+	body := line
+	if h.bodyTemplate != nil {
+		var buffer bytes.Buffer
+		if err := h.bodyTemplate.Execute(&buffer, message); err != nil {
+			return nil, nil, fmt.Errorf("body template failed due to: %s", err.Error())
+		}
+		body = buffer.Bytes()
+	}
+
+	if h.urlTemplate == nil && len(h.queryTemplates) == 0 && len(h.headerTemplates) == 0 {
+		return body, nil, nil
+	}
+
+	t := &target{headers: make(map[string]string, len(h.headerTemplates))}
+	queryParams := h.queryParams
+	if len(h.queryTemplates) > 0 {
+		queryParams = make(map[string]string, len(h.queryParams)+len(h.queryTemplates))
+		for key, val := range h.queryParams {
+			queryParams[key] = val
+		}
+		for key, t := range h.queryTemplates {
+			var buffer bytes.Buffer
+			if err := t.Execute(&buffer, message); err != nil {
+				return nil, nil, fmt.Errorf("query parameter template failed due to: %s", err.Error())
+			}
+			queryParams[key] = buffer.String()
+		}
+		t.query = queryParams
+	}
+
+	// Without a URL template the endpoint is selected when sending.
+	if h.urlTemplate != nil {
+		var buffer bytes.Buffer
+		if err := h.urlTemplate.Execute(&buffer, message); err != nil {
+			return nil, nil, fmt.Errorf("URL template failed due to: %s", err.Error())
+		}
+		targetURL, err := h.requestURL(buffer.String(), queryParams)
+		if err != nil {
+			return nil, nil, err
+		}
+		t.url, t.query = targetURL, nil
+	}
+
+	for key, headerTemplate := range h.headerTemplates {
+		var buffer bytes.Buffer
+		if err := headerTemplate.Execute(&buffer, message); err != nil {
+			return nil, nil, fmt.Errorf("header template failed due to: %s", err.Error())
+		}
+		t.headers[key] = buffer.String()
+	}
+	return body, t, nil
+}
+
+// rendered holds the body and the target rendered for a log.
+type rendered struct {
+	body   []byte
+	target *target
+}
+
+// writeTemplated renders each log contained in provided bytes and submits,
+// or batches, the results. Nothing is submitted unless all the logs are
+// rendered, so that a failed Write can be retried without duplicates.
+func (h *Stream) writeTemplated(messageBytes []byte) error {
+	lines, err := h.splitLogs(messageBytes)
+	if err != nil {
+		return err
+	}
+	entries := []rendered{}
+	for _, line := range lines {
+		message, err := gonyan.Deserialise(line)
+		if err != nil {
+			message = &gonyan.LogMessage{Message: string(line)}
+		}
+
+		body, t, err := h.render(message, line)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, rendered{body: body, target: t})
+	}
+
+	for _, entry := range entries {
+		var err error
+		if h.batchEncoding != NoBatching {
+			err = h.addToBatch(entry.body, entry.target)
+		} else {
+			_, err = h.submit(entry.body, entry.target)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sameTarget reports whether provided targets are equal.
+func sameTarget(a, b *target) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.url == b.url && (a.query == nil) == (b.query == nil) && samePairs(a.query, b.query) && samePairs(a.headers, b.headers)
+}
+
+// samePairs reports whether provided maps are equal.
+func samePairs(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, val := range a {
+		if other, ok := b[key]; !ok || other != val {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeRecord builds the queued record carrying provided body and target,
+// if any, after the record type. The body is copied as the caller may reuse
+// its buffer.
+func encodeRecord(t *target, body []byte) []byte {
+	if t == nil {
+		return append([]byte{recordBody}, body...)
+	}
+	record := append([]byte{recordTargeted}, encodeString(t.url)...)
+	// The query parameters count is shifted by one, zero standing for nil.
+	if t.query == nil {
+		record = appendUvarint(record, 0)
+	} else {
+		record = encodePairs(appendUvarint(record, 1), t.query)
+	}
+	record = encodePairs(record, t.headers)
+	return append(record, body...)
+}
+
+// decodeRecord extracts target and body from a queued record, the target is
+// nil for records carrying the body alone.
+func decodeRecord(record []byte) (*target, []byte, error) {
+	if len(record) == 0 {
+		return nil, nil, errInvalidRecord
+	}
+	switch record[0] {
+	case recordBody:
+		return nil, record[1:], nil
+	case recordTargeted:
+	default:
+		return nil, nil, errInvalidRecord
+	}
+
+	rest := record[1:]
+	t := &target{}
+	var ok bool
+	if t.url, rest, ok = decodeString(rest); !ok {
+		return nil, nil, errInvalidRecord
+	}
+	hasQuery, n := binary.Uvarint(rest)
+	if n <= 0 {
+		return nil, nil, errInvalidRecord
+	}
+	rest = rest[n:]
+	if hasQuery != 0 {
+		if t.query, rest, ok = decodePairs(rest); !ok {
+			return nil, nil, errInvalidRecord
+		}
+	}
+	if t.headers, rest, ok = decodePairs(rest); !ok {
+		return nil, nil, errInvalidRecord
+	}
+	return t, rest, nil
+}
+
+// encodePairs appends provided key-value pairs prefixed by their count.
+func encodePairs(b []byte, pairs map[string]string) []byte {
+	b = appendUvarint(b, uint64(len(pairs)))
+	for key, val := range pairs {
+		b = append(b, encodeString(key)...)
+		b = append(b, encodeString(val)...)
+	}
+	return b
+}
+
+// decodePairs decodes count prefixed key-value pairs returning the rest.
+func decodePairs(b []byte) (map[string]string, []byte, bool) {
+	count, n := binary.Uvarint(b)
+	if n <= 0 {
+		return nil, nil, false
+	}
+	b = b[n:]
+	pairs := make(map[string]string)
+	for i := uint64(0); i < count; i++ {
+		var key, val string
+		var ok bool
+		if key, b, ok = decodeString(b); !ok {
+			return nil, nil, false
+		}
+		if val, b, ok = decodeString(b); !ok {
+			return nil, nil, false
+		}
+		pairs[key] = val
+	}
+	return pairs, b, true
+}
+
+// encodeString encodes provided string prefixed by its length.
+func encodeString(s string) []byte {
+	return append(appendUvarint(nil, uint64(len(s))), s...)
+}
+
+// decodeString decodes a length prefixed string returning the rest.
+func decodeString(b []byte) (string, []byte, bool) {
+	length, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < length {
+		return "", nil, false
+	}
+	return string(b[n : n+int(length)]), b[n+int(length):], true
+}
+
+// appendUvarint appends provided unsigned varint.
+func appendUvarint(b []byte, v uint64) []byte {
+	buffer := make([]byte, binary.MaxVarintLen64)
+	return append(b, buffer[:binary.PutUvarint(buffer, v)]...)
+}
@@ -0,0 +1,154 @@
+package http
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"gonyan"
+)
+
+// templateRecorder records method, URL, a header and body of the requests.
+type templateRecorder struct {
+	mutex    sync.Mutex
+	requests []string
+}
+
+func (rec *templateRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	payload, _ := ioutil.ReadAll(r.Body)
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	rec.requests = append(rec.requests, fmt.Sprintf("%s|%s|%s", r.URL.RequestURI(), r.Header.Get("X-Severity"), payload))
+}
+
+// TestTemplateFuncs verifies the helper functions.
+func TestTemplateFuncs(t *testing.T) {
+	s := NewStream("")
+	if err := s.SetBodyTemplate(`{{json .Message}} {{upper .Tag}} {{lower .Level}} {{level "error"}} {{level 4}} {{timestamp .Timestamp}} {{formatTime "2006-01-02" .Timestamp}}`); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	line := []byte(`{"tag":"api","timestamp":1500000000000000000,"level":"Warning","message":"say \"hi\""}`)
+	message, _ := gonyan.Deserialise(line)
+	body, rendered, err := s.render(message, line)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	expected := `"say \"hi\"" API warning Error Error 2017-07-14T02:40:00Z 2017-07-14`
+	if string(body) != expected || rendered != nil {
+		t.Fatalf("Unexpected rendering. Expected: `%s` - Found: `%s` (%+v).", expected, body, rendered)
+	}
+
+	for _, set := range []func(string) error{s.SetURLTemplate, s.SetBodyTemplate, func(text string) error {
+		return s.SetHeaderTemplate("k", text)
+	}, func(text string) error {
+		return s.SetQueryParamTemplate("k", text)
+	}} {
+		if set("{{.Unclosed") == nil {
+			t.Fatalf("Invalid templates should fail.")
+		}
+	}
+}
+
+// TestWriteTemplated verifies that each log is sent to its rendered URL with
+// its rendered headers and body, and that batches are split by target.
+func TestWriteTemplated(t *testing.T) {
+	rec := &templateRecorder{}
+	ts := httptest.NewServer(rec)
+	defer ts.Close()
+
+	s := NewStream("").SetMethod(http.MethodGet).SetQueryParam("static", "1").EnableOrdering()
+	s.SetURLTemplate(ts.URL + "/{{.Tag}}/{{lower .Level}}")
+	s.SetQueryParamTemplate("user", `{{index .Metadata "user"}}`)
+	s.SetHeaderTemplate("X-Severity", "{{upper .Level}}")
+	s.SetBodyTemplate(`{"text":{{json .Message}}}`)
+
+	s.Write([]byte(`{"tag":"api","level":"Error","message":"failed","metadata":{"user":"alice"}}` + "\n" + `{"tag":"db","level":"Info","message":"ok"}`))
+	s.Close()
+
+	expected := []string{
+		`/api/error?static=1&user=alice|ERROR|{"text":"failed"}`,
+		`/db/info?static=1&user=|INFO|{"text":"ok"}`,
+	}
+	if fmt.Sprint(rec.requests) != fmt.Sprint(expected) {
+		t.Fatalf("Unexpected requests: %q.", rec.requests)
+	}
+
+	rec.requests = nil
+	s = NewStream("").EnableBatching(JSONArray).SetBatchLinger(time.Hour).EnableOrdering()
+	s.SetURLTemplate(ts.URL + "/{{.Tag}}")
+	s.Write([]byte(`{"tag":"a","message":"1"}` + "\n" + `{"tag":"a","message":"2"}` + "\n" + `{"tag":"b","message":"3"}`))
+	s.Close()
+
+	expected = []string{
+		`/a||[{"tag":"a","message":"1"},{"tag":"a","message":"2"}]`,
+		`/b||[{"tag":"b","message":"3"}]`,
+	}
+	if fmt.Sprint(rec.requests) != fmt.Sprint(expected) {
+		t.Fatalf("Unexpected batched requests: %q.", rec.requests)
+	}
+
+	// Nothing is sent when any log fails rendering.
+	rec.requests = nil
+	s = NewStream(ts.URL)
+	s.SetBodyTemplate(`{{if eq .Tag "bad"}}{{template "missing"}}{{end}}{{.Message}}`)
+	if _, err := s.Write([]byte(`{"tag":"a","message":"1"}` + "\n" + `{"tag":"bad","message":"2"}`)); err == nil {
+		t.Fatalf("An error was expected!")
+	}
+	s.Close()
+	if len(rec.requests) != 0 {
+		t.Fatalf("Unexpected requests: %q.", rec.requests)
+	}
+}
+
+// TestTemplatedSpool verifies that rendered targets survive the spool.
+func TestTemplatedSpool(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	rec := &templateRecorder{}
+	ts := httptest.NewServer(rec)
+	defer ts.Close()
+
+	spool, _ := NewSpool(dir, 0)
+	s := NewStream("")
+	s.SetURLTemplate(ts.URL + "/{{.Tag}}")
+	s.SetHeaderTemplate("X-Severity", "{{.Level}}")
+	s.SetSpool(spool)
+	s.Write([]byte(`{"tag":"spooled","level":"Fatal","message":"m"}`))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for spool.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Close()
+
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	if len(rec.requests) != 1 || rec.requests[0] != `/spooled|Fatal|{"tag":"spooled","level":"Fatal","message":"m"}` {
+		t.Fatalf("Unexpected requests: %q.", rec.requests)
+	}
+
+	decoded, body, err := decodeRecord(encodeRecord(&target{url: "u", headers: map[string]string{"k": "v"}}, []byte("b")))
+	if err != nil || decoded.url != "u" || decoded.headers["k"] != "v" || string(body) != "b" {
+		t.Fatalf("Unexpected record round trip: %+v, `%s`, %v.", decoded, body, err)
+	}
+	decoded, body, err = decodeRecord(encodeRecord(&target{query: map[string]string{"q": "1"}, headers: map[string]string{}}, []byte("b")))
+	if err != nil || decoded.url != "" || decoded.query["q"] != "1" || len(decoded.headers) != 0 || string(body) != "b" {
+		t.Fatalf("Unexpected record round trip: %+v, `%s`, %v.", decoded, body, err)
+	}
+	// Bodies are never mistaken for targets, whatever their content.
+	decoded, body, err = decodeRecord(encodeRecord(nil, encodeRecord(&target{url: "u"}, []byte("b"))))
+	if err != nil || decoded != nil || string(body) != "\x01\x01u\x00\x00b" {
+		t.Fatalf("Unexpected body record: %+v, %q, %v.", decoded, body, err)
+	}
+	for _, record := range [][]byte{nil, []byte("\x02b"), []byte("\x01\x05u")} {
+		if _, _, err := decodeRecord(record); err != errInvalidRecord {
+			t.Fatalf("Record %q should be invalid. Found: %v.", record, err)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// SetTransport allows to replace the RoundTripper of the client shared by
+// the requests. The transport settings of the stream (TLS and proxy) only
+// apply to the default transport.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (h *Stream) SetTransport(transport http.RoundTripper) *Stream {
+	if transport != nil {
+		h.client = &http.Client{Transport: transport, Timeout: h.client.Timeout}
+		h.transport = nil
+	}
+	return h
+}
+
+// SetTimeout sets the maximum duration of each request attempt, by default
+// DefaultTimeout; 0 disables it. The timeout is enforced through the request
+// context, so it applies to custom clients too.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (h *Stream) SetTimeout(timeout time.Duration) *Stream {
+	if timeout >= 0 {
+		h.timeout = timeout
+	}
+	return h
+}
+
+// SetTLSConfig sets the TLS configuration of the default transport; it has
+// no effect once the client or the transport are replaced.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (h *Stream) SetTLSConfig(config *tls.Config) *Stream {
+	if h.transport != nil {
+		h.transport.TLSClientConfig = config
+	}
+	return h
+}
+
+// SetRootCAs sets the certificate authorities used to verify the endpoint
+// certificate in place of the system ones.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (h *Stream) SetRootCAs(pool *x509.CertPool) *Stream {
+	if config := h.tlsConfig(); config != nil {
+		config.RootCAs = pool
+	}
+	return h
+}
+
+// AddRootCAsFromPEM adds the PEM encoded certificates to the certificate
+// authorities used to verify the endpoint certificate; once invoked the
+// system ones are not used anymore.
+func (h *Stream) AddRootCAsFromPEM(pemCerts []byte) error {
+	config := h.tlsConfig()
+	if config == nil {
+		return errors.New("the default transport has been replaced")
+	}
+	if config.RootCAs == nil {
+		config.RootCAs = x509.NewCertPool()
+	}
+	if !config.RootCAs.AppendCertsFromPEM(pemCerts) {
+		return errors.New("no valid PEM certificate found")
+	}
+	return nil
+}
+
+// SetClientCertificate sets the certificate presented to endpoints requiring
+// mutual TLS.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (h *Stream) SetClientCertificate(certificate tls.Certificate) *Stream {
+	if config := h.tlsConfig(); config != nil {
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return h
+}
+
+// LoadClientCertificate loads the certificate presented to endpoints
+// requiring mutual TLS from a pair of PEM encoded files.
+func (h *Stream) LoadClientCertificate(certFile, keyFile string) error {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("client certificate load failed due to: %s", err.Error())
+	}
+	if h.tlsConfig() == nil {
+		return errors.New("the default transport has been replaced")
+	}
+	h.SetClientCertificate(certificate)
+	return nil
+}
+
+// SetProxy sets the function selecting the proxy of each request, such as
+// http.ProxyURL; nil disables the proxy. By default the proxy is taken from
+// the environment (HTTP_PROXY, HTTPS_PROXY and NO_PROXY).
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (h *Stream) SetProxy(proxy func(*http.Request) (*url.URL, error)) *Stream {
+	if h.transport != nil {
+		h.transport.Proxy = proxy
+	}
+	return h
+}
+
+// tlsConfig returns the TLS configuration of the default transport, creating
+// it when missing, or nil when the transport has been replaced.
+func (h *Stream) tlsConfig() *tls.Config {
+	if h.transport == nil {
+		return nil
+	}
+	if h.transport.TLSClientConfig == nil {
+		h.transport.TLSClientConfig = &tls.Config{}
+	}
+	return h.transport.TLSClientConfig
+}
+
+// requestURL returns the target URL of the requests to provided base URL
+// with provided query parameters. When HTTPS is enabled plain HTTP URLs, and
+// URLs without a scheme, are rewritten to HTTPS while other schemes are
+// refused.
+func (h *Stream) requestURL(targetURL string, queryParams map[string]string) (string, error) {
+	if h.useHTTPS {
+		separator := strings.Index(targetURL, "://")
+		switch {
+		case separator < 0:
+			targetURL = "https://" + targetURL
+		case strings.EqualFold(targetURL[:separator], "http"):
+			targetURL = "https" + targetURL[separator:]
+		case !strings.EqualFold(targetURL[:separator], "https"):
+			return "", fmt.Errorf("HTTPS is enabled but the URL scheme is `%s`", targetURL[:separator])
+		}
+	}
+
+	// Prepare GET Query parameters for GET method.
+	if h.method == http.MethodGet {
+		getParams := url.Values{}
+		for key, val := range queryParams {
+			getParams.Add(key, val)
+		}
+		targetURL += "?" + getParams.Encode()
+	}
+	return targetURL, nil
+}
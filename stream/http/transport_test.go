@@ -0,0 +1,159 @@
+package http
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// selfSignedCertificate generates a certificate for 127.0.0.1.
+func selfSignedCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unexpected key error: %s", err.Error())
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gonyan"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Unexpected certificate error: %s", err.Error())
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// TestRequestURL verifies the HTTPS enforcement.
+func TestRequestURL(t *testing.T) {
+	cases := []struct {
+		url      string
+		https    bool
+		expected string
+	}{
+		{"http://host/path", false, "http://host/path"},
+		{"http://host/path", true, "https://host/path"},
+		{"HTTP://host/path", true, "https://host/path"},
+		{"https://host/path", true, "https://host/path"},
+		{"host:8080/path", true, "https://host:8080/path"},
+		{"ftp://host/path", true, ""},
+	}
+	for _, c := range cases {
+		s := NewStream(c.url)
+		if c.https {
+			s.EnableHTTPS()
+		}
+		targetURL, err := s.requestURL(s.url, s.queryParams)
+		if c.expected == "" {
+			if err == nil {
+				t.Fatalf("An error was expected for `%s`.", c.url)
+			}
+			continue
+		}
+		if err != nil || targetURL != c.expected {
+			t.Fatalf("Unexpected URL for `%s`. Expected: `%s` - Found: `%s` (%v).", c.url, c.expected, targetURL, err)
+		}
+	}
+}
+
+// TestTLSAndMutualTLS verifies the custom CA pool, the HTTPS rewrite and the
+// client certificate.
+func TestTLSAndMutualTLS(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) != 1 || r.TLS.PeerCertificates[0].Subject.CommonName != "gonyan" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	ts.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	ts.StartTLS()
+	defer ts.Close()
+
+	plainURL := strings.Replace(ts.URL, "https://", "http://", 1)
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+
+	// Without the CA pool the certificate is not trusted.
+	s := NewStream(plainURL).EnableHTTPS().SetRetryPolicy(RetryPolicy{MaxAttempts: 1})
+	if err := deliverBody(s, []byte("hey")); err == nil {
+		t.Fatalf("The server certificate should not be trusted.")
+	}
+
+	if err := s.AddRootCAsFromPEM(certificate); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if err := s.AddRootCAsFromPEM([]byte("garbage")); err == nil {
+		t.Fatalf("Invalid PEM certificates should fail.")
+	}
+	// Without a client certificate the handshake fails.
+	if err := deliverBody(s, []byte("hey")); err == nil {
+		t.Fatalf("The request should fail without a client certificate.")
+	}
+
+	s.SetClientCertificate(selfSignedCertificate(t))
+	if err := deliverBody(s, []byte("hey")); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	s = NewStream(ts.URL).SetRootCAs(pool).SetClientCertificate(selfSignedCertificate(t))
+	if err := deliverBody(s, []byte("hey")); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	// Settings do not apply to replaced transports.
+	s = NewStream(ts.URL).SetTransport(&http.Transport{})
+	if err := s.AddRootCAsFromPEM(certificate); err == nil {
+		t.Fatalf("Replaced transports should not be configured.")
+	}
+	if err := s.LoadClientCertificate("missing.crt", "missing.key"); err == nil {
+		t.Fatalf("Missing certificates should fail.")
+	}
+}
+
+// TestTimeoutAndProxy verifies the request timeout and the proxy setting.
+func TestTimeoutAndProxy(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	s := NewStream(ts.URL).SetTimeout(50 * time.Millisecond).SetRetryPolicy(RetryPolicy{MaxAttempts: 1})
+	start := time.Now()
+	if err := deliverBody(s, []byte("hey")); err == nil {
+		t.Fatalf("The request should have timed out.")
+	}
+	if time.Since(start) > 400*time.Millisecond {
+		t.Fatalf("The timeout was not enforced.")
+	}
+
+	proxied := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied <- r.URL.String()
+	}))
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	s = NewStream("http://logs.example.invalid/ingest").SetProxy(http.ProxyURL(proxyURL))
+	if err := deliverBody(s, []byte("hey")); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if target := <-proxied; target != "http://logs.example.invalid/ingest" {
+		t.Fatalf("Unexpected proxied request: `%s`.", target)
+	}
+}
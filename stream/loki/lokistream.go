@@ -0,0 +1,385 @@
+// Package loki contains definition of the Gonyan Stream pushing logs to
+// Grafana Loki through its `/loki/api/v1/push` JSON endpoint.
+//
+// Each Write call is treated as a batch: the payload is split using the
+// default BufferedStream separator and every serialised LogMessage becomes a
+// Loki entry. Wrap the Stream in a gonyan.BufferedStream to push logs in
+// batches:
+//
+//	lokiStream := loki.NewStream("http://loki:3100").SetMetadataLabels("service", "env")
+//	buffered := gonyan.NewBufferedStream(lokiStream)
+//	buffered.SetBufferLimit(1000)
+//	buffered.SetSchedulingInterval(2*time.Second, true)
+package loki
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gonyan"
+)
+
+// PushPath is the path of the Loki push API, appended to the base URL.
+const PushPath = "/loki/api/v1/push"
+
+// DefaultMaxAttempts defines the default number of push attempts performed
+// before giving up on a batch.
+const DefaultMaxAttempts = 5
+
+// DefaultMinBackoff defines the default delay before the first retry.
+const DefaultMinBackoff = 100 * time.Millisecond
+
+// DefaultMaxBackoff defines the default upper bound for retry delays.
+const DefaultMaxBackoff = 5 * time.Second
+
+// DefaultTimeout defines the default timeout of each push request.
+const DefaultTimeout = 10 * time.Second
+
+// DefaultMaxLabelSets defines the default number of label sets whose last
+// pushed timestamp is remembered.
+const DefaultMaxLabelSets = 1000
+
+// Stream defines the Gonyan Stream for Grafana Loki.
+type Stream struct {
+	url            string                   // Loki push URL;
+	client         *http.Client             // HTTP client used for pushes;
+	headers        map[string]string        // HTTP headers container;
+	labels         map[string]string        // Static labels added to every stream;
+	tagLabel       string                   // Label name holding the logger tag;
+	levelLabel     string                   // Label name holding the log level;
+	metadataLabels []string                 // Metadata keys promoted to labels;
+	maxAttempts    int                      // Push attempts for each batch;
+	minBackoff     time.Duration            // Delay before the first retry;
+	maxBackoff     time.Duration            // Upper bound of retry delays;
+	lastTimestamp  map[string]*list.Element // Last timestamp pushed per label set;
+	labelSets      *list.List               // Label sets, most recently pushed first;
+	maxLabelSets   int                      // Maximum number of remembered label sets;
+	pushMutex      sync.Mutex               // Mutex serialising pushes.
+}
+
+// labelSetTimestamp holds the last timestamp pushed for a label set.
+type labelSetTimestamp struct {
+	key       string
+	timestamp int64
+}
+
+// NewStream creates a new Loki stream pushing to the Loki instance reachable
+// at provided base URL (e.g. `http://loki:3100`).
+func NewStream(baseURL string) *Stream {
+	return &Stream{
+		url:            strings.TrimSuffix(baseURL, "/") + PushPath,
+		client:         &http.Client{Timeout: DefaultTimeout},
+		headers:        make(map[string]string),
+		labels:         make(map[string]string),
+		tagLabel:       "tag",
+		levelLabel:     "level",
+		metadataLabels: []string{},
+		maxAttempts:    DefaultMaxAttempts,
+		minBackoff:     DefaultMinBackoff,
+		maxBackoff:     DefaultMaxBackoff,
+		lastTimestamp:  make(map[string]*list.Element),
+		labelSets:      list.New(),
+		maxLabelSets:   DefaultMaxLabelSets,
+	}
+}
+
+// SetMaxLabelSets sets the number of label sets whose last pushed timestamp
+// is remembered to keep their entries ordered across pushes, by default
+// DefaultMaxLabelSets; the least recently pushed ones are forgotten beyond
+// it. Values lower than 1 are ignored.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (l *Stream) SetMaxLabelSets(maxLabelSets int) *Stream {
+	if maxLabelSets > 0 {
+		l.pushMutex.Lock()
+		l.maxLabelSets = maxLabelSets
+		l.pushMutex.Unlock()
+	}
+	return l
+}
+
+// SetLabel sets a static label added to every pushed stream.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (l *Stream) SetLabel(key, value string) *Stream {
+	l.labels[sanitiseLabelName(key)] = value
+	return l
+}
+
+// SetTagLabel sets the label name used for the logger tag, by default it is
+// `tag`; an empty name disables the label.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (l *Stream) SetTagLabel(name string) *Stream {
+	l.tagLabel = sanitiseLabelName(name)
+	return l
+}
+
+// SetLevelLabel sets the label name used for the log level, by default it is
+// `level`; an empty name disables the label.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (l *Stream) SetLevelLabel(name string) *Stream {
+	l.levelLabel = sanitiseLabelName(name)
+	return l
+}
+
+// SetMetadataLabels sets the allow-list of metadata keys promoted to stream
+// labels. Keep the list short: every distinct combination of values creates
+// a new Loki stream.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (l *Stream) SetMetadataLabels(keys ...string) *Stream {
+	l.metadataLabels = keys
+	return l
+}
+
+// SetTenantID sets the `X-Scope-OrgID` header used by multi-tenant Loki
+// installations.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (l *Stream) SetTenantID(tenant string) *Stream {
+	return l.SetHeader("X-Scope-OrgID", tenant)
+}
+
+// SetHeader sets provided key-value pair for later usage as HTTP headers.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (l *Stream) SetHeader(key, value string) *Stream {
+	l.headers[key] = value
+	return l
+}
+
+// SetClient allows to replace the HTTP client used for pushes.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (l *Stream) SetClient(client *http.Client) *Stream {
+	if client != nil {
+		l.client = client
+	}
+	return l
+}
+
+// SetRetry configures how pushes failed with a 429 or 5xx status code (or a
+// network error) are retried: up to maxAttempts attempts are performed,
+// waiting an exponentially growing delay between minBackoff and maxBackoff.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (l *Stream) SetRetry(maxAttempts int, minBackoff, maxBackoff time.Duration) *Stream {
+	if maxAttempts > 0 {
+		l.maxAttempts = maxAttempts
+	}
+	if minBackoff > 0 {
+		l.minBackoff = minBackoff
+	}
+	if maxBackoff >= l.minBackoff {
+		l.maxBackoff = maxBackoff
+	}
+	return l
+}
+
+// Write function defined to implement the Stream interface.
+// The function groups the serialised logs by label set and synchronously
+// pushes them to Loki, retrying on rate limiting and server errors.
+func (l *Stream) Write(messageBytes []byte) (int, error) {
+	messages := gonyan.DeserialiseBatch(messageBytes)
+	if len(messages) == 0 {
+		return 0, nil
+	}
+
+	// Pushes are serialised so that entries of the same label set are always
+	// received in order.
+	l.pushMutex.Lock()
+	defer l.pushMutex.Unlock()
+
+	body, err := json.Marshal(l.buildRequest(messages))
+	if err != nil {
+		return 0, fmt.Errorf("push request serialisation failed: %s", err.Error())
+	}
+	if err := l.push(body); err != nil {
+		return 0, err
+	}
+	return len(messageBytes), nil
+}
+
+// pushRequest is the JSON body expected by the Loki push API.
+type pushRequest struct {
+	Streams []pushStream `json:"streams"`
+}
+
+// pushStream holds the entries sharing the same label set; each value is a
+// `[<unix epoch in nanoseconds>, <log line>]` pair.
+type pushStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// buildRequest groups provided messages by label set, preserving both the
+// order in which label sets first appear and the order of the entries.
+// Entry timestamps never go backwards within a label set, since Loki may
+// reject out of order entries.
+// It *must* be called holding the push lock.
+func (l *Stream) buildRequest(messages []*gonyan.LogMessage) *pushRequest {
+	request := &pushRequest{Streams: []pushStream{}}
+	indexes := make(map[string]int)
+
+	for _, message := range messages {
+		labels := l.labelsOf(message)
+		key := labelSetKey(labels)
+
+		i, ok := indexes[key]
+		if !ok {
+			i = len(request.Streams)
+			indexes[key] = i
+			request.Streams = append(request.Streams, pushStream{Stream: labels, Values: [][2]string{}})
+		}
+
+		timestamp := message.Timestamp
+		if timestamp == 0 {
+			timestamp = time.Now().UnixNano()
+		}
+		timestamp = l.advance(key, timestamp)
+
+		line, err := message.Serialise()
+		if err != nil {
+			line = []byte(message.Message)
+		}
+		request.Streams[i].Values = append(request.Streams[i].Values, [2]string{strconv.FormatInt(timestamp, 10), string(line)})
+	}
+	return request
+}
+
+// advance returns provided timestamp of provided label set, moved forward
+// when older than the last one pushed, and remembers it. The least recently
+// pushed label sets are forgotten beyond maxLabelSets.
+// It *must* be called holding the push lock.
+func (l *Stream) advance(key string, timestamp int64) int64 {
+	if element, ok := l.lastTimestamp[key]; ok {
+		last := element.Value.(*labelSetTimestamp)
+		if timestamp < last.timestamp {
+			timestamp = last.timestamp
+		}
+		last.timestamp = timestamp
+		l.labelSets.MoveToFront(element)
+		return timestamp
+	}
+
+	l.lastTimestamp[key] = l.labelSets.PushFront(&labelSetTimestamp{key: key, timestamp: timestamp})
+	for l.labelSets.Len() > l.maxLabelSets {
+		oldest := l.labelSets.Back()
+		l.labelSets.Remove(oldest)
+		delete(l.lastTimestamp, oldest.Value.(*labelSetTimestamp).key)
+	}
+	return timestamp
+}
+
+// labelsOf builds the label set of provided message.
+func (l *Stream) labelsOf(message *gonyan.LogMessage) map[string]string {
+	labels := make(map[string]string, len(l.labels)+len(l.metadataLabels)+2)
+	for key, val := range l.labels {
+		labels[key] = val
+	}
+	for _, key := range l.metadataLabels {
+		if val, ok := message.Metadata[key]; ok && val != "" {
+			labels[sanitiseLabelName(key)] = val
+		}
+	}
+	if l.tagLabel != "" && message.Tag != "" {
+		labels[l.tagLabel] = message.Tag
+	}
+	if l.levelLabel != "" && message.Level != "" {
+		labels[l.levelLabel] = strings.ToLower(message.Level)
+	}
+	return labels
+}
+
+// push sends provided body, retrying it when the failure is transient.
+func (l *Stream) push(body []byte) error {
+	backoff := l.minBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		var retryable bool
+		retryable, err = l.pushOnce(body)
+		if err == nil {
+			return nil
+		}
+		if !retryable || attempt >= l.maxAttempts {
+			break
+		}
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > l.maxBackoff {
+			backoff = l.maxBackoff
+		}
+	}
+	return fmt.Errorf("loki push failed: %s", err.Error())
+}
+
+// pushOnce performs a single push attempt and reports whether a failure can
+// be retried.
+func (l *Stream) pushOnce(body []byte) (bool, error) {
+	request, err := http.NewRequest(http.MethodPost, l.url, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("request creation failed due to: %s", err.Error())
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for key, val := range l.headers {
+		request.Header.Set(key, val)
+	}
+
+	response, err := l.client.Do(request)
+	if err != nil {
+		return true, fmt.Errorf("request execution failed due to: %s", err.Error())
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		io.Copy(ioutil.Discard, response.Body)
+		return false, nil
+	}
+
+	details, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+	retryable := response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500
+	return retryable, fmt.Errorf("unexpected status `%s`: %s", response.Status, strings.TrimSpace(string(details)))
+}
+
+// labelSetKey returns a string uniquely identifying provided label set.
+func labelSetKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var key strings.Builder
+	for _, k := range keys {
+		key.WriteString(k)
+		key.WriteByte('=')
+		key.WriteString(strconv.Quote(labels[k]))
+		key.WriteByte(',')
+	}
+	return key.String()
+}
+
+// sanitiseLabelName converts provided name into a valid Prometheus label
+// name replacing all invalid characters with underscores.
+func sanitiseLabelName(name string) string {
+	sanitised := []byte(name)
+	for i, c := range sanitised {
+		valid := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')
+		if !valid {
+			sanitised[i] = '_'
+		}
+	}
+	return string(sanitised)
+}
@@ -0,0 +1,191 @@
+package loki
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestServer creates a Loki-like server answering with provided status
+// codes in order (the last one is repeated) and collecting received pushes.
+func newTestServer(t *testing.T, statuses ...int) (*httptest.Server, *[]pushRequest, *sync.Mutex) {
+	pushes := &[]pushRequest{}
+	mtx := &sync.Mutex{}
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != PushPath {
+			t.Errorf("Unexpected path. Expected: %s - Found: %s.", PushPath, r.URL.Path)
+		}
+		payload, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("Error reading body: %v", err)
+		}
+		request := pushRequest{}
+		if err := json.Unmarshal(payload, &request); err != nil {
+			t.Errorf("Invalid push body: %s", err.Error())
+		}
+
+		mtx.Lock()
+		status := statuses[len(statuses)-1]
+		if calls < len(statuses) {
+			status = statuses[calls]
+		}
+		calls++
+		*pushes = append(*pushes, request)
+		mtx.Unlock()
+
+		w.WriteHeader(status)
+	}))
+	return ts, pushes, mtx
+}
+
+// TestWriteLabels verifies the label extraction and the grouping of the
+// entries by label set.
+func TestWriteLabels(t *testing.T) {
+	ts, pushes, _ := newTestServer(t, http.StatusNoContent)
+	defer ts.Close()
+
+	s := NewStream(ts.URL+"/").SetLabel("job", "test").SetMetadataLabels("env", "request.id")
+	batch := `{"tag":"app","timestamp":2000,"level":"Error","message":"a","metadata":{"env":"prod","user":"x"}}
+{"tag":"app","timestamp":3000,"level":"Info","message":"b"}
+{"tag":"app","timestamp":1000,"level":"Error","message":"c","metadata":{"env":"prod","request.id":"1"}}
+{"tag":"app","timestamp":1000,"level":"Error","message":"d","metadata":{"env":"prod"}}`
+
+	n, err := s.Write([]byte(batch))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if n != len(batch) {
+		t.Fatalf("Unexpected number of written bytes. Expected: %d - Found: %d.", len(batch), n)
+	}
+
+	if len(*pushes) != 1 {
+		t.Fatalf("Unexpected number of pushes. Expected: %d - Found: %d.", 1, len(*pushes))
+	}
+	streams := (*pushes)[0].Streams
+	if len(streams) != 3 {
+		t.Fatalf("Unexpected number of streams. Expected: %d - Found: %d.", 3, len(streams))
+	}
+
+	first := streams[0]
+	expectedLabels := map[string]string{"job": "test", "tag": "app", "level": "error", "env": "prod"}
+	if len(first.Stream) != len(expectedLabels) {
+		t.Fatalf("Unexpected labels. Expected: %+v - Found: %+v.", expectedLabels, first.Stream)
+	}
+	for key, val := range expectedLabels {
+		if first.Stream[key] != val {
+			t.Fatalf("Unexpected labels. Expected: %+v - Found: %+v.", expectedLabels, first.Stream)
+		}
+	}
+	if len(first.Values) != 2 {
+		t.Fatalf("Unexpected number of values. Expected: %d - Found: %d.", 2, len(first.Values))
+	}
+	// Timestamps never go backwards within a label set.
+	if first.Values[0][0] != "2000" || first.Values[1][0] != "2000" {
+		t.Fatalf("Unexpected timestamps: %+v.", first.Values)
+	}
+	if first.Values[1][1] != `{"tag":"app","timestamp":1000,"level":"Error","message":"d","metadata":{"env":"prod"}}` {
+		t.Fatalf("Unexpected line: %s.", first.Values[1][1])
+	}
+
+	if streams[1].Stream["level"] != "info" {
+		t.Fatalf("Unexpected second stream labels: %+v.", streams[1].Stream)
+	}
+	if streams[2].Stream["request_id"] != "1" {
+		t.Fatalf("Unexpected third stream labels: %+v.", streams[2].Stream)
+	}
+}
+
+// TestWriteRetries verifies that rate limiting and server errors are retried
+// while client errors are not.
+func TestWriteRetries(t *testing.T) {
+	ts, pushes, mtx := newTestServer(t, http.StatusTooManyRequests, http.StatusBadGateway, http.StatusNoContent)
+	defer ts.Close()
+
+	s := NewStream(ts.URL).SetRetry(3, time.Millisecond, 2*time.Millisecond).SetTenantID("tenant")
+	if _, err := s.Write([]byte(`{"tag":"app","message":"a"}`)); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	mtx.Lock()
+	if len(*pushes) != 3 {
+		t.Fatalf("Unexpected number of pushes. Expected: %d - Found: %d.", 3, len(*pushes))
+	}
+	mtx.Unlock()
+
+	ts2, pushes2, _ := newTestServer(t, http.StatusBadRequest)
+	defer ts2.Close()
+
+	s = NewStream(ts2.URL).SetRetry(3, time.Millisecond, time.Millisecond)
+	n, err := s.Write([]byte(`{"tag":"app","message":"a"}`))
+	if err == nil {
+		t.Fatalf("An error was expected!")
+	}
+	if n != 0 {
+		t.Fatalf("Unexpected number of written bytes. Expected: %d - Found: %d.", 0, n)
+	}
+	if len(*pushes2) != 1 {
+		t.Fatalf("Client errors should not be retried. Found %d pushes.", len(*pushes2))
+	}
+}
+
+// TestWriteExhaustedRetries verifies that Write fails once all the attempts
+// have been performed.
+func TestWriteExhaustedRetries(t *testing.T) {
+	ts, pushes, _ := newTestServer(t, http.StatusServiceUnavailable)
+	defer ts.Close()
+
+	s := NewStream(ts.URL).SetRetry(2, time.Millisecond, time.Millisecond)
+	if _, err := s.Write([]byte(`{"message":"a"}`)); err == nil {
+		t.Fatalf("An error was expected!")
+	}
+	if len(*pushes) != 2 {
+		t.Fatalf("Unexpected number of pushes. Expected: %d - Found: %d.", 2, len(*pushes))
+	}
+
+	if n, err := s.Write(nil); n != 0 || err != nil {
+		t.Fatalf("Empty writes should be ignored. Found: %d, %v.", n, err)
+	}
+}
+
+// TestSanitiseLabelName verifies label name sanitisation.
+func TestSanitiseLabelName(t *testing.T) {
+	cases := map[string]string{
+		"valid_name": "valid_name",
+		"1abc":       "_abc",
+		"a-b.c":      "a_b_c",
+		"abc1":       "abc1",
+	}
+	for in, expected := range cases {
+		if found := sanitiseLabelName(in); found != expected {
+			t.Fatalf("Unexpected sanitised name for `%s`. Expected: `%s` - Found: `%s`.", in, expected, found)
+		}
+	}
+}
+
+// TestLastTimestampBound verifies that timestamps keep moving forward per
+// label set while the least recently pushed label sets are forgotten.
+func TestLastTimestampBound(t *testing.T) {
+	s := NewStream("http://loki").SetMaxLabelSets(2)
+	if timestamp := s.advance("a", 10); timestamp != 10 {
+		t.Fatalf("Unexpected timestamp. Expected: %d - Found: %d.", 10, timestamp)
+	}
+	if timestamp := s.advance("a", 5); timestamp != 10 {
+		t.Fatalf("Unexpected timestamp. Expected: %d - Found: %d.", 10, timestamp)
+	}
+	s.advance("b", 20)
+	s.advance("a", 30)
+	s.advance("c", 40)
+	if len(s.lastTimestamp) != 2 || s.labelSets.Len() != 2 {
+		t.Fatalf("Unexpected number of label sets: %d.", len(s.lastTimestamp))
+	}
+	if _, ok := s.lastTimestamp["b"]; ok {
+		t.Fatalf("The least recently pushed label set should have been forgotten.")
+	}
+	if timestamp := s.advance("a", 1); timestamp != 30 {
+		t.Fatalf("Unexpected timestamp. Expected: %d - Found: %d.", 30, timestamp)
+	}
+}
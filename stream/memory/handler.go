@@ -0,0 +1,194 @@
+package memory
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"gonyan"
+)
+
+// DefaultKeepAlive defines how often an idle live-tail connection receives a
+// keep-alive message.
+const DefaultKeepAlive = 15 * time.Second
+
+// Handler is an http.Handler exposing the logs kept by a memory Stream. The
+// endpoint is selected by the last element of the request path:
+//
+//   - `.../entries` (or any other path): the stored logs as a JSON array;
+//   - `.../sse`: Server-Sent Events live-tail of the new logs;
+//   - `.../ws`: WebSocket live-tail of the new logs, one JSON text message
+//     per log.
+//
+// All the endpoints accept the following query parameters: `level` (minimum
+// level label), `tag`, `since` (RFC 3339 time, unix nanoseconds or a
+// duration such as `5m` meaning that long ago), `q` (case insensitive text
+// search) and `limit` (number of most recent stored logs). Live-tail
+// endpoints first send the stored logs matching the filter (none unless
+// `limit` or `since` are provided) and then the new ones; SSE clients
+// reconnecting with `Last-Event-ID` resume where they left.
+//
+// WebSocket upgrades carrying an `Origin` header are accepted only when the
+// origin matches the request host or one of the origins allowed through
+// SetAllowedOrigins, preventing cross-site pages from reading the logs
+// through the browser of a user.
+type Handler struct {
+	stream    *Stream
+	keepAlive time.Duration
+	origins   []string
+}
+
+// NewHandler creates a new Handler exposing provided stream.
+func NewHandler(stream *Stream) *Handler {
+	return &Handler{stream: stream, keepAlive: DefaultKeepAlive}
+}
+
+// SetAllowedOrigins sets the origins (e.g. `https://example.com`) allowed to
+// open WebSocket live-tails besides the request host itself. The `*` origin
+// allows any origin.
+// Note: the method will return the same instance in order to allow the
+// chaining of the configuration methods.
+func (h *Handler) SetAllowedOrigins(origins ...string) *Handler {
+	h.origins = origins
+	return h
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, err := parseFilter(r, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch path.Base(r.URL.Path) {
+	case "sse":
+		h.serveSSE(w, r, filter)
+	case "ws":
+		h.serveWebSocket(w, r, filter)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.stream.Entries(filter))
+	}
+}
+
+// serveSSE streams the logs as Server-Sent Events, each event carries the
+// log sequence number as ID.
+func (h *Handler) serveSSE(w http.ResponseWriter, r *http.Request, filter Filter) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	if lastID, err := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64); err == nil {
+		filter.AfterID = lastID
+		filter.Limit = 0
+	} else if filter.Limit == 0 && filter.Since.IsZero() {
+		filter.AfterID = ^uint64(0)
+	}
+
+	backlog, entries, unsubscribe := h.stream.Subscribe(filter)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(entry *Entry) error {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", entry.ID, data)
+		return err
+	}
+
+	for _, entry := range backlog {
+		if send(entry) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	h.tail(r.Context().Done(), filter, entries, send, func() error {
+		_, err := fmt.Fprint(w, ": keep-alive\n\n")
+		return err
+	}, flusher.Flush)
+}
+
+// tail forwards the new logs matching provided filter until done is closed
+// or a write fails.
+func (h *Handler) tail(done <-chan struct{}, filter Filter, entries <-chan *Entry, send func(*Entry) error, keepAlive func() error, flush func()) {
+	// The backlog already covers the stored logs, only new ones are tailed.
+	filter.AfterID = 0
+	filter.Since = time.Time{}
+
+	ticker := time.NewTicker(h.keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if keepAlive() != nil {
+				return
+			}
+			flush()
+		case entry := <-entries:
+			if !filter.Match(entry) {
+				continue
+			}
+			if send(entry) != nil {
+				return
+			}
+			flush()
+		}
+	}
+}
+
+// parseFilter builds a Filter from the request query parameters.
+func parseFilter(r *http.Request, now time.Time) (Filter, error) {
+	query := r.URL.Query()
+	filter := Filter{
+		Tag:  query.Get("tag"),
+		Text: query.Get("q"),
+	}
+
+	if label := query.Get("level"); label != "" {
+		level, err := gonyan.ParseLevelLabel(label)
+		if err != nil {
+			return filter, err
+		}
+		filter.MinLevel = &level
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			return filter, fmt.Errorf("invalid limit `%s`", limit)
+		}
+		filter.Limit = n
+	}
+
+	if since := query.Get("since"); since != "" {
+		if t, err := time.Parse(time.RFC3339Nano, since); err == nil {
+			filter.Since = t
+		} else if nanos, err := strconv.ParseInt(since, 10, 64); err == nil {
+			filter.Since = time.Unix(0, nanos)
+		} else if d, err := time.ParseDuration(since); err == nil {
+			filter.Since = now.Add(-d)
+		} else {
+			return filter, fmt.Errorf("invalid since `%s`", since)
+		}
+	}
+	return filter, nil
+}
@@ -0,0 +1,231 @@
+package memory
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHandlerEntries verifies the JSON endpoint and its filters.
+func TestHandlerEntries(t *testing.T) {
+	m := NewStream(10)
+	m.Write([]byte(`{"tag":"api","level":"Info","message":"a"}
+{"tag":"api","level":"Error","message":"b"}`))
+	ts := httptest.NewServer(NewHandler(m))
+	defer ts.Close()
+
+	response, err := http.Get(ts.URL + "/logs/entries?level=warning&since=1h")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	defer response.Body.Close()
+	if ct := response.Header.Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("Unexpected content type: %s.", ct)
+	}
+	entries := []Entry{}
+	if err := json.NewDecoder(response.Body).Decode(&entries); err != nil {
+		t.Fatalf("Invalid response: %s", err.Error())
+	}
+	if len(entries) != 1 || entries[0].Message != "b" || entries[0].ID != 2 || entries[0].Tag != "api" {
+		t.Fatalf("Unexpected entries: %+v.", entries)
+	}
+
+	for _, query := range []string{"level=nope", "limit=-1", "since=yesterday"} {
+		response, err := http.Get(ts.URL + "/entries?" + query)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Unexpected status for `%s`: %d.", query, response.StatusCode)
+		}
+	}
+
+	response, err = http.Post(ts.URL+"/entries", "text/plain", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("Unexpected status: %d.", response.StatusCode)
+	}
+}
+
+// TestHandlerSSE verifies the Server-Sent Events live-tail.
+func TestHandlerSSE(t *testing.T) {
+	m := NewStream(10)
+	m.Write([]byte(`{"message":"old"}` + "\n" + `{"message":"resumed"}`))
+	ts := httptest.NewServer(NewHandler(m))
+	defer ts.Close()
+
+	request, _ := http.NewRequest(http.MethodGet, ts.URL+"/sse?tag=app", nil)
+	request.Header.Set("Last-Event-ID", "1")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	defer response.Body.Close()
+	if ct := response.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Unexpected content type: %s.", ct)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		m.Write([]byte(`{"tag":"other","message":"filtered"}` + "\n" + `{"tag":"app","message":"live"}`))
+	}()
+
+	reader := bufio.NewReader(response.Body)
+	events := []string{}
+	for len(events) < 1 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Unexpected read error: %s", err.Error())
+		}
+		if strings.HasPrefix(line, "data: ") {
+			events = append(events, strings.TrimSpace(strings.TrimPrefix(line, "data: ")))
+		}
+	}
+	entry := Entry{}
+	json.Unmarshal([]byte(events[0]), &entry)
+	if entry.Message != "live" || entry.ID != 4 {
+		t.Fatalf("Unexpected event: %s.", events[0])
+	}
+}
+
+// TestHandlerSSEResume verifies that Last-Event-ID replays the missed logs.
+func TestHandlerSSEResume(t *testing.T) {
+	m := NewStream(10)
+	m.Write([]byte(`{"message":"seen"}` + "\n" + `{"message":"missed"}`))
+	ts := httptest.NewServer(NewHandler(m))
+	defer ts.Close()
+
+	request, _ := http.NewRequest(http.MethodGet, ts.URL+"/sse", nil)
+	request.Header.Set("Last-Event-ID", "1")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	defer response.Body.Close()
+
+	reader := bufio.NewReader(response.Body)
+	if line, _ := reader.ReadString('\n'); line != "id: 2\n" {
+		t.Fatalf("Unexpected first line: %q.", line)
+	}
+}
+
+// TestHandlerWebSocket verifies the WebSocket handshake and live-tail.
+func TestHandlerWebSocket(t *testing.T) {
+	m := NewStream(10)
+	m.Write([]byte(`{"message":"old"}`))
+	ts := httptest.NewServer(NewHandler(m))
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	io.WriteString(conn, "GET /ws?limit=1 HTTP/1.1\r\nHost: test\r\nConnection: keep-alive, Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: "+key+"\r\n\r\n")
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Unexpected handshake error: %s", err.Error())
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Unexpected status: %d.", response.StatusCode)
+	}
+	if accept := response.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Unexpected accept key: %s.", accept)
+	}
+
+	readText := func() string {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			t.Fatalf("Unexpected frame error: %s", err.Error())
+		}
+		if header[0] != 0x81 {
+			t.Fatalf("Unexpected frame header: %x.", header[0])
+		}
+		length := int(header[1])
+		if length == 126 {
+			size := make([]byte, 2)
+			io.ReadFull(reader, size)
+			length = int(binary.BigEndian.Uint16(size))
+		}
+		payload := make([]byte, length)
+		io.ReadFull(reader, payload)
+		return string(payload)
+	}
+
+	if text := readText(); !strings.Contains(text, `"message":"old"`) {
+		t.Fatalf("Unexpected backlog message: %s.", text)
+	}
+	m.Write([]byte(`{"message":"live"}`))
+	if text := readText(); !strings.Contains(text, `"message":"live"`) {
+		t.Fatalf("Unexpected live message: %s.", text)
+	}
+
+	// Masked close frame from the client.
+	conn.Write([]byte{0x88, 0x80, 1, 2, 3, 4})
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil || header[0] != 0x88 {
+		t.Fatalf("A close frame was expected. Found: %x, %v.", header, err)
+	}
+
+	response, err = http.Get(ts.URL + "/ws")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Plain requests should be refused. Found status: %d.", response.StatusCode)
+	}
+}
+
+// TestHandlerWebSocketRefused verifies that cross-site origins and
+// unsupported protocol versions are refused.
+func TestHandlerWebSocketRefused(t *testing.T) {
+	ts := httptest.NewServer(NewHandler(NewStream(10)).SetAllowedOrigins("https://allowed.example"))
+	defer ts.Close()
+
+	upgrade := func(version, origin string) *http.Response {
+		request, _ := http.NewRequest(http.MethodGet, ts.URL+"/ws", nil)
+		request.Header.Set("Connection", "Upgrade")
+		request.Header.Set("Upgrade", "websocket")
+		request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		request.Header.Set("Sec-WebSocket-Version", version)
+		if origin != "" {
+			request.Header.Set("Origin", origin)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+		response.Body.Close()
+		return response
+	}
+
+	response := upgrade("8", "")
+	if response.StatusCode != http.StatusUpgradeRequired || response.Header.Get("Sec-WebSocket-Version") != "13" {
+		t.Fatalf("Unsupported versions should be refused. Found status: %d.", response.StatusCode)
+	}
+	if response := upgrade("13", "https://evil.example"); response.StatusCode != http.StatusForbidden {
+		t.Fatalf("Cross-site origins should be refused. Found status: %d.", response.StatusCode)
+	}
+	for _, origin := range []string{ts.URL, "https://allowed.example"} {
+		if response := upgrade("13", origin); response.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("Origin %s should be allowed. Found status: %d.", origin, response.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// Package memory contains definition of the Gonyan Stream keeping the most
+// recent logs in a bounded in-memory ring buffer, together with an
+// http.Handler exposing them for live debugging without a log backend.
+package memory
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"gonyan"
+)
+
+// DefaultCapacity defines the default number of logs kept in memory.
+const DefaultCapacity = 5000
+
+// DefaultSubscriberBuffer defines how many logs can be queued for a live
+// subscriber before newer logs get dropped for it.
+const DefaultSubscriberBuffer = 256
+
+// Entry represents a log kept in memory.
+type Entry struct {
+	ID       uint64    `json:"id"`       // Sequence number, increasing;
+	Received time.Time `json:"received"` // Time the log was written;
+	gonyan.LogMessage
+}
+
+// Filter defines the criteria used to select logs; zero values match
+// everything.
+type Filter struct {
+	MinLevel *gonyan.LogLevel // Minimum level of the logs;
+	Tag      string           // Exact tag of the logs;
+	Since    time.Time        // Logs received after this time;
+	AfterID  uint64           // Logs with a greater sequence number;
+	Text     string           // Case insensitive text in message or metadata;
+	Limit    int              // Maximum number of logs, the most recent.
+}
+
+// Match reports whether provided entry satisfies the filter (Limit aside).
+func (f *Filter) Match(entry *Entry) bool {
+	if f.MinLevel != nil {
+		level, err := gonyan.ParseLevelLabel(entry.Level)
+		if err != nil || level < *f.MinLevel {
+			return false
+		}
+	}
+	if f.Tag != "" && entry.Tag != f.Tag {
+		return false
+	}
+	if !f.Since.IsZero() && !entry.Received.After(f.Since) {
+		return false
+	}
+	if entry.ID <= f.AfterID {
+		return false
+	}
+	if f.Text != "" {
+		text := strings.ToLower(f.Text)
+		if strings.Contains(strings.ToLower(entry.Message), text) {
+			return true
+		}
+		for _, val := range entry.Metadata {
+			if strings.Contains(strings.ToLower(val), text) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Stream defines the Gonyan Stream keeping recent logs in memory. When the
+// capacity is reached the oldest logs are overwritten.
+type Stream struct {
+	entries     []*Entry                 // Ring buffer storage;
+	next        int                      // Position of the next write;
+	count       int                      // Number of stored entries;
+	lastID      uint64                   // Last assigned sequence number;
+	subscribers map[*subscriber]struct{} // Live subscribers;
+	mutex       sync.RWMutex             // Mutex for all the above.
+}
+
+// subscriber represents a live consumer of new logs.
+type subscriber struct {
+	entries chan *Entry
+}
+
+// NewStream creates a new in-memory stream keeping at most capacity logs; a
+// non-positive capacity selects DefaultCapacity.
+func NewStream(capacity int) *Stream {
+	if capacity <= 0 {
+		capacity = DefaultCapacity
+	}
+	return &Stream{
+		entries:     make([]*Entry, capacity),
+		subscribers: make(map[*subscriber]struct{}),
+	}
+}
+
+// Write function defined to implement the Stream interface.
+// The function stores the serialised logs in the ring buffer and forwards
+// them to the live subscribers.
+func (m *Stream) Write(messageBytes []byte) (int, error) {
+	messages := gonyan.DeserialiseBatch(messageBytes)
+	now := time.Now()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, message := range messages {
+		m.lastID++
+		entry := &Entry{ID: m.lastID, Received: now, LogMessage: *message}
+		m.entries[m.next] = entry
+		m.next = (m.next + 1) % len(m.entries)
+		if m.count < len(m.entries) {
+			m.count++
+		}
+
+		for s := range m.subscribers {
+			select {
+			case s.entries <- entry:
+			default:
+				// Slow subscribers must not block the logger.
+			}
+		}
+	}
+	return len(messageBytes), nil
+}
+
+// Len returns the number of logs currently kept in memory.
+func (m *Stream) Len() int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.count
+}
+
+// Entries returns the stored logs matching provided filter, from the oldest
+// to the most recent.
+func (m *Stream) Entries(filter Filter) []*Entry {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.entriesLocked(filter)
+}
+
+// Subscribe registers a live subscriber receiving every new log and returns
+// the stored logs matching provided filter, atomically, so that no log is
+// lost or duplicated between the two. Subscribers not keeping up miss the
+// logs exceeding DefaultSubscriberBuffer. The returned function must be
+// invoked to unsubscribe.
+func (m *Stream) Subscribe(filter Filter) ([]*Entry, <-chan *Entry, func()) {
+	s := &subscriber{entries: make(chan *Entry, DefaultSubscriberBuffer)}
+
+	m.mutex.Lock()
+	backlog := m.entriesLocked(filter)
+	m.subscribers[s] = struct{}{}
+	m.mutex.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			m.mutex.Lock()
+			delete(m.subscribers, s)
+			m.mutex.Unlock()
+		})
+	}
+	return backlog, s.entries, unsubscribe
+}
+
+// entriesLocked returns the stored logs matching provided filter. It *must*
+// be called holding the lock.
+func (m *Stream) entriesLocked(filter Filter) []*Entry {
+	matching := []*Entry{}
+	start := (m.next - m.count + len(m.entries)) % len(m.entries)
+	for i := 0; i < m.count; i++ {
+		entry := m.entries[(start+i)%len(m.entries)]
+		if filter.Match(entry) {
+			matching = append(matching, entry)
+		}
+	}
+	if filter.Limit > 0 && len(matching) > filter.Limit {
+		matching = matching[len(matching)-filter.Limit:]
+	}
+	return matching
+}
@@ -0,0 +1,106 @@
+package memory
+
+import (
+	"testing"
+	"time"
+
+	"gonyan"
+)
+
+// TestWriteEviction verifies that the oldest logs are overwritten once the
+// capacity is reached.
+func TestWriteEviction(t *testing.T) {
+	m := NewStream(3)
+	for _, message := range []string{"a", "b", "c", "d", "e"} {
+		if _, err := m.Write([]byte(`{"message":"` + message + `"}`)); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+	}
+	if m.Len() != 3 {
+		t.Fatalf("Unexpected length. Expected: %d - Found: %d.", 3, m.Len())
+	}
+
+	entries := m.Entries(Filter{})
+	for i, expected := range []string{"c", "d", "e"} {
+		if entries[i].Message != expected || entries[i].ID != uint64(i+3) {
+			t.Fatalf("Unexpected entry %d: %+v.", i, entries[i])
+		}
+	}
+
+	if NewStream(0).Len() != 0 || len(NewStream(0).entries) != DefaultCapacity {
+		t.Fatalf("Non-positive capacities should select the default one.")
+	}
+}
+
+// TestEntriesFilter verifies the supported filters.
+func TestEntriesFilter(t *testing.T) {
+	m := NewStream(10)
+	m.Write([]byte(`{"tag":"api","level":"Debug","message":"request served"}
+{"tag":"api","level":"Error","message":"request failed","metadata":{"user":"Alice"}}
+{"tag":"worker","level":"Warning","message":"slow job"}
+{"tag":"worker","message":"no level"}`))
+
+	warning := gonyan.Warning
+	cases := []struct {
+		filter   Filter
+		expected []string
+	}{
+		{Filter{}, []string{"request served", "request failed", "slow job", "no level"}},
+		{Filter{MinLevel: &warning}, []string{"request failed", "slow job"}},
+		{Filter{Tag: "worker"}, []string{"slow job", "no level"}},
+		{Filter{Text: "REQUEST"}, []string{"request served", "request failed"}},
+		{Filter{Text: "alice"}, []string{"request failed"}},
+		{Filter{Limit: 2}, []string{"slow job", "no level"}},
+		{Filter{AfterID: 3}, []string{"no level"}},
+		{Filter{Since: time.Now()}, []string{}},
+	}
+	for i, c := range cases {
+		entries := m.Entries(c.filter)
+		if len(entries) != len(c.expected) {
+			t.Fatalf("Case %d: unexpected number of entries. Expected: %d - Found: %d.", i, len(c.expected), len(entries))
+		}
+		for j, entry := range entries {
+			if entry.Message != c.expected[j] {
+				t.Fatalf("Case %d: unexpected entry %d. Expected: `%s` - Found: `%s`.", i, j, c.expected[j], entry.Message)
+			}
+		}
+	}
+}
+
+// TestSubscribe verifies that subscribers receive the backlog and the new
+// logs, and nothing after unsubscribing.
+func TestSubscribe(t *testing.T) {
+	m := NewStream(10)
+	m.Write([]byte(`{"message":"old"}`))
+
+	backlog, entries, unsubscribe := m.Subscribe(Filter{})
+	if len(backlog) != 1 || backlog[0].Message != "old" {
+		t.Fatalf("Unexpected backlog: %+v.", backlog)
+	}
+
+	m.Write([]byte(`{"message":"new"}`))
+	select {
+	case entry := <-entries:
+		if entry.Message != "new" {
+			t.Fatalf("Unexpected entry: %+v.", entry)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("No entry received.")
+	}
+
+	unsubscribe()
+	unsubscribe()
+	m.Write([]byte(`{"message":"ignored"}`))
+	select {
+	case entry := <-entries:
+		t.Fatalf("Unexpected entry after unsubscribe: %+v.", entry)
+	default:
+	}
+
+	// Slow subscribers do not block writers.
+	_, _, unsubscribe = m.Subscribe(Filter{})
+	defer unsubscribe()
+	for i := 0; i < DefaultSubscriberBuffer+10; i++ {
+		m.Write([]byte(`{"message":"flood"}`))
+	}
+}
@@ -0,0 +1,248 @@
+package memory
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file contains the minimal server side WebSocket (RFC 6455)
+// implementation required by the live-tail endpoint: the handshake, unmasked
+// text frames towards the client and the control frames sent by the client.
+
+// webSocketVersion is the only protocol version supported.
+const webSocketVersion = "13"
+
+// webSocketGUID is the key suffix defined by RFC 6455 for the handshake.
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes.
+const (
+	opText  = 0x1
+	opClose = 0x8
+	opPing  = 0x9
+	opPong  = 0xa
+)
+
+// maxControlPayload is the maximum payload size of control frames.
+const maxControlPayload = 125
+
+// webSocketAccept computes the Sec-WebSocket-Accept value for provided key.
+func webSocketAccept(key string) string {
+	hash := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// serveWebSocket upgrades the connection and streams the logs as JSON text
+// messages.
+func (h *Handler) serveWebSocket(w http.ResponseWriter, r *http.Request, filter Filter) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != webSocketVersion {
+		w.Header().Set("Sec-WebSocket-Version", webSocketVersion)
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return
+	}
+	if !h.originAllowed(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket unsupported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	rw.WriteString("Upgrade: websocket\r\n")
+	rw.WriteString("Connection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n\r\n")
+	if rw.Flush() != nil {
+		return
+	}
+
+	if filter.Limit == 0 && filter.Since.IsZero() {
+		filter.AfterID = ^uint64(0)
+	}
+	backlog, entries, unsubscribe := h.stream.Subscribe(filter)
+	defer unsubscribe()
+
+	ws := &webSocketConn{conn: conn, rw: rw}
+	// The read loop handles the client control frames and detects the
+	// connection closure.
+	closed := make(chan struct{})
+	go func() {
+		ws.readLoop()
+		close(closed)
+	}()
+
+	send := func(entry *Entry) error {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return ws.writeFrame(opText, data)
+	}
+	for _, entry := range backlog {
+		if send(entry) != nil {
+			return
+		}
+	}
+
+	h.tail(closed, filter, entries, send, func() error {
+		return ws.writeFrame(opPing, nil)
+	}, func() {})
+	ws.writeFrame(opClose, nil)
+}
+
+// originAllowed reports whether the request origin may open a live-tail.
+// Requests without an Origin header do not come from browsers and are
+// always allowed.
+func (h *Handler) originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range h.origins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	parsed, err := url.Parse(origin)
+	return err == nil && parsed.Host != "" && strings.EqualFold(parsed.Host, r.Host)
+}
+
+// webSocketConn wraps a hijacked connection serialising frame writes.
+type webSocketConn struct {
+	conn       net.Conn
+	rw         *bufio.ReadWriter
+	writeMutex sync.Mutex
+}
+
+// writeFrame writes a single unfragmented, unmasked frame.
+func (c *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n <= 125:
+		header = append(header, byte(n))
+	case n <= 0xffff:
+		header = append(header, 126, byte(n>>8), byte(n))
+	default:
+		header = append(header, 127)
+		size := make([]byte, 8)
+		binary.BigEndian.PutUint64(size, uint64(n))
+		header = append(header, size...)
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := c.rw.Write(header); err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(payload); err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+// readLoop reads the client frames answering pings and returning when the
+// client closes the connection or an error occurs. Data frames are ignored.
+func (c *webSocketConn) readLoop() {
+	for {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case opClose:
+			return
+		case opPing:
+			if c.writeFrame(opPong, payload) != nil {
+				return
+			}
+		}
+	}
+}
+
+// readFrame reads a single client frame, unmasking its payload.
+func (c *webSocketConn) readFrame() (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.rw, header); err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+
+	switch length {
+	case 126:
+		size := make([]byte, 2)
+		if _, err := io.ReadFull(c.rw, size); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(size))
+	case 127:
+		size := make([]byte, 8)
+		if _, err := io.ReadFull(c.rw, size); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(size)
+	}
+	if opcode >= opClose && length > maxControlPayload {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+
+	mask := make([]byte, 4)
+	if masked {
+		if _, err := io.ReadFull(c.rw, mask); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if opcode < opClose {
+		// Data frames are not used, discard them without buffering.
+		_, err := io.CopyN(ioutil.Discard, c.rw, int64(length))
+		return opcode, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.rw, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+// headerContains reports whether provided comma separated header contains
+// provided token, case insensitively.
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
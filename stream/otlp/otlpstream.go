@@ -0,0 +1,396 @@
+// Package otlp contains definition of the Gonyan Stream exporting logs to an
+// OpenTelemetry collector using the OTLP/HTTP protocol with JSON encoding.
+//
+// Each Write call is treated as a batch: the payload is split using the
+// default BufferedStream separator and every serialised LogMessage becomes
+// an OTLP log record. Wrap the Stream in a gonyan.BufferedStream to export
+// logs in batches:
+//
+//	otlpStream := otlp.NewStream("http://collector:4318").SetResourceAttribute("deployment.environment", "prod")
+//	buffered := gonyan.NewBufferedStream(otlpStream)
+//	buffered.SetBufferLimit(512)
+//	buffered.SetSchedulingInterval(time.Second, true)
+package otlp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gonyan"
+)
+
+// LogsPath is the OTLP/HTTP logs path, appended to the base URL.
+const LogsPath = "/v1/logs"
+
+// ScopeName is the instrumentation scope name used for exported records.
+const ScopeName = "gonyan"
+
+// DefaultTraceIDKey is the default metadata key holding the trace ID.
+const DefaultTraceIDKey = "trace_id"
+
+// DefaultSpanIDKey is the default metadata key holding the span ID.
+const DefaultSpanIDKey = "span_id"
+
+// DefaultMaxAttempts defines the default number of export attempts
+// performed before giving up on a batch.
+const DefaultMaxAttempts = 5
+
+// DefaultMinBackoff defines the default delay before the first retry.
+const DefaultMinBackoff = 100 * time.Millisecond
+
+// DefaultMaxBackoff defines the default upper bound for retry delays.
+const DefaultMaxBackoff = 5 * time.Second
+
+// DefaultTimeout defines the default timeout of each export request.
+const DefaultTimeout = 10 * time.Second
+
+// SeverityNumber returns the OTLP severity number corresponding to provided
+// level: Debug and Verbose map to the DEBUG range, Fatal and Panic to the
+// FATAL range.
+func SeverityNumber(level gonyan.LogLevel) int {
+	switch level {
+	case gonyan.Debug:
+		return 5
+	case gonyan.Verbose:
+		return 6
+	case gonyan.Info:
+		return 9
+	case gonyan.Warning:
+		return 13
+	case gonyan.Error:
+		return 17
+	case gonyan.Fatal:
+		return 21
+	case gonyan.Panic:
+		return 24
+	default:
+		return 0
+	}
+}
+
+// Stream defines the Gonyan Stream for OTLP/HTTP logs export.
+type Stream struct {
+	url                string            // OTLP logs URL;
+	client             *http.Client      // HTTP client used for exports;
+	headers            map[string]string // HTTP headers container;
+	resourceAttributes map[string]string // Attributes of the exported resource;
+	traceIDKey         string            // Metadata key holding the trace ID;
+	spanIDKey          string            // Metadata key holding the span ID;
+	maxAttempts        int               // Export attempts for each batch;
+	minBackoff         time.Duration     // Delay before the first retry;
+	maxBackoff         time.Duration     // Upper bound of retry delays.
+}
+
+// NewStream creates a new OTLP stream exporting to the collector reachable
+// at provided base URL (e.g. `http://collector:4318`).
+func NewStream(baseURL string) *Stream {
+	return &Stream{
+		url:                strings.TrimSuffix(baseURL, "/") + LogsPath,
+		client:             &http.Client{Timeout: DefaultTimeout},
+		headers:            make(map[string]string),
+		resourceAttributes: make(map[string]string),
+		traceIDKey:         DefaultTraceIDKey,
+		spanIDKey:          DefaultSpanIDKey,
+		maxAttempts:        DefaultMaxAttempts,
+		minBackoff:         DefaultMinBackoff,
+		maxBackoff:         DefaultMaxBackoff,
+	}
+}
+
+// SetResourceAttribute sets an attribute of the exported resource. Unless
+// explicitly set, the `service.name` attribute is filled with the logger tag.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (o *Stream) SetResourceAttribute(key, value string) *Stream {
+	o.resourceAttributes[key] = value
+	return o
+}
+
+// SetTraceContextKeys sets the metadata keys holding the hex encoded trace
+// and span IDs; by default they are `trace_id` and `span_id`.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (o *Stream) SetTraceContextKeys(traceIDKey, spanIDKey string) *Stream {
+	o.traceIDKey = traceIDKey
+	o.spanIDKey = spanIDKey
+	return o
+}
+
+// SetHeader sets provided key-value pair for later usage as HTTP headers.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (o *Stream) SetHeader(key, value string) *Stream {
+	o.headers[key] = value
+	return o
+}
+
+// SetClient allows to replace the HTTP client used for exports.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (o *Stream) SetClient(client *http.Client) *Stream {
+	if client != nil {
+		o.client = client
+	}
+	return o
+}
+
+// SetRetry configures how exports failed with a retryable status (429, 502,
+// 503 and 504) or a network error are retried: up to maxAttempts attempts are
+// performed, waiting an exponentially growing delay between minBackoff and
+// maxBackoff unless the collector provides a `Retry-After` header, which is
+// honoured up to maxBackoff.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (o *Stream) SetRetry(maxAttempts int, minBackoff, maxBackoff time.Duration) *Stream {
+	if maxAttempts > 0 {
+		o.maxAttempts = maxAttempts
+	}
+	if minBackoff > 0 {
+		o.minBackoff = minBackoff
+	}
+	if maxBackoff >= o.minBackoff {
+		o.maxBackoff = maxBackoff
+	}
+	return o
+}
+
+// Write function defined to implement the Stream interface.
+// The function converts the serialised logs into the OTLP data model and
+// synchronously exports them, retrying on transient failures.
+func (o *Stream) Write(messageBytes []byte) (int, error) {
+	messages := gonyan.DeserialiseBatch(messageBytes)
+	if len(messages) == 0 {
+		return 0, nil
+	}
+
+	body, err := json.Marshal(o.buildRequest(messages, time.Now()))
+	if err != nil {
+		return 0, fmt.Errorf("export request serialisation failed: %s", err.Error())
+	}
+
+	backoff := o.minBackoff
+	for attempt := 1; ; attempt++ {
+		retryAfter, retryable, err := o.export(body)
+		if err == nil {
+			return len(messageBytes), nil
+		}
+		if !retryable || attempt >= o.maxAttempts {
+			return 0, fmt.Errorf("otlp export failed: %s", err.Error())
+		}
+
+		// Retry-After is honoured up to maxBackoff so that a collector
+		// cannot stall the exporter.
+		delay := backoff
+		if retryAfter > 0 {
+			delay = retryAfter
+		}
+		if delay > o.maxBackoff {
+			delay = o.maxBackoff
+		}
+		time.Sleep(delay)
+		if backoff *= 2; backoff > o.maxBackoff {
+			backoff = o.maxBackoff
+		}
+	}
+}
+
+// The following types mirror the OTLP logs JSON encoding.
+
+type exportRequest struct {
+	ResourceLogs []resourceLogs `json:"resourceLogs"`
+}
+
+type resourceLogs struct {
+	Resource  resource    `json:"resource"`
+	ScopeLogs []scopeLogs `json:"scopeLogs"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeLogs struct {
+	Scope      scope       `json:"scope"`
+	LogRecords []logRecord `json:"logRecords"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type logRecord struct {
+	TimeUnixNano         string     `json:"timeUnixNano,omitempty"`
+	ObservedTimeUnixNano string     `json:"observedTimeUnixNano"`
+	SeverityNumber       int        `json:"severityNumber,omitempty"`
+	SeverityText         string     `json:"severityText,omitempty"`
+	Body                 anyValue   `json:"body"`
+	Attributes           []keyValue `json:"attributes,omitempty"`
+	TraceID              string     `json:"traceId,omitempty"`
+	SpanID               string     `json:"spanId,omitempty"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// buildRequest converts provided messages into an export request, messages
+// are grouped into one resource per logger tag preserving their order.
+func (o *Stream) buildRequest(messages []*gonyan.LogMessage, observed time.Time) *exportRequest {
+	request := &exportRequest{ResourceLogs: []resourceLogs{}}
+	indexes := make(map[string]int)
+
+	for _, message := range messages {
+		i, ok := indexes[message.Tag]
+		if !ok {
+			i = len(request.ResourceLogs)
+			indexes[message.Tag] = i
+			request.ResourceLogs = append(request.ResourceLogs, resourceLogs{
+				Resource:  resource{Attributes: o.resourceAttributesOf(message.Tag)},
+				ScopeLogs: []scopeLogs{{Scope: scope{Name: ScopeName}, LogRecords: []logRecord{}}},
+			})
+		}
+
+		logs := &request.ResourceLogs[i].ScopeLogs[0]
+		logs.LogRecords = append(logs.LogRecords, o.buildRecord(message, observed))
+	}
+	return request
+}
+
+// buildRecord converts provided message into an OTLP log record.
+func (o *Stream) buildRecord(message *gonyan.LogMessage, observed time.Time) logRecord {
+	record := logRecord{
+		ObservedTimeUnixNano: strconv.FormatInt(observed.UnixNano(), 10),
+		SeverityText:         message.Level,
+		Body:                 anyValue{StringValue: message.Message},
+	}
+	if message.Timestamp != 0 {
+		record.TimeUnixNano = strconv.FormatInt(message.Timestamp, 10)
+	}
+	if level, err := gonyan.ParseLevelLabel(message.Level); err == nil {
+		record.SeverityNumber = SeverityNumber(level)
+	}
+
+	attributes := make(map[string]string, len(message.Metadata))
+	for key, val := range message.Metadata {
+		switch {
+		case key == o.traceIDKey && isHexID(val, 16):
+			record.TraceID = strings.ToLower(val)
+		case key == o.spanIDKey && isHexID(val, 8):
+			record.SpanID = strings.ToLower(val)
+		default:
+			attributes[key] = val
+		}
+	}
+	record.Attributes = toKeyValues(attributes)
+	return record
+}
+
+// resourceAttributesOf returns the resource attributes for provided tag.
+func (o *Stream) resourceAttributesOf(tag string) []keyValue {
+	attributes := make(map[string]string, len(o.resourceAttributes)+1)
+	if tag != "" {
+		attributes["service.name"] = tag
+	}
+	for key, val := range o.resourceAttributes {
+		attributes[key] = val
+	}
+	return toKeyValues(attributes)
+}
+
+// export performs a single export attempt and reports whether a failure can
+// be retried and after how long, when the collector suggests it.
+func (o *Stream) export(body []byte) (time.Duration, bool, error) {
+	request, err := http.NewRequest(http.MethodPost, o.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, fmt.Errorf("request creation failed due to: %s", err.Error())
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for key, val := range o.headers {
+		request.Header.Set(key, val)
+	}
+
+	response, err := o.client.Do(request)
+	if err != nil {
+		return 0, true, fmt.Errorf("request execution failed due to: %s", err.Error())
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		io.Copy(ioutil.Discard, response.Body)
+		return 0, false, nil
+	}
+
+	details, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+	err = fmt.Errorf("unexpected status `%s`: %s", response.Status, strings.TrimSpace(string(details)))
+	switch response.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return parseRetryAfter(response.Header.Get("Retry-After")), true, err
+	default:
+		return 0, false, err
+	}
+}
+
+// parseRetryAfter parses a `Retry-After` header value expressed either in
+// seconds or as an HTTP date; zero is returned when the value is missing or
+// invalid.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
+
+// toKeyValues converts provided map into OTLP attributes sorted by key.
+func toKeyValues(m map[string]string) []keyValue {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	attributes := make([]keyValue, 0, len(keys))
+	for _, key := range keys {
+		attributes = append(attributes, keyValue{Key: key, Value: anyValue{StringValue: m[key]}})
+	}
+	return attributes
+}
+
+// isHexID reports whether provided value is a non-zero hex encoded ID of
+// provided size in bytes.
+func isHexID(value string, size int) bool {
+	if len(value) != 2*size {
+		return false
+	}
+	id, err := hex.DecodeString(value)
+	if err != nil {
+		return false
+	}
+	for _, b := range id {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
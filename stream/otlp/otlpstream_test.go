@@ -0,0 +1,186 @@
+package otlp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"gonyan"
+)
+
+// TestSeverityNumber verifies the level to severity mapping.
+func TestSeverityNumber(t *testing.T) {
+	expected := map[gonyan.LogLevel]int{
+		gonyan.Debug:   5,
+		gonyan.Verbose: 6,
+		gonyan.Info:    9,
+		gonyan.Warning: 13,
+		gonyan.Error:   17,
+		gonyan.Fatal:   21,
+		gonyan.Panic:   24,
+	}
+	for level, number := range expected {
+		if found := SeverityNumber(level); found != number {
+			t.Fatalf("Unexpected severity for %s. Expected: %d - Found: %d.", gonyan.GetLevelLabel(level), number, found)
+		}
+	}
+	if found := SeverityNumber(gonyan.LogLevel(-1)); found != 0 {
+		t.Fatalf("Unexpected severity for invalid level: %d.", found)
+	}
+}
+
+// TestWriteExport verifies the conversion to the OTLP data model.
+func TestWriteExport(t *testing.T) {
+	var received exportRequest
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != LogsPath {
+			t.Errorf("Unexpected path. Expected: %s - Found: %s.", LogsPath, r.URL.Path)
+		}
+		if val := r.Header.Get("Content-Type"); val != "application/json" {
+			t.Errorf("Unexpected content type: %s.", val)
+		}
+		payload, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(payload, &received); err != nil {
+			t.Errorf("Invalid export body: %s", err.Error())
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+
+	s := NewStream(ts.URL).SetResourceAttribute("deployment.environment", "test")
+	batch := `{"tag":"app","timestamp":1483439014000000200,"level":"Error","message":"failure","metadata":{"trace_id":"4BF92F3577B34DA6A3CE929D0E0E4736","span_id":"00f067aa0ba902b7","user":"x"}}
+{"tag":"worker","level":"Info","message":"done","metadata":{"trace_id":"not-an-id"}}
+{"tag":"app","message":"raw"}`
+	n, err := s.Write([]byte(batch))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if n != len(batch) {
+		t.Fatalf("Unexpected number of written bytes. Expected: %d - Found: %d.", len(batch), n)
+	}
+
+	if len(received.ResourceLogs) != 2 {
+		t.Fatalf("Unexpected number of resources. Expected: %d - Found: %d.", 2, len(received.ResourceLogs))
+	}
+	app := received.ResourceLogs[0]
+	expectedResource := []keyValue{
+		{Key: "deployment.environment", Value: anyValue{StringValue: "test"}},
+		{Key: "service.name", Value: anyValue{StringValue: "app"}},
+	}
+	if len(app.Resource.Attributes) != 2 || app.Resource.Attributes[0] != expectedResource[0] || app.Resource.Attributes[1] != expectedResource[1] {
+		t.Fatalf("Unexpected resource attributes. Expected: %+v - Found: %+v.", expectedResource, app.Resource.Attributes)
+	}
+
+	records := app.ScopeLogs[0].LogRecords
+	if app.ScopeLogs[0].Scope.Name != ScopeName || len(records) != 2 {
+		t.Fatalf("Unexpected scope logs: %+v.", app.ScopeLogs[0])
+	}
+	first := records[0]
+	if first.TimeUnixNano != "1483439014000000200" || first.SeverityNumber != 17 || first.SeverityText != "Error" || first.Body.StringValue != "failure" {
+		t.Fatalf("Unexpected record: %+v.", first)
+	}
+	if first.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || first.SpanID != "00f067aa0ba902b7" {
+		t.Fatalf("Unexpected trace context: %s/%s.", first.TraceID, first.SpanID)
+	}
+	if len(first.Attributes) != 1 || first.Attributes[0].Key != "user" {
+		t.Fatalf("Unexpected attributes: %+v.", first.Attributes)
+	}
+	if records[1].TimeUnixNano != "" || records[1].SeverityNumber != 0 || records[1].ObservedTimeUnixNano == "" {
+		t.Fatalf("Unexpected raw record: %+v.", records[1])
+	}
+
+	worker := received.ResourceLogs[1].ScopeLogs[0].LogRecords[0]
+	if worker.TraceID != "" || len(worker.Attributes) != 1 || worker.Attributes[0].Value.StringValue != "not-an-id" {
+		t.Fatalf("Invalid trace IDs should be kept as attributes: %+v.", worker)
+	}
+}
+
+// TestWriteRetries verifies that retryable statuses are retried honouring
+// the Retry-After header while other statuses are not.
+func TestWriteRetries(t *testing.T) {
+	mtx := sync.Mutex{}
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		calls++
+		current := calls
+		mtx.Unlock()
+		switch current {
+		case 1:
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 3:
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer ts.Close()
+
+	s := NewStream(ts.URL).SetRetry(3, time.Millisecond, 2*time.Second)
+	start := time.Now()
+	if _, err := s.Write([]byte(`{"message":"a"}`)); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("Retry-After header should have been honoured. Elapsed: %s.", elapsed)
+	}
+
+	n, err := s.Write([]byte(`{"message":"a"}`))
+	if err == nil {
+		t.Fatalf("An error was expected!")
+	}
+	if n != 0 {
+		t.Fatalf("Unexpected number of written bytes. Expected: %d - Found: %d.", 0, n)
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	if calls != 4 {
+		t.Fatalf("Unexpected number of calls. Expected: %d - Found: %d.", 4, calls)
+	}
+}
+
+// TestWriteRetryAfterCap verifies that Retry-After delays are capped by the
+// maximum backoff.
+func TestWriteRetryAfterCap(t *testing.T) {
+	mtx := sync.Mutex{}
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if calls++; calls == 1 {
+			w.Header().Set("Retry-After", "86400")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	s := NewStream(ts.URL).SetRetry(2, time.Millisecond, 10*time.Millisecond)
+	start := time.Now()
+	if _, err := s.Write([]byte(`{"message":"a"}`)); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Retry-After should have been capped by the maximum backoff. Elapsed: %s.", elapsed)
+	}
+}
+
+// TestParseRetryAfter verifies the supported Retry-After formats.
+func TestParseRetryAfter(t *testing.T) {
+	if delay := parseRetryAfter("2"); delay != 2*time.Second {
+		t.Fatalf("Unexpected delay. Expected: %s - Found: %s.", 2*time.Second, delay)
+	}
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if delay := parseRetryAfter(date); delay <= 0 || delay > time.Hour {
+		t.Fatalf("Unexpected delay for date: %s.", delay)
+	}
+	if delay := parseRetryAfter("nope"); delay != 0 {
+		t.Fatalf("Unexpected delay for invalid value: %s.", delay)
+	}
+}
@@ -0,0 +1,535 @@
+// Package smtp contains definition of the Gonyan Stream sending logs by
+// email, typically registered for the Fatal and Panic levels.
+//
+// Each Write call produces a single email: when the payload contains more
+// than one serialised LogMessage (e.g. when the Stream is wrapped by a
+// gonyan.BufferedStream) the email is a digest of all of them. Subject and
+// body are rendered from `text/template` templates and the number of emails
+// sent within a time window can be capped: logs written while throttled are
+// held and sent as a digest as soon as the window allows it.
+package smtp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"gonyan"
+)
+
+// DefaultSubjectTemplate is the template used to render email subjects.
+const DefaultSubjectTemplate = `[{{.Level}}] {{.Tag}}: {{if eq .Count 1}}{{.Message}}{{else}}{{.Count}} logs{{end}}`
+
+// DefaultBodyTemplate is the template used to render email bodies.
+const DefaultBodyTemplate = `{{range .Messages}}{{if .Timestamp}}{{timestamp .Timestamp}} {{end}}[{{.Level}}] {{.Tag}}: {{.Message}}
+{{range $key, $value := .Metadata}}    {{$key}}: {{$value}}
+{{end}}
+{{end}}{{if .Retried}}{{.Retried}} of these logs were kept after failed sendings.
+{{end}}{{if .Suppressed}}{{.Suppressed}} of these logs were held back by the mail throttling.
+{{end}}`
+
+// DefaultTimeout defines the default timeout of the whole SMTP conversation.
+const DefaultTimeout = 30 * time.Second
+
+// DefaultMaxHeld defines the default maximum number of logs held by the
+// throttling or kept after failed sendings.
+const DefaultMaxHeld = 1000
+
+// AuthMechanism represents a supported SMTP authentication mechanism.
+type AuthMechanism int
+
+// Supported authentication mechanisms.
+const (
+	PlainAuth AuthMechanism = iota
+	LoginAuth AuthMechanism = iota
+)
+
+// StartTLSPolicy defines how STARTTLS is used.
+type StartTLSPolicy int
+
+// Supported STARTTLS policies:
+//
+//   - StartTLSOpportunistic: STARTTLS is used when advertised by the server;
+//   - StartTLSRequired: sending fails if the server does not support it;
+//   - StartTLSDisabled: STARTTLS is never used.
+const (
+	StartTLSOpportunistic StartTLSPolicy = iota
+	StartTLSRequired      StartTLSPolicy = iota
+	StartTLSDisabled      StartTLSPolicy = iota
+)
+
+// Digest is the data provided to the subject and body templates.
+type Digest struct {
+	Tag        string               // Tag of the first log;
+	Level      string               // Most severe level among the logs;
+	Message    string               // Message of the first log;
+	Count      int                  // Number of logs;
+	Suppressed int                  // Logs held back by the throttling;
+	Retried    int                  // Logs kept after failed sendings;
+	Messages   []*gonyan.LogMessage // All the logs.
+}
+
+// Stream defines the Gonyan Stream for SMTP.
+type Stream struct {
+	address       string               // SMTP server address (host:port);
+	from          string               // Sender address;
+	to            []string             // Recipient addresses;
+	auth          smtp.Auth            // Optional authentication;
+	startTLS      StartTLSPolicy       // STARTTLS usage policy;
+	tlsConfig     *tls.Config          // TLS configuration used by STARTTLS;
+	timeout       time.Duration        // Timeout of the SMTP conversation;
+	subject       *template.Template   // Subject template;
+	body          *template.Template   // Body template;
+	maxMails      int                  // Mails allowed per throttling window;
+	window        time.Duration        // Throttling window;
+	sent          []time.Time          // Sending times within the window;
+	held          []*gonyan.LogMessage // Logs held by the throttling;
+	failed        []*gonyan.LogMessage // Logs kept after failed sendings;
+	maxHeld       int                  // Maximum number of held and failed logs;
+	dropped       uint64               // Logs dropped by maxHeld;
+	timer         *time.Timer          // Timer sending the held logs;
+	throttleMutex sync.Mutex           // Mutex for throttling state;
+	fatal         func(error)          // Callback for asynchronous failures.
+}
+
+// NewStream creates a new SMTP stream sending emails through the server at
+// provided address, from and to provided addresses.
+func NewStream(address string, from string, to ...string) *Stream {
+	host, _, _ := net.SplitHostPort(address)
+	return &Stream{
+		address:   address,
+		from:      from,
+		to:        to,
+		startTLS:  StartTLSOpportunistic,
+		tlsConfig: &tls.Config{ServerName: host},
+		timeout:   DefaultTimeout,
+		subject:   template.Must(newTemplate("subject").Parse(DefaultSubjectTemplate)),
+		body:      template.Must(newTemplate("body").Parse(DefaultBodyTemplate)),
+		sent:      []time.Time{},
+		held:      []*gonyan.LogMessage{},
+		failed:    []*gonyan.LogMessage{},
+		maxHeld:   DefaultMaxHeld,
+		fatal: func(err error) {
+			fmt.Printf("[Gonyan] [SMTP] [Fatal] %s.\n", err.Error())
+		},
+	}
+}
+
+// SetAuth sets the credentials used to authenticate with the server using
+// provided mechanism. Both mechanisms refuse to send credentials over an
+// unencrypted connection unless the server is on localhost.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (s *Stream) SetAuth(username, password string, mechanism AuthMechanism) *Stream {
+	host, _, _ := net.SplitHostPort(s.address)
+	if mechanism == LoginAuth {
+		s.auth = &loginAuth{username: username, password: password, host: host}
+	} else {
+		s.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return s
+}
+
+// SetStartTLSPolicy sets how STARTTLS is used, by default it is used when
+// advertised by the server.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (s *Stream) SetStartTLSPolicy(policy StartTLSPolicy) *Stream {
+	s.startTLS = policy
+	return s
+}
+
+// SetTLSConfig sets the TLS configuration used by STARTTLS.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (s *Stream) SetTLSConfig(config *tls.Config) *Stream {
+	if config != nil {
+		s.tlsConfig = config
+	}
+	return s
+}
+
+// SetTimeout sets the timeout of the whole SMTP conversation. Non-positive
+// values are ignored.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (s *Stream) SetTimeout(timeout time.Duration) *Stream {
+	if timeout > 0 {
+		s.timeout = timeout
+	}
+	return s
+}
+
+// SetSubjectTemplate parses and sets the template used for email subjects.
+// The template is executed with a Digest; the `timestamp` function formats
+// a log timestamp as RFC 3339.
+func (s *Stream) SetSubjectTemplate(text string) error {
+	subject, err := newTemplate("subject").Parse(text)
+	if err != nil {
+		return fmt.Errorf("invalid subject template: %s", err.Error())
+	}
+	s.subject = subject
+	return nil
+}
+
+// SetBodyTemplate parses and sets the template used for email bodies.
+// The template is executed with a Digest; the `timestamp` function formats
+// a log timestamp as RFC 3339.
+func (s *Stream) SetBodyTemplate(text string) error {
+	body, err := newTemplate("body").Parse(text)
+	if err != nil {
+		return fmt.Errorf("invalid body template: %s", err.Error())
+	}
+	s.body = body
+	return nil
+}
+
+// SetThrottle caps the number of emails sent within provided window. Logs
+// written while the cap is reached are held and sent as a single digest as
+// soon as the window allows it. Passing 0 disables the throttling.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (s *Stream) SetThrottle(maxMails int, window time.Duration) *Stream {
+	if maxMails < 0 || window < 0 {
+		return s
+	}
+	s.throttleMutex.Lock()
+	s.maxMails = maxMails
+	s.window = window
+	s.throttleMutex.Unlock()
+	return s
+}
+
+// SetMaxHeld sets the maximum number of logs held by the throttling, or
+// kept after failed sendings, by default DefaultMaxHeld; the oldest logs are
+// dropped, and counted, beyond it. Values lower than 1 are ignored.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (s *Stream) SetMaxHeld(maxHeld int) *Stream {
+	if maxHeld > 0 {
+		s.throttleMutex.Lock()
+		s.maxHeld = maxHeld
+		s.throttleMutex.Unlock()
+	}
+	return s
+}
+
+// Dropped returns the number of held or failed logs dropped because of the
+// maximum set with SetMaxHeld.
+func (s *Stream) Dropped() uint64 {
+	s.throttleMutex.Lock()
+	defer s.throttleMutex.Unlock()
+	return s.dropped
+}
+
+// SetFatalFn sets the optional function used to signal failures of held
+// digests sent asynchronously.
+// Note: the method will return the same instance of the invoked structure
+// so that multiple `Set` functions can be chained together.
+func (s *Stream) SetFatalFn(fatalFn func(error)) *Stream {
+	s.fatal = fatalFn
+	return s
+}
+
+// Write function defined to implement the Stream interface.
+// The function synchronously sends an email for the serialised logs, unless
+// the throttling cap has been reached: in that case the logs are held and
+// the function returns immediately.
+// When the sending fails the logs held so far, and the ones kept after
+// previous failures, are kept for the next one.
+func (s *Stream) Write(messageBytes []byte) (int, error) {
+	messages := gonyan.DeserialiseBatch(messageBytes)
+	if len(messages) == 0 {
+		return 0, nil
+	}
+
+	s.throttleMutex.Lock()
+	if wait := s.reserve(time.Now()); wait > 0 {
+		s.hold(messages)
+		if s.timer == nil {
+			s.timer = time.AfterFunc(wait, s.sendHeld)
+		}
+		s.throttleMutex.Unlock()
+		return len(messageBytes), nil
+	}
+	// Logs kept so far are sent together with the new ones.
+	failed, held := s.takeKept()
+	s.throttleMutex.Unlock()
+
+	kept := append(failed, held...)
+	if err := s.send(append(kept[:len(kept):len(kept)], messages...), len(held), len(failed)); err != nil {
+		// The caller is in charge of the new logs.
+		s.keep(kept)
+		return 0, err
+	}
+	return len(messageBytes), nil
+}
+
+// sendHeld sends the logs held by the throttling, or kept after failed
+// sendings, as a single digest.
+func (s *Stream) sendHeld() {
+	s.throttleMutex.Lock()
+	s.timer = nil
+	if len(s.held) == 0 && len(s.failed) == 0 {
+		s.throttleMutex.Unlock()
+		return
+	}
+	if wait := s.reserve(time.Now()); wait > 0 {
+		s.timer = time.AfterFunc(wait, s.sendHeld)
+		s.throttleMutex.Unlock()
+		return
+	}
+	failed, held := s.takeKept()
+	s.throttleMutex.Unlock()
+
+	messages := append(failed, held...)
+	if err := s.send(messages, len(held), len(failed)); err != nil {
+		s.keep(messages)
+		if s.fatal != nil {
+			s.fatal(err)
+		}
+	}
+}
+
+// takeKept returns the logs kept after failed sendings and the ones held by
+// the throttling, emptying both.
+// It *must* be called holding the throttle lock.
+func (s *Stream) takeKept() ([]*gonyan.LogMessage, []*gonyan.LogMessage) {
+	failed, held := s.failed, s.held
+	s.failed, s.held = []*gonyan.LogMessage{}, []*gonyan.LogMessage{}
+	return failed, held
+}
+
+// keep puts back provided logs, whose sending failed, ahead of the failed
+// ones kept meanwhile and schedules a new sending once the throttling window
+// expires.
+func (s *Stream) keep(messages []*gonyan.LogMessage) {
+	if len(messages) == 0 {
+		return
+	}
+	s.throttleMutex.Lock()
+	defer s.throttleMutex.Unlock()
+	s.failed = append(append([]*gonyan.LogMessage{}, messages...), s.failed...)
+	s.trim()
+	if s.timer == nil && s.window > 0 {
+		s.timer = time.AfterFunc(s.window, s.sendHeld)
+	}
+}
+
+// hold adds provided logs to the held ones.
+// It *must* be called holding the throttle lock.
+func (s *Stream) hold(messages []*gonyan.LogMessage) {
+	s.held = append(s.held, messages...)
+	s.trim()
+}
+
+// trim drops the oldest logs, the failed ones first, beyond maxHeld.
+// It *must* be called holding the throttle lock.
+func (s *Stream) trim() {
+	over := len(s.failed) + len(s.held) - s.maxHeld
+	if over <= 0 {
+		return
+	}
+	s.dropped += uint64(over)
+	if over <= len(s.failed) {
+		s.failed = s.failed[over:]
+		return
+	}
+	s.held = s.held[over-len(s.failed):]
+	s.failed = []*gonyan.LogMessage{}
+}
+
+// reserve records a sending at provided time if allowed by the throttling,
+// otherwise it returns how long to wait before the next sending is allowed.
+// It *must* be called holding the throttle lock.
+func (s *Stream) reserve(now time.Time) time.Duration {
+	if s.maxMails == 0 || s.window == 0 {
+		return 0
+	}
+
+	recent := []time.Time{}
+	for _, sent := range s.sent {
+		if now.Sub(sent) < s.window {
+			recent = append(recent, sent)
+		}
+	}
+	s.sent = recent
+
+	if len(s.sent) >= s.maxMails {
+		return s.window - now.Sub(s.sent[0])
+	}
+	s.sent = append(s.sent, now)
+	return 0
+}
+
+// send renders and sends an email for provided logs.
+func (s *Stream) send(messages []*gonyan.LogMessage, suppressed, retried int) error {
+	digest := newDigest(messages, suppressed, retried)
+
+	subject := bytes.Buffer{}
+	if err := s.subject.Execute(&subject, digest); err != nil {
+		return fmt.Errorf("subject rendering failed: %s", err.Error())
+	}
+	body := bytes.Buffer{}
+	if err := s.body.Execute(&body, digest); err != nil {
+		return fmt.Errorf("body rendering failed: %s", err.Error())
+	}
+
+	mail, err := s.compose(strings.TrimSpace(subject.String()), body.Bytes())
+	if err != nil {
+		return fmt.Errorf("email composition failed: %s", err.Error())
+	}
+	if err := s.deliver(mail); err != nil {
+		return fmt.Errorf("email delivery failed: %s", err.Error())
+	}
+	return nil
+}
+
+// compose builds the RFC 5322 email with a quoted-printable UTF-8 body.
+func (s *Stream) compose(subject string, body []byte) ([]byte, error) {
+	mail := bytes.Buffer{}
+	fmt.Fprintf(&mail, "From: %s\r\n", s.from)
+	fmt.Fprintf(&mail, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(&mail, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&mail, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	mail.WriteString("MIME-Version: 1.0\r\n")
+	mail.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	mail.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	writer := quotedprintable.NewWriter(&mail)
+	body = bytes.Replace(body, []byte("\r\n"), []byte("\n"), -1)
+	if _, err := writer.Write(bytes.Replace(body, []byte("\n"), []byte("\r\n"), -1)); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return mail.Bytes(), nil
+}
+
+// deliver performs the SMTP conversation sending provided email.
+func (s *Stream) deliver(mail []byte) error {
+	conn, err := net.DialTimeout("tcp", s.address, s.timeout)
+	if err != nil {
+		return fmt.Errorf("connection failed due to: %s", err.Error())
+	}
+	conn.SetDeadline(time.Now().Add(s.timeout))
+
+	host, _, _ := net.SplitHostPort(s.address)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if s.startTLS != StartTLSDisabled {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(s.tlsConfig); err != nil {
+				return fmt.Errorf("STARTTLS failed due to: %s", err.Error())
+			}
+		} else if s.startTLS == StartTLSRequired {
+			return fmt.Errorf("server does not support STARTTLS")
+		}
+	}
+
+	if s.auth != nil {
+		if err := client.Auth(s.auth); err != nil {
+			return fmt.Errorf("authentication failed due to: %s", err.Error())
+		}
+	}
+
+	if err := client.Mail(s.from); err != nil {
+		return err
+	}
+	for _, to := range s.to {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(mail); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// newDigest builds the template data for provided logs.
+func newDigest(messages []*gonyan.LogMessage, suppressed, retried int) *Digest {
+	digest := &Digest{
+		Tag:        messages[0].Tag,
+		Message:    messages[0].Message,
+		Count:      len(messages),
+		Suppressed: suppressed,
+		Retried:    retried,
+		Messages:   messages,
+	}
+
+	highest := -1
+	for _, message := range messages {
+		if level, err := gonyan.ParseLevelLabel(message.Level); err == nil && int(level) > highest {
+			highest = int(level)
+			digest.Level = message.Level
+		}
+	}
+	return digest
+}
+
+// newTemplate creates a new template with the helper functions available.
+func newTemplate(name string) *template.Template {
+	return template.New(name).Funcs(template.FuncMap{
+		"timestamp": func(timestamp int64) string {
+			return time.Unix(0, timestamp).UTC().Format(time.RFC3339)
+		},
+	})
+}
+
+// loginAuth implements the LOGIN authentication mechanism, not provided by
+// the standard library.
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+// Start begins the LOGIN authentication refusing to send credentials over
+// unencrypted connections, as smtp.PlainAuth does.
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	localhost := server.Name == "localhost" || server.Name == "127.0.0.1" || server.Name == "::1"
+	if !server.TLS && !localhost {
+		return "", nil, fmt.Errorf("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, fmt.Errorf("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+// Next answers the server username and password challenges.
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected server challenge: %s", fromServer)
+	}
+}
@@ -0,0 +1,339 @@
+package smtp
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer is a minimal SMTP server supporting STARTTLS and the PLAIN and
+// LOGIN authentication mechanisms.
+type fakeServer struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	mtx       sync.Mutex
+	mails     []string
+	auths     []string
+	tlsUsed   []bool
+	rejects   int // Number of mails to be rejected.
+}
+
+func newFakeServer(t *testing.T, withTLS bool) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected listen error: %s", err.Error())
+	}
+	s := &fakeServer{listener: listener}
+	if withTLS {
+		s.tlsConfig = &tls.Config{Certificates: []tls.Certificate{selfSignedCertificate(t)}}
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) handle(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	secure := false
+	tp.PrintfLine("220 fake ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch command {
+		case "EHLO":
+			extensions := []string{"250-fake", "250-AUTH PLAIN LOGIN"}
+			if s.tlsConfig != nil && !secure {
+				extensions = append(extensions, "250-STARTTLS")
+			}
+			for _, extension := range extensions {
+				tp.PrintfLine("%s", extension)
+			}
+			tp.PrintfLine("250 OK")
+		case "STARTTLS":
+			tp.PrintfLine("220 ready")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+			tp = textproto.NewConn(conn)
+			secure = true
+		case "AUTH":
+			fields := strings.Fields(line)
+			credentials := ""
+			if fields[1] == "PLAIN" {
+				decoded, _ := base64.StdEncoding.DecodeString(fields[2])
+				credentials = "PLAIN" + strings.Replace(string(decoded), "\x00", ":", -1)
+			} else {
+				tp.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte("Username:")))
+				user, _ := tp.ReadLine()
+				tp.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte("Password:")))
+				pass, _ := tp.ReadLine()
+				decodedUser, _ := base64.StdEncoding.DecodeString(user)
+				decodedPass, _ := base64.StdEncoding.DecodeString(pass)
+				credentials = "LOGIN:" + string(decodedUser) + ":" + string(decodedPass)
+			}
+			s.mtx.Lock()
+			s.auths = append(s.auths, credentials)
+			s.mtx.Unlock()
+			tp.PrintfLine("235 accepted")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mtx.Lock()
+			s.mails = append(s.mails, string(data))
+			s.tlsUsed = append(s.tlsUsed, secure)
+			s.mtx.Unlock()
+			tp.PrintfLine("250 queued")
+		case "MAIL":
+			s.mtx.Lock()
+			reject := s.rejects > 0
+			s.rejects--
+			s.mtx.Unlock()
+			if reject {
+				tp.PrintfLine("554 rejected")
+				continue
+			}
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("250 OK")
+		}
+	}
+}
+
+func (s *fakeServer) received() ([]string, []string, []bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append([]string{}, s.mails...), append([]string{}, s.auths...), append([]bool{}, s.tlsUsed...)
+}
+
+func selfSignedCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unexpected key error: %s", err.Error())
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Unexpected certificate error: %s", err.Error())
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// readMail extracts subject and decoded body of a received mail.
+func readMail(t *testing.T, mail string) (string, string) {
+	reader := textproto.NewReader(bufio.NewReader(strings.NewReader(mail)))
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		t.Fatalf("Invalid mail header: %s", err.Error())
+	}
+	body := strings.SplitN(mail, "\n\n", 2)[1]
+	return header.Get("Subject"), strings.Replace(body, "=\n", "", -1)
+}
+
+// TestWriteWithStartTLSAndPlainAuth verifies a full SMTP conversation.
+func TestWriteWithStartTLSAndPlainAuth(t *testing.T) {
+	server := newFakeServer(t, true)
+	defer server.listener.Close()
+
+	s := NewStream(server.listener.Addr().String(), "alerts@example.com", "ops@example.com").
+		SetStartTLSPolicy(StartTLSRequired).
+		SetTLSConfig(&tls.Config{InsecureSkipVerify: true}).
+		SetAuth("user", "secret", PlainAuth)
+
+	batch := `{"tag":"job","timestamp":1483439014000000200,"level":"Fatal","message":"disk full","metadata":{"host":"h1"}}`
+	n, err := s.Write([]byte(batch))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if n != len(batch) {
+		t.Fatalf("Unexpected number of written bytes. Expected: %d - Found: %d.", len(batch), n)
+	}
+
+	mails, auths, tlsUsed := server.received()
+	if len(mails) != 1 || !tlsUsed[0] {
+		t.Fatalf("A single mail over TLS was expected. Found: %d mails, TLS: %v.", len(mails), tlsUsed)
+	}
+	if len(auths) != 1 || auths[0] != "PLAIN:user:secret" {
+		t.Fatalf("Unexpected authentication: %+v.", auths)
+	}
+	subject, body := readMail(t, mails[0])
+	if subject != "[Fatal] job: disk full" {
+		t.Fatalf("Unexpected subject: %s.", subject)
+	}
+	if !strings.Contains(body, "2017-01-03T10:23:34Z [Fatal] job: disk full") || !strings.Contains(body, "host: h1") {
+		t.Fatalf("Unexpected body: %s.", body)
+	}
+}
+
+// TestWriteDigestWithLoginAuth verifies digests, custom templates and LOGIN
+// authentication.
+func TestWriteDigestWithLoginAuth(t *testing.T) {
+	server := newFakeServer(t, false)
+	defer server.listener.Close()
+
+	s := NewStream(server.listener.Addr().String(), "alerts@example.com", "ops@example.com").SetAuth("user", "secret", LoginAuth)
+	if err := s.SetSubjectTemplate(`{{.Count}} logs, worst: {{.Level}}`); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if err := s.SetBodyTemplate(`{{range .Messages}}{{.Message}};{{end}}`); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if err := s.SetBodyTemplate(`{{.Broken`); err == nil {
+		t.Fatalf("Invalid templates should be refused.")
+	}
+
+	if _, err := s.Write([]byte(`{"level":"Error","message":"a"}` + "\n" + `{"level":"Panic","message":"b"}`)); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	mails, auths, _ := server.received()
+	if len(auths) != 1 || auths[0] != "LOGIN:user:secret" {
+		t.Fatalf("Unexpected authentication: %+v.", auths)
+	}
+	subject, body := readMail(t, mails[0])
+	if subject != "2 logs, worst: Panic" {
+		t.Fatalf("Unexpected subject: %s.", subject)
+	}
+	if strings.TrimSpace(body) != "a;b;" {
+		t.Fatalf("Unexpected body: %s.", body)
+	}
+}
+
+// TestWriteThrottle verifies that logs written while throttled are held and
+// sent as a single digest when the window allows it.
+func TestWriteThrottle(t *testing.T) {
+	server := newFakeServer(t, false)
+	defer server.listener.Close()
+
+	s := NewStream(server.listener.Addr().String(), "alerts@example.com", "ops@example.com").SetThrottle(1, 300*time.Millisecond)
+	for _, message := range []string{"a", "b", "c"} {
+		if _, err := s.Write([]byte(`{"level":"Fatal","message":"` + message + `"}`)); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+	}
+	if mails, _, _ := server.received(); len(mails) != 1 {
+		t.Fatalf("Only one mail should be sent within the window. Found: %d.", len(mails))
+	}
+
+	time.Sleep(600 * time.Millisecond)
+	mails, _, _ := server.received()
+	if len(mails) != 2 {
+		t.Fatalf("Held logs should have been sent. Found: %d mails.", len(mails))
+	}
+	subject, body := readMail(t, mails[1])
+	if subject != "[Fatal] : 2 logs" {
+		t.Fatalf("Unexpected digest subject: %s.", subject)
+	}
+	if !strings.Contains(body, "2 of these logs were held back") {
+		t.Fatalf("Unexpected digest body: %s.", body)
+	}
+}
+
+// TestWriteThrottleFailures verifies that held logs are kept when their
+// sending fails and that the oldest ones are dropped beyond the maximum.
+func TestWriteThrottleFailures(t *testing.T) {
+	server := newFakeServer(t, false)
+	defer server.listener.Close()
+	server.rejects = 2
+
+	failures := make(chan error, 10)
+	s := NewStream(server.listener.Addr().String(), "alerts@example.com", "ops@example.com").SetThrottle(1, 200*time.Millisecond)
+	s.SetFatalFn(func(err error) {
+		failures <- err
+	})
+	if _, err := s.Write([]byte(`{"level":"Fatal","message":"a"}`)); err == nil {
+		t.Fatalf("An error was expected!")
+	}
+	for _, message := range []string{"b", "c"} {
+		if _, err := s.Write([]byte(`{"level":"Fatal","message":"` + message + `"}`)); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+	}
+
+	// The first sending of the held logs fails, the second succeeds.
+	select {
+	case <-failures:
+	case <-time.After(time.Second):
+		t.Fatalf("The failure of the held logs should have been reported.")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for mails, _, _ := server.received(); len(mails) == 0 && time.Now().Before(deadline); mails, _, _ = server.received() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	mails, _, _ := server.received()
+	if len(mails) != 1 {
+		t.Fatalf("Held logs should have been sent. Found: %d mails.", len(mails))
+	}
+	subject, body := readMail(t, mails[0])
+	if subject != "[Fatal] : 2 logs" {
+		t.Fatalf("Unexpected digest subject: %s.", subject)
+	}
+	if !strings.Contains(body, "2 of these logs were kept after failed sendings") || strings.Contains(body, "held back") {
+		t.Fatalf("Failed logs should not be reported as throttled. Found body: %s.", body)
+	}
+
+	s = NewStream(server.listener.Addr().String(), "alerts@example.com", "ops@example.com").SetThrottle(1, time.Hour).SetMaxHeld(2)
+	for _, message := range []string{"a", "b", "c", "d"} {
+		s.Write([]byte(`{"level":"Fatal","message":"` + message + `"}`))
+	}
+	if s.Dropped() != 1 || len(s.held) != 2 || s.held[0].Message != "c" {
+		t.Fatalf("Unexpected held logs. Dropped: %d - Held: %d.", s.Dropped(), len(s.held))
+	}
+}
+
+// TestWriteFailures verifies the delivery failures.
+func TestWriteFailures(t *testing.T) {
+	server := newFakeServer(t, false)
+	defer server.listener.Close()
+
+	s := NewStream(server.listener.Addr().String(), "a@example.com", "b@example.com").SetStartTLSPolicy(StartTLSRequired)
+	if _, err := s.Write([]byte(`{"message":"a"}`)); err == nil {
+		t.Fatalf("STARTTLS should have been required.")
+	}
+
+	address := server.listener.Addr().String()
+	server.listener.Close()
+	s = NewStream(address, "a@example.com", "b@example.com").SetTimeout(time.Second)
+	if _, err := s.Write([]byte(`{"message":"a"}`)); err == nil {
+		t.Fatalf("An error was expected!")
+	}
+	if n, err := s.Write(nil); n != 0 || err != nil {
+		t.Fatalf("Empty writes should be ignored. Found: %d, %v.", n, err)
+	}
+}
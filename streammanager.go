@@ -59,8 +59,30 @@ func (s *StreamManager) Send(level LogLevel, message *LogMessage) error {
 		return fmt.Errorf("serialisation error: %s", err.Error())
 	}
 
-	for i := 0; i < len(registeredStreams); i++ {
-		registeredStreams[i].Write(messageBytes)
-	}
+	write(registeredStreams, level, messageBytes)
 	return nil
 }
+
+// registered returns the number of streams registered for provided level,
+// and whether the level is valid.
+func (s *StreamManager) registered(level LogLevel) (int, bool) {
+	registeredStreams, ok := s.streams[level]
+	return len(registeredStreams), ok
+}
+
+// send writes provided serialised log into all streams registered for
+// provided level, which *must* be valid.
+func (s *StreamManager) send(level LogLevel, messageBytes []byte) {
+	write(s.streams[level], level, messageBytes)
+}
+
+// write writes provided serialised log into provided streams.
+func write(streams []Stream, level LogLevel, messageBytes []byte) {
+	for i := 0; i < len(streams); i++ {
+		if levelWriter, ok := streams[i].(LevelWriter); ok {
+			levelWriter.WriteLevel(level, messageBytes)
+			continue
+		}
+		streams[i].Write(messageBytes)
+	}
+}
@@ -257,3 +257,20 @@ func TestStreamManagerSend(t *testing.T) {
 		t.Fatalf("Unexpected error: %s", err.Error())
 	}
 }
+
+// TestStreamManagerSendLevelWriter verifies that LevelWriter streams receive
+// the level of the logs.
+func TestStreamManagerSendLevelWriter(t *testing.T) {
+	manager := NewStreamManager()
+	stream := newMockStream(1)
+	b := NewBufferedStream(stream)
+	b.SetFlushLevel(Error)
+	manager.Register(Error, b)
+
+	if err := manager.Send(Error, NewLogMessage("tag", 0, "message", nil)); err != nil {
+		t.Fatalf("Unexpected error: %s.", err.Error())
+	}
+	if received := <-stream.out; received != `{"tag":"tag","message":"message"}` {
+		t.Fatalf("Unexpected received message: `%s`.", received)
+	}
+}